@@ -0,0 +1,409 @@
+// Package client talks to a file server node the way other nodes do, over
+// the transport, to store and read files in the network.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/fileserver"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// DefaultRequestTimeout bounds requests whose context has no deadline. It
+// covers the transfer of the content, so it is generous.
+const DefaultRequestTimeout = 10 * time.Minute
+
+var ErrClosed = errors.New("connection to node closed")
+
+type ClientOpts struct {
+	// Addr is the address of the node the client connects to. Files are
+	// kept in the namespace of the node they are stored through.
+	Addr           string
+	TLSConfig      *tls.Config
+	RequestTimeout time.Duration
+	Logger         *zap.Logger
+}
+
+type Client struct {
+	ClientOpts
+
+	transport *transport.TCPTransport
+	peer      transport.Peer
+	closed    chan struct{}
+}
+
+// NewClient connects to the node at opts.Addr.
+func NewClient(opts ClientOpts) (*Client, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+
+	c := &Client{
+		ClientOpts: opts,
+		closed:     make(chan struct{}),
+	}
+
+	// Over TLS the node checks the ID against the certificate.
+	id := "client-" + fscrypto.GenerateServerID()[:16]
+	if opts.TLSConfig != nil && len(opts.TLSConfig.Certificates) > 0 {
+		names, err := transport.CertificateNames(opts.TLSConfig.Certificates[0])
+		if err != nil {
+			return nil, err
+		}
+		id = names[0]
+	}
+
+	peers := make(chan transport.Peer, 1)
+	c.transport = transport.NewTCPTransport(transport.TCPTransportOpts{
+		Logger:         opts.Logger,
+		HandshakeFunc:  transport.NewTCPHandshakeFunc(id),
+		RequestTimeout: opts.RequestTimeout,
+		TLSConfig:      opts.TLSConfig,
+	})
+	c.transport.OnPeer = func(p transport.Peer) error {
+		peers <- p
+		return nil
+	}
+
+	if err := c.transport.Dial(opts.Addr); err != nil {
+		return nil, err
+	}
+
+	select {
+	case c.peer = <-peers:
+	case <-c.transport.ClosedPeer():
+		return nil, fmt.Errorf("node %s closed the connection during the handshake", opts.Addr)
+	case <-time.After(transport.HandshakeTimeout):
+		return nil, fmt.Errorf("handshake with node %s timed out", opts.Addr)
+	}
+
+	go c.consume()
+
+	return c, nil
+}
+
+// consume drops the messages the node sends on its own, like its hello.
+func (c *Client) consume() {
+	for {
+		select {
+		case rpc := <-c.transport.Consume():
+			if rpc.Stream {
+				rpc.Reader.Close()
+			}
+		case <-c.transport.ClosedPeer():
+			close(c.closed)
+			return
+		}
+	}
+}
+
+func (c *Client) Close() error {
+	return c.peer.Close()
+}
+
+// Put stores the size bytes read from r under key.
+func (c *Client) Put(ctx context.Context, key string, r io.Reader, size int64, level fileserver.ConsistencyLevel) error {
+	payload, err := encodeMessage(fileserver.MessageClientPut{Key: key, Size: size, Consistency: level})
+	if err != nil {
+		return err
+	}
+
+	rpc, err := c.transport.RequestStream(ctx, c.peer, payload, size, func(w io.Writer) error {
+		n, err := io.Copy(w, io.LimitReader(r, size))
+		if err == nil && n < size {
+			err = fmt.Errorf("content is %d bytes long, expected %d", n, size)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientAck](rpc)
+	if err != nil {
+		return err
+	}
+
+	return ackError(reply.Key, reply.Err, reply.NotFound)
+}
+
+// Get returns the size and the content of the file stored under key. The
+// caller must close the content.
+func (c *Client) Get(ctx context.Context, key string, level fileserver.ConsistencyLevel) (int64, io.ReadCloser, error) {
+	rpc, err := c.request(ctx, fileserver.MessageClientGet{Key: key, Consistency: level})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !rpc.Stream {
+		reply, err := decodeReply[fileserver.MessageClientAck](rpc)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := ackError(key, reply.Err, reply.NotFound); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, fmt.Errorf("node did not send the content of %s", key)
+	}
+
+	return rpc.StreamSize, rpc.Reader, nil
+}
+
+// Delete removes the file stored under key from the network.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	rpc, err := c.request(ctx, fileserver.MessageClientDelete{Key: key})
+	if err != nil {
+		return err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientAck](rpc)
+	if err != nil {
+		return err
+	}
+
+	return ackError(key, reply.Err, reply.NotFound)
+}
+
+func (c *Client) Stat(ctx context.Context, key string) (fileserver.FileInfo, error) {
+	rpc, err := c.request(ctx, fileserver.MessageClientStat{Key: key})
+	if err != nil {
+		return fileserver.FileInfo{}, err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientFileInfo](rpc)
+	if err != nil {
+		return fileserver.FileInfo{}, err
+	}
+
+	return reply.Info, ackError(key, reply.Err, reply.NotFound)
+}
+
+// List returns every key starting with prefix stored in the network,
+// listing them a page at a time.
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		keys   []string
+		cursor string
+	)
+	for {
+		page, next, err := c.ListPage(ctx, prefix, cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// ListPage returns, in order, at most limit of the keys starting with prefix
+// that sort after cursor, along with the cursor of the next page, empty once
+// every key was listed. A limit of zero lets the node pick the page size.
+func (c *Client) ListPage(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	rpc, err := c.request(ctx, fileserver.MessageClientList{Prefix: prefix, Cursor: cursor, Limit: limit})
+	if err != nil {
+		return nil, "", err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientKeys](rpc)
+	if err != nil {
+		return nil, "", err
+	}
+	if reply.Err != "" {
+		return nil, "", errors.New(reply.Err)
+	}
+
+	return reply.Keys, reply.Next, nil
+}
+
+// CreateUpload starts an upload session of the file stored under key. Its
+// parts are sent with UploadPart, in any order and in parallel, and the file
+// is stored once CompleteUpload is called. Sessions expire after a while,
+// a day by default.
+func (c *Client) CreateUpload(ctx context.Context, key, contentType string) (storage.Upload, error) {
+	rpc, err := c.request(ctx, fileserver.MessageClientCreateUpload{Key: key, ContentType: contentType})
+	if err != nil {
+		return storage.Upload{}, err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientUpload](rpc)
+	if err != nil {
+		return storage.Upload{}, err
+	}
+	if reply.Err != "" {
+		return storage.Upload{}, errors.New(reply.Err)
+	}
+
+	return reply.Upload, nil
+}
+
+// UploadPart sends the size bytes read from r as the part number, from 1,
+// of the upload session id, replacing the one sent before with the same
+// number.
+func (c *Client) UploadPart(ctx context.Context, id string, number int, r io.Reader, size int64) (storage.Part, error) {
+	payload, err := encodeMessage(fileserver.MessageClientUploadPart{UploadID: id, Number: number, Size: size})
+	if err != nil {
+		return storage.Part{}, err
+	}
+
+	rpc, err := c.transport.RequestStream(ctx, c.peer, payload, size, func(w io.Writer) error {
+		n, err := io.Copy(w, io.LimitReader(r, size))
+		if err == nil && n < size {
+			err = fmt.Errorf("part is %d bytes long, expected %d", n, size)
+		}
+		return err
+	})
+	if err != nil {
+		return storage.Part{}, err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientParts](rpc)
+	if err != nil {
+		return storage.Part{}, err
+	}
+	if err := uploadError(id, reply.Err, reply.NoSuchUpload); err != nil {
+		return storage.Part{}, err
+	}
+	if len(reply.Parts) != 1 {
+		return storage.Part{}, fmt.Errorf("node did not acknowledge part %d", number)
+	}
+
+	return reply.Parts[0], nil
+}
+
+// ListParts returns, in order, the parts of the upload session id the node
+// received, so an interrupted upload only sends the others again.
+func (c *Client) ListParts(ctx context.Context, id string) ([]storage.Part, error) {
+	rpc, err := c.request(ctx, fileserver.MessageClientListParts{UploadID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientParts](rpc)
+	if err != nil {
+		return nil, err
+	}
+
+	return reply.Parts, uploadError(id, reply.Err, reply.NoSuchUpload)
+}
+
+// CompleteUpload stores the file of the upload session id, its parts
+// numbered from 1 without a gap concatenated in order.
+func (c *Client) CompleteUpload(ctx context.Context, id string, level fileserver.ConsistencyLevel) error {
+	rpc, err := c.request(ctx, fileserver.MessageClientCompleteUpload{UploadID: id, Consistency: level})
+	if err != nil {
+		return err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientAck](rpc)
+	if err != nil {
+		return err
+	}
+
+	return uploadError(id, reply.Err, reply.NoSuchUpload)
+}
+
+// AbortUpload ends the upload session id, dropping its parts.
+func (c *Client) AbortUpload(ctx context.Context, id string) error {
+	rpc, err := c.request(ctx, fileserver.MessageClientAbortUpload{UploadID: id})
+	if err != nil {
+		return err
+	}
+
+	reply, err := decodeReply[fileserver.MessageClientAck](rpc)
+	if err != nil {
+		return err
+	}
+
+	return uploadError(id, reply.Err, reply.NoSuchUpload)
+}
+
+func (c *Client) request(ctx context.Context, payload any) (transport.RPC, error) {
+	select {
+	case <-c.closed:
+		return transport.RPC{}, ErrClosed
+	default:
+	}
+
+	b, err := encodeMessage(payload)
+	if err != nil {
+		return transport.RPC{}, err
+	}
+
+	return c.transport.Request(ctx, c.peer, b)
+}
+
+// ackError turns the error a node replied with back into an error, files
+// not found match fileserver.ErrFileNotFound.
+func ackError(key, msg string, notFound bool) error {
+	switch {
+	case notFound:
+		return fmt.Errorf("%s: %w", key, fileserver.ErrFileNotFound)
+	case msg != "":
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// uploadError turns the error a node replied with to a request about an
+// upload session back into an error, sessions not found match
+// storage.ErrNoSuchUpload.
+func uploadError(id, msg string, noSuchUpload bool) error {
+	switch {
+	case noSuchUpload:
+		return fmt.Errorf("upload %s: %w", id, storage.ErrNoSuchUpload)
+	case msg != "":
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+func encodeMessage(payload any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&fileserver.Message{Payload: payload}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decodeReply decodes the payload of rpc as a T. A stream it carries is
+// closed when it is not what was expected.
+func decodeReply[T any](rpc transport.RPC) (T, error) {
+	var zero T
+
+	var msg fileserver.Message
+	if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
+		if rpc.Stream {
+			rpc.Reader.Close()
+		}
+		return zero, err
+	}
+
+	reply, ok := msg.Payload.(T)
+	if !ok {
+		if rpc.Stream {
+			rpc.Reader.Close()
+		}
+		return zero, fmt.Errorf("unexpected reply %T", msg.Payload)
+	}
+
+	return reply, nil
+}
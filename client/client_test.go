@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/gusga/dfsgo/fileserver"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestServer(t *testing.T, disc *discovery.StaticDiscoverySrv) *fileserver.FileServer {
+	t.Helper()
+
+	known, _ := disc.GetNodes()
+
+	logger := zap.NewNop()
+	id := fscrypto.GenerateServerID()
+
+	tr := transport.NewTCPTransport(transport.TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: transport.NewTCPHandshakeFunc(id),
+		Logger:        logger,
+	})
+
+	srv := fileserver.NewServer(fileserver.FileServerOpts{
+		ID:           id,
+		EncKey:       fscrypto.NewEncryptionKey(),
+		Transport:    tr,
+		Logger:       logger,
+		DiscoverySrv: disc,
+		// Tests run two nodes.
+		ReplicationFactor: 2,
+		Storage: storage.NewStorage(storage.StorageOpts{
+			Root:              t.TempDir(),
+			PathTransformFunc: storage.CASPathTransformFunc,
+			Logger:            logger,
+		}),
+	})
+	tr.OnPeer = srv.OnPeer
+
+	go srv.Start()
+	t.Cleanup(srv.Close)
+
+	// The server registers itself once it is listening.
+	require.Eventually(t, func() bool {
+		nodes, _ := disc.GetNodes()
+		return len(nodes) == len(known)+1
+	}, time.Second, 10*time.Millisecond)
+
+	return srv
+}
+
+func newTestClient(t *testing.T, addr string) *Client {
+	t.Helper()
+
+	c, err := NewClient(ClientOpts{Addr: addr, RequestTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestClient(t *testing.T) {
+	disc, err := discovery.NewStaticDiscoverySrv(nil, zap.NewNop())
+	require.NoError(t, err)
+
+	s1 := newTestServer(t, disc)
+	s2 := newTestServer(t, disc)
+
+	c := newTestClient(t, s1.Transport.Addr())
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("some big file content "), 4096)
+
+	// Writes with consistency ALL succeed once the nodes are connected.
+	require.Eventually(t, func() bool {
+		return c.Put(ctx, "dir/my_file.txt", bytes.NewReader(content), int64(len(content)), fileserver.All) == nil
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// The client is not taken for a node.
+	hashedKey := fscrypto.HashKey("dir/my_file.txt")
+	assert.True(t, s2.Storage.HasFile(s1.ID, hashedKey))
+
+	info, err := c.Stat(ctx, "dir/my_file.txt")
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+	assert.Equal(t, fileserver.FileInfo{
+		Key:       "dir/my_file.txt",
+		Size:      int64(len(content)),
+		Local:     true,
+		Replicas:  1,
+		Checksum:  hex.EncodeToString(sum[:]),
+		CreatedAt: info.CreatedAt,
+		Owner:     s1.ID,
+	}, info)
+
+	size, r, err := c.Get(ctx, "dir/my_file.txt", 0)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, int64(len(content)), size)
+	assert.Equal(t, content, got)
+
+	// Keys stored through any node are listed.
+	c2 := newTestClient(t, s2.Transport.Addr())
+	require.NoError(t, c2.Put(ctx, "dir/other.txt", strings.NewReader("other"), 5, 0))
+	require.NoError(t, c2.Put(ctx, "other/file.txt", strings.NewReader("other"), 5, 0))
+
+	keys, err := c.List(ctx, "dir/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir/my_file.txt", "dir/other.txt"}, keys)
+
+	keys, next, err := c.ListPage(ctx, "", "", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir/my_file.txt", "dir/other.txt"}, keys)
+	keys, next, err = c.ListPage(ctx, "", next, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other/file.txt"}, keys)
+	assert.Empty(t, next)
+
+	require.NoError(t, c.Delete(ctx, "dir/my_file.txt"))
+
+	_, _, err = c.Get(ctx, "dir/my_file.txt", 0)
+	assert.ErrorIs(t, err, fileserver.ErrFileNotFound)
+	_, err = c.Stat(ctx, "dir/my_file.txt")
+	assert.ErrorIs(t, err, fileserver.ErrFileNotFound)
+
+	keys, err = c.List(ctx, "dir/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dir/other.txt"}, keys)
+}
+
+func TestClient_Upload(t *testing.T) {
+	disc, err := discovery.NewStaticDiscoverySrv(nil, zap.NewNop())
+	require.NoError(t, err)
+
+	srv := newTestServer(t, disc)
+	c := newTestClient(t, srv.Transport.Addr())
+	ctx := context.Background()
+
+	u, err := c.CreateUpload(ctx, "backups/db.tar", "application/x-tar")
+	require.NoError(t, err)
+
+	parts := [][]byte{
+		bytes.Repeat([]byte("a"), 5000),
+		bytes.Repeat([]byte("b"), 5000),
+		[]byte("end"),
+	}
+
+	// Parts are sent in parallel, the second one is interrupted.
+	errs := make(chan error, 2)
+	for _, number := range []int{3, 1} {
+		go func(number int) {
+			part := parts[number-1]
+			_, err := c.UploadPart(ctx, u.ID, number, bytes.NewReader(part), int64(len(part)))
+			errs <- err
+		}(number)
+	}
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	received, err := c.ListParts(ctx, u.ID)
+	require.NoError(t, err)
+	require.Len(t, received, 2)
+	assert.Equal(t, 1, received[0].Number)
+	assert.Equal(t, 3, received[1].Number)
+
+	err = c.CompleteUpload(ctx, u.ID, 0)
+	assert.ErrorContains(t, err, "missing part")
+
+	// The upload resumes with the missing part only.
+	part, err := c.UploadPart(ctx, u.ID, 2, bytes.NewReader(parts[1]), int64(len(parts[1])))
+	require.NoError(t, err)
+	sum := sha256.Sum256(parts[1])
+	assert.Equal(t, hex.EncodeToString(sum[:]), part.Checksum)
+	require.NoError(t, c.CompleteUpload(ctx, u.ID, 0))
+
+	_, r, err := c.Get(ctx, "backups/db.tar", 0)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, bytes.Join(parts, nil), got)
+
+	info, err := c.Stat(ctx, "backups/db.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "application/x-tar", info.ContentType)
+
+	// The session ends once completed, or aborted.
+	_, err = c.ListParts(ctx, u.ID)
+	assert.ErrorIs(t, err, storage.ErrNoSuchUpload)
+
+	u, err = c.CreateUpload(ctx, "backups/db.tar", "")
+	require.NoError(t, err)
+	require.NoError(t, c.AbortUpload(ctx, u.ID))
+	_, err = c.UploadPart(ctx, u.ID, 1, strings.NewReader("a"), 1)
+	assert.ErrorIs(t, err, storage.ErrNoSuchUpload)
+}
+
+func TestClient_PutShortContent(t *testing.T) {
+	disc, err := discovery.NewStaticDiscoverySrv(nil, zap.NewNop())
+	require.NoError(t, err)
+
+	srv := newTestServer(t, disc)
+	c := newTestClient(t, srv.Transport.Addr())
+
+	err = c.Put(context.Background(), "short.txt", strings.NewReader("too short"), 1024, 0)
+	assert.Error(t, err)
+}
+
+func TestNewClient_Unreachable(t *testing.T) {
+	_, err := NewClient(ClientOpts{Addr: "127.0.0.1:1"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+// Command certgen creates a local certificate authority and issues node
+// certificates signed by it, so a cluster can run over mutual TLS without an
+// external PKI.
+//
+//	certgen -out certs -nodes node-1,node-2 -hosts 127.0.0.1,localhost
+//
+// The CA is written to ca.crt and ca.key in the output directory and reused
+// when it already exists there. Every node gets <name>.crt and <name>.key.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gusga/dfsgo/pki"
+)
+
+func main() {
+	out := flag.String("out", "certs", "directory the certificates are written to")
+	nodes := flag.String("nodes", "", "comma separated names of the nodes to issue certificates for")
+	hosts := flag.String("hosts", "127.0.0.1,localhost", "comma separated IP addresses and DNS names the node certificates are valid for")
+	validity := flag.Duration("validity", pki.DefaultValidity, "validity of the generated certificates")
+	flag.Parse()
+
+	if err := run(*out, splitList(*nodes), splitList(*hosts), *validity); err != nil {
+		fmt.Fprintln(os.Stderr, "certgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(out string, nodes, hosts []string, validity time.Duration) error {
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return err
+	}
+
+	caCert := filepath.Join(out, "ca.crt")
+	caKey := filepath.Join(out, "ca.key")
+
+	ca, err := pki.LoadCA(caCert, caKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		ca, err = pki.NewCA("dfsgo local CA", validity)
+		if err != nil {
+			return err
+		}
+		if err := ca.Save(caCert, caKey); err != nil {
+			return err
+		}
+		fmt.Println("created", caCert)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		cert, err := ca.IssueNodeCert(node, hosts, validity)
+		if err != nil {
+			return fmt.Errorf("issue certificate for %s: %w", node, err)
+		}
+
+		certFile := filepath.Join(out, node+".crt")
+		if err := cert.Save(certFile, filepath.Join(out, node+".key")); err != nil {
+			return err
+		}
+		fmt.Println("created", certFile)
+	}
+
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,285 @@
+// Command client stores and reads files through a file storage node.
+//
+//	client -addr 10.0.0.1:3000 put <key> <file|->
+//	client -addr 10.0.0.1:3000 get <key> [file|-]
+//	client -addr 10.0.0.1:3000 rm <key>
+//	client -addr 10.0.0.1:3000 ls [prefix]
+//	client -addr 10.0.0.1:3000 stat <key>
+//
+// Files are kept in the namespace of the node they are put through, read
+// them through the same node. put reads the standard input when the file is
+// -, get writes to the standard output when no file is given.
+//
+// The exit code is 0 on success, 1 on errors, 2 on usage errors and 3 when
+// the file is not found.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gusga/dfsgo/client"
+	"github.com/gusga/dfsgo/fileserver"
+	"github.com/gusga/dfsgo/transport"
+)
+
+const (
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+var errUsage = errors.New("usage")
+
+type options struct {
+	addr        string
+	tlsCert     string
+	tlsKey      string
+	tlsCA       string
+	consistency string
+	timeout     time.Duration
+	quiet       bool
+}
+
+func main() {
+	addr := os.Getenv("DFSGO_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:3000"
+	}
+
+	var opts options
+	flag.StringVar(&opts.addr, "addr", addr, "address of the node (env DFSGO_ADDR)")
+	flag.StringVar(&opts.tlsCert, "tls-cert", os.Getenv("DFSGO_TLS_CERT"), "certificate of the client for mutual TLS (env DFSGO_TLS_CERT)")
+	flag.StringVar(&opts.tlsKey, "tls-key", os.Getenv("DFSGO_TLS_KEY"), "key of the client certificate (env DFSGO_TLS_KEY)")
+	flag.StringVar(&opts.tlsCA, "tls-ca", os.Getenv("DFSGO_TLS_CA"), "CA certificate of the nodes (env DFSGO_TLS_CA)")
+	flag.StringVar(&opts.consistency, "consistency", "", "consistency level of put and get: one, quorum or all (default the node's)")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Minute, "timeout of the command")
+	flag.BoolVar(&opts.quiet, "q", false, "do not show progress bars")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] put <key> <file|->\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] get <key> [file|-]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] rm|stat <key>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] ls [prefix]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	err := run(opts, flag.Args())
+	switch {
+	case err == nil:
+	case errors.Is(err, errUsage):
+		flag.Usage()
+		os.Exit(exitUsage)
+	case errors.Is(err, fileserver.ErrFileNotFound):
+		fmt.Fprintln(os.Stderr, "client:", err)
+		os.Exit(exitNotFound)
+	default:
+		fmt.Fprintln(os.Stderr, "client:", err)
+		os.Exit(exitError)
+	}
+}
+
+func run(opts options, args []string) error {
+	if len(args) == 0 || !validArgs(args[0], len(args)-1) {
+		return errUsage
+	}
+
+	var level fileserver.ConsistencyLevel
+	if opts.consistency != "" {
+		var err error
+		if level, err = fileserver.ParseConsistencyLevel(opts.consistency); err != nil {
+			return err
+		}
+	}
+
+	if (opts.tlsCert == "") != (opts.tlsKey == "") || (opts.tlsCert == "") != (opts.tlsCA == "") {
+		return errors.New("-tls-cert, -tls-key and -tls-ca must be set together")
+	}
+
+	clientOpts := client.ClientOpts{Addr: opts.addr}
+	if opts.tlsCert != "" {
+		tlsConfig, err := transport.LoadMutualTLSConfig(opts.tlsCert, opts.tlsKey, opts.tlsCA)
+		if err != nil {
+			return err
+		}
+		clientOpts.TLSConfig = tlsConfig
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+
+	c, err := client.NewClient(clientOpts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var progressOut io.Writer
+	if !opts.quiet && isTerminal(os.Stderr) {
+		progressOut = os.Stderr
+	}
+
+	switch args[0] {
+	case "put":
+		return put(ctx, c, args[1], args[2], level, progressOut)
+	case "get":
+		out := "-"
+		if len(args) == 3 {
+			out = args[2]
+		}
+		return get(ctx, c, args[1], out, level, progressOut)
+	case "rm":
+		return c.Delete(ctx, args[1])
+	case "ls":
+		prefix := ""
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		// Keys are printed a page at a time, listing large namespaces
+		// does not hold them all in memory.
+		for cursor := ""; ; {
+			keys, next, err := c.ListPage(ctx, prefix, cursor, 0)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				fmt.Println(key)
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	case "stat":
+		info, err := c.Stat(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		printFileInfo(os.Stdout, info)
+	}
+
+	return nil
+}
+
+// validArgs reports whether command takes n arguments.
+func validArgs(command string, n int) bool {
+	switch command {
+	case "put":
+		return n == 2
+	case "get":
+		return n == 1 || n == 2
+	case "rm", "stat":
+		return n == 1
+	case "ls":
+		return n <= 1
+	}
+
+	return false
+}
+
+func put(ctx context.Context, c *client.Client, key, path string, level fileserver.ConsistencyLevel, progressOut io.Writer) error {
+	f, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	p := newProgress(progressOut, "put "+key, info.Size())
+	defer p.Finish()
+
+	return c.Put(ctx, key, p.Reader(f), info.Size(), level)
+}
+
+// openInput opens the file at path. The standard input, -, is buffered to a
+// temporary file first, the size of the content must be known up front.
+func openInput(path string) (*os.File, error) {
+	if path != "-" {
+		return os.Open(path)
+	}
+
+	tmp, err := os.CreateTemp("", "dfsgo-put-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, os.Stdin); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	return tmp, nil
+}
+
+func get(ctx context.Context, c *client.Client, key, path string, level fileserver.ConsistencyLevel, progressOut io.Writer) error {
+	size, r, err := c.Get(ctx, key, level)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out := os.Stdout
+	if path != "-" {
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	p := newProgress(progressOut, "get "+key, size)
+	defer p.Finish()
+
+	n, err := io.Copy(out, p.Reader(r))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("received %d bytes of %s, expected %d", n, key, size)
+	}
+	if out == os.Stdout {
+		return nil
+	}
+
+	return out.Sync()
+}
+
+func printFileInfo(w io.Writer, info fileserver.FileInfo) {
+	size := "unknown"
+	if info.Size >= 0 {
+		size = fmt.Sprintf("%d (%s)", info.Size, formatBytes(info.Size))
+	}
+
+	fmt.Fprintf(w, "key:      %s\n", info.Key)
+	fmt.Fprintf(w, "size:     %s\n", size)
+	fmt.Fprintf(w, "local:    %t\n", info.Local)
+	fmt.Fprintf(w, "replicas: %d\n", info.Replicas)
+
+	// Only the local copy has metadata.
+	if info.Checksum == "" {
+		return
+	}
+	if info.ContentType != "" {
+		fmt.Fprintf(w, "type:     %s\n", info.ContentType)
+	}
+	fmt.Fprintf(w, "sha256:   %s\n", info.Checksum)
+	fmt.Fprintf(w, "created:  %s\n", info.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "owner:    %s\n", info.Owner)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gusga/dfsgo/fileserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidArgs(t *testing.T) {
+	tests := []struct {
+		command string
+		n       int
+		want    bool
+	}{
+		{command: "put", n: 2, want: true},
+		{command: "put", n: 1},
+		{command: "get", n: 1, want: true},
+		{command: "get", n: 2, want: true},
+		{command: "get", n: 3},
+		{command: "rm", n: 1, want: true},
+		{command: "rm", n: 0},
+		{command: "stat", n: 1, want: true},
+		{command: "ls", n: 0, want: true},
+		{command: "ls", n: 1, want: true},
+		{command: "ls", n: 2},
+		{command: "cp", n: 2},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, validArgs(tt.command, tt.n), "%s with %d arguments", tt.command, tt.n)
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	assert.ErrorIs(t, run(options{}, nil), errUsage)
+	assert.ErrorIs(t, run(options{}, []string{"put", "key"}), errUsage)
+
+	// Invalid flags are reported before connecting.
+	assert.Error(t, run(options{consistency: "most"}, []string{"stat", "key"}))
+	assert.Error(t, run(options{tlsCert: "client.crt"}, []string{"stat", "key"}))
+}
+
+func TestPrintFileInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		info fileserver.FileInfo
+		want string
+	}{
+		{
+			name: "replicas only",
+			info: fileserver.FileInfo{Key: "my_file.txt", Size: 2048, Replicas: 2},
+			want: "key:      my_file.txt\nsize:     2048 (2.0KiB)\nlocal:    false\nreplicas: 2\n",
+		},
+		{
+			name: "local copy",
+			info: fileserver.FileInfo{
+				Key:         "my_file.txt",
+				Size:        2048,
+				Local:       true,
+				Replicas:    2,
+				ContentType: "text/plain",
+				Checksum:    "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7",
+				CreatedAt:   time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+				Owner:       "node-1",
+			},
+			want: "key:      my_file.txt\nsize:     2048 (2.0KiB)\nlocal:    true\nreplicas: 2\n" +
+				"type:     text/plain\nsha256:   3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7\n" +
+				"created:  2024-05-01T12:30:00Z\nowner:    node-1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			printFileInfo(buf, tt.info)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressWidth = 30
+
+// progress counts the bytes copied through it and draws a progress bar on
+// out while they are. It draws nothing when out is nil.
+type progress struct {
+	out   io.Writer
+	label string
+	total int64
+
+	mu      sync.Mutex
+	done    int64
+	drawn   time.Time
+	started time.Time
+}
+
+func newProgress(out io.Writer, label string, total int64) *progress {
+	return &progress{out: out, label: label, total: total, started: time.Now()}
+}
+
+// isTerminal reports whether f is a terminal, progress bars are only drawn
+// on terminals.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += int64(len(b))
+	if time.Since(p.drawn) >= 100*time.Millisecond {
+		p.draw()
+	}
+
+	return len(b), nil
+}
+
+// Reader returns r counting the bytes read from it.
+func (p *progress) Reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, p)
+}
+
+// Finish draws the bar one last time and ends its line.
+func (p *progress) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.out == nil {
+		return
+	}
+	p.draw()
+	fmt.Fprintln(p.out)
+}
+
+func (p *progress) draw() {
+	p.drawn = time.Now()
+	if p.out == nil {
+		return
+	}
+
+	filled := progressWidth
+	percent := 100
+	if p.total > 0 {
+		filled = int(min(p.done, p.total) * progressWidth / p.total)
+		percent = int(min(p.done, p.total) * 100 / p.total)
+	}
+
+	rate := float64(p.done) / max(time.Since(p.started).Seconds(), 0.001)
+	fmt.Fprintf(p.out, "\r%s [%s%s] %3d%% %s/%s %s/s",
+		p.label,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled),
+		percent, formatBytes(p.done), formatBytes(p.total), formatBytes(int64(rate)))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0B"},
+		{n: 1023, want: "1023B"},
+		{n: 1024, want: "1.0KiB"},
+		{n: 1536, want: "1.5KiB"},
+		{n: 5 << 20, want: "5.0MiB"},
+		{n: 3 << 30, want: "3.0GiB"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, formatBytes(tt.n))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	out := new(bytes.Buffer)
+	p := newProgress(out, "put key", 2048)
+
+	n, err := io.Copy(io.Discard, p.Reader(strings.NewReader(strings.Repeat("a", 2048))))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2048), n)
+
+	p.Finish()
+	assert.Contains(t, out.String(), "put key ["+strings.Repeat("=", progressWidth)+"] 100% 2.0KiB/2.0KiB")
+	assert.True(t, strings.HasSuffix(out.String(), "\n"))
+
+	// Without an output nothing is drawn.
+	p = newProgress(nil, "get key", 10)
+	io.Copy(io.Discard, p.Reader(strings.NewReader("0123456789")))
+	p.Finish()
+}
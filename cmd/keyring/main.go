@@ -0,0 +1,87 @@
+// Command keyring manages the file-based keyring holding the key encryption
+// keys of a node.
+//
+//	keyring -file keyring.json init
+//	keyring -file keyring.json list
+//	keyring -file keyring.json rotate
+//
+// rotate adds a new active key to the keyring. Files replicated before keep
+// their data key wrapped by the previous key, which stays in the keyring,
+// until the node reloads the keyring and rewraps them with
+// FileServer.RewrapKeys. Their contents are never re-encrypted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+)
+
+func main() {
+	file := flag.String("file", "keyring.json", "path of the keyring file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-file path] init|list|rotate\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*file, flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, "keyring:", err)
+		os.Exit(1)
+	}
+}
+
+func run(file, command string) error {
+	switch command {
+	case "init":
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists", file)
+		}
+		kr, err := fscrypto.LoadKeyring(file)
+		if err != nil {
+			return err
+		}
+		fmt.Println("created", file, "with key", kr.ActiveID())
+	case "list":
+		kr, err := loadExisting(file)
+		if err != nil {
+			return err
+		}
+		for _, id := range kr.IDs() {
+			if id == kr.ActiveID() {
+				fmt.Println(id, "(active)")
+			} else {
+				fmt.Println(id)
+			}
+		}
+	case "rotate":
+		kr, err := loadExisting(file)
+		if err != nil {
+			return err
+		}
+		id, err := kr.Rotate()
+		if err != nil {
+			return err
+		}
+		fmt.Println("active key is now", id)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+
+	return nil
+}
+
+func loadExisting(file string) (*fscrypto.Keyring, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+
+	return fscrypto.LoadKeyring(file)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gusga/dfsgo/fileserver"
+)
+
+// Config is the configuration of a node, read from a JSON file and then
+// overridden by the environment and the command line, see overrides.
+type Config struct {
+	ListenAddr string `json:"listenAddr"`
+	// HTTPAddr is the address of the HTTP gateway, disabled when empty.
+	HTTPAddr string `json:"httpAddr"`
+	// DataDir holds the stored files, the server ID and, unless Keyring is
+	// set, the keyring.
+	DataDir string `json:"dataDir"`
+	// ServerID is generated and kept in DataDir when empty. With TLS, it
+	// must be one of the names the certificate of the node was issued to.
+	ServerID string `json:"serverId"`
+	Keyring  string `json:"keyring"`
+
+	ReplicationFactor int    `json:"replicationFactor"`
+	WriteConsistency  string `json:"writeConsistency"`
+	ReadConsistency   string `json:"readConsistency"`
+	// ScrubInterval is how often the stored files are checked for
+	// corruption, as a duration like "24h". Zero disables the checks.
+	ScrubInterval string `json:"scrubInterval"`
+	// ChunkSize is the size in bytes of the chunks files larger than it
+	// are replicated in.
+	ChunkSize int64 `json:"chunkSize"`
+	// Erasure is the erasure code files are stored with, data+parity
+	// shards like "4+2", instead of being replicated. "none" or empty
+	// replicates them.
+	Erasure string `json:"erasure"`
+	// RebuildDelay is how long after a node left the shards it held are
+	// rebuilt, as a duration like "5m".
+	RebuildDelay string `json:"rebuildDelay"`
+	// UploadTTL is how long an upload session is kept before it is
+	// garbage collected, as a duration like "24h".
+	UploadTTL string `json:"uploadTTL"`
+
+	TLS TLSConfig `json:"tls"`
+	S3  S3Config  `json:"s3"`
+
+	// Discovery is the discovery service used: redis, static, file or
+	// gossip. When empty it is guessed from the settings present.
+	Discovery string       `json:"discovery"`
+	Redis     RedisConfig  `json:"redis"`
+	Nodes     []string     `json:"nodes"`
+	NodesFile string       `json:"nodesFile"`
+	Gossip    GossipConfig `json:"gossip"`
+}
+
+type TLSConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca"`
+}
+
+// S3Config enables the S3 API on ListenAddr. Credentials maps the access
+// keys allowed to sign requests to their secret keys.
+type S3Config struct {
+	ListenAddr  string            `json:"listenAddr"`
+	Region      string            `json:"region"`
+	Credentials map[string]string `json:"credentials"`
+}
+
+// RedisConfig connects either to a single server at URL or, when
+// MasterName is set, to the master monitored by the sentinels.
+type RedisConfig struct {
+	URL              string   `json:"url"`
+	MasterName       string   `json:"masterName"`
+	SentinelAddrs    []string `json:"sentinelAddrs"`
+	Password         string   `json:"password"`
+	SentinelPassword string   `json:"sentinelPassword"`
+	DB               int      `json:"db"`
+}
+
+type GossipConfig struct {
+	ListenAddr    string   `json:"listenAddr"`
+	AdvertiseAddr string   `json:"advertiseAddr"`
+	Seeds         []string `json:"seeds"`
+}
+
+const (
+	discoveryRedis  = "redis"
+	discoveryStatic = "static"
+	discoveryFile   = "file"
+	discoveryGossip = "gossip"
+)
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:        ":3000",
+		DataDir:           "data",
+		ReplicationFactor: fileserver.DefaultReplicationFactor,
+		WriteConsistency:  fileserver.One.String(),
+		ReadConsistency:   fileserver.One.String(),
+		ScrubInterval:     "24h",
+		ChunkSize:         fileserver.DefaultChunkSize,
+		RebuildDelay:      fileserver.DefaultRebuildDelay.String(),
+		UploadTTL:         fileserver.DefaultUploadTTL.String(),
+	}
+}
+
+// override is a setting that can be changed with a flag and an environment
+// variable, the flag taking precedence.
+type override struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var overrides = []override{
+	{"listen", "DFSGO_LISTEN_ADDR", "address the node listens on", func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"http", "DFSGO_HTTP_ADDR", "address the HTTP gateway listens on, disabled when empty", func(c *Config, v string) error {
+		c.HTTPAddr = v
+		return nil
+	}},
+	{"s3-listen", "DFSGO_S3_LISTEN_ADDR", "address the S3 API listens on, disabled when empty", func(c *Config, v string) error {
+		c.S3.ListenAddr = v
+		return nil
+	}},
+	{"s3-region", "DFSGO_S3_REGION", "region S3 requests are signed for", func(c *Config, v string) error {
+		c.S3.Region = v
+		return nil
+	}},
+	{"s3-credentials", "DFSGO_S3_CREDENTIALS", "comma separated accessKey:secretKey pairs allowed to use the S3 API", func(c *Config, v string) error {
+		credentials, err := parseCredentials(v)
+		c.S3.Credentials = credentials
+		return err
+	}},
+	{"data-dir", "DFSGO_DATA_DIR", "directory holding the node data", func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{"id", "DFSGO_SERVER_ID", "server ID, generated when empty", func(c *Config, v string) error {
+		c.ServerID = v
+		return nil
+	}},
+	{"keyring", "DFSGO_KEYRING", "path of the keyring file", func(c *Config, v string) error {
+		c.Keyring = v
+		return nil
+	}},
+	{"replication", "DFSGO_REPLICATION_FACTOR", "number of nodes every file is stored on", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.ReplicationFactor = n
+		return err
+	}},
+	{"write-consistency", "DFSGO_WRITE_CONSISTENCY", "default write consistency: one, quorum or all", func(c *Config, v string) error {
+		c.WriteConsistency = v
+		return nil
+	}},
+	{"read-consistency", "DFSGO_READ_CONSISTENCY", "default read consistency: one, quorum or all", func(c *Config, v string) error {
+		c.ReadConsistency = v
+		return nil
+	}},
+	{"scrub-interval", "DFSGO_SCRUB_INTERVAL", "how often stored files are checked for corruption, 0 disables the checks", func(c *Config, v string) error {
+		c.ScrubInterval = v
+		return nil
+	}},
+	{"chunk-size", "DFSGO_CHUNK_SIZE", "size in bytes of the chunks files larger than it are replicated in", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		c.ChunkSize = n
+		return err
+	}},
+	{"erasure", "DFSGO_ERASURE", "erasure code files are stored with, as data+parity shards like 4+2, none replicates them", func(c *Config, v string) error {
+		c.Erasure = v
+		return nil
+	}},
+	{"rebuild-delay", "DFSGO_REBUILD_DELAY", "how long after a node left the shards it held are rebuilt", func(c *Config, v string) error {
+		c.RebuildDelay = v
+		return nil
+	}},
+	{"upload-ttl", "DFSGO_UPLOAD_TTL", "how long an upload session is kept before it is garbage collected", func(c *Config, v string) error {
+		c.UploadTTL = v
+		return nil
+	}},
+	{"tls-cert", "DFSGO_TLS_CERT", "certificate of the node", func(c *Config, v string) error {
+		c.TLS.Cert = v
+		return nil
+	}},
+	{"tls-key", "DFSGO_TLS_KEY", "private key of the node certificate", func(c *Config, v string) error {
+		c.TLS.Key = v
+		return nil
+	}},
+	{"tls-ca", "DFSGO_TLS_CA", "CA certificate the peers are verified with", func(c *Config, v string) error {
+		c.TLS.CA = v
+		return nil
+	}},
+	{"discovery", "DFSGO_DISCOVERY", "discovery service: redis, static, file or gossip", func(c *Config, v string) error {
+		c.Discovery = v
+		return nil
+	}},
+	{"redis-url", "DFSGO_REDIS_URL", "URL of the redis server", func(c *Config, v string) error {
+		c.Redis.URL = v
+		return nil
+	}},
+	{"redis-master", "DFSGO_REDIS_MASTER", "name of the master monitored by the sentinels", func(c *Config, v string) error {
+		c.Redis.MasterName = v
+		return nil
+	}},
+	{"redis-sentinels", "DFSGO_REDIS_SENTINELS", "comma separated sentinel addresses", func(c *Config, v string) error {
+		c.Redis.SentinelAddrs = splitList(v)
+		return nil
+	}},
+	{"nodes", "DFSGO_NODES", "comma separated addresses of the nodes of a static network", func(c *Config, v string) error {
+		c.Nodes = splitList(v)
+		return nil
+	}},
+	{"nodes-file", "DFSGO_NODES_FILE", "JSON or YAML file listing the nodes of the network", func(c *Config, v string) error {
+		c.NodesFile = v
+		return nil
+	}},
+	{"gossip-listen", "DFSGO_GOSSIP_LISTEN_ADDR", "address the gossip discovery listens on", func(c *Config, v string) error {
+		c.Gossip.ListenAddr = v
+		return nil
+	}},
+	{"gossip-advertise", "DFSGO_GOSSIP_ADVERTISE_ADDR", "address other nodes reach the gossip discovery at", func(c *Config, v string) error {
+		c.Gossip.AdvertiseAddr = v
+		return nil
+	}},
+	{"gossip-seeds", "DFSGO_GOSSIP_SEEDS", "comma separated gossip addresses of the seed nodes", func(c *Config, v string) error {
+		c.Gossip.Seeds = splitList(v)
+		return nil
+	}},
+}
+
+// registerFlags defines a flag for every override, it returns the values
+// given on the command line once fs is parsed.
+func registerFlags(fs *flag.FlagSet) func() map[string]string {
+	values := make(map[string]*string, len(overrides))
+	for _, o := range overrides {
+		values[o.flag] = fs.String(o.flag, "", fmt.Sprintf("%s (env %s)", o.usage, o.env))
+	}
+
+	return func() map[string]string {
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			if v, ok := values[f.Name]; ok {
+				set[f.Name] = *v
+			}
+		})
+		return set
+	}
+}
+
+// loadConfig reads the config file at path, when given, over the defaults
+// and applies the overrides found in env and then in flags.
+func loadConfig(path string, env func(string) string, flags map[string]string) (Config, error) {
+	config := defaultConfig()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	for _, o := range overrides {
+		if v := env(o.env); v != "" {
+			if err := o.set(&config, v); err != nil {
+				return Config{}, fmt.Errorf("%s: %w", o.env, err)
+			}
+		}
+	}
+	for _, o := range overrides {
+		if v, ok := flags[o.flag]; ok {
+			if err := o.set(&config, v); err != nil {
+				return Config{}, fmt.Errorf("-%s: %w", o.flag, err)
+			}
+		}
+	}
+
+	if config.Discovery == "" {
+		config.Discovery = config.guessDiscovery()
+	}
+
+	return config, config.validate()
+}
+
+func (c *Config) guessDiscovery() string {
+	switch {
+	case c.Redis.URL != "" || c.Redis.MasterName != "":
+		return discoveryRedis
+	case c.NodesFile != "":
+		return discoveryFile
+	case c.Gossip.ListenAddr != "" || len(c.Gossip.Seeds) > 0:
+		return discoveryGossip
+	default:
+		return discoveryStatic
+	}
+}
+
+func (c *Config) validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listen address is required")
+	}
+	if c.DataDir == "" {
+		return errors.New("data directory is required")
+	}
+	if c.ReplicationFactor <= 0 {
+		return fmt.Errorf("invalid replication factor %d", c.ReplicationFactor)
+	}
+	if _, err := fileserver.ParseConsistencyLevel(c.WriteConsistency); err != nil {
+		return err
+	}
+	if _, err := fileserver.ParseConsistencyLevel(c.ReadConsistency); err != nil {
+		return err
+	}
+	if _, err := c.scrubInterval(); err != nil {
+		return err
+	}
+	if c.ChunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", c.ChunkSize)
+	}
+	if _, err := fileserver.ParseErasureCode(c.Erasure); err != nil {
+		return err
+	}
+	if _, err := c.rebuildDelay(); err != nil {
+		return err
+	}
+	if _, err := c.uploadTTL(); err != nil {
+		return err
+	}
+
+	tlsFiles := 0
+	for _, f := range []string{c.TLS.Cert, c.TLS.Key, c.TLS.CA} {
+		if f != "" {
+			tlsFiles++
+		}
+	}
+	if tlsFiles != 0 && tlsFiles != 3 {
+		return errors.New("TLS needs a certificate, its key and a CA certificate")
+	}
+
+	if c.S3.ListenAddr != "" && len(c.S3.Credentials) == 0 {
+		return errors.New("S3 API needs credentials")
+	}
+
+	switch c.Discovery {
+	case discoveryRedis:
+		if c.Redis.URL == "" && c.Redis.MasterName == "" {
+			return errors.New("redis discovery needs a URL or a sentinel master name")
+		}
+	case discoveryFile:
+		if c.NodesFile == "" {
+			return errors.New("file discovery needs a nodes file")
+		}
+	case discoveryGossip:
+		if c.Gossip.ListenAddr == "" {
+			return errors.New("gossip discovery needs a listen address")
+		}
+	case discoveryStatic:
+	default:
+		return fmt.Errorf("unknown discovery %q", c.Discovery)
+	}
+
+	return nil
+}
+
+// scrubInterval returns how often the stored files are checked, zero when
+// they are not.
+func (c *Config) scrubInterval() (time.Duration, error) {
+	if c.ScrubInterval == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(c.ScrubInterval)
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("invalid scrub interval %q", c.ScrubInterval)
+	}
+
+	return interval, nil
+}
+
+// rebuildDelay returns how long after a node left the shards it held are
+// rebuilt, the default when it is not set.
+func (c *Config) rebuildDelay() (time.Duration, error) {
+	if c.RebuildDelay == "" {
+		return fileserver.DefaultRebuildDelay, nil
+	}
+
+	delay, err := time.ParseDuration(c.RebuildDelay)
+	if err != nil || delay <= 0 {
+		return 0, fmt.Errorf("invalid rebuild delay %q", c.RebuildDelay)
+	}
+
+	return delay, nil
+}
+
+// uploadTTL returns how long an upload session is kept, the default when
+// it is not set.
+func (c *Config) uploadTTL() (time.Duration, error) {
+	if c.UploadTTL == "" {
+		return fileserver.DefaultUploadTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(c.UploadTTL)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid upload TTL %q", c.UploadTTL)
+	}
+
+	return ttl, nil
+}
+
+// keyringPath returns where the keyring is kept.
+func (c *Config) keyringPath() string {
+	if c.Keyring != "" {
+		return c.Keyring
+	}
+
+	return filepath.Join(c.DataDir, "keyring.json")
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// parseCredentials parses comma separated accessKey:secretKey pairs.
+func parseCredentials(s string) (map[string]string, error) {
+	credentials := make(map[string]string)
+	for _, pair := range splitList(s) {
+		accessKey, secretKey, ok := strings.Cut(pair, ":")
+		if !ok || accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("invalid credentials %q, expected accessKey:secretKey", pair)
+		}
+		credentials[accessKey] = secretKey
+	}
+
+	return credentials, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"listenAddr": "10.0.0.1:3000",
+		"dataDir": "/var/lib/dfsgo",
+		"replicationFactor": 2,
+		"redis": {"masterName": "mymaster", "sentinelAddrs": ["10.0.0.9:26379"]},
+		"s3": {"listenAddr": ":9000", "region": "eu-west-1", "credentials": {"AKIDFILE": "file-secret"}}
+	}`), 0o644))
+
+	env := map[string]string{
+		"DFSGO_LISTEN_ADDR":     "10.0.0.2:3000",
+		"DFSGO_DATA_DIR":        "/data",
+		"DFSGO_HTTP_ADDR":       ":8080",
+		"DFSGO_REDIS_SENTINELS": "10.0.0.7:26379, 10.0.0.8:26379",
+		"DFSGO_S3_CREDENTIALS":  "AKID1:secret1, AKID2:sec:ret2",
+		"DFSGO_SCRUB_INTERVAL":  "6h",
+		"DFSGO_CHUNK_SIZE":      "1048576",
+		"DFSGO_ERASURE":         "4+2",
+		"DFSGO_UPLOAD_TTL":      "2h",
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	flagValues := registerFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-listen", "10.0.0.3:3000", "-write-consistency", "quorum"}))
+
+	config, err := loadConfig(path, func(k string) string { return env[k] }, flagValues())
+	require.NoError(t, err)
+
+	// Flags win over the environment, which wins over the file.
+	assert.Equal(t, "10.0.0.3:3000", config.ListenAddr)
+	assert.Equal(t, "/data", config.DataDir)
+	assert.Equal(t, ":8080", config.HTTPAddr)
+	assert.Equal(t, 2, config.ReplicationFactor)
+	assert.Equal(t, "quorum", config.WriteConsistency)
+	assert.Equal(t, "ONE", config.ReadConsistency)
+	interval, err := config.scrubInterval()
+	require.NoError(t, err)
+	assert.Equal(t, 6*time.Hour, interval)
+	assert.Equal(t, int64(1<<20), config.ChunkSize)
+	assert.Equal(t, "4+2", config.Erasure)
+	delay, err := config.rebuildDelay()
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, delay)
+	ttl, err := config.uploadTTL()
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, ttl)
+	assert.Equal(t, "mymaster", config.Redis.MasterName)
+	assert.Equal(t, []string{"10.0.0.7:26379", "10.0.0.8:26379"}, config.Redis.SentinelAddrs)
+	assert.Equal(t, discoveryRedis, config.Discovery)
+	assert.Equal(t, S3Config{
+		ListenAddr:  ":9000",
+		Region:      "eu-west-1",
+		Credentials: map[string]string{"AKID1": "secret1", "AKID2": "sec:ret2"},
+	}, config.S3)
+	assert.Equal(t, filepath.Join("/data", "keyring.json"), config.keyringPath())
+}
+
+func TestLoadConfig_Discovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "standalone node", want: discoveryStatic},
+		{name: "redis url", env: map[string]string{"DFSGO_REDIS_URL": "redis://localhost:6379"}, want: discoveryRedis},
+		{name: "nodes file", env: map[string]string{"DFSGO_NODES_FILE": "nodes.yaml"}, want: discoveryFile},
+		{name: "gossip", env: map[string]string{"DFSGO_GOSSIP_LISTEN_ADDR": ":7946"}, want: discoveryGossip},
+		{name: "redis without settings", env: map[string]string{"DFSGO_DISCOVERY": "redis"}, wantErr: true},
+		{name: "unknown", env: map[string]string{"DFSGO_DISCOVERY": "consul"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadConfig("", func(k string) string { return tt.env[k] }, nil)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, config.Discovery)
+		})
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{name: "replication factor", env: map[string]string{"DFSGO_REPLICATION_FACTOR": "0"}},
+		{name: "replication factor not a number", env: map[string]string{"DFSGO_REPLICATION_FACTOR": "three"}},
+		{name: "consistency", env: map[string]string{"DFSGO_READ_CONSISTENCY": "most"}},
+		{name: "scrub interval", env: map[string]string{"DFSGO_SCRUB_INTERVAL": "daily"}},
+		{name: "negative scrub interval", env: map[string]string{"DFSGO_SCRUB_INTERVAL": "-1h"}},
+		{name: "chunk size", env: map[string]string{"DFSGO_CHUNK_SIZE": "0"}},
+		{name: "chunk size not a number", env: map[string]string{"DFSGO_CHUNK_SIZE": "4MB"}},
+		{name: "erasure code", env: map[string]string{"DFSGO_ERASURE": "4"}},
+		{name: "erasure code without data", env: map[string]string{"DFSGO_ERASURE": "0+2"}},
+		{name: "rebuild delay", env: map[string]string{"DFSGO_REBUILD_DELAY": "soon"}},
+		{name: "upload TTL", env: map[string]string{"DFSGO_UPLOAD_TTL": "0s"}},
+		{name: "partial TLS", env: map[string]string{"DFSGO_TLS_CERT": "node.crt"}},
+		{name: "S3 without credentials", env: map[string]string{"DFSGO_S3_LISTEN_ADDR": ":9000"}},
+		{name: "S3 credentials without secret", env: map[string]string{"DFSGO_S3_CREDENTIALS": "AKID"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig("", func(k string) string { return tt.env[k] }, nil)
+			assert.Error(t, err)
+		})
+	}
+}
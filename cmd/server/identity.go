@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+)
+
+const serverIDFile = "server_id"
+
+// loadServerID returns the server ID kept in dir, generating and keeping a
+// new one the first time. Files are stored and placed under the server ID,
+// so a node must keep it across restarts.
+func loadServerID(dir string) (string, error) {
+	path := filepath.Join(dir, serverIDFile)
+
+	b, err := os.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(b))
+		if id == "" {
+			return "", fmt.Errorf("%s is empty", path)
+		}
+		return id, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	id := fscrypto.GenerateServerID()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o600); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadServerID(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+
+	id, err := loadServerID(dir)
+	require.NoError(t, err)
+	assert.Len(t, id, 64)
+
+	// The ID survives restarts.
+	again, err := loadServerID(dir)
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, serverIDFile), []byte("\n"), 0o600))
+	_, err = loadServerID(dir)
+	assert.Error(t, err)
+}
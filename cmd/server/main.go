@@ -0,0 +1,301 @@
+// Command server runs a file storage node.
+//
+//	server -config config.json -listen :3000 -data-dir data
+//
+// Settings are read from the JSON config file, then from the DFSGO_*
+// environment variables and last from the flags, see server -h. The server
+// ID and the keyring are generated on the first run and kept in the data
+// directory. With -s3-listen the node also serves the S3 API, storing its
+// objects in the network like any other file.
+//
+// The server stops on SIGINT or SIGTERM. On SIGHUP it reloads the keyring
+// and rewraps with its active key the data keys of the files held by the
+// peers, see the keyring command.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/gusga/dfsgo/fileserver"
+	"github.com/gusga/dfsgo/s3"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+func main() {
+	configPath := flag.String("config", os.Getenv("DFSGO_CONFIG"), "path of the JSON config file (env DFSGO_CONFIG)")
+	flagValues := registerFlags(flag.CommandLine)
+	flag.Parse()
+
+	config, err := loadConfig(*configPath, os.Getenv, flagValues())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "server:", err)
+		os.Exit(2)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "server:", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	if err := run(config, logger); err != nil {
+		logger.Error("server failed", zap.Error(err))
+		logger.Sync()
+		os.Exit(1)
+	}
+}
+
+func run(config Config, logger *zap.Logger) error {
+	if err := os.MkdirAll(config.DataDir, 0o700); err != nil {
+		return err
+	}
+
+	id := config.ServerID
+	if id == "" {
+		var err error
+		if id, err = loadServerID(config.DataDir); err != nil {
+			return fmt.Errorf("loading server ID: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(config.keyringPath()), 0o700); err != nil {
+		return err
+	}
+	keyring, err := fscrypto.LoadKeyring(config.keyringPath())
+	if err != nil {
+		return fmt.Errorf("loading keyring: %w", err)
+	}
+
+	srv, err := newServer(config, id, keyring, logger)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(stop)
+	defer signal.Stop(reload)
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Start() }()
+
+	logger.Info("server started", zap.String("server_id", id), zap.String("listen_addr", config.ListenAddr))
+
+	if config.S3.ListenAddr != "" {
+		s3Server, err := startS3(config, srv, logger)
+		if err != nil {
+			srv.Close()
+			<-errc
+			return fmt.Errorf("starting S3 API: %w", err)
+		}
+		defer s3Server.Close()
+	}
+
+	for {
+		select {
+		case err := <-errc:
+			srv.DiscoverySrv.Close()
+			if err == nil {
+				err = errors.New("server stopped unexpectedly")
+			}
+			return err
+		case <-reload:
+			go rewrapKeys(srv, logger)
+		case sig := <-stop:
+			logger.Info("shutting down", zap.Stringer("signal", sig))
+			srv.Close()
+			return <-errc
+		}
+	}
+}
+
+func rewrapKeys(srv *fileserver.FileServer, logger *zap.Logger) {
+	n, err := srv.RewrapKeys(context.Background())
+	if err != nil {
+		logger.Error("could not rewrap every data key", zap.Error(err), zap.Int("rewrapped", n))
+		return
+	}
+
+	logger.Info("rewrapped data keys", zap.Int("rewrapped", n), zap.String("active_key", srv.Keyring.ActiveID()))
+}
+
+func newServer(config Config, id string, keyring *fscrypto.Keyring, logger *zap.Logger) (*fileserver.FileServer, error) {
+	writeConsistency, err := fileserver.ParseConsistencyLevel(config.WriteConsistency)
+	if err != nil {
+		return nil, err
+	}
+	readConsistency, err := fileserver.ParseConsistencyLevel(config.ReadConsistency)
+	if err != nil {
+		return nil, err
+	}
+	scrubInterval, err := config.scrubInterval()
+	if err != nil {
+		return nil, err
+	}
+	erasureCode, err := fileserver.ParseErasureCode(config.Erasure)
+	if err != nil {
+		return nil, err
+	}
+	rebuildDelay, err := config.rebuildDelay()
+	if err != nil {
+		return nil, err
+	}
+	uploadTTL, err := config.uploadTTL()
+	if err != nil {
+		return nil, err
+	}
+	store, err := openStorage(filepath.Join(config.DataDir, "storage"), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	transportOpts := transport.TCPTransportOpts{
+		ListenAddr:    config.ListenAddr,
+		HandshakeFunc: transport.NewTCPHandshakeFunc(id),
+		Logger:        logger,
+	}
+	if config.TLS.Cert != "" {
+		transportOpts.TLSConfig, err = transport.LoadMutualTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.CA)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS config: %w", err)
+		}
+		// Peers reject a server ID the certificate was not issued to.
+		names, err := transport.CertificateNames(transportOpts.TLSConfig.Certificates[0])
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS config: %w", err)
+		}
+		if !slices.Contains(names, id) {
+			return nil, fmt.Errorf("server ID %q is not one of the names of the TLS certificate %q", id, names)
+		}
+	}
+	tr := transport.NewTCPTransport(transportOpts)
+
+	disc, err := newDiscovery(config, transportOpts, logger)
+	if err != nil {
+		return nil, fmt.Errorf("starting %s discovery: %w", config.Discovery, err)
+	}
+
+	srv := fileserver.NewServer(fileserver.FileServerOpts{
+		ID:                id,
+		Keyring:           keyring,
+		Transport:         tr,
+		Logger:            logger,
+		DiscoverySrv:      disc,
+		ReplicationFactor: config.ReplicationFactor,
+		WriteConsistency:  writeConsistency,
+		ReadConsistency:   readConsistency,
+		HTTPAddr:          config.HTTPAddr,
+		ScrubInterval:     scrubInterval,
+		ChunkSize:         config.ChunkSize,
+		Erasure:           erasureCode,
+		RebuildDelay:      rebuildDelay,
+		UploadTTL:         uploadTTL,
+		Storage:           store,
+	})
+	tr.OnPeer = srv.OnPeer
+
+	return srv, nil
+}
+
+// startS3 serves the S3 API, storing the objects through srv.
+func startS3(config Config, srv *fileserver.FileServer, logger *zap.Logger) (*http.Server, error) {
+	gateway, err := s3.NewGateway(s3.GatewayOpts{
+		Backend:     srv,
+		Credentials: config.S3.Credentials,
+		Region:      config.S3.Region,
+		Logger:      logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", config.S3.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           gateway,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("S3 API stopped", zap.Error(err))
+		}
+	}()
+
+	logger.Info("serving S3 API", zap.String("s3_addr", ln.Addr().String()))
+
+	return server, nil
+}
+
+// openStorage opens the storage rooted at root, removing the files the
+// writes interrupted by the last shutdown left behind.
+func openStorage(root string, logger *zap.Logger) (*storage.Storage, error) {
+	store := storage.NewStorage(storage.StorageOpts{
+		Root:              root,
+		PathTransformFunc: storage.CASPathTransformFunc,
+		Logger:            logger,
+	})
+
+	removed, err := store.RemoveTempFiles()
+	if err != nil {
+		return nil, fmt.Errorf("cleaning up storage %s: %w", root, err)
+	}
+	if removed > 0 {
+		logger.Warn("removed files of interrupted writes", zap.String("root", root), zap.Int("removed", removed))
+	}
+
+	return store, nil
+}
+
+func newDiscovery(config Config, transportOpts transport.TCPTransportOpts, logger *zap.Logger) (discovery.DiscoveryService, error) {
+	switch config.Discovery {
+	case discoveryRedis:
+		// The context outlives the shutdown signal, the node deregisters
+		// itself on close.
+		ctx := context.Background()
+		if config.Redis.MasterName != "" {
+			return discovery.NewRedisSentinelDiscoverySrv(ctx, discovery.RedisSentinelOpts{
+				MasterName:       config.Redis.MasterName,
+				SentinelAddrs:    config.Redis.SentinelAddrs,
+				Password:         config.Redis.Password,
+				SentinelPassword: config.Redis.SentinelPassword,
+				DB:               config.Redis.DB,
+			}, logger)
+		}
+		return discovery.NewRedisDiscoverySrv(ctx, config.Redis.URL, logger)
+	case discoveryStatic:
+		return discovery.NewStaticDiscoverySrv(config.Nodes, logger)
+	case discoveryFile:
+		return discovery.NewFileDiscoverySrv(config.NodesFile, logger)
+	case discoveryGossip:
+		return discovery.NewGossipDiscoverySrv(discovery.GossipOpts{
+			ListenAddr:    config.Gossip.ListenAddr,
+			AdvertiseAddr: config.Gossip.AdvertiseAddr,
+			Seeds:         config.Gossip.Seeds,
+			TLSConfig:     transportOpts.TLSConfig,
+			Logger:        logger,
+		})
+	}
+
+	return nil, fmt.Errorf("unknown discovery %q", config.Discovery)
+}
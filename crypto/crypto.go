@@ -5,7 +5,10 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -26,64 +29,213 @@ func NewEncryptionKey() []byte {
 	return keyBuffer
 }
 
+const (
+	// SegmentSize is the size of the plain content sealed in every segment.
+	SegmentSize = 64 * 1024
+
+	maxSegmentSize = 16 << 20
+	formatVersion  = 1
+	noncePrefixLen = 7
+	tagSize        = 16
+
+	// headerSize is the size of the header preceding the segments: format
+	// version (1), segment size (4) and nonce prefix (7).
+	headerSize = 5 + noncePrefixLen
+)
+
+var (
+	ErrAuthentication    = errors.New("encrypted content failed authentication")
+	ErrTruncated         = errors.New("encrypted content is truncated")
+	ErrUnsupportedFormat = errors.New("unsupported encrypted content format")
+	ErrTooManySegments   = errors.New("encrypted content has too many segments")
+)
+
+// EncryptedSize returns the size of the output EncryptContent produces for
+// n bytes of plain content.
+func EncryptedSize(n int64) int64 {
+	segments := n/SegmentSize + 1
+	return headerSize + n + segments*tagSize
+}
+
+// EncryptContent encrypts src into dst with AES-GCM. The content is split
+// in segments of SegmentSize bytes sealed one after the other, so it can be
+// streamed, see DecryptContent. It returns the number of bytes written to
+// dst.
 func EncryptContent(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+	aead, err := newAEAD(key)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
-	iv := make([]byte, block.BlockSize()) // 16 bytes size
 
-	_, err = io.ReadFull(rand.Reader, iv)
-	if err != nil {
-		return 0, nil
+	header := make([]byte, headerSize)
+	header[0] = formatVersion
+	binary.BigEndian.PutUint32(header[1:5], SegmentSize)
+	if _, err := io.ReadFull(rand.Reader, header[5:]); err != nil {
+		return 0, err
 	}
 
-	// prepend the iv to the file
-	_, err = dst.Write(iv)
+	nw, err := dst.Write(header)
 	if err != nil {
-		return 0, nil
+		return nw, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
+	s := newSegmenter(aead, header)
+	buf := make([]byte, SegmentSize, SegmentSize+tagSize)
 
-	return copyStream(stream, block.BlockSize(), src, dst)
+	for {
+		// Every segment but the last one is full, so the last one can be
+		// told apart even when it is empty.
+		n, err := io.ReadFull(src, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nw, err
+		}
+
+		sealed, err := s.seal(buf[:n], last)
+		if err != nil {
+			return nw, err
+		}
+
+		nn, err := dst.Write(sealed)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if last {
+			return nw, nil
+		}
+	}
 }
 
+// DecryptContent decrypts into dst the content EncryptContent wrote to src,
+// checking every segment before writing it. Tampered, reordered or missing
+// segments are reported with ErrAuthentication or ErrTruncated, in which
+// case the content already written to dst must be discarded. It returns the
+// number of bytes written to dst.
 func DecryptContent(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+	aead, err := newAEAD(key)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
-	iv := make([]byte, block.BlockSize())
-	_, err = src.Read(iv)
-	if err != nil {
-		return 0, nil
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrTruncated
+		}
+		return 0, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
-}
+	if header[0] != formatVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedFormat, header[0])
+	}
 
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
-	buff := make([]byte, 1024*32)
-	nw := blockSize
+	segmentSize := binary.BigEndian.Uint32(header[1:5])
+	if segmentSize == 0 || segmentSize > maxSegmentSize {
+		return 0, fmt.Errorf("%w: segment size %d", ErrUnsupportedFormat, segmentSize)
+	}
+
+	s := newSegmenter(aead, header)
+	buf := make([]byte, int(segmentSize)+tagSize)
+	nw := 0
 
 	for {
-		n, err := src.Read(buff)
-		if n > 0 {
-			stream.XORKeyStream(buff, buff[:n])
-			nn, err := dst.Write(buff[:n])
-			if err != nil {
-				return 0, nil
-			}
-			nw += nn
-		}
+		n, err := io.ReadFull(src, buf)
 		if err == io.EOF {
-			break
+			return nw, ErrTruncated
+		}
+
+		last := err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nw, err
 		}
+
+		plain, err := s.open(buf[:n], last)
 		if err != nil {
-			return 0, nil
+			return nw, err
 		}
+
+		nn, err := dst.Write(plain)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if last {
+			return nw, nil
+		}
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// segmenter seals and opens the segments of a content in order. The nonce of
+// every segment is made of the random prefix from the header, the index of
+// the segment and a flag marking the last one, so segments can not be
+// reordered, dropped or appended. The header is authenticated with every
+// segment.
+type segmenter struct {
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	index  uint32
+	done   bool
+}
+
+func newSegmenter(aead cipher.AEAD, header []byte) *segmenter {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[headerSize-noncePrefixLen:])
+
+	return &segmenter{aead: aead, header: header, nonce: nonce}
+}
+
+func (s *segmenter) next(last bool) ([]byte, error) {
+	if s.done {
+		return nil, ErrTooManySegments
 	}
-	return nw, nil
+
+	binary.BigEndian.PutUint32(s.nonce[noncePrefixLen:], s.index)
+	s.nonce[len(s.nonce)-1] = 0
+	if last {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+
+	s.index++
+	// The index must never wrap around and reuse a nonce.
+	s.done = last || s.index == 0
+
+	return s.nonce, nil
+}
+
+// seal encrypts plain in place.
+func (s *segmenter) seal(plain []byte, last bool) ([]byte, error) {
+	nonce, err := s.next(last)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.aead.Seal(plain[:0], nonce, plain, s.header), nil
+}
+
+// open decrypts sealed in place.
+func (s *segmenter) open(sealed []byte, last bool) ([]byte, error) {
+	nonce, err := s.next(last)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := s.aead.Open(sealed[:0], nonce, sealed, s.header)
+	if err != nil {
+		return nil, fmt.Errorf("segment %d: %w", s.index-1, ErrAuthentication)
+	}
+
+	return plain, nil
 }
@@ -2,6 +2,8 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/rand"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -47,7 +49,7 @@ func TestEncryptionDecryption(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, n)
 
-	assert.Equal(t, 16+len(content), n)
+	assert.Equal(t, int(EncryptedSize(int64(len(content)))), n)
 
 	newDest := new(bytes.Buffer)
 	n, err = DecryptContent(encryptionKey, encryptedDst, newDest)
@@ -57,3 +59,115 @@ func TestEncryptionDecryption(t *testing.T) {
 	assert.Equal(t, newDest.String(), content)
 
 }
+
+func TestEncryptionDecryption_Sizes(t *testing.T) {
+	key := NewEncryptionKey()
+
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 100} {
+		content := make([]byte, size)
+		_, err := io.ReadFull(rand.Reader, content)
+		require.NoError(t, err)
+
+		encrypted := new(bytes.Buffer)
+		n, err := EncryptContent(key, bytes.NewReader(content), encrypted)
+		require.NoError(t, err)
+		assert.Equal(t, EncryptedSize(int64(size)), int64(n))
+		assert.Equal(t, n, encrypted.Len())
+
+		decrypted := new(bytes.Buffer)
+		n, err = DecryptContent(key, encrypted, decrypted)
+		require.NoError(t, err)
+		assert.Equal(t, size, n)
+		assert.True(t, bytes.Equal(content, decrypted.Bytes()))
+	}
+}
+
+func TestDecryptContent_Errors(t *testing.T) {
+	key := NewEncryptionKey()
+	content := bytes.Repeat([]byte("0123456789abcdef"), SegmentSize/8)
+
+	encrypted := new(bytes.Buffer)
+	_, err := EncryptContent(key, bytes.NewReader(content), encrypted)
+	require.NoError(t, err)
+	valid := encrypted.Bytes()
+
+	segment := SegmentSize + tagSize
+
+	tests := []struct {
+		name   string
+		key    []byte
+		modify func([]byte) []byte
+		err    error
+	}{
+		{
+			name: "wrong key",
+			key:  NewEncryptionKey(),
+			err:  ErrAuthentication,
+		},
+		{
+			name:   "tampered content",
+			modify: func(b []byte) []byte { b[headerSize+10] ^= 0xff; return b },
+			err:    ErrAuthentication,
+		},
+		{
+			name:   "tampered header",
+			modify: func(b []byte) []byte { b[headerSize-1] ^= 0xff; return b },
+			err:    ErrAuthentication,
+		},
+		{
+			name:   "unknown format",
+			modify: func(b []byte) []byte { b[0] = 9; return b },
+			err:    ErrUnsupportedFormat,
+		},
+		{
+			name:   "truncated header",
+			modify: func(b []byte) []byte { return b[:headerSize-2] },
+			err:    ErrTruncated,
+		},
+		{
+			name:   "truncated at segment boundary",
+			modify: func(b []byte) []byte { return b[:headerSize+segment] },
+			err:    ErrTruncated,
+		},
+		{
+			name:   "truncated inside segment",
+			modify: func(b []byte) []byte { return b[:headerSize+segment+100] },
+			err:    ErrAuthentication,
+		},
+		{
+			name: "reordered segments",
+			modify: func(b []byte) []byte {
+				first := append([]byte{}, b[headerSize:headerSize+segment]...)
+				copy(b[headerSize:], b[headerSize+segment:headerSize+2*segment])
+				copy(b[headerSize+segment:], first)
+				return b
+			},
+			err: ErrAuthentication,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := key
+			if tt.key != nil {
+				key = tt.key
+			}
+
+			src := append([]byte{}, valid...)
+			if tt.modify != nil {
+				src = tt.modify(src)
+			}
+
+			_, err := DecryptContent(key, bytes.NewReader(src), io.Discard)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestEncryptContent_InvalidKey(t *testing.T) {
+	_, err := EncryptContent([]byte("short"), bytes.NewReader([]byte("content")), io.Discard)
+	assert.Error(t, err)
+
+	_, err = DecryptContent([]byte("short"), bytes.NewReader([]byte("content")), io.Discard)
+	assert.Error(t, err)
+}
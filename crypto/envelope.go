@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	envelopeVersion = 1
+	dataKeySize     = 32
+	wrappedKeySize  = 12 + dataKeySize + tagSize
+
+	// EnvelopeHeaderSize is the size of the header preceding the content
+	// encrypted by EncryptEnvelope: version (1), ID of the key encryption
+	// key (KeyIDSize) and the wrapped data key. It has a fixed size so it
+	// can be rewritten in place when the data key is rewrapped.
+	EnvelopeHeaderSize = 1 + KeyIDSize + wrappedKeySize
+)
+
+var ErrInvalidEnvelope = errors.New("invalid envelope header")
+
+// EnvelopeSize returns the size of the output EncryptEnvelope produces for
+// n bytes of plain content.
+func EnvelopeSize(n int64) int64 {
+	return EnvelopeHeaderSize + EncryptedSize(n)
+}
+
+// EnvelopeContentSize returns the size of the plain content held by an
+// envelope of the given size, the inverse of EnvelopeSize.
+func EnvelopeContentSize(size int64) (int64, error) {
+	// Every segment but the last is full and carries a tag, the last one
+	// always has room left.
+	sealed := size - EnvelopeHeaderSize - headerSize
+	full := sealed / (SegmentSize + tagSize)
+	if sealed-full*(SegmentSize+tagSize) < tagSize {
+		return 0, ErrTruncated
+	}
+
+	return sealed - (full+1)*tagSize, nil
+}
+
+// EncryptEnvelope encrypts src into dst with a new random data key, which is
+// stored in the header wrapped by the active key of the keyring.
+func EncryptEnvelope(kr *Keyring, src io.Reader, dst io.Writer) (int, error) {
+	dataKey := NewEncryptionKey()
+
+	header, err := wrapDataKey(kr, kr.ActiveID(), dataKey)
+	if err != nil {
+		return 0, err
+	}
+
+	nw, err := dst.Write(header)
+	if err != nil {
+		return nw, err
+	}
+
+	n, err := EncryptContent(dataKey, src, dst)
+	return nw + n, err
+}
+
+// DecryptEnvelope decrypts into dst the content EncryptEnvelope wrote to src,
+// unwrapping its data key with the key of the keyring named in the header.
+func DecryptEnvelope(kr *Keyring, src io.Reader, dst io.Writer) (int, error) {
+	header := make([]byte, EnvelopeHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrTruncated
+		}
+		return 0, err
+	}
+
+	dataKey, err := unwrapDataKey(kr, header)
+	if err != nil {
+		return 0, err
+	}
+
+	return DecryptContent(dataKey, src, dst)
+}
+
+// EnvelopeKeyID returns the ID of the key wrapping the data key in header.
+func EnvelopeKeyID(header []byte) (string, error) {
+	if len(header) < EnvelopeHeaderSize || header[0] != envelopeVersion {
+		return "", ErrInvalidEnvelope
+	}
+
+	return string(header[1 : 1+KeyIDSize]), nil
+}
+
+// RewrapEnvelope returns header with its data key wrapped by the active key
+// of the keyring instead. The content following the header is left as is.
+func RewrapEnvelope(kr *Keyring, header []byte) ([]byte, error) {
+	dataKey, err := unwrapDataKey(kr, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapDataKey(kr, kr.ActiveID(), dataKey)
+}
+
+func wrapDataKey(kr *Keyring, keyID string, dataKey []byte) ([]byte, error) {
+	kek, err := kr.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 1+KeyIDSize, EnvelopeHeaderSize)
+	header[0] = envelopeVersion
+	copy(header[1:], keyID)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header = append(header, nonce...)
+
+	// The version and key ID are authenticated with the data key.
+	return aead.Seal(header, nonce, dataKey, header[:1+KeyIDSize]), nil
+}
+
+func unwrapDataKey(kr *Keyring, header []byte) ([]byte, error) {
+	keyID, err := EnvelopeKeyID(header)
+	if err != nil {
+		return nil, err
+	}
+
+	kek, err := kr.Key(keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := header[1+KeyIDSize : EnvelopeHeaderSize]
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+
+	dataKey, err := aead.Open(nil, nonce, sealed, header[:1+KeyIDSize])
+	if err != nil {
+		return nil, fmt.Errorf("data key: %w", ErrAuthentication)
+	}
+
+	return dataKey, nil
+}
@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope(t *testing.T) {
+	kr := NewKeyring(NewEncryptionKey())
+	content := bytes.Repeat([]byte("envelope content "), 10000)
+
+	encrypted := new(bytes.Buffer)
+	n, err := EncryptEnvelope(kr, bytes.NewReader(content), encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, EnvelopeSize(int64(len(content))), int64(n))
+
+	keyID, err := EnvelopeKeyID(encrypted.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, kr.ActiveID(), keyID)
+
+	decrypted := new(bytes.Buffer)
+	_, err = DecryptEnvelope(kr, bytes.NewReader(encrypted.Bytes()), decrypted)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, decrypted.Bytes()))
+
+	// A keyring missing the key can not open the file.
+	_, err = DecryptEnvelope(NewKeyring(NewEncryptionKey()), bytes.NewReader(encrypted.Bytes()), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestRewrapEnvelope(t *testing.T) {
+	kr := NewKeyring(NewEncryptionKey())
+	oldID := kr.ActiveID()
+	content := []byte("content that is not re-encrypted")
+
+	encrypted := new(bytes.Buffer)
+	_, err := EncryptEnvelope(kr, bytes.NewReader(content), encrypted)
+	require.NoError(t, err)
+	file := encrypted.Bytes()
+
+	newID, err := kr.Rotate()
+	require.NoError(t, err)
+
+	header, err := RewrapEnvelope(kr, file[:EnvelopeHeaderSize])
+	require.NoError(t, err)
+	require.Len(t, header, EnvelopeHeaderSize)
+
+	keyID, err := EnvelopeKeyID(header)
+	require.NoError(t, err)
+	assert.Equal(t, newID, keyID)
+	assert.NotEqual(t, oldID, keyID)
+
+	rewrapped := append(header, file[EnvelopeHeaderSize:]...)
+
+	decrypted := new(bytes.Buffer)
+	_, err = DecryptEnvelope(kr, bytes.NewReader(rewrapped), decrypted)
+	require.NoError(t, err)
+	assert.Equal(t, content, decrypted.Bytes())
+
+	// The key ID is authenticated with the data key.
+	tampered := append([]byte{}, rewrapped...)
+	copy(tampered[1:], oldID)
+	_, err = DecryptEnvelope(kr, bytes.NewReader(tampered), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrAuthentication)
+
+	_, err = RewrapEnvelope(kr, []byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+}
+
+func TestEnvelopeContentSize(t *testing.T) {
+	for _, n := range []int64{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 17} {
+		got, err := EnvelopeContentSize(EnvelopeSize(n))
+		require.NoError(t, err)
+		assert.Equal(t, n, got)
+	}
+
+	for _, size := range []int64{0, EnvelopeHeaderSize, EnvelopeSize(SegmentSize-1) + 1} {
+		_, err := EnvelopeContentSize(size)
+		assert.ErrorIs(t, err, ErrTruncated, size)
+	}
+}
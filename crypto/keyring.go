@@ -0,0 +1,185 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// KeyIDSize is the size of the IDs of the keys in a Keyring.
+const KeyIDSize = 16
+
+var ErrUnknownKey = errors.New("unknown key ID")
+
+// Keyring holds the key encryption keys wrapping the data key of every
+// encrypted file. New files are wrapped with the active key, older keys are
+// kept so files wrapped with them can still be opened.
+type Keyring struct {
+	mu     sync.RWMutex
+	path   string
+	active string
+	keys   map[string][]byte
+}
+
+type keyringFile struct {
+	Active string            `json:"active"`
+	Keys   map[string][]byte `json:"keys"`
+}
+
+// NewKeyring returns an in-memory keyring holding only key. Its ID is
+// derived from the key so it stays the same across restarts.
+func NewKeyring(key []byte) *Keyring {
+	sum := sha256.Sum256(key)
+	id := hex.EncodeToString(sum[:KeyIDSize/2])
+
+	return &Keyring{
+		active: id,
+		keys:   map[string][]byte{id: key},
+	}
+}
+
+// LoadKeyring reads the keyring stored at path, creating it with a new
+// active key when the file does not exist. Rotations are written back to
+// the same file.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+
+	err := k.Reload()
+	if errors.Is(err, fs.ErrNotExist) {
+		k.keys = make(map[string][]byte)
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Reload reads the keyring file again, picking up rotations made by
+// another process. It does nothing for in-memory keyrings.
+func (k *Keyring) Reload() error {
+	if k.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("keyring %s: %w", k.path, err)
+	}
+
+	for id, key := range file.Keys {
+		if len(id) != KeyIDSize || len(key) != 32 {
+			return fmt.Errorf("keyring %s: invalid key %q", k.path, id)
+		}
+	}
+	if _, ok := file.Keys[file.Active]; !ok {
+		return fmt.Errorf("keyring %s: active key %q: %w", k.path, file.Active, ErrUnknownKey)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.active = file.Active
+	k.keys = file.Keys
+
+	return nil
+}
+
+func (k *Keyring) ActiveID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.active
+}
+
+// IDs returns the IDs of every key in the keyring, sorted.
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (k *Keyring) Key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+// Rotate adds a new key to the keyring and makes it the active one. The
+// keyring file, if any, is rewritten.
+func (k *Keyring) Rotate() (string, error) {
+	rawID := make([]byte, KeyIDSize/2)
+	if _, err := io.ReadFull(rand.Reader, rawID); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(rawID)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	keys := make(map[string][]byte, len(k.keys)+1)
+	for existing, key := range k.keys {
+		keys[existing] = key
+	}
+	keys[id] = NewEncryptionKey()
+
+	if k.path != "" {
+		if err := saveKeyring(k.path, keyringFile{Active: id, Keys: keys}); err != nil {
+			return "", err
+		}
+	}
+
+	k.active = id
+	k.keys = keys
+
+	return id, nil
+}
+
+func saveKeyring(path string, file keyringFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "keyring.json")
+
+	kr, err := LoadKeyring(path)
+	require.NoError(t, err)
+	first := kr.ActiveID()
+	assert.Len(t, first, KeyIDSize)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	second, err := kr.Rotate()
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, second, kr.ActiveID())
+
+	loaded, err := LoadKeyring(path)
+	require.NoError(t, err)
+	assert.Equal(t, second, loaded.ActiveID())
+	assert.ElementsMatch(t, []string{first, second}, loaded.IDs())
+
+	key, err := kr.Key(first)
+	require.NoError(t, err)
+	loadedKey, err := loaded.Key(first)
+	require.NoError(t, err)
+	assert.Equal(t, key, loadedKey)
+
+	_, err = loaded.Key("missing")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestLoadKeyring_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "not json", content: "keys"},
+		{name: "unknown active key", content: `{"active": "0123456789abcdef", "keys": {}}`},
+		{name: "short key", content: `{"active": "0123456789abcdef", "keys": {"0123456789abcdef": "AAEC"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keyring.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			_, err := LoadKeyring(path)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewKeyring(t *testing.T) {
+	key := NewEncryptionKey()
+
+	kr := NewKeyring(key)
+	assert.Equal(t, NewKeyring(key).ActiveID(), kr.ActiveID())
+
+	got, err := kr.Key(kr.ActiveID())
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+
+	// Rotating an in-memory keyring keeps the previous key.
+	_, err = kr.Rotate()
+	require.NoError(t, err)
+	assert.Len(t, kr.IDs(), 2)
+}
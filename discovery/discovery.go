@@ -12,9 +12,56 @@ type Node struct {
 	Address           string    `json:"address,omitempty" reder:"address"`
 }
 
+type EventType int
+
+const (
+	NodeJoined EventType = iota + 1
+	NodeLeft
+)
+
+func (t EventType) String() string {
+	switch t {
+	case NodeJoined:
+		return "joined"
+	case NodeLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports a node joining or leaving the network.
+type Event struct {
+	Type EventType
+	Node Node
+}
+
 type DiscoveryService interface {
 	GetNodes() ([]Node, error)
+	// AddNode registers the node, keeping it registered until the service
+	// is closed.
 	AddNode(Node) error
 	RemoveDeadNode(Node) error
+	// Watch returns a channel receiving an event every time a node joins or
+	// leaves the network after the call. It is closed by Close.
+	Watch() <-chan Event
 	Close() error
 }
+
+// diffNodes returns the events turning the nodes in prev into the nodes in
+// next, both keyed by address.
+func diffNodes(prev, next map[string]Node) []Event {
+	var events []Event
+	for addr, node := range next {
+		if _, ok := prev[addr]; !ok {
+			events = append(events, Event{Type: NodeJoined, Node: node})
+		}
+	}
+	for addr, node := range prev {
+		if _, ok := next[addr]; !ok {
+			events = append(events, Event{Type: NodeLeft, Node: node})
+		}
+	}
+
+	return events
+}
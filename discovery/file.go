@@ -0,0 +1,80 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// nodesFile is the content of the file read by NewFileDiscoverySrv. Nodes
+// use the JSON field names of Node in both formats, only the address is
+// required:
+//
+//	nodes:
+//	  - address: 10.0.0.1:3000
+//	    server_id: node-1
+type nodesFile struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// NewFileDiscoverySrv returns a discovery service serving the nodes listed
+// in the JSON or YAML file at path, by extension. The file is read again
+// every time the nodes are needed, so Watch reports the changes made to it.
+func NewFileDiscoverySrv(path string, logger *zap.Logger) (*StaticDiscoverySrv, error) {
+	load := func() ([]Node, error) {
+		return loadNodesFile(path)
+	}
+
+	if _, err := load(); err != nil {
+		return nil, err
+	}
+
+	return &StaticDiscoverySrv{
+		load:   load,
+		logger: logger,
+	}, nil
+}
+
+func loadNodesFile(path string) ([]Node, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// YAML is turned into JSON so both formats share the field names.
+		var v any
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if b, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+
+	var file nodesFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for i, node := range file.Nodes {
+		parsed, err := nodeFromAddr(node.Address)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if node.IP == "" {
+			file.Nodes[i].IP = parsed.IP
+		}
+		if node.Port == 0 {
+			file.Nodes[i].Port = parsed.Port
+		}
+	}
+
+	return file.Nodes, nil
+}
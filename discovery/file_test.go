@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeNodesFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	// Written aside and renamed, as editors do, so the file is never read
+	// half written.
+	tmp := path + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte(content), 0o644))
+	require.NoError(t, os.Rename(tmp, path))
+}
+
+func TestFileDiscoverySrv_Formats(t *testing.T) {
+	want := []Node{
+		{ServerID: "node-1", IP: "10.0.0.1", Port: 3000, Address: "10.0.0.1:3000"},
+		{IP: "10.0.0.2", Port: 3000, Address: "10.0.0.2:3000"},
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "json",
+			file: "nodes.json",
+			content: `{"nodes": [
+				{"address": "10.0.0.1:3000", "server_id": "node-1"},
+				{"address": "10.0.0.2:3000"}
+			]}`,
+		},
+		{
+			name: "yaml",
+			file: "nodes.yaml",
+			content: `
+nodes:
+  - address: 10.0.0.1:3000
+    server_id: node-1
+  - address: 10.0.0.2:3000
+`,
+		},
+		{
+			name:    "yml",
+			file:    "nodes.yml",
+			content: `nodes: [{address: "10.0.0.2:3000"}, {address: "10.0.0.1:3000", server_id: node-1}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			writeNodesFile(t, path, tt.content)
+
+			srv, err := NewFileDiscoverySrv(path, zap.NewNop())
+			require.NoError(t, err)
+
+			nodes, err := srv.GetNodes()
+			require.NoError(t, err)
+			assert.Equal(t, want, nodes)
+		})
+	}
+}
+
+func TestNewFileDiscoverySrv_Invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "missing file", file: "missing.json"},
+		{name: "invalid json", file: "nodes.json", content: `{"nodes": [`},
+		{name: "invalid yaml", file: "nodes.yaml", content: "nodes: [\n"},
+		{name: "missing address", file: "nodes.yaml", content: "nodes:\n  - server_id: node-1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if tt.content != "" {
+				writeNodesFile(t, path, tt.content)
+			}
+
+			_, err := NewFileDiscoverySrv(path, zap.NewNop())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFileDiscoverySrv_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	writeNodesFile(t, path, `{"nodes": [{"address": "10.0.0.1:3000"}, {"address": "10.0.0.2:3000"}]}`)
+
+	srv, err := NewFileDiscoverySrv(path, zap.NewNop())
+	require.NoError(t, err)
+	srv.WatchInterval = 5 * time.Millisecond
+	t.Cleanup(func() { srv.Close() })
+
+	events := srv.Watch()
+
+	// A broken edit is not taken as every node leaving.
+	writeNodesFile(t, path, `{"nodes": [`)
+	time.Sleep(20 * time.Millisecond)
+	writeNodesFile(t, path, `{"nodes": [{"address": "10.0.0.2:3000"}, {"address": "10.0.0.3:3000"}]}`)
+
+	received := map[EventType]string{}
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			received[event.Type] = event.Node.Address
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+
+	assert.Equal(t, map[EventType]string{
+		NodeJoined: "10.0.0.3:3000",
+		NodeLeft:   "10.0.0.1:3000",
+	}, received)
+}
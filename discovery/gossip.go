@@ -0,0 +1,878 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultProbeInterval    = time.Second
+	DefaultProbeTimeout     = 500 * time.Millisecond
+	DefaultIndirectChecks   = 3
+	DefaultSuspicionTimeout = 5 * time.Second
+
+	// An update is piggybacked retransmitMult times the logarithm of the
+	// network size, at most maxPiggyback of them per message.
+	retransmitMult = 3
+	maxPiggyback   = 16
+
+	// pushPullRounds is the number of probe rounds between full membership
+	// exchanges with a random member.
+	pushPullRounds = 30
+
+	// tombstoneTTL is how long dead members are remembered, so stale
+	// gossip does not bring them back.
+	tombstoneTTL = time.Minute
+)
+
+var ErrGossipClosed = errors.New("gossip discovery closed")
+
+type GossipOpts struct {
+	// ListenAddr is the address the gossip transport listens on.
+	// AdvertiseAddr is the one other members reach it at, it defaults to
+	// the listen address.
+	ListenAddr    string
+	AdvertiseAddr string
+	// Seeds are the gossip addresses of the members contacted to join the
+	// network.
+	Seeds     []string
+	TLSConfig *tls.Config
+	Logger    *zap.Logger
+
+	// Every ProbeInterval a member is pinged and has ProbeTimeout to
+	// answer. When it does not, IndirectChecks other members are asked to
+	// ping it. A member nobody reached is suspected, and declared dead
+	// unless it refutes the suspicion within SuspicionTimeout.
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	IndirectChecks   int
+	SuspicionTimeout time.Duration
+}
+
+// GossipDiscoverySrv finds the nodes of the network without any external
+// coordinator. Members probe each other following the SWIM protocol over
+// their own transport, and spread the membership changes piggybacked on the
+// probes.
+type GossipDiscoverySrv struct {
+	GossipOpts
+
+	transport *transport.TCPTransport
+
+	mu         sync.Mutex
+	self       *member
+	members    map[string]*member
+	broadcasts []*broadcast
+	probeOrder []string
+	probeIndex int
+	peers      map[string]transport.Peer
+	dials      map[string][]chan transport.Peer
+	watcher    *nodeWatcher
+	leaving    bool
+	closed     bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// broadcast is a membership update waiting to be piggybacked.
+type broadcast struct {
+	member    member
+	transmits int
+}
+
+// NewGossipDiscoverySrv starts listening for other members. The service
+// joins the network through the seeds once AddNode gives it the node to
+// announce.
+func NewGossipDiscoverySrv(opts GossipOpts) (*GossipDiscoverySrv, error) {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = DefaultProbeInterval
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = DefaultProbeTimeout
+	}
+	if opts.IndirectChecks <= 0 {
+		opts.IndirectChecks = DefaultIndirectChecks
+	}
+	if opts.SuspicionTimeout <= 0 {
+		opts.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+
+	srv := &GossipDiscoverySrv{
+		GossipOpts: opts,
+		members:    make(map[string]*member),
+		peers:      make(map[string]transport.Peer),
+		dials:      make(map[string][]chan transport.Peer),
+		done:       make(chan struct{}),
+	}
+
+	srv.transport = transport.NewTCPTransport(transport.TCPTransportOpts{
+		ListenAddr:     opts.ListenAddr,
+		Logger:         opts.Logger,
+		HandshakeFunc:  transport.TCPNoHandshakeFunc,
+		RequestTimeout: opts.ProbeTimeout,
+		TLSConfig:      opts.TLSConfig,
+	})
+	srv.transport.OnPeer = srv.onPeer
+
+	if err := srv.transport.ListenAndAccept(); err != nil {
+		return nil, err
+	}
+	if srv.AdvertiseAddr == "" {
+		srv.AdvertiseAddr = srv.transport.Addr()
+	}
+
+	srv.wg.Add(2)
+	go srv.consume()
+	go srv.probeLoop()
+
+	return srv, nil
+}
+
+// AddNode announces node as the local member of the network and joins it
+// through the seeds. The service announces a single node, adding another
+// one replaces it.
+func (srv *GossipDiscoverySrv) AddNode(node Node) error {
+	srv.mu.Lock()
+	if srv.leaving {
+		srv.mu.Unlock()
+		return ErrGossipClosed
+	}
+	if srv.self == nil {
+		srv.self = &member{Addr: srv.AdvertiseAddr, State: stateAlive}
+	} else {
+		srv.self.Incarnation++
+	}
+	srv.self.Node = node
+	srv.queue(*srv.self)
+	srv.mu.Unlock()
+
+	if len(srv.Seeds) == 0 {
+		return nil
+	}
+
+	// The seeds may not be up yet, the probe loop keeps trying.
+	if err := srv.join(); err != nil {
+		srv.Logger.Warn("could not join gossip network", zap.Error(err))
+	}
+
+	return nil
+}
+
+// GetNodes returns the nodes of the members believed to be alive, the
+// suspected ones included.
+func (srv *GossipDiscoverySrv) GetNodes() ([]Node, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	var nodes []Node
+	if srv.self != nil && srv.self.live() {
+		nodes = append(nodes, srv.self.Node)
+	}
+	for _, m := range srv.members {
+		if m.live() {
+			nodes = append(nodes, m.Node)
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Address < nodes[j].Address })
+
+	return nodes, nil
+}
+
+// RemoveDeadNode suspects the member announcing n. It is removed unless it
+// refutes the suspicion.
+func (srv *GossipDiscoverySrv) RemoveDeadNode(n Node) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, m := range srv.members {
+		if m.Node.Address == n.Address && m.State == stateAlive {
+			srv.apply(member{Addr: m.Addr, Node: m.Node, State: stateSuspect, Incarnation: m.Incarnation})
+		}
+	}
+
+	return nil
+}
+
+// Watch implements the DiscoveryService interface by polling the members
+// every ProbeInterval.
+func (srv *GossipDiscoverySrv) Watch() <-chan Event {
+	srv.mu.Lock()
+	if srv.watcher == nil {
+		srv.watcher = newNodeWatcher(srv.ProbeInterval, srv.GetNodes, srv.Logger)
+	}
+	watcher := srv.watcher
+	srv.mu.Unlock()
+
+	return watcher.watch()
+}
+
+// Close tells some members the local one is leaving, so the network does
+// not wait for the suspicion timeout to remove it, and stops the service.
+func (srv *GossipDiscoverySrv) Close() error {
+	srv.mu.Lock()
+	if srv.leaving {
+		srv.mu.Unlock()
+		return nil
+	}
+	srv.leaving = true
+
+	var targets []string
+	if srv.self != nil {
+		srv.self.State = stateLeft
+		srv.queue(*srv.self)
+		targets = srv.randomMembers(srv.IndirectChecks, "")
+	}
+	watcher := srv.watcher
+	srv.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range targets {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			srv.ping(addr)
+		}(addr)
+	}
+	wg.Wait()
+
+	srv.mu.Lock()
+	srv.closed = true
+	srv.mu.Unlock()
+
+	close(srv.done)
+	err := srv.transport.Close()
+	srv.wg.Wait()
+
+	if watcher != nil {
+		watcher.close()
+	}
+
+	return err
+}
+
+func (srv *GossipDiscoverySrv) consume() {
+	defer srv.wg.Done()
+
+	for {
+		select {
+		case rpc := <-srv.transport.Consume():
+			srv.wg.Add(1)
+			go srv.handleRPC(rpc)
+		case addr := <-srv.transport.ClosedPeer():
+			srv.mu.Lock()
+			delete(srv.peers, addr)
+			srv.mu.Unlock()
+		case <-srv.done:
+			srv.closePeers()
+			return
+		}
+	}
+}
+
+// closePeers closes every connection and waits for the transport to report
+// them closed, so none of its goroutines is left blocked.
+func (srv *GossipDiscoverySrv) closePeers() {
+	srv.mu.Lock()
+	peers := make([]transport.Peer, 0, len(srv.peers))
+	for _, p := range srv.peers {
+		peers = append(peers, p)
+	}
+	srv.mu.Unlock()
+
+	for _, p := range peers {
+		p.Close()
+	}
+
+	timeout := time.After(srv.ProbeTimeout)
+	for range peers {
+		select {
+		case <-srv.transport.ClosedPeer():
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func (srv *GossipDiscoverySrv) probeLoop() {
+	defer srv.wg.Done()
+
+	ticker := time.NewTicker(srv.ProbeInterval)
+	defer ticker.Stop()
+
+	for round := 1; ; round++ {
+		select {
+		case <-ticker.C:
+			if srv.isolated() {
+				if err := srv.join(); err != nil {
+					srv.Logger.Debug("could not join gossip network", zap.Error(err))
+				}
+			} else if round%pushPullRounds == 0 {
+				srv.pushPullRandom()
+			}
+			srv.probe()
+			srv.reap()
+		case <-srv.done:
+			return
+		}
+	}
+}
+
+func (srv *GossipDiscoverySrv) pushPullRandom() {
+	srv.mu.Lock()
+	if srv.self == nil || srv.leaving {
+		srv.mu.Unlock()
+		return
+	}
+	addrs := srv.randomMembers(1, "")
+	srv.mu.Unlock()
+
+	for _, addr := range addrs {
+		if err := srv.pushPull(addr); err != nil {
+			srv.Logger.Debug("could not exchange membership", zap.String("member", addr), zap.Error(err))
+		}
+	}
+}
+
+// isolated reports whether the local member is announced but knows no
+// other live member to gossip with.
+func (srv *GossipDiscoverySrv) isolated() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.self == nil || srv.leaving || len(srv.Seeds) == 0 {
+		return false
+	}
+	for _, m := range srv.members {
+		if m.live() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// join announces the local member to every seed and merges the members
+// they know. It fails when no seed answered.
+func (srv *GossipDiscoverySrv) join() error {
+	joined := false
+	var errs []error
+	for _, seed := range srv.Seeds {
+		if seed == srv.AdvertiseAddr {
+			continue
+		}
+
+		if err := srv.pushPull(seed); err != nil {
+			errs = append(errs, fmt.Errorf("seed %s: %w", seed, err))
+			continue
+		}
+		joined = true
+	}
+
+	if joined {
+		return nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// pushPull exchanges the full membership with the member at addr. Besides
+// joining, it repairs the views that gossip left apart, like a member
+// declared dead while it could still reach others.
+func (srv *GossipDiscoverySrv) pushPull(addr string) error {
+	srv.mu.Lock()
+	self := *srv.self
+	srv.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), srv.ProbeTimeout)
+	defer cancel()
+
+	reply, err := srv.request(ctx, addr, gossipJoin{Member: self})
+	if err != nil {
+		return err
+	}
+
+	state, ok := reply.(gossipSync)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T to join", reply)
+	}
+
+	srv.merge(state.Members)
+
+	return nil
+}
+
+// probe pings the next member, directly and then through other members,
+// and suspects it when nobody reached it.
+func (srv *GossipDiscoverySrv) probe() {
+	target, ok := srv.nextProbeTarget()
+	if !ok {
+		return
+	}
+
+	if srv.ping(target) || srv.indirectPing(target) {
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if m, ok := srv.members[target]; ok && m.State == stateAlive {
+		srv.apply(member{Addr: m.Addr, Node: m.Node, State: stateSuspect, Incarnation: m.Incarnation})
+	}
+}
+
+// nextProbeTarget returns the live members in turns, shuffled every round.
+func (srv *GossipDiscoverySrv) nextProbeTarget() (string, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for {
+		if srv.probeIndex >= len(srv.probeOrder) {
+			srv.probeOrder = srv.probeOrder[:0]
+			for addr, m := range srv.members {
+				if m.live() {
+					srv.probeOrder = append(srv.probeOrder, addr)
+				}
+			}
+			rand.Shuffle(len(srv.probeOrder), func(i, j int) {
+				srv.probeOrder[i], srv.probeOrder[j] = srv.probeOrder[j], srv.probeOrder[i]
+			})
+			srv.probeIndex = 0
+
+			if len(srv.probeOrder) == 0 {
+				return "", false
+			}
+		}
+
+		addr := srv.probeOrder[srv.probeIndex]
+		srv.probeIndex++
+
+		if m, ok := srv.members[addr]; ok && m.live() {
+			return addr, true
+		}
+	}
+}
+
+// ping reports whether the member at addr answered a ping in time.
+func (srv *GossipDiscoverySrv) ping(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), srv.ProbeTimeout)
+	defer cancel()
+
+	reply, err := srv.request(ctx, addr, gossipPing{Target: addr})
+	if err != nil {
+		srv.Logger.Debug("ping failed", zap.String("member", addr), zap.Error(err))
+		return false
+	}
+
+	_, ok := reply.(gossipAck)
+	return ok
+}
+
+// indirectPing reports whether any of IndirectChecks random members reached
+// target.
+func (srv *GossipDiscoverySrv) indirectPing(target string) bool {
+	srv.mu.Lock()
+	helpers := srv.randomMembers(srv.IndirectChecks, target)
+	srv.mu.Unlock()
+
+	if len(helpers) == 0 {
+		return false
+	}
+
+	// The helpers need a probe timeout of their own to ping target.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*srv.ProbeTimeout)
+	defer cancel()
+
+	acks := make(chan bool, len(helpers))
+	for _, addr := range helpers {
+		go func(addr string) {
+			reply, err := srv.request(ctx, addr, gossipPingReq{Target: target})
+			_, ok := reply.(gossipAck)
+			acks <- err == nil && ok
+		}(addr)
+	}
+
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+
+	return false
+}
+
+// randomMembers returns up to n random alive members other than exclude.
+// It must be called with the lock held.
+func (srv *GossipDiscoverySrv) randomMembers(n int, exclude string) []string {
+	var addrs []string
+	for addr, m := range srv.members {
+		if m.State == stateAlive && addr != exclude {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+
+	return addrs
+}
+
+// reap declares dead the members suspected for longer than the suspicion
+// timeout and forgets the members dead for longer than tombstoneTTL.
+func (srv *GossipDiscoverySrv) reap() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	now := time.Now()
+	for addr, m := range srv.members {
+		switch m.State {
+		case stateSuspect:
+			if now.Sub(m.since) >= srv.SuspicionTimeout {
+				srv.apply(member{Addr: m.Addr, Node: m.Node, State: stateDead, Incarnation: m.Incarnation})
+			}
+		case stateDead, stateLeft:
+			if now.Sub(m.since) >= tombstoneTTL {
+				delete(srv.members, addr)
+			}
+		}
+	}
+}
+
+func (srv *GossipDiscoverySrv) handleRPC(rpc transport.RPC) {
+	defer srv.wg.Done()
+
+	if rpc.Stream {
+		rpc.Reader.Close()
+		return
+	}
+
+	msg, err := decodeGossip(rpc.Payload)
+	if err != nil {
+		srv.Logger.Error("decoding gossip message", zap.Error(err), zap.String("peer", rpc.From))
+		return
+	}
+
+	srv.merge(msg.Updates)
+
+	var reply any
+	switch payload := msg.Payload.(type) {
+	case gossipPing:
+		if payload.Target == srv.AdvertiseAddr {
+			reply = gossipAck{Addr: srv.AdvertiseAddr}
+		} else {
+			reply = gossipNack{Target: payload.Target}
+		}
+	case gossipPingReq:
+		if srv.ping(payload.Target) {
+			reply = gossipAck{Addr: payload.Target}
+		} else {
+			reply = gossipNack{Target: payload.Target}
+		}
+	case gossipJoin:
+		srv.merge([]member{payload.Member})
+		reply = gossipSync{Members: srv.snapshot()}
+	default:
+		srv.Logger.Warn("unexpected gossip message", zap.String("type", fmt.Sprintf("%T", payload)), zap.String("peer", rpc.From))
+		return
+	}
+
+	srv.mu.Lock()
+	peer, ok := srv.peers[rpc.From]
+	srv.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	b, err := encodeGossip(&gossipMessage{Updates: srv.piggyback(), Payload: reply})
+	if err != nil {
+		srv.Logger.Error("encoding gossip message", zap.Error(err))
+		return
+	}
+
+	if err := transport.Reply(peer, rpc, b); err != nil {
+		srv.Logger.Debug("could not reply to gossip message", zap.Error(err), zap.String("peer", rpc.From))
+	}
+}
+
+// request sends payload to the member at addr, with the pending updates
+// piggybacked, and returns the payload of its reply.
+func (srv *GossipDiscoverySrv) request(ctx context.Context, addr string, payload any) (any, error) {
+	peer, err := srv.peerFor(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := encodeGossip(&gossipMessage{Updates: srv.piggyback(), Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+
+	rpc, err := srv.transport.Request(ctx, peer, b)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := decodeGossip(rpc.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.merge(msg.Updates)
+
+	return msg.Payload, nil
+}
+
+// peerFor returns the connection to the member at addr, dialing it when
+// there is none yet.
+func (srv *GossipDiscoverySrv) peerFor(ctx context.Context, addr string) (transport.Peer, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Outbound connections are known by the address they were dialed at.
+	key := tcpAddr.String()
+
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return nil, ErrGossipClosed
+	}
+	if peer, ok := srv.peers[key]; ok {
+		srv.mu.Unlock()
+		return peer, nil
+	}
+	dialing := len(srv.dials[key]) > 0
+	ch := make(chan transport.Peer, 1)
+	srv.dials[key] = append(srv.dials[key], ch)
+	srv.mu.Unlock()
+
+	if !dialing {
+		if err := srv.transport.Dial(key); err != nil {
+			srv.mu.Lock()
+			waiting := srv.dials[key]
+			delete(srv.dials, key)
+			srv.mu.Unlock()
+
+			for _, ch := range waiting {
+				close(ch)
+			}
+			return nil, err
+		}
+	}
+
+	select {
+	case peer, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("could not dial %s", addr)
+		}
+		return peer, nil
+	case <-ctx.Done():
+		srv.mu.Lock()
+		srv.forgetDial(key, ch)
+		srv.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// forgetDial stops waiting with ch for the connection to key. It must be
+// called with the lock held.
+func (srv *GossipDiscoverySrv) forgetDial(key string, ch chan transport.Peer) {
+	waiting := srv.dials[key]
+	for i, c := range waiting {
+		if c == ch {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiting) == 0 {
+		delete(srv.dials, key)
+	} else {
+		srv.dials[key] = waiting
+	}
+}
+
+func (srv *GossipDiscoverySrv) onPeer(p transport.Peer) error {
+	addr := p.RemoteAddr().String()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return ErrGossipClosed
+	}
+
+	srv.peers[addr] = p
+	for _, ch := range srv.dials[addr] {
+		ch <- p
+	}
+	delete(srv.dials, addr)
+
+	return nil
+}
+
+// snapshot returns every member known, the local one included.
+func (srv *GossipDiscoverySrv) snapshot() []member {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	members := make([]member, 0, len(srv.members)+1)
+	if srv.self != nil {
+		members = append(members, *srv.self)
+	}
+	for _, m := range srv.members {
+		members = append(members, *m)
+	}
+
+	return members
+}
+
+func (srv *GossipDiscoverySrv) merge(updates []member) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, u := range updates {
+		srv.apply(u)
+	}
+}
+
+// apply merges an update about a member into the membership and queues it
+// to be gossiped when it changed anything. Updates with a higher
+// incarnation win, at equal incarnation suspect wins over alive and dead
+// over both. It must be called with the lock held.
+func (srv *GossipDiscoverySrv) apply(u member) bool {
+	if u.Addr == srv.AdvertiseAddr {
+		return srv.refute(u)
+	}
+
+	cur, ok := srv.members[u.Addr]
+	if !ok {
+		// Members are only learnt of alive, dead ones are not missed.
+		if u.State != stateAlive {
+			return false
+		}
+
+		m := u
+		m.since = time.Now()
+		srv.members[u.Addr] = &m
+		srv.queue(m)
+		srv.Logger.Info("gossip member joined", zap.String("member", m.Addr), zap.String("node_addr", m.Node.Address))
+
+		return true
+	}
+
+	switch u.State {
+	case stateAlive:
+		if u.Incarnation <= cur.Incarnation {
+			return false
+		}
+	case stateSuspect:
+		if u.Incarnation < cur.Incarnation || !cur.live() ||
+			cur.State == stateSuspect && u.Incarnation == cur.Incarnation {
+			return false
+		}
+	case stateDead, stateLeft:
+		if u.Incarnation < cur.Incarnation || !cur.live() {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if cur.State != u.State {
+		cur.since = time.Now()
+	}
+	cur.State = u.State
+	cur.Incarnation = u.Incarnation
+	if u.State == stateAlive {
+		cur.Node = u.Node
+	}
+
+	srv.queue(*cur)
+	srv.Logger.Info("gossip member changed state",
+		zap.String("member", cur.Addr),
+		zap.Stringer("state", cur.State),
+		zap.Uint64("incarnation", cur.Incarnation),
+	)
+
+	return true
+}
+
+// refute raises the incarnation of the local member when an update
+// suspects it or declares it gone, so the network learns it is alive.
+func (srv *GossipDiscoverySrv) refute(u member) bool {
+	if srv.self == nil || srv.leaving || u.State == stateAlive || u.Incarnation < srv.self.Incarnation {
+		return false
+	}
+
+	srv.self.Incarnation = u.Incarnation + 1
+	srv.queue(*srv.self)
+	srv.Logger.Info("refuting gossip about local member",
+		zap.Stringer("state", u.State),
+		zap.Uint64("incarnation", srv.self.Incarnation),
+	)
+
+	return true
+}
+
+// queue schedules m to be piggybacked, replacing any pending update about
+// the same member. It must be called with the lock held.
+func (srv *GossipDiscoverySrv) queue(m member) {
+	for _, b := range srv.broadcasts {
+		if b.member.Addr == m.Addr {
+			b.member = m
+			b.transmits = 0
+			return
+		}
+	}
+
+	srv.broadcasts = append(srv.broadcasts, &broadcast{member: m})
+}
+
+// piggyback returns the updates to send along the next message, the least
+// transmitted first. Updates transmitted often enough to have reached
+// every member are dropped.
+func (srv *GossipDiscoverySrv) piggyback() []member {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	limit := retransmitMult * int(math.Ceil(math.Log10(float64(len(srv.members)+2))))
+
+	sort.SliceStable(srv.broadcasts, func(i, j int) bool {
+		return srv.broadcasts[i].transmits < srv.broadcasts[j].transmits
+	})
+
+	n := min(len(srv.broadcasts), maxPiggyback)
+	updates := make([]member, 0, n)
+	for _, b := range srv.broadcasts[:n] {
+		updates = append(updates, b.member)
+		b.transmits++
+	}
+
+	pending := srv.broadcasts[:0]
+	for _, b := range srv.broadcasts {
+		if b.transmits < limit {
+			pending = append(pending, b)
+		}
+	}
+	srv.broadcasts = pending
+
+	return updates
+}
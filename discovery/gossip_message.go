@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+type memberState int
+
+const (
+	stateAlive memberState = iota
+	stateSuspect
+	stateDead
+	stateLeft
+)
+
+func (st memberState) String() string {
+	switch st {
+	case stateAlive:
+		return "alive"
+	case stateSuspect:
+		return "suspect"
+	case stateDead:
+		return "dead"
+	case stateLeft:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// member is what a gossip member knows about another one. Addr is the
+// gossip address of the member, which identifies it, while Node is the node
+// it announces. Every member alone can raise its Incarnation, to refute a
+// suspicion about itself.
+type member struct {
+	Addr        string
+	Node        Node
+	State       memberState
+	Incarnation uint64
+
+	// since is when the member entered its current state.
+	since time.Time
+}
+
+func (m *member) live() bool {
+	return m.State == stateAlive || m.State == stateSuspect
+}
+
+// gossipMessage carries a request or reply between members together with
+// the membership updates piggybacked on it.
+type gossipMessage struct {
+	Updates []member
+	Payload any
+}
+
+// gossipPing probes the member at Target, it is answered with a gossipAck,
+// or a gossipNack when the receiver is not Target.
+type gossipPing struct {
+	Target string
+}
+
+// gossipPingReq asks a member to probe Target on behalf of the sender, it
+// is answered with a gossipAck when Target answered.
+type gossipPingReq struct {
+	Target string
+}
+
+type gossipAck struct {
+	Addr string
+}
+
+type gossipNack struct {
+	Target string
+}
+
+// gossipJoin is sent to the seeds by a member joining the network, it is
+// answered with a gossipSync holding every member the seed knows.
+type gossipJoin struct {
+	Member member
+}
+
+type gossipSync struct {
+	Members []member
+}
+
+func init() {
+	gob.Register(gossipPing{})
+	gob.Register(gossipPingReq{})
+	gob.Register(gossipAck{})
+	gob.Register(gossipNack{})
+	gob.Register(gossipJoin{})
+	gob.Register(gossipSync{})
+}
+
+func encodeGossip(msg *gossipMessage) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeGossip(payload []byte) (*gossipMessage, error) {
+	var msg gossipMessage
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
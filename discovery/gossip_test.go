@@ -0,0 +1,301 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestGossip(t *testing.T, suspicionTimeout time.Duration, seeds ...string) *GossipDiscoverySrv {
+	t.Helper()
+
+	srv, err := NewGossipDiscoverySrv(GossipOpts{
+		ListenAddr:       "127.0.0.1:0",
+		Seeds:            seeds,
+		Logger:           zap.NewNop(),
+		ProbeInterval:    20 * time.Millisecond,
+		ProbeTimeout:     100 * time.Millisecond,
+		SuspicionTimeout: suspicionTimeout,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv
+}
+
+// startGossipNetwork starts n members, all seeded with the first one, and
+// waits until every member knows every other.
+func startGossipNetwork(t *testing.T, n int, suspicionTimeout time.Duration) []*GossipDiscoverySrv {
+	t.Helper()
+
+	var members []*GossipDiscoverySrv
+	for i := 0; i < n; i++ {
+		var seeds []string
+		if i > 0 {
+			seeds = []string{members[0].AdvertiseAddr}
+		}
+
+		srv := newTestGossip(t, suspicionTimeout, seeds...)
+		require.NoError(t, srv.AddNode(Node{ServerID: fmt.Sprintf("server-%d", i), Address: fmt.Sprintf("127.0.0.1:%d", 4000+i)}))
+		members = append(members, srv)
+	}
+
+	for _, srv := range members {
+		requireNodeAddrs(t, srv, nodeAddrsOf(members...))
+	}
+
+	return members
+}
+
+func nodeAddrsOf(members ...*GossipDiscoverySrv) []string {
+	var addrs []string
+	for _, srv := range members {
+		srv.mu.Lock()
+		addrs = append(addrs, srv.self.Node.Address)
+		srv.mu.Unlock()
+	}
+
+	return addrs
+}
+
+func requireNodeAddrs(t *testing.T, srv *GossipDiscoverySrv, want []string) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		nodes, err := srv.GetNodes()
+		return err == nil && assert.ObjectsAreEqual(want, nodeAddrs(nodes))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// crash stops the member without telling the others it leaves.
+func crash(srv *GossipDiscoverySrv) {
+	srv.mu.Lock()
+	srv.self = nil
+	srv.mu.Unlock()
+
+	srv.Close()
+}
+
+func waitEvent(t *testing.T, events <-chan Event, want Event) {
+	t.Helper()
+
+	for {
+		select {
+		case event := <-events:
+			if event.Type == want.Type && event.Node.Address == want.Node.Address {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s event of %s", want.Type, want.Node.Address)
+		}
+	}
+}
+
+func TestGossipDiscoverySrv_Join(t *testing.T) {
+	members := startGossipNetwork(t, 3, time.Second)
+
+	// Members started later are learnt of through gossip too.
+	events := members[1].Watch()
+	late := newTestGossip(t, time.Second, members[2].AdvertiseAddr)
+	require.NoError(t, late.AddNode(Node{ServerID: "late", Address: "127.0.0.1:4100"}))
+
+	waitEvent(t, events, Event{Type: NodeJoined, Node: Node{Address: "127.0.0.1:4100"}})
+	for _, srv := range append(members, late) {
+		requireNodeAddrs(t, srv, nodeAddrsOf(append(members, late)...))
+	}
+}
+
+func TestGossipDiscoverySrv_DetectsFailure(t *testing.T) {
+	members := startGossipNetwork(t, 3, 200*time.Millisecond)
+	events := members[0].Watch()
+
+	crash(members[2])
+
+	waitEvent(t, events, Event{Type: NodeLeft, Node: Node{Address: "127.0.0.1:4002"}})
+	requireNodeAddrs(t, members[1], nodeAddrsOf(members[:2]...))
+}
+
+func TestGossipDiscoverySrv_Leave(t *testing.T) {
+	// The suspicion timeout is too long for the test, the leave must be
+	// gossiped.
+	members := startGossipNetwork(t, 3, time.Minute)
+	events := members[0].Watch()
+
+	require.NoError(t, members[2].Close())
+
+	waitEvent(t, events, Event{Type: NodeLeft, Node: Node{Address: "127.0.0.1:4002"}})
+	requireNodeAddrs(t, members[1], nodeAddrsOf(members[:2]...))
+}
+
+func TestGossipDiscoverySrv_RefutesSuspicion(t *testing.T) {
+	members := startGossipNetwork(t, 2, 300*time.Millisecond)
+
+	require.NoError(t, members[0].RemoveDeadNode(Node{Address: "127.0.0.1:4001"}))
+
+	require.Eventually(t, func() bool {
+		members[1].mu.Lock()
+		defer members[1].mu.Unlock()
+		return members[1].self.Incarnation > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Past the suspicion timeout the member is still there.
+	time.Sleep(500 * time.Millisecond)
+	requireNodeAddrs(t, members[0], nodeAddrsOf(members...))
+}
+
+func TestGossipDiscoverySrv_JoinLaterSeed(t *testing.T) {
+	first := newTestGossip(t, time.Second)
+	second := newTestGossip(t, time.Second, first.AdvertiseAddr)
+
+	// The seed announces its node after second tried to join.
+	require.NoError(t, second.AddNode(Node{ServerID: "second", Address: "127.0.0.1:4001"}))
+	require.NoError(t, first.AddNode(Node{ServerID: "first", Address: "127.0.0.1:4000"}))
+
+	requireNodeAddrs(t, first, []string{"127.0.0.1:4000", "127.0.0.1:4001"})
+	requireNodeAddrs(t, second, []string{"127.0.0.1:4000", "127.0.0.1:4001"})
+}
+
+func TestGossipDiscoverySrv_Apply(t *testing.T) {
+	tests := []struct {
+		name    string
+		current *member
+		update  member
+		changed bool
+		want    memberState
+		wantInc uint64
+	}{
+		{
+			name:    "unknown alive member is added",
+			update:  member{Addr: "b", State: stateAlive, Incarnation: 2},
+			changed: true,
+			want:    stateAlive,
+			wantInc: 2,
+		},
+		{
+			name:   "unknown dead member is ignored",
+			update: member{Addr: "b", State: stateDead},
+		},
+		{
+			name:    "suspect overrides alive at the same incarnation",
+			current: &member{Addr: "b", State: stateAlive, Incarnation: 1},
+			update:  member{Addr: "b", State: stateSuspect, Incarnation: 1},
+			changed: true,
+			want:    stateSuspect,
+			wantInc: 1,
+		},
+		{
+			name:    "alive at the same incarnation does not clear a suspicion",
+			current: &member{Addr: "b", State: stateSuspect, Incarnation: 1},
+			update:  member{Addr: "b", State: stateAlive, Incarnation: 1},
+			want:    stateSuspect,
+			wantInc: 1,
+		},
+		{
+			name:    "alive at a higher incarnation clears a suspicion",
+			current: &member{Addr: "b", State: stateSuspect, Incarnation: 1},
+			update:  member{Addr: "b", State: stateAlive, Incarnation: 2},
+			changed: true,
+			want:    stateAlive,
+			wantInc: 2,
+		},
+		{
+			name:    "stale suspicion is ignored",
+			current: &member{Addr: "b", State: stateAlive, Incarnation: 3},
+			update:  member{Addr: "b", State: stateSuspect, Incarnation: 2},
+			want:    stateAlive,
+			wantInc: 3,
+		},
+		{
+			name:    "dead overrides suspect",
+			current: &member{Addr: "b", State: stateSuspect, Incarnation: 1},
+			update:  member{Addr: "b", State: stateDead, Incarnation: 1},
+			changed: true,
+			want:    stateDead,
+			wantInc: 1,
+		},
+		{
+			name:    "suspicion of a dead member is ignored",
+			current: &member{Addr: "b", State: stateDead, Incarnation: 1},
+			update:  member{Addr: "b", State: stateSuspect, Incarnation: 2},
+			want:    stateDead,
+			wantInc: 1,
+		},
+		{
+			name:    "dead member rejoins at a higher incarnation",
+			current: &member{Addr: "b", State: stateDead, Incarnation: 1},
+			update:  member{Addr: "b", State: stateAlive, Incarnation: 2},
+			changed: true,
+			want:    stateAlive,
+			wantInc: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &GossipDiscoverySrv{
+				GossipOpts: GossipOpts{AdvertiseAddr: "a", Logger: zap.NewNop()},
+				members:    map[string]*member{},
+			}
+			if tt.current != nil {
+				srv.members[tt.current.Addr] = tt.current
+			}
+
+			assert.Equal(t, tt.changed, srv.apply(tt.update))
+			assert.Equal(t, tt.changed, len(srv.broadcasts) == 1)
+
+			m, ok := srv.members[tt.update.Addr]
+			if tt.current == nil && !tt.changed {
+				assert.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			assert.Equal(t, tt.want, m.State)
+			assert.Equal(t, tt.wantInc, m.Incarnation)
+		})
+	}
+}
+
+func TestGossipDiscoverySrv_ApplyRefutes(t *testing.T) {
+	srv := &GossipDiscoverySrv{
+		GossipOpts: GossipOpts{AdvertiseAddr: "a", Logger: zap.NewNop()},
+		members:    map[string]*member{},
+		self:       &member{Addr: "a", State: stateAlive, Incarnation: 2},
+	}
+
+	assert.False(t, srv.apply(member{Addr: "a", State: stateSuspect, Incarnation: 1}))
+	assert.Equal(t, uint64(2), srv.self.Incarnation)
+
+	assert.True(t, srv.apply(member{Addr: "a", State: stateDead, Incarnation: 2}))
+	assert.Equal(t, uint64(3), srv.self.Incarnation)
+	assert.Equal(t, stateAlive, srv.self.State)
+	require.Len(t, srv.broadcasts, 1)
+	assert.Equal(t, srv.broadcasts[0].member.Incarnation, uint64(3))
+}
+
+func TestGossipDiscoverySrv_Piggyback(t *testing.T) {
+	srv := &GossipDiscoverySrv{members: map[string]*member{}}
+	for i := 0; i < maxPiggyback+4; i++ {
+		srv.queue(member{Addr: fmt.Sprintf("m%d", i)})
+	}
+
+	// Every update goes out before any is repeated.
+	first := srv.piggyback()
+	second := srv.piggyback()
+	assert.Len(t, first, maxPiggyback)
+
+	seen := map[string]bool{}
+	for _, m := range append(first, second[:4]...) {
+		seen[m.Addr] = true
+	}
+	assert.Len(t, seen, maxPiggyback+4)
+
+	// Updates are dropped once transmitted often enough.
+	for i := 0; i < 10; i++ {
+		srv.piggyback()
+	}
+	assert.Empty(t, srv.piggyback())
+}
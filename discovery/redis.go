@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
@@ -12,12 +15,32 @@ import (
 const (
 	discoveryKey  string = "dfsgo:nodes"
 	infoKeyPrefix string = "dfsgo:nodes:info"
+
+	// DefaultLeaseTTL is how long a node stays registered without renewing
+	// its lease.
+	DefaultLeaseTTL = 10 * time.Second
 )
 
 type RedisDiscoverySrv struct {
 	client *redis.Client
 	ctx    context.Context
 	logger *zap.Logger
+
+	// LeaseTTL is how long a node added by this service stays in the
+	// network after its last renewal. Leases are renewed every third of it.
+	LeaseTTL time.Duration
+	// WatchInterval is how often Watch polls the nodes.
+	WatchInterval time.Duration
+	// FailoverRetries is the number of times a request failing while the
+	// master is unavailable is retried, a negative value disables retries.
+	// FailoverRetryBackoff is the wait before the first retry.
+	FailoverRetries      int
+	FailoverRetryBackoff time.Duration
+
+	mu         sync.Mutex
+	heartbeats map[string]context.CancelFunc
+	watcher    *nodeWatcher
+	wg         sync.WaitGroup
 }
 
 func NewRedisDiscoverySrv(ctx context.Context, redisURL string, logger *zap.Logger) (*RedisDiscoverySrv, error) {
@@ -33,19 +56,114 @@ func NewRedisDiscoverySrv(ctx context.Context, redisURL string, logger *zap.Logg
 	}, nil
 }
 
+// Close stops renewing the leases of the nodes added by the service and
+// removes them from the network.
 func (srv *RedisDiscoverySrv) Close() error {
+	srv.mu.Lock()
+	heartbeats := srv.heartbeats
+	srv.heartbeats = nil
+	watcher := srv.watcher
+	srv.mu.Unlock()
+
+	for addr, cancel := range heartbeats {
+		cancel()
+		srv.deregister(addr)
+	}
+	srv.wg.Wait()
+
+	if watcher != nil {
+		watcher.close()
+	}
+
 	return srv.client.Close()
 }
 
+// AddNode registers the node with a lease renewed in the background until
+// the node is removed or the service closed.
 func (srv *RedisDiscoverySrv) AddNode(node Node) error {
+	if err := srv.withRetry("add node", func() error { return srv.register(node) }); err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.heartbeats == nil {
+		srv.heartbeats = make(map[string]context.CancelFunc)
+	}
+	if cancel, ok := srv.heartbeats[node.Address]; ok {
+		cancel()
+	}
+
+	ctx, cancel := context.WithCancel(srv.ctx)
+	srv.heartbeats[node.Address] = cancel
+
+	srv.wg.Add(1)
+	go srv.heartbeat(ctx, node)
+
+	return nil
+}
+
+func (srv *RedisDiscoverySrv) register(node Node) error {
 	b, err := json.Marshal(node)
 	if err != nil {
 		return err
 	}
-	return srv.client.HSet(srv.ctx, discoveryKey, node.Address, string(b)).Err()
+
+	// A node listed without its lease would be taken for expired and
+	// removed by the next GetNodes, both are written in one transaction.
+	_, err = srv.client.TxPipelined(srv.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(srv.ctx, leaseKey(node.Address), node.ServerID, srv.leaseTTL())
+		pipe.HSet(srv.ctx, discoveryKey, node.Address, string(b))
+		return nil
+	})
+
+	return err
+}
+
+func (srv *RedisDiscoverySrv) deregister(addr string) {
+	if err := srv.client.Del(srv.ctx, leaseKey(addr)).Err(); err != nil {
+		srv.logger.Error("could not delete node lease", zap.Error(err), zap.String("node_addr", addr))
+	}
+	if err := srv.client.HDel(srv.ctx, discoveryKey, addr).Err(); err != nil {
+		srv.logger.Error("could not delete node from discovery service", zap.Error(err), zap.String("node_addr", addr))
+	}
+}
+
+// heartbeat renews the lease of node until ctx is done. The node is
+// registered again, so it comes back if its lease lapsed meanwhile.
+func (srv *RedisDiscoverySrv) heartbeat(ctx context.Context, node Node) {
+	defer srv.wg.Done()
+
+	ticker := time.NewTicker(srv.leaseTTL() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := srv.withRetry("renew lease", func() error { return srv.register(node) }); err != nil {
+				srv.logger.Error("could not renew node lease", zap.Error(err), zap.String("node_addr", node.Address))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
+// GetNodes returns the nodes holding a lease. Nodes whose lease lapsed are
+// removed from the network.
 func (srv *RedisDiscoverySrv) GetNodes() ([]Node, error) {
+	var nodes []Node
+	err := srv.withRetry("get nodes", func() error {
+		var err error
+		nodes, err = srv.getNodes()
+		return err
+	})
+
+	return nodes, err
+}
+
+func (srv *RedisDiscoverySrv) getNodes() ([]Node, error) {
 	nodesStr, err := srv.client.HGetAll(srv.ctx, discoveryKey).Result()
 	if err == redis.Nil {
 		return nil, fmt.Errorf("there is no node in discovery service")
@@ -53,11 +171,36 @@ func (srv *RedisDiscoverySrv) GetNodes() ([]Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(nodesStr) == 0 {
+		return nil, nil
+	}
+
+	addrs := make([]string, 0, len(nodesStr))
+	leaseKeys := make([]string, 0, len(nodesStr))
+	for addr := range nodesStr {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		leaseKeys = append(leaseKeys, leaseKey(addr))
+	}
+
+	leases, err := srv.client.MGet(srv.ctx, leaseKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
 	var nodes []Node
-	var node Node
+	var expired []string
 
-	for addr, nodeStr := range nodesStr {
-		err := json.Unmarshal([]byte(nodeStr), &node)
+	for i, addr := range addrs {
+		if i >= len(leases) || leases[i] == nil {
+			expired = append(expired, addr)
+			continue
+		}
+
+		var node Node
+		err := json.Unmarshal([]byte(nodesStr[addr]), &node)
 		if err != nil {
 			srv.logger.Error("could not parse node info", zap.String("node_addr", addr))
 			continue
@@ -66,15 +209,48 @@ func (srv *RedisDiscoverySrv) GetNodes() ([]Node, error) {
 		nodes = append(nodes, node)
 	}
 
-	return nodes, nil
+	if len(expired) > 0 {
+		srv.logger.Info("removing nodes with expired lease", zap.Strings("node_addrs", expired))
+		if err := srv.client.HDel(srv.ctx, discoveryKey, expired...).Err(); err != nil {
+			srv.logger.Error("could not delete expired nodes", zap.Error(err))
+		}
+	}
 
+	return nodes, nil
 }
 
 func (srv *RedisDiscoverySrv) RemoveDeadNode(n Node) error {
-	err := srv.client.HDel(srv.ctx, discoveryKey, n.Address).Err()
+	err := srv.withRetry("remove node", func() error {
+		return srv.client.HDel(srv.ctx, discoveryKey, n.Address).Err()
+	})
 	if err != nil {
 		srv.logger.Error("could not delete node from discovery service", zap.String("node_addr", n.Address))
 		return err
 	}
 	return nil
 }
+
+// Watch implements the DiscoveryService interface by polling the nodes
+// every WatchInterval.
+func (srv *RedisDiscoverySrv) Watch() <-chan Event {
+	srv.mu.Lock()
+	if srv.watcher == nil {
+		srv.watcher = newNodeWatcher(srv.WatchInterval, srv.GetNodes, srv.logger)
+	}
+	watcher := srv.watcher
+	srv.mu.Unlock()
+
+	return watcher.watch()
+}
+
+func (srv *RedisDiscoverySrv) leaseTTL() time.Duration {
+	if srv.LeaseTTL <= 0 {
+		return DefaultLeaseTTL
+	}
+
+	return srv.LeaseTTL
+}
+
+func leaseKey(addr string) string {
+	return infoKeyPrefix + ":" + addr
+}
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultFailoverRetries      = 5
+	DefaultFailoverRetryBackoff = 100 * time.Millisecond
+	maxFailoverRetryBackoff     = 2 * time.Second
+)
+
+type RedisSentinelOpts struct {
+	MasterName       string
+	SentinelAddrs    []string
+	Password         string
+	SentinelPassword string
+	DB               int
+}
+
+// NewRedisSentinelDiscoverySrv returns a discovery service connected to the
+// master monitored by the sentinels under MasterName. When the sentinels
+// promote a replica, the requests failing meanwhile are retried against the
+// new master.
+func NewRedisSentinelDiscoverySrv(ctx context.Context, opts RedisSentinelOpts, logger *zap.Logger) (*RedisDiscoverySrv, error) {
+	if opts.MasterName == "" {
+		return nil, errors.New("sentinel master name is required")
+	}
+	if len(opts.SentinelAddrs) == 0 {
+		return nil, errors.New("at least one sentinel address is required")
+	}
+
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:       opts.MasterName,
+		SentinelAddrs:    opts.SentinelAddrs,
+		Password:         opts.Password,
+		SentinelPassword: opts.SentinelPassword,
+		DB:               opts.DB,
+	})
+
+	return &RedisDiscoverySrv{
+		client: client,
+		ctx:    ctx,
+		logger: logger,
+	}, nil
+}
+
+// withRetry runs op until it succeeds, fails with an error not caused by a
+// failover, or the retries run out. The wait between attempts doubles every
+// time.
+func (srv *RedisDiscoverySrv) withRetry(name string, op func() error) error {
+	retries := srv.FailoverRetries
+	if retries == 0 {
+		retries = DefaultFailoverRetries
+	}
+	backoff := srv.FailoverRetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultFailoverRetryBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= retries || !isFailoverError(err) {
+			return err
+		}
+
+		srv.logger.Warn("redis unavailable, retrying", zap.String("op", name), zap.Int("attempt", attempt+1), zap.Error(err))
+
+		select {
+		case <-time.After(backoff):
+		case <-srv.ctx.Done():
+			return fmt.Errorf("%s: %w", name, errors.Join(err, srv.ctx.Err()))
+		}
+
+		backoff = min(2*backoff, maxFailoverRetryBackoff)
+	}
+}
+
+// isFailoverError reports whether err is the kind of error seen while the
+// master is unreachable or being replaced.
+func isFailoverError(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// A transaction whose writes a replica answered READONLY is discarded
+	// with EXECABORT.
+	msg := err.Error()
+	for _, prefix := range []string{"READONLY ", "EXECABORT ", "LOADING ", "MASTERDOWN ", "TRYAGAIN ", "redis: all sentinels"} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,411 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeRedis is a stand-in for a redis-server speaking just enough RESP2 for
+// the discovery service, acting either as a master or as a sentinel.
+type fakeRedis struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	hashes   map[string]map[string]string
+	strings  map[string]string
+	readonly bool
+	conns    map[net.Conn]bool
+
+	// Sentinel state.
+	masterAddr  string
+	subscribers []net.Conn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	r := &fakeRedis{
+		listener: ln,
+		hashes:   map[string]map[string]string{},
+		strings:  map[string]string{},
+		conns:    map[net.Conn]bool{},
+	}
+	t.Cleanup(r.close)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.conns[conn] = true
+			r.mu.Unlock()
+			go r.serve(conn)
+		}
+	}()
+
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) close() {
+	r.listener.Close()
+	r.dropClients()
+}
+
+// dropClients closes every client connection, as redis does when a master
+// is demoted.
+func (r *fakeRedis) dropClients() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.conns = map[net.Conn]bool{}
+}
+
+// failover promotes next as the new master: the data is copied to it, the
+// current master turns read only and the sentinel announces the switch.
+func (r *fakeRedis) failover(master, next *fakeRedis) {
+	master.mu.Lock()
+	next.mu.Lock()
+	for key, hash := range master.hashes {
+		next.hashes[key] = map[string]string{}
+		for field, value := range hash {
+			next.hashes[key][field] = value
+		}
+	}
+	for key, value := range master.strings {
+		next.strings[key] = value
+	}
+	master.readonly = true
+	next.mu.Unlock()
+	master.mu.Unlock()
+
+	r.mu.Lock()
+	old := r.masterAddr
+	r.masterAddr = next.addr()
+	subscribers := r.subscribers
+	r.mu.Unlock()
+
+	oldHost, oldPort, _ := net.SplitHostPort(old)
+	newHost, newPort, _ := net.SplitHostPort(next.addr())
+	payload := strings.Join([]string{"mymaster", oldHost, oldPort, newHost, newPort}, " ")
+	for _, conn := range subscribers {
+		writeArray(conn, "message", "+switch-master", payload)
+	}
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// Commands sent between MULTI and EXEC are queued, queued is nil
+	// outside of a transaction.
+	var (
+		queued  [][]string
+		aborted bool
+	)
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "MULTI":
+			queued, aborted = [][]string{}, false
+			fmt.Fprint(conn, "+OK\r\n")
+		case cmd == "EXEC" && aborted:
+			queued = nil
+			fmt.Fprint(conn, "-EXECABORT Transaction discarded because of previous errors.\r\n")
+		case cmd == "EXEC":
+			fmt.Fprintf(conn, "*%d\r\n", len(queued))
+			for _, args := range queued {
+				r.handle(conn, args)
+			}
+			queued = nil
+		case queued != nil && r.rejectsWrite(cmd):
+			aborted = true
+			fmt.Fprint(conn, "-READONLY You can't write against a read only replica.\r\n")
+		case queued != nil:
+			queued = append(queued, args)
+			fmt.Fprint(conn, "+QUEUED\r\n")
+		default:
+			r.handle(conn, args)
+		}
+	}
+}
+
+// rejectsWrite reports whether cmd writes to a read only replica.
+func (r *fakeRedis) rejectsWrite(cmd string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch cmd {
+	case "HSET", "SET", "DEL", "HDEL":
+		return r.readonly
+	}
+
+	return false
+}
+
+func (r *fakeRedis) handle(conn net.Conn, args []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cmd := strings.ToUpper(args[0])
+
+	switch cmd {
+	case "HSET", "SET", "DEL", "HDEL":
+		if r.readonly {
+			fmt.Fprint(conn, "-READONLY You can't write against a read only replica.\r\n")
+			return
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		fmt.Fprint(conn, "+PONG\r\n")
+	case "CLIENT":
+		fmt.Fprint(conn, "+OK\r\n")
+	case "HSET":
+		hash, ok := r.hashes[args[1]]
+		if !ok {
+			hash = map[string]string{}
+			r.hashes[args[1]] = hash
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			hash[args[i]] = args[i+1]
+		}
+		fmt.Fprintf(conn, ":%d\r\n", (len(args)-2)/2)
+	case "HGETALL":
+		var flat []string
+		for field, value := range r.hashes[args[1]] {
+			flat = append(flat, field, value)
+		}
+		writeArray(conn, flat...)
+	case "HDEL":
+		for _, field := range args[2:] {
+			delete(r.hashes[args[1]], field)
+		}
+		fmt.Fprintf(conn, ":%d\r\n", len(args)-2)
+	case "SET":
+		r.strings[args[1]] = args[2]
+		fmt.Fprint(conn, "+OK\r\n")
+	case "DEL":
+		for _, key := range args[1:] {
+			delete(r.strings, key)
+		}
+		fmt.Fprintf(conn, ":%d\r\n", len(args)-1)
+	case "MGET":
+		fmt.Fprintf(conn, "*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if value, ok := r.strings[key]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		}
+	case "SENTINEL":
+		switch strings.ToLower(args[1]) {
+		case "get-master-addr-by-name":
+			host, port, _ := net.SplitHostPort(r.masterAddr)
+			writeArray(conn, host, port)
+		default:
+			fmt.Fprint(conn, "*0\r\n")
+		}
+	case "SUBSCRIBE":
+		for i, channel := range args[1:] {
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(channel), channel, i+1)
+		}
+		r.subscribers = append(r.subscribers, conn)
+	default:
+		fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func writeArray(w io.Writer, items ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(items))
+	for _, item := range items {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(item), item)
+	}
+	io.WriteString(w, b.String())
+}
+
+func nodeAddrs(nodes []Node) []string {
+	addrs := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		addrs = append(addrs, n.Address)
+	}
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+func TestRedisSentinelDiscoverySrv_Failover(t *testing.T) {
+	master := newFakeRedis(t)
+	replica := newFakeRedis(t)
+	sentinel := newFakeRedis(t)
+	sentinel.masterAddr = master.addr()
+
+	srv, err := NewRedisSentinelDiscoverySrv(context.Background(), RedisSentinelOpts{
+		MasterName:    "mymaster",
+		SentinelAddrs: []string{sentinel.addr()},
+	}, zap.NewNop())
+	require.NoError(t, err)
+	srv.LeaseTTL = time.Hour
+	srv.FailoverRetryBackoff = 20 * time.Millisecond
+	t.Cleanup(func() { srv.Close() })
+
+	require.NoError(t, srv.AddNode(Node{ServerID: "one", Address: "127.0.0.1:3000"}))
+
+	nodes, err := srv.GetNodes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:3000"}, nodeAddrs(nodes))
+
+	sentinel.failover(master, replica)
+	master.dropClients()
+
+	// The writes reach the promoted replica.
+	require.NoError(t, srv.AddNode(Node{ServerID: "two", Address: "127.0.0.1:3001"}))
+
+	nodes, err = srv.GetNodes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:3000", "127.0.0.1:3001"}, nodeAddrs(nodes))
+
+	replica.mu.Lock()
+	assert.Contains(t, replica.hashes[discoveryKey], "127.0.0.1:3001")
+	replica.mu.Unlock()
+}
+
+func TestNewRedisSentinelDiscoverySrv_InvalidOpts(t *testing.T) {
+	_, err := NewRedisSentinelDiscoverySrv(context.Background(), RedisSentinelOpts{SentinelAddrs: []string{"127.0.0.1:26379"}}, zap.NewNop())
+	assert.Error(t, err)
+
+	_, err = NewRedisSentinelDiscoverySrv(context.Background(), RedisSentinelOpts{MasterName: "mymaster"}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestRedisDiscoverySrv_RetryOnFailover(t *testing.T) {
+	client, mock := redismock.NewClientMock()
+
+	srv := &RedisDiscoverySrv{
+		client:               client,
+		ctx:                  context.TODO(),
+		logger:               zap.NewNop(),
+		FailoverRetries:      2,
+		FailoverRetryBackoff: time.Millisecond,
+	}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		wantErr  bool
+		attempts int
+	}{
+		{
+			name:     "master promoted after a read only answer",
+			errs:     []error{errors.New("READONLY You can't write against a read only replica.")},
+			attempts: 2,
+		},
+		{
+			name:     "transaction discarded by a read only replica",
+			errs:     []error{errors.New("EXECABORT Transaction discarded because of previous errors.")},
+			attempts: 2,
+		},
+		{
+			name:     "master unreachable until retries run out",
+			errs:     []error{io.EOF, io.EOF, io.EOF},
+			wantErr:  true,
+			attempts: 3,
+		},
+		{
+			name:     "errors not caused by a failover are not retried",
+			errs:     []error{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")},
+			wantErr:  true,
+			attempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < tt.attempts; i++ {
+				expected := mock.ExpectHDel(discoveryKey, "127.0.0.1:3000")
+				if i < len(tt.errs) {
+					expected.SetErr(tt.errs[i])
+				} else {
+					expected.SetVal(1)
+				}
+			}
+
+			err := srv.RemoveDeadNode(Node{Address: "127.0.0.1:3000"})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
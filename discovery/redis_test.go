@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redismock/v9"
 	"github.com/redis/go-redis/v9"
@@ -69,12 +70,14 @@ func TestRedisDiscoverySrv_AddNode(t *testing.T) {
 			n, err := json.Marshal(tt.args.node)
 			require.Nil(t, err)
 
+			mock.ExpectTxPipeline()
+			mock.ExpectSet(leaseKey(tt.args.node.Address), tt.args.node.ServerID, DefaultLeaseTTL).SetVal("OK")
 			expectedInt := mock.ExpectHSet(discoveryKey, tt.args.node.Address, string(n))
-
 			if tt.wantErr {
 				expectedInt.SetErr(tt.expectedErr)
 			} else {
 				expectedInt.SetVal(1)
+				mock.ExpectTxPipelineExec()
 			}
 
 			err = srv.AddNode(tt.args.node)
@@ -83,6 +86,7 @@ func TestRedisDiscoverySrv_AddNode(t *testing.T) {
 			} else {
 				require.Nil(t, err)
 			}
+			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
 }
@@ -97,11 +101,12 @@ func TestRedisDiscoverySrv_GetNodes(t *testing.T) {
 		logger: zap.NewExample(),
 	}
 	tests := []struct {
-		name        string
-		want        []Node
-		wantErr     bool
-		expectedMap map[string]string
-		expectedErr error
+		name           string
+		want           []Node
+		wantErr        bool
+		expectedMap    map[string]string
+		expectedLeases []interface{}
+		expectedErr    error
 	}{
 		{
 			name: "successfully retieve a list of nodes",
@@ -118,7 +123,23 @@ func TestRedisDiscoverySrv_GetNodes(t *testing.T) {
 			expectedMap: map[string]string{
 				"127.0.0.1:3000": "{\"server_id\":\"server_id\",\"ip\":\"127.0.0.1\",\"hostmane\":\"my_machine\",\"port\":3000,\"created_at\":\"0001-01-01T00:00:00Z\",\"address\":\"127.0.0.1:3000\"}",
 			},
-			wantErr: false,
+			expectedLeases: []interface{}{"server_id"},
+			wantErr:        false,
+		},
+		{
+			name: "nodes with an expired lease are removed",
+			want: []Node{
+				{
+					ServerID: "alive",
+					Address:  "127.0.0.1:3001",
+				},
+			},
+			expectedMap: map[string]string{
+				"127.0.0.1:3000": "{\"server_id\":\"expired\",\"address\":\"127.0.0.1:3000\"}",
+				"127.0.0.1:3001": "{\"server_id\":\"alive\",\"address\":\"127.0.0.1:3001\"}",
+			},
+			expectedLeases: []interface{}{nil, "alive"},
+			wantErr:        false,
 		},
 		{
 			name:        "empty nodes",
@@ -137,6 +158,22 @@ func TestRedisDiscoverySrv_GetNodes(t *testing.T) {
 				resultMap.SetErr(tt.expectedErr)
 			}
 			resultMap.SetVal(tt.expectedMap)
+
+			if tt.expectedLeases != nil {
+				var keys []string
+				var expired []string
+				for i, addr := range []string{"127.0.0.1:3000", "127.0.0.1:3001"}[:len(tt.expectedLeases)] {
+					keys = append(keys, leaseKey(addr))
+					if tt.expectedLeases[i] == nil {
+						expired = append(expired, addr)
+					}
+				}
+				mock.ExpectMGet(keys...).SetVal(tt.expectedLeases)
+				if len(expired) > 0 {
+					mock.ExpectHDel(discoveryKey, expired...).SetVal(int64(len(expired)))
+				}
+			}
+
 			nodes, err := srv.GetNodes()
 			if tt.wantErr {
 				require.Error(t, err)
@@ -145,7 +182,7 @@ func TestRedisDiscoverySrv_GetNodes(t *testing.T) {
 			}
 
 			assert.Equal(t, tt.want, nodes)
-
+			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
 }
@@ -195,3 +232,31 @@ func TestRedisDiscoverySrv_RemoveDeadNode(t *testing.T) {
 		})
 	}
 }
+
+func TestRedisDiscoverySrv_Close(t *testing.T) {
+	client, mock := redismock.NewClientMock()
+
+	srv := &RedisDiscoverySrv{
+		client:   client,
+		ctx:      context.TODO(),
+		logger:   zap.NewExample(),
+		LeaseTTL: time.Hour,
+	}
+
+	node := Node{ServerID: "server_id", Address: "127.0.0.1:3000"}
+	n, err := json.Marshal(node)
+	require.NoError(t, err)
+
+	mock.ExpectTxPipeline()
+	mock.ExpectSet(leaseKey(node.Address), node.ServerID, time.Hour).SetVal("OK")
+	mock.ExpectHSet(discoveryKey, node.Address, string(n)).SetVal(1)
+	mock.ExpectTxPipelineExec()
+	require.NoError(t, srv.AddNode(node))
+
+	// Closing the service removes the node it added from the network.
+	mock.ExpectDel(leaseKey(node.Address)).SetVal(1)
+	mock.ExpectHDel(discoveryKey, node.Address).SetVal(1)
+	require.NoError(t, srv.Close())
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
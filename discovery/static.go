@@ -0,0 +1,143 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// StaticDiscoverySrv serves a list of nodes set by hand, either given once
+// or read from a file, see NewFileDiscoverySrv. Nodes registered with
+// AddNode are served along with the list.
+type StaticDiscoverySrv struct {
+	load   func() ([]Node, error)
+	logger *zap.Logger
+
+	// WatchInterval is how often Watch reloads the nodes.
+	WatchInterval time.Duration
+
+	mu      sync.Mutex
+	added   map[string]Node
+	watcher *nodeWatcher
+}
+
+// NewStaticDiscoverySrv returns a discovery service serving a node for
+// every one of addrs.
+func NewStaticDiscoverySrv(addrs []string, logger *zap.Logger) (*StaticDiscoverySrv, error) {
+	nodes := make([]Node, 0, len(addrs))
+	for _, addr := range addrs {
+		node, err := nodeFromAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+
+	return &StaticDiscoverySrv{
+		load:   func() ([]Node, error) { return nodes, nil },
+		logger: logger,
+	}, nil
+}
+
+// nodeFromAddr returns the node listening at addr.
+func nodeFromAddr(addr string) (Node, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Node{}, fmt.Errorf("invalid node address %q: %w", addr, err)
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Node{}, fmt.Errorf("invalid node address %q: %w", addr, err)
+	}
+
+	return Node{
+		IP:      host,
+		Port:    port,
+		Address: addr,
+	}, nil
+}
+
+// GetNodes returns the nodes of the list and the ones added, the latter
+// replacing the nodes of the list at the same address.
+func (srv *StaticDiscoverySrv) GetNodes() ([]Node, error) {
+	listed, err := srv.load()
+	if err != nil {
+		return nil, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	byAddr := make(map[string]Node, len(listed)+len(srv.added))
+	for _, node := range listed {
+		byAddr[node.Address] = node
+	}
+	for addr, node := range srv.added {
+		byAddr[addr] = node
+	}
+
+	nodes := make([]Node, 0, len(byAddr))
+	for _, node := range byAddr {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Address < nodes[j].Address })
+
+	return nodes, nil
+}
+
+// AddNode serves node until the service is closed, the list itself is not
+// changed.
+func (srv *StaticDiscoverySrv) AddNode(node Node) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.added == nil {
+		srv.added = make(map[string]Node)
+	}
+	srv.added[node.Address] = node
+
+	return nil
+}
+
+// RemoveDeadNode stops serving a node added with AddNode. Nodes of the list
+// stay, they are expected to come back.
+func (srv *StaticDiscoverySrv) RemoveDeadNode(n Node) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	delete(srv.added, n.Address)
+
+	return nil
+}
+
+// Watch implements the DiscoveryService interface by reloading the nodes
+// every WatchInterval.
+func (srv *StaticDiscoverySrv) Watch() <-chan Event {
+	srv.mu.Lock()
+	if srv.watcher == nil {
+		srv.watcher = newNodeWatcher(srv.WatchInterval, srv.GetNodes, srv.logger)
+	}
+	watcher := srv.watcher
+	srv.mu.Unlock()
+
+	return watcher.watch()
+}
+
+func (srv *StaticDiscoverySrv) Close() error {
+	srv.mu.Lock()
+	srv.added = nil
+	watcher := srv.watcher
+	srv.mu.Unlock()
+
+	if watcher != nil {
+		watcher.close()
+	}
+
+	return nil
+}
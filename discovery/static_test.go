@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStaticDiscoverySrv(t *testing.T) {
+	srv, err := NewStaticDiscoverySrv([]string{"127.0.0.1:3001", "node-1:3000"}, zap.NewNop())
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	nodes, err := srv.GetNodes()
+	require.NoError(t, err)
+	assert.Equal(t, []Node{
+		{IP: "127.0.0.1", Port: 3001, Address: "127.0.0.1:3001"},
+		{IP: "node-1", Port: 3000, Address: "node-1:3000"},
+	}, nodes)
+
+	// Added nodes replace the listed ones at the same address.
+	self := Node{ServerID: "self", Address: "127.0.0.1:3001"}
+	require.NoError(t, srv.AddNode(self))
+
+	nodes, err = srv.GetNodes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:3001", "node-1:3000"}, nodeAddrs(nodes))
+	assert.Equal(t, self, nodes[0])
+
+	// Listed nodes are not removed.
+	require.NoError(t, srv.RemoveDeadNode(Node{Address: "node-1:3000"}))
+	require.NoError(t, srv.RemoveDeadNode(self))
+
+	nodes, err = srv.GetNodes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:3001", "node-1:3000"}, nodeAddrs(nodes))
+	assert.Empty(t, nodes[0].ServerID)
+}
+
+func TestNewStaticDiscoverySrv_InvalidAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:http", ""} {
+		_, err := NewStaticDiscoverySrv([]string{addr}, zap.NewNop())
+		assert.Error(t, err, addr)
+	}
+}
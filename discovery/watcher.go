@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const DefaultWatchInterval = 2 * time.Second
+
+// nodeWatcher implements Watch for services that can only be polled. It
+// compares the nodes returned by getNodes every interval with the previous
+// ones and sends the differences to every subscriber.
+type nodeWatcher struct {
+	interval time.Duration
+	getNodes func() ([]Node, error)
+	logger   *zap.Logger
+
+	mu      sync.Mutex
+	subs    []chan Event
+	prev    map[string]Node
+	started bool
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newNodeWatcher(interval time.Duration, getNodes func() ([]Node, error), logger *zap.Logger) *nodeWatcher {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	return &nodeWatcher{
+		interval: interval,
+		getNodes: getNodes,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+}
+
+func (w *nodeWatcher) watch() <-chan Event {
+	ch := make(chan Event, 64)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		close(ch)
+		return ch
+	}
+
+	w.subs = append(w.subs, ch)
+
+	if !w.started {
+		w.started = true
+		w.prev = w.poll()
+		w.wg.Add(1)
+		go w.loop()
+	}
+
+	return ch
+}
+
+func (w *nodeWatcher) loop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// check polls the nodes and notifies the subscribers of the changes.
+func (w *nodeWatcher) check() {
+	next := w.poll()
+	if next == nil {
+		return
+	}
+
+	w.mu.Lock()
+	events := diffNodes(w.prev, next)
+	w.prev = next
+	subs := append([]chan Event(nil), w.subs...)
+	w.mu.Unlock()
+
+	for _, event := range events {
+		for _, ch := range subs {
+			select {
+			case ch <- event:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// poll returns the current nodes keyed by address, or nil when they could
+// not be retrieved.
+func (w *nodeWatcher) poll() map[string]Node {
+	nodes, err := w.getNodes()
+	if err != nil {
+		w.logger.Error("could not poll discovery nodes", zap.Error(err))
+		return nil
+	}
+
+	byAddr := make(map[string]Node, len(nodes))
+	for _, node := range nodes {
+		byAddr[node.Address] = node
+	}
+
+	return byAddr
+}
+
+func (w *nodeWatcher) close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+
+	w.wg.Wait()
+
+	for _, ch := range w.subs {
+		close(ch)
+	}
+}
@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNodeWatcher(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		nodes = []Node{{Address: "a"}, {Address: "b"}}
+		err   error
+	)
+	setNodes := func(n []Node, e error) {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes, err = n, e
+	}
+
+	w := newNodeWatcher(5*time.Millisecond, func() ([]Node, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return nodes, err
+	}, zap.NewNop())
+
+	events := w.watch()
+
+	// Failed polls do not report every node as gone.
+	setNodes(nil, errors.New("unreachable"))
+	time.Sleep(20 * time.Millisecond)
+	setNodes([]Node{{Address: "b"}, {Address: "c"}}, nil)
+
+	received := map[Event]bool{}
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			received[event] = true
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for events")
+		}
+	}
+
+	assert.Equal(t, map[Event]bool{
+		{Type: NodeJoined, Node: Node{Address: "c"}}: true,
+		{Type: NodeLeft, Node: Node{Address: "a"}}:   true,
+	}, received)
+
+	w.close()
+
+	_, ok := <-events
+	require.False(t, ok)
+
+	_, ok = <-w.watch()
+	assert.False(t, ok)
+}
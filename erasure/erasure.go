@@ -0,0 +1,228 @@
+// Package erasure implements a systematic Reed-Solomon code over GF(2^8):
+// data shards are kept as they are and parity shards are added, any data
+// shards number of shards being enough to get the data back.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the largest number of shards, data and parity, a Coder
+// handles.
+const MaxShards = 256
+
+var (
+	ErrInvalidShards = errors.New("invalid number of shards")
+	ErrTooFewShards  = errors.New("too few shards to reconstruct the data")
+	ErrShardSize     = errors.New("shards differ in size")
+)
+
+type CoderOpts struct {
+	DataShards   int
+	ParityShards int
+}
+
+// Coder encodes and reconstructs the shards of DataShards data shards and
+// ParityShards parity shards. Its parity rows form a Cauchy matrix, so any
+// DataShards rows of the encoding matrix can be inverted.
+type Coder struct {
+	CoderOpts
+	// matrix has a row per shard, the identity for the data shards.
+	matrix [][]byte
+}
+
+func NewCoder(opts CoderOpts) (*Coder, error) {
+	if opts.DataShards <= 0 || opts.ParityShards < 0 || opts.DataShards+opts.ParityShards > MaxShards {
+		return nil, fmt.Errorf("%w: %d data and %d parity", ErrInvalidShards, opts.DataShards, opts.ParityShards)
+	}
+
+	k := opts.DataShards
+	matrix := make([][]byte, k+opts.ParityShards)
+	for i := range matrix {
+		matrix[i] = make([]byte, k)
+		if i < k {
+			matrix[i][i] = 1
+			continue
+		}
+		for j := range matrix[i] {
+			// i and j never meet, i^j is never zero.
+			matrix[i][j] = gfInv(byte(i) ^ byte(j))
+		}
+	}
+
+	return &Coder{CoderOpts: opts, matrix: matrix}, nil
+}
+
+// Shards returns the total number of shards.
+func (c *Coder) Shards() int {
+	return c.DataShards + c.ParityShards
+}
+
+// Encode computes the parity shards of the data shards, the first
+// DataShards of shards, all of the same size. Parity shards are allocated
+// when they are nil.
+func (c *Coder) Encode(shards [][]byte) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("%w: got %d, expected %d", ErrInvalidShards, len(shards), c.Shards())
+	}
+
+	size := len(shards[0])
+	for _, shard := range shards[:c.DataShards] {
+		if len(shard) != size {
+			return ErrShardSize
+		}
+	}
+
+	for i := c.DataShards; i < c.Shards(); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+		}
+		if len(shards[i]) != size {
+			return ErrShardSize
+		}
+		c.encodeRow(c.matrix[i], shards[:c.DataShards], shards[i])
+	}
+
+	return nil
+}
+
+// Reconstruct fills in the missing shards, the nil ones, from the others.
+// At least DataShards of them must be present.
+func (c *Coder) Reconstruct(shards [][]byte) error {
+	return c.reconstruct(shards, false)
+}
+
+// ReconstructData is Reconstruct leaving out the missing parity shards.
+func (c *Coder) ReconstructData(shards [][]byte) error {
+	return c.reconstruct(shards, true)
+}
+
+func (c *Coder) reconstruct(shards [][]byte, dataOnly bool) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("%w: got %d, expected %d", ErrInvalidShards, len(shards), c.Shards())
+	}
+
+	// The data is decoded from the first DataShards shards present.
+	size := -1
+	var present []int
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return ErrShardSize
+		}
+		size = len(shard)
+		if len(present) < c.DataShards {
+			present = append(present, i)
+		}
+	}
+	if len(present) < c.DataShards {
+		return fmt.Errorf("%w: %d present, %d needed", ErrTooFewShards, len(present), c.DataShards)
+	}
+
+	missingData := false
+	for _, shard := range shards[:c.DataShards] {
+		if shard == nil {
+			missingData = true
+			break
+		}
+	}
+
+	if missingData {
+		sub := make([][]byte, c.DataShards)
+		inputs := make([][]byte, c.DataShards)
+		for i, idx := range present {
+			sub[i] = c.matrix[idx]
+			inputs[i] = shards[idx]
+		}
+
+		decode, err := invert(sub)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < c.DataShards; i++ {
+			if shards[i] != nil {
+				continue
+			}
+			shards[i] = make([]byte, size)
+			c.encodeRow(decode[i], inputs, shards[i])
+		}
+	}
+
+	if dataOnly {
+		return nil
+	}
+
+	for i := c.DataShards; i < c.Shards(); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			c.encodeRow(c.matrix[i], shards[:c.DataShards], shards[i])
+		}
+	}
+
+	return nil
+}
+
+// encodeRow sets out to the sum of the inputs multiplied by the
+// coefficients of row.
+func (c *Coder) encodeRow(row []byte, inputs [][]byte, out []byte) {
+	clear(out)
+	for j, in := range inputs {
+		coef := row[j]
+		if coef == 0 {
+			continue
+		}
+		mt := &mulTable[coef]
+		for b, v := range in {
+			out[b] ^= mt[v]
+		}
+	}
+}
+
+// invert returns the inverse of the square matrix m, by Gauss-Jordan
+// elimination.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i := range work {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		inv := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul(work[col][j], inv)
+		}
+
+		for i := 0; i < n; i++ {
+			if i == col || work[i][col] == 0 {
+				continue
+			}
+			factor := work[i][col]
+			for j := range work[i] {
+				work[i][j] ^= gfMul(factor, work[col][j])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = work[i][n:]
+	}
+
+	return inverse, nil
+}
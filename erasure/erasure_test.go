@@ -0,0 +1,98 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGalois(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		assert.Equal(t, byte(1), gfMul(byte(a), gfInv(byte(a))), a)
+	}
+	assert.Equal(t, byte(0), gfMul(0, 7))
+	// x * x^7 wraps around the polynomial.
+	assert.Equal(t, byte(0x1d), gfMul(2, 0x80))
+}
+
+func TestNewCoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    CoderOpts
+		wantErr bool
+	}{
+		{name: "data and parity", opts: CoderOpts{DataShards: 4, ParityShards: 2}},
+		{name: "no parity", opts: CoderOpts{DataShards: 3}},
+		{name: "largest", opts: CoderOpts{DataShards: 200, ParityShards: 56}},
+		{name: "no data", opts: CoderOpts{ParityShards: 2}, wantErr: true},
+		{name: "negative parity", opts: CoderOpts{DataShards: 2, ParityShards: -1}, wantErr: true},
+		{name: "too many", opts: CoderOpts{DataShards: 200, ParityShards: 57}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCoder(tt.opts)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidShards)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func newShards(t *testing.T, c *Coder, size int) [][]byte {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(1))
+	shards := make([][]byte, c.Shards())
+	for i := 0; i < c.DataShards; i++ {
+		shards[i] = make([]byte, size)
+		rnd.Read(shards[i])
+	}
+	require.NoError(t, c.Encode(shards))
+
+	return shards
+}
+
+func TestCoder_Reconstruct(t *testing.T) {
+	c, err := NewCoder(CoderOpts{DataShards: 4, ParityShards: 2})
+	require.NoError(t, err)
+	shards := newShards(t, c, 1000)
+
+	// Any two shards can be lost.
+	for i := 0; i < c.Shards(); i++ {
+		for j := i; j < c.Shards(); j++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[i], damaged[j] = nil, nil
+
+			require.NoError(t, c.Reconstruct(damaged))
+			for n := range shards {
+				assert.True(t, bytes.Equal(shards[n], damaged[n]), "lost %d and %d, shard %d", i, j, n)
+			}
+		}
+	}
+
+	damaged := make([][]byte, len(shards))
+	copy(damaged, shards)
+	damaged[0], damaged[5] = nil, nil
+	require.NoError(t, c.ReconstructData(damaged))
+	assert.Equal(t, shards[0], damaged[0])
+	assert.Nil(t, damaged[5])
+
+	damaged[1], damaged[2], damaged[4] = nil, nil, nil
+	assert.ErrorIs(t, c.Reconstruct(damaged), ErrTooFewShards)
+}
+
+func TestCoder_Errors(t *testing.T) {
+	c, err := NewCoder(CoderOpts{DataShards: 2, ParityShards: 1})
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, c.Encode(make([][]byte, 2)), ErrInvalidShards)
+	assert.ErrorIs(t, c.Encode([][]byte{make([]byte, 2), make([]byte, 3), nil}), ErrShardSize)
+	assert.ErrorIs(t, c.Reconstruct([][]byte{make([]byte, 2), make([]byte, 3), nil}), ErrShardSize)
+}
@@ -0,0 +1,41 @@
+package erasure
+
+// The arithmetic of GF(2^8), generated by 2 with the polynomial
+// x^8 + x^4 + x^3 + x^2 + 1.
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for a := range mulTable {
+		for b := range mulTable[a] {
+			mulTable[a][b] = gfMul(byte(a), byte(b))
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// gfInv returns the inverse of a, which must not be zero.
+func gfInv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
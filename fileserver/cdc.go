@@ -0,0 +1,108 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"math/bits"
+)
+
+// gear holds the random values the rolling hash of chunker adds for every
+// byte. The boundaries of the chunks, and so their keys, depend on it: it
+// must never change or the chunks stored would not be shared anymore.
+var gear = newGear(0x64667367)
+
+// newGear returns the gear table generated by splitmix64 from seed.
+func newGear(seed uint64) [256]uint64 {
+	var g [256]uint64
+	for i := range g {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		g[i] = z ^ (z >> 31)
+	}
+
+	return g
+}
+
+// chunker splits the content written to it in chunks cut where the content
+// itself says, as FastCDC does: a gear hash rolls over the content and a
+// chunk ends where its top bits are zero. An insertion only changes the
+// chunks around it, the ones after it are cut at the same places and so
+// share their keys with the chunks of the original content.
+type chunker struct {
+	min, avg, max int64
+	// Chunks shorter than avg are cut on more bits than the longer ones,
+	// bringing the sizes closer to avg.
+	maskS, maskL uint64
+
+	fp   uint64
+	size int64
+	h    hash.Hash
+
+	chunks []chunkInfo
+}
+
+// newChunker returns a chunker cutting chunks of about avg bytes, never
+// shorter than a quarter of it but for the last one, nor longer than eight
+// times it.
+func newChunker(avg int64) *chunker {
+	n := bits.Len64(uint64(avg)) - 1
+
+	return &chunker{
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 8,
+		maskS: topBits(n + 2),
+		maskL: topBits(n - 2),
+		h:     sha256.New(),
+	}
+}
+
+// topBits returns a mask of the n top bits of a uint64, with n between 1
+// and 63.
+func topBits(n int) uint64 {
+	n = min(max(n, 1), 63)
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	start := 0
+	for i, b := range p {
+		c.fp = c.fp<<1 + gear[b]
+		c.size++
+		if c.size < c.min {
+			continue
+		}
+
+		mask := c.maskL
+		if c.size < c.avg {
+			mask = c.maskS
+		}
+		if c.size >= c.max || c.fp&mask == 0 {
+			c.h.Write(p[start : i+1])
+			start = i + 1
+			c.cut()
+		}
+	}
+	c.h.Write(p[start:])
+
+	return len(p), nil
+}
+
+func (c *chunker) cut() {
+	c.chunks = append(c.chunks, chunkInfo{Size: c.size, Checksum: hex.EncodeToString(c.h.Sum(nil))})
+	c.h.Reset()
+	c.fp = 0
+	c.size = 0
+}
+
+// Chunks returns the chunks of the content written, in order.
+func (c *chunker) Chunks() []chunkInfo {
+	if c.size > 0 {
+		c.cut()
+	}
+
+	return c.chunks
+}
@@ -0,0 +1,78 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func split(t *testing.T, avg int64, content []byte, writeSize int) []chunkInfo {
+	t.Helper()
+
+	c := newChunker(avg)
+	for len(content) > 0 {
+		n := min(writeSize, len(content))
+		_, err := c.Write(content[:n])
+		require.NoError(t, err)
+		content = content[n:]
+	}
+
+	return c.Chunks()
+}
+
+func TestChunker(t *testing.T) {
+	content := randomContent(4, 200000)
+	chunks := split(t, 1000, content, len(content))
+
+	// Chunks cover the content, within the size bounds but for the last
+	// one, and their checksums match it.
+	var off int64
+	for i, c := range chunks {
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, c.Size, int64(250))
+		}
+		assert.LessOrEqual(t, c.Size, int64(8000))
+
+		sum := sha256.Sum256(content[off : off+c.Size])
+		assert.Equal(t, hex.EncodeToString(sum[:]), c.Checksum)
+		off += c.Size
+	}
+	assert.Equal(t, int64(len(content)), off)
+	assert.InDelta(t, 1000, len(content)/len(chunks), 500)
+
+	// Boundaries do not depend on how the content is written.
+	assert.Equal(t, chunks, split(t, 1000, content, 7))
+
+	// Content repeating itself is cut at the maximum size.
+	assert.Len(t, split(t, 1000, make([]byte, 24000), 1024), 3)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    int
+	}{
+		{name: "empty", want: 0},
+		{name: "shorter than the minimum", content: content[:100], want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Len(t, split(t, 1000, tt.content, 10), tt.want)
+		})
+	}
+}
+
+func TestChunker_Insertion(t *testing.T) {
+	content := randomContent(5, 100000)
+	edited := append(append(bytes.Clone(content[:50000]), "a few more bytes"...), content[50000:]...)
+
+	keys := manifest{Chunks: split(t, 1000, content, len(content))}.keys()
+	editedKeys := manifest{Chunks: split(t, 1000, edited, len(edited))}.keys()
+
+	// Only the chunks around the insertion change.
+	assert.LessOrEqual(t, len(without(editedKeys, keys)), 3)
+	assert.LessOrEqual(t, len(without(keys, editedKeys)), 3)
+}
@@ -0,0 +1,724 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// DefaultChunkSize is the size of the chunks files are replicated in when
+// FileServerOpts does not set one.
+const DefaultChunkSize = 4 << 20
+
+// chunkNamespace is the server ID the chunks are stored for by every node,
+// so the files of all the nodes share them.
+const chunkNamespace = "chunks"
+
+// chunkPrefetch is the number of chunks of a file fetched ahead of the one
+// being read.
+const chunkPrefetch = 4
+
+// maxManifestSize bounds the size of the manifests read from the peers.
+const maxManifestSize = 64 << 20
+
+var errChunkMismatch = errors.New("chunk does not match the manifest")
+
+// manifest lists the chunks a file is replicated in, in order, or the
+// shards it is erasure coded in. It is replicated encrypted under the
+// hashed key of the file, in place of its content.
+type manifest struct {
+	Size      int64       `json:"size"`
+	ChunkSize int64       `json:"chunkSize,omitempty"`
+	Checksum  string      `json:"checksum"`
+	Chunks    []chunkInfo `json:"chunks,omitempty"`
+
+	// Data and Parity are the shards of an erasure coded file, every shard
+	// getting a piece of PieceSize bytes of every stripe in turn.
+	Data      int         `json:"data,omitempty"`
+	Parity    int         `json:"parity,omitempty"`
+	PieceSize int64       `json:"pieceSize,omitempty"`
+	Shards    []chunkInfo `json:"shards,omitempty"`
+}
+
+// chunkInfo describes a chunk, or a shard, of a file. Chunks are stored by
+// content in chunkNamespace, under a key derived from their checksum, see
+// chunkKey: the chunks of the files of every node sharing content are
+// stored once.
+type chunkInfo struct {
+	Size int64 `json:"size"`
+	// Checksum is the hex encoded SHA-256 of the plaintext of the chunk.
+	Checksum string `json:"checksum"`
+}
+
+// newManifest returns the manifest of the file described by meta, split in
+// chunks.
+func newManifest(meta storage.Metadata, chunks []chunkInfo) manifest {
+	return manifest{
+		Size:      meta.Size,
+		ChunkSize: meta.ChunkSize,
+		Checksum:  meta.Checksum,
+		Chunks:    chunks,
+	}
+}
+
+// keys returns the keys of the chunks of the manifest, each one once.
+func (m manifest) keys() []string {
+	seen := make(map[string]bool, len(m.Chunks))
+	var keys []string
+	for _, c := range m.Chunks {
+		key := chunkKey(c.Checksum)
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// chunkKey returns the key the chunk of the given checksum is stored under.
+// Chunks are encrypted with a key derived from their checksum as well, see
+// chunkDataKey, which their key does not reveal: only the nodes that had
+// the content of the chunk can read it.
+func chunkKey(checksum string) string {
+	sum := sha256.Sum256([]byte("dfsgo chunk key " + checksum))
+	return hex.EncodeToString(sum[:])
+}
+
+// chunkDataKey returns the key the chunk of the given checksum is encrypted
+// with. Every node storing the same content derives the same key.
+func chunkDataKey(checksum string) []byte {
+	sum := sha256.Sum256([]byte("dfsgo chunk data key " + checksum))
+	return sum[:]
+}
+
+// chunkRef returns the reference a chunk records for the file of server ID
+// id replicated under hashedKey, see storage.Metadata.Refs.
+func chunkRef(id, hashedKey string) string {
+	return id + "/" + hashedKey
+}
+
+// parseChunkRef splits a reference returned by chunkRef.
+func parseChunkRef(ref string) (id, hashedKey string, ok bool) {
+	return strings.Cut(ref, "/")
+}
+
+// shardKeys returns the keys of the shards of the manifest, none when the
+// file is not erasure coded.
+func (m manifest) shardKeys(hashedKey string) []string {
+	return shardKeys(hashedKey, storage.Metadata{
+		Checksum:     m.Checksum,
+		DataShards:   m.Data,
+		ParityShards: m.Parity,
+	})
+}
+
+// isChunked reports whether the file described by meta is replicated in
+// chunks.
+func isChunked(meta storage.Metadata) bool {
+	return meta.ChunkSize > 0 && meta.Size > meta.ChunkSize
+}
+
+// without returns the keys not in exclude.
+func without(keys, exclude []string) []string {
+	excluded := make(map[string]bool, len(exclude))
+	for _, key := range exclude {
+		excluded[key] = true
+	}
+
+	var rest []string
+	for _, key := range keys {
+		if !excluded[key] {
+			rest = append(rest, key)
+		}
+	}
+
+	return rest
+}
+
+// readManifest decrypts and decodes the manifest envelope of size bytes
+// read from r.
+func (s *FileServer) readManifest(r io.Reader, size int64) (manifest, error) {
+	var m manifest
+	if size > maxManifestSize {
+		return m, fmt.Errorf("manifest of %d bytes is too large", size)
+	}
+
+	var buf bytes.Buffer
+	if _, err := fscrypto.DecryptEnvelope(s.Keyring, io.LimitReader(r, size), &buf); err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+// localChunks returns the keys of the chunks the local copy of the file
+// stored under key in the namespace id was replicated in, splitting it
+// again as it was then. It returns none when there is no local copy or it
+// was replicated whole.
+func (s *FileServer) localChunks(id, key string) ([]string, error) {
+	meta, err := s.Storage.Metadata(id, key)
+	if errors.Is(err, storage.ErrNoMetadata) || !isChunked(meta) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.localManifest(id, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.keys(), nil
+}
+
+// storeChunked replicates the chunks of the local file stored under key in
+// the namespace id listed by m, and then m. prev are the chunks of the
+// content the file replaces, still referenced by its manifest.
+func (s *FileServer) storeChunked(ctx context.Context, id, key, hashedKey, contentType string, m manifest, prev []string) error {
+	if err := s.storeChunks(ctx, id, key, hashedKey, m); err != nil {
+		// No manifest lists the chunks only the new content has.
+		s.releaseChunks(id, hashedKey, without(m.keys(), prev))
+		return err
+	}
+
+	return s.storeManifest(ctx, id, hashedKey, contentType, m)
+}
+
+// storeManifest replicates m to the owners of hashedKey.
+func (s *FileServer) storeManifest(ctx context.Context, id, hashedKey, contentType string, m manifest) error {
+	msg, open, err := s.manifestReplica(id, hashedKey, contentType, m)
+	if err != nil {
+		return err
+	}
+
+	return s.storeReplicas(ctx, msg, open)
+}
+
+// manifestReplica returns the message replicating m under hashedKey in the
+// namespace id and the function opening its content.
+func (s *FileServer) manifestReplica(id, hashedKey, contentType string, m manifest) (MessageStoreFile, func() (io.ReadCloser, error), error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return MessageStoreFile{}, nil, err
+	}
+
+	msg := MessageStoreFile{
+		ID:           id,
+		Key:          hashedKey,
+		Size:         fscrypto.EnvelopeSize(int64(len(b))),
+		ContentType:  contentType,
+		Manifest:     true,
+		FileSize:     m.Size,
+		FileChecksum: m.Checksum,
+	}
+
+	return msg, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}, nil
+}
+
+// localManifest returns the manifest of the local file of the namespace id
+// described by meta, splitting it in chunks or encoding it in shards again
+// as it was when stored, unless the node only keeps the manifest. Reading
+// the file through checks it still matches its checksum.
+func (s *FileServer) localManifest(id string, meta storage.Metadata) (manifest, error) {
+	if meta.Manifest {
+		var m manifest
+		_, r, err := s.Storage.Read(id, meta.Key)
+		if err != nil {
+			return m, err
+		}
+		defer r.Close()
+
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return m, err
+		}
+		return m, json.Unmarshal(b, &m)
+	}
+	if meta.DataShards > 0 {
+		layout := newShardLayout(ErasureCode{Data: meta.DataShards, Parity: meta.ParityShards}, meta.Size)
+		sums, err := s.shardSums(id, meta.Key, layout)
+		if err != nil {
+			return manifest{}, err
+		}
+
+		return manifest{
+			Size:      meta.Size,
+			Checksum:  meta.Checksum,
+			Data:      meta.DataShards,
+			Parity:    meta.ParityShards,
+			PieceSize: layout.pieceSize,
+			Shards:    sums,
+		}, nil
+	}
+
+	_, r, err := s.Storage.Read(id, meta.Key)
+	if err != nil {
+		return manifest{}, err
+	}
+	defer r.Close()
+
+	chunks := newChunker(meta.ChunkSize)
+	if _, err := io.Copy(chunks, r); err != nil {
+		return manifest{}, err
+	}
+
+	return newManifest(meta, chunks.Chunks()), nil
+}
+
+// storeChunks replicates the chunks listed by m to the owners of their
+// keys, each one until the write consistency level is satisfied. Owners
+// already holding a chunk, whichever node stored it, only record the file
+// among its references, it is sent to the others.
+func (s *FileServer) storeChunks(ctx context.Context, id, key, hashedKey string, m manifest) error {
+	// Chunks are read from the first place they appear in the file.
+	offsets := make(map[string]int64, len(m.Chunks))
+	var off int64
+	for _, c := range m.Chunks {
+		if _, ok := offsets[chunkKey(c.Checksum)]; !ok {
+			offsets[chunkKey(c.Checksum)] = off
+		}
+		off += c.Size
+	}
+
+	owners := make(map[string][]transport.Peer, len(offsets))
+	byPeer := make(map[string][]string)
+	peers := make(map[string]transport.Peer)
+	for _, chunk := range m.keys() {
+		owners[chunk] = s.ownerPeers(chunk)
+		for _, peer := range owners[chunk] {
+			addr := peer.RemoteAddr().String()
+			peers[addr] = peer
+			byPeer[addr] = append(byPeer[addr], chunk)
+		}
+	}
+
+	missing := s.refChunks(ctx, id, hashedKey, peers, byPeer)
+
+	stored := make(map[string]bool, len(offsets))
+	for _, c := range m.Chunks {
+		chunk := chunkKey(c.Checksum)
+		if stored[chunk] {
+			continue
+		}
+		stored[chunk] = true
+
+		acked := 0
+		if s.isOwner(chunk) {
+			if err := s.keepChunk(id, key, hashedKey, offsets[chunk], c); err != nil {
+				s.Logger.Error("could not store chunk", zap.Error(err), zap.String("key", chunk))
+			} else {
+				acked++
+			}
+		}
+
+		var send []transport.Peer
+		for _, peer := range owners[chunk] {
+			// Peers that could not tell are sent the chunk.
+			lacks, ok := missing[peer.RemoteAddr().String()]
+			if ok && !lacks[chunk] {
+				acked++
+				continue
+			}
+			send = append(send, peer)
+		}
+
+		err := s.replicateTo(ctx, s.chunkReplica(id, hashedKey, c), send, acked, s.localChunk(id, key, offsets[chunk], c))
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Logger.Info("replicated chunks",
+		zap.String("key", key),
+		zap.Int("chunks", len(m.Chunks)),
+		zap.Int("unique", len(offsets)))
+
+	return nil
+}
+
+// keepChunk stores in the local storage the chunk c read at off in the
+// local file stored under key in the namespace id, or only records the file
+// replicated under hashedKey among its references when the node holds it
+// already.
+func (s *FileServer) keepChunk(id, key, hashedKey string, off int64, c chunkInfo) error {
+	ref := chunkRef(id, hashedKey)
+	held, err := s.Storage.AddRef(chunkNamespace, chunkKey(c.Checksum), ref)
+	if err != nil || held {
+		return err
+	}
+
+	r, err := s.localChunk(id, key, off, c)()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = s.Storage.WriteWithMetadata(chunkNamespace, storage.Metadata{
+		Key:  chunkKey(c.Checksum),
+		Size: fscrypto.EncryptedSize(c.Size),
+		Refs: []string{ref},
+	}, r)
+	return err
+}
+
+// chunkReplica returns the message replicating the chunk c of the file
+// replicated under hashedKey in the namespace id.
+func (s *FileServer) chunkReplica(id, hashedKey string, c chunkInfo) MessageStoreFile {
+	return MessageStoreFile{
+		ID:   chunkNamespace,
+		Key:  chunkKey(c.Checksum),
+		Size: fscrypto.EncryptedSize(c.Size),
+		Ref:  chunkRef(id, hashedKey),
+	}
+}
+
+// localChunk returns a function opening, encrypted with its data key, the
+// chunk c read at off in the local file stored under key in the namespace
+// id.
+func (s *FileServer) localChunk(id, key string, off int64, c chunkInfo) func() (io.ReadCloser, error) {
+	open := s.localContent(id, key, off, c.Size)
+
+	return func() (io.ReadCloser, error) {
+		r, err := open()
+		if err != nil {
+			return nil, err
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := fscrypto.EncryptContent(chunkDataKey(c.Checksum), r, pw)
+			r.Close()
+			pw.CloseWithError(err)
+		}()
+
+		return pr, nil
+	}
+}
+
+// refChunks asks every peer to record the file replicated under hashedKey
+// in the namespace id among the references of the chunks of byPeer it
+// holds. It returns the chunks every peer answering lacks.
+func (s *FileServer) refChunks(ctx context.Context, id, hashedKey string, peers map[string]transport.Peer, byPeer map[string][]string) map[string]map[string]bool {
+	type refReply struct {
+		addr    string
+		missing []string
+		err     error
+	}
+
+	results := make(chan refReply, len(byPeer))
+	for addr, keys := range byPeer {
+		go func(addr string, keys []string) {
+			msg := &Message{
+				Payload: MessageRefChunks{
+					ID:   chunkNamespace,
+					Ref:  chunkRef(id, hashedKey),
+					Keys: keys,
+				},
+			}
+
+			_, reply, err := s.request(ctx, peers[addr], msg)
+			if err != nil {
+				results <- refReply{addr: addr, err: err}
+				return
+			}
+
+			refs, ok := reply.Payload.(MessageChunkRefs)
+			switch {
+			case !ok:
+				err = fmt.Errorf("unexpected reply %T to chunk references", reply.Payload)
+			case refs.Err != "":
+				err = fmt.Errorf("peer %s failed to reference chunks: %s", addr, refs.Err)
+			}
+			results <- refReply{addr: addr, missing: refs.Missing, err: err}
+		}(addr, keys)
+	}
+
+	missing := make(map[string]map[string]bool, len(byPeer))
+	for range byPeer {
+		res := <-results
+		if res.err != nil {
+			s.Logger.Error("could not reference chunks", zap.Error(res.err), zap.String("remote_addr", res.addr))
+			continue
+		}
+
+		missing[res.addr] = make(map[string]bool, len(res.missing))
+		for _, key := range res.missing {
+			missing[res.addr][key] = true
+		}
+	}
+
+	return missing
+}
+
+// releaseChunks asks every peer, and the local storage, to drop the file
+// replicated under hashedKey in the namespace id from the references of the
+// chunks of keys it holds, deleting the chunks no file references anymore.
+func (s *FileServer) releaseChunks(id, hashedKey string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	s.releaseLocalChunks(id, hashedKey, keys)
+
+	msg := &Message{
+		Payload: MessageReleaseChunks{
+			ID:   chunkNamespace,
+			Ref:  chunkRef(id, hashedKey),
+			Keys: keys,
+		},
+	}
+
+	if err := s.broadcast(msg); err != nil {
+		s.Logger.Error("could not release chunks", zap.Error(err), zap.String("key", hashedKey))
+	}
+}
+
+// releaseLocalChunks drops the file replicated under hashedKey in the
+// namespace id from the references of the chunks of keys the node keeps as
+// an owner, see keepChunk.
+func (s *FileServer) releaseLocalChunks(id, hashedKey string, keys []string) {
+	for _, key := range keys {
+		if _, err := s.Storage.Release(chunkNamespace, key, chunkRef(id, hashedKey)); err != nil {
+			s.Logger.Error("could not release chunk", zap.Error(err), zap.String("key", key))
+		}
+	}
+}
+
+// fetchChunks returns the metadata of the file described by m and a reader
+// of its content, yielding its chunks in order while the next ones are
+// fetched, at most chunkPrefetch at a time. The local copy is written under
+// key in the namespace id in the background as the chunks come, the reader reaches its end
+// once it is stored and fails if it could not be. Closing the reader early
+// leaves the local copy to complete on its own.
+func (s *FileServer) fetchChunks(ctx context.Context, id, key, contentType string, m manifest) (storage.Metadata, io.ReadCloser) {
+	meta := storage.Metadata{
+		Key:         key,
+		Size:        m.Size,
+		Checksum:    m.Checksum,
+		ContentType: contentType,
+		ChunkSize:   m.ChunkSize,
+	}
+
+	// The fetch outlives the request that started it.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	chunks := s.prefetchChunks(ctx, m.Chunks)
+
+	local, localW := io.Pipe()
+	stored := make(chan error, 1)
+	go func() {
+		_, err := s.Storage.WriteWithMetadata(id, meta, local)
+		// Unblocks the writes of chunks left once the write stopped early.
+		local.CloseWithError(err)
+		stored <- err
+	}()
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer cancel()
+
+		reading, storing := true, true
+		for fetched := range chunks {
+			c := <-fetched
+			if c.err != nil {
+				localW.CloseWithError(c.err)
+				pw.CloseWithError(c.err)
+				return
+			}
+
+			if storing {
+				if _, err := localW.Write(c.b); err != nil {
+					storing = false
+				}
+			}
+			// The reader was closed, only the local copy is left to write.
+			if reading {
+				if _, err := pw.Write(c.b); err != nil {
+					reading = false
+				}
+			}
+			if !reading && !storing {
+				break
+			}
+		}
+
+		localW.Close()
+		err := <-stored
+		if err != nil {
+			s.Logger.Error("could not store chunks fetched", zap.Error(err), zap.String("key", key))
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return meta, pr
+}
+
+// fetchedChunk is the content of a chunk fetched by prefetchChunks.
+type fetchedChunk struct {
+	b   []byte
+	err error
+}
+
+// prefetchChunks fetches the chunks, at most chunkPrefetch at a time, and
+// returns the channels receiving their content in the order of chunks. A
+// chunk is only fetched once the one chunkPrefetch before it was received.
+// Cancelling ctx stops the fetch.
+func (s *FileServer) prefetchChunks(ctx context.Context, chunks []chunkInfo) <-chan chan fetchedChunk {
+	// The consumer waits on one chunk while the others are in the buffer.
+	order := make(chan chan fetchedChunk, chunkPrefetch-1)
+	go func() {
+		defer close(order)
+
+		for _, c := range chunks {
+			fetched := make(chan fetchedChunk, 1)
+			select {
+			case order <- fetched:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(c chunkInfo) {
+				chunkCtx, cancel := withDefaultTimeout(ctx)
+				defer cancel()
+
+				b, err := s.fetchChunk(chunkCtx, c)
+				fetched <- fetchedChunk{b: b, err: err}
+			}(c)
+		}
+	}()
+
+	return order
+}
+
+// fetchChunk reads the chunk from the local storage when the node holds
+// it, otherwise asks the owners of the chunk for it, then the rest of the
+// peers, one at a time until one of them sends it back intact.
+func (s *FileServer) fetchChunk(ctx context.Context, c chunkInfo) ([]byte, error) {
+	key := chunkKey(c.Checksum)
+	if s.Storage.HasFile(chunkNamespace, key) {
+		b, err := s.readLocalChunk(c)
+		if err == nil {
+			return b, nil
+		}
+		s.Logger.Error("could not read local chunk", zap.Error(err), zap.String("key", key))
+	}
+
+	msg := &Message{
+		Payload: MessageGetFile{
+			ID:  chunkNamespace,
+			Key: key,
+		},
+	}
+
+	owners := s.ownerPeers(key)
+	for _, peer := range append(owners, s.otherPeers(owners)...) {
+		b, err := s.readChunk(ctx, peer, msg, c)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			s.Logger.Error("could not get chunk", zap.Error(err), zap.String("key", key), zap.String("remote_addr", peer.RemoteAddr().String()))
+			continue
+		}
+
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("%w: no peer holds chunk %s", ErrFileNotFound, key)
+}
+
+func (s *FileServer) readChunk(ctx context.Context, peer transport.Peer, msg *Message, c chunkInfo) ([]byte, error) {
+	rpc, _, err := s.request(ctx, peer, msg)
+	if err != nil {
+		return nil, err
+	}
+	if !rpc.Stream {
+		return nil, ErrFileNotFound
+	}
+	defer rpc.Reader.Close()
+
+	return decryptChunk(rpc.Reader, c)
+}
+
+func (s *FileServer) readLocalChunk(c chunkInfo) ([]byte, error) {
+	_, r, err := s.Storage.Read(chunkNamespace, chunkKey(c.Checksum))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return decryptChunk(r, c)
+}
+
+// decryptChunk decrypts the chunk c read from r and checks it matches its
+// checksum.
+func decryptChunk(r io.Reader, c chunkInfo) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := fscrypto.DecryptContent(chunkDataKey(c.Checksum), io.LimitReader(r, fscrypto.EncryptedSize(c.Size)), &buf); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	if int64(buf.Len()) != c.Size || hex.EncodeToString(sum[:]) != c.Checksum {
+		return nil, errChunkMismatch
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fetchManifest asks the peers in turn for the manifest of the file
+// replicated under hashedKey in the namespace id. It reports false when
+// none of them holds the file replicated in chunks.
+func (s *FileServer) fetchManifest(ctx context.Context, id, hashedKey string, peers []transport.Peer) (manifest, bool) {
+	msg := &Message{
+		Payload: MessageGetFile{
+			ID:  id,
+			Key: hashedKey,
+		},
+	}
+
+	for _, peer := range peers {
+		rpc, reply, err := s.request(ctx, peer, msg)
+		if err != nil {
+			s.Logger.Error("could not get manifest", zap.Error(err), zap.String("remote_addr", peer.RemoteAddr().String()))
+			continue
+		}
+		if !rpc.Stream {
+			continue
+		}
+
+		stream, _ := reply.Payload.(MessageFileStream)
+		if !stream.Manifest {
+			rpc.Reader.Close()
+			return manifest{}, false
+		}
+
+		m, err := s.readManifest(rpc.Reader, stream.Size)
+		rpc.Reader.Close()
+		if err != nil {
+			s.Logger.Error("could not read manifest", zap.Error(err), zap.String("remote_addr", peer.RemoteAddr().String()))
+			continue
+		}
+
+		return m, true
+	}
+
+	return manifest{}, false
+}
@@ -0,0 +1,303 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer_StoreChunked(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	peers := []*FileServer{newTestServer(t, disc, 3), newTestServer(t, disc, 3), newTestServer(t, disc, 3)}
+	waitForPeers(t, 3, append(peers, s1)...)
+	s1.ChunkSize = 1000
+
+	ctx := WithConsistency(context.Background(), All)
+	content := randomContent(1, 10500)
+	require.NoError(t, s1.Store(ctx, "big.bin", bytes.NewReader(content)))
+
+	hashedKey := fscrypto.HashKey("big.bin")
+	chunks, err := s1.localChunks(s1.ID, "big.bin")
+	require.NoError(t, err)
+	require.Greater(t, len(chunks), 1)
+
+	// Every chunk is replicated to the owners of its own key only.
+	for _, key := range append(chunks, hashedKey) {
+		id := chunkNamespace
+		if key == hashedKey {
+			id = s1.ID
+		}
+
+		owners := map[string]bool{}
+		for _, node := range s1.ring.Owners(key, 3) {
+			owners[node.Address] = true
+		}
+		for _, srv := range peers {
+			assert.Equal(t, owners[srv.Transport.Addr()], srv.Storage.HasFile(id, key), key)
+		}
+	}
+
+	// Chunks are not keyring envelopes, their data key is derived from
+	// their content.
+	for _, srv := range peers {
+		if meta, err := srv.Storage.Metadata(chunkNamespace, chunks[0]); err == nil {
+			assert.False(t, meta.KeyHeader)
+			assert.Equal(t, []string{chunkRef(s1.ID, hashedKey)}, meta.Refs)
+		}
+	}
+
+	// The replica stored under the key of the file is its manifest.
+	for _, srv := range peers {
+		if meta, err := srv.Storage.Metadata(s1.ID, hashedKey); err == nil {
+			assert.True(t, meta.Manifest)
+		}
+	}
+
+	get := func() {
+		t.Helper()
+
+		r, err := s1.Get(context.Background(), "big.bin")
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.Equal(t, content, got)
+	}
+
+	// Without a local copy the file is reassembled from its chunks.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "big.bin"))
+	info, err := s1.Stat(ctx, "big.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	get()
+	meta, err := s1.Storage.Metadata(s1.ID, "big.bin")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), meta.ChunkSize)
+
+	// A chunk a peer fails to send intact is asked to another one.
+	for _, srv := range peers {
+		if srv.Storage.HasFile(chunkNamespace, chunks[1]) {
+			corruptFile(t, srv, chunkNamespace, chunks[1])
+			break
+		}
+	}
+	require.NoError(t, s1.Storage.Delete(s1.ID, "big.bin"))
+	get()
+
+	// Deleting the file deletes its chunks, even without a local copy.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "big.bin"))
+	require.NoError(t, s1.Delete(ctx, "big.bin"))
+	require.Eventually(t, func() bool {
+		for _, srv := range peers {
+			if srv.Storage.HasFile(s1.ID, hashedKey) {
+				return false
+			}
+			for _, key := range chunks {
+				if srv.Storage.HasFile(chunkNamespace, key) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServer_GetChunkedStream(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 2)
+	s2 := newTestServer(t, disc, 2)
+	waitForPeers(t, 1, s1, s2)
+	s1.ChunkSize = 1000
+
+	ctx := WithConsistency(context.Background(), All)
+	content := randomContent(2, 40500)
+	require.NoError(t, s1.Store(ctx, "big.bin", bytes.NewReader(content)))
+	require.NoError(t, s1.Storage.Delete(s1.ID, "big.bin"))
+
+	// The content is read before every chunk was fetched.
+	r, err := s1.Get(context.Background(), "big.bin")
+	require.NoError(t, err)
+	head := make([]byte, 10)
+	_, err = io.ReadFull(r, head)
+	require.NoError(t, err)
+	assert.Equal(t, content[:10], head)
+	assert.False(t, s1.Storage.HasFile(s1.ID, "big.bin"))
+
+	// The local copy is completed once the reader is closed.
+	require.NoError(t, r.Close())
+	require.Eventually(t, func() bool {
+		return s1.Verify("big.bin") == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The local copy is stored once the reader reaches its end.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "big.bin"))
+	r, err = s1.Get(context.Background(), "big.bin")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+	assert.NoError(t, s1.Verify("big.bin"))
+}
+
+func TestFileServer_StoreDeduplicated(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	peers := []*FileServer{newTestServer(t, disc, 3), newTestServer(t, disc, 3), newTestServer(t, disc, 3)}
+	waitForPeers(t, 3, append(peers, s1)...)
+	s1.ChunkSize = 1000
+
+	ctx := WithConsistency(context.Background(), All)
+	a := randomContent(2, 40000)
+	// b is a with a few bytes inserted in the middle.
+	b := append(append(bytes.Clone(a[:20000]), "inserted"...), a[20000:]...)
+	require.NoError(t, s1.Store(ctx, "a.img", bytes.NewReader(a)))
+	require.NoError(t, s1.Store(ctx, "b.img", bytes.NewReader(b)))
+
+	chunksA, err := s1.localChunks(s1.ID, "a.img")
+	require.NoError(t, err)
+	chunksB, err := s1.localChunks(s1.ID, "b.img")
+	require.NoError(t, err)
+
+	// Only the chunks around the insertion differ.
+	onlyA := without(chunksA, chunksB)
+	onlyB := without(chunksB, chunksA)
+	shared := without(chunksA, onlyA)
+	assert.LessOrEqual(t, len(onlyB), 3)
+	assert.GreaterOrEqual(t, len(shared), len(chunksA)-3)
+
+	refA, refB := chunkRef(s1.ID, fscrypto.HashKey("a.img")), chunkRef(s1.ID, fscrypto.HashKey("b.img"))
+	refs := func(key string) [][]string {
+		var refs [][]string
+		for _, srv := range peers {
+			if meta, err := srv.Storage.Metadata(chunkNamespace, key); err == nil {
+				refs = append(refs, meta.Refs)
+			}
+		}
+		return refs
+	}
+
+	// Shared chunks are stored once on every owner, referenced by both
+	// files.
+	for _, key := range shared {
+		assert.NotEmpty(t, refs(key))
+		for _, got := range refs(key) {
+			assert.ElementsMatch(t, []string{refA, refB}, got)
+		}
+	}
+
+	// Replacing a releases the chunks only its previous content had.
+	require.NoError(t, s1.Store(ctx, "a.img", bytes.NewReader(randomContent(3, 5000))))
+	chunksC, err := s1.localChunks(s1.ID, "a.img")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for _, key := range without(onlyA, chunksC) {
+			if len(refs(key)) > 0 {
+				return false
+			}
+		}
+		for _, key := range shared {
+			for _, got := range refs(key) {
+				if len(got) != 1 || got[0] != refB {
+					return false
+				}
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Deleting a keeps the chunks b still references.
+	require.NoError(t, s1.Delete(ctx, "a.img"))
+	require.NoError(t, s1.Storage.Delete(s1.ID, "b.img"))
+	r, err := s1.Get(context.Background(), "b.img")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, b, got)
+
+	require.NoError(t, s1.Delete(ctx, "b.img"))
+	require.Eventually(t, func() bool {
+		for _, srv := range peers {
+			for _, id := range []string{s1.ID, chunkNamespace} {
+				keys, _, err := srv.Storage.List(id, "", "", 0)
+				if err != nil || len(keys) > 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServer_StoreDeduplicatedAcrossNodes(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	s2 := newTestServer(t, disc, 3)
+	peers := []*FileServer{newTestServer(t, disc, 3), newTestServer(t, disc, 3)}
+	waitForPeers(t, 3, append(peers, s1, s2)...)
+	s1.ChunkSize = 1000
+	s2.ChunkSize = 1000
+
+	ctx := WithConsistency(context.Background(), All)
+	content := randomContent(4, 20000)
+	require.NoError(t, s1.Store(ctx, "image.img", bytes.NewReader(content)))
+	require.NoError(t, s2.Store(ctx, "copy.img", bytes.NewReader(content)))
+
+	chunks, err := s1.localChunks(s1.ID, "image.img")
+	require.NoError(t, err)
+	copyChunks, err := s2.localChunks(s2.ID, "copy.img")
+	require.NoError(t, err)
+	assert.Equal(t, chunks, copyChunks)
+
+	// The chunks stored through s1 are only referenced by s2.
+	refs := []string{chunkRef(s1.ID, fscrypto.HashKey("image.img")), chunkRef(s2.ID, fscrypto.HashKey("copy.img"))}
+	for _, key := range chunks {
+		for _, srv := range append(peers, s1, s2) {
+			if meta, err := srv.Storage.Metadata(chunkNamespace, key); err == nil {
+				assert.ElementsMatch(t, refs, meta.Refs, key)
+			}
+		}
+	}
+
+	// s1 can not release the references of s2.
+	peer, ok := s1.peerForNode(peers[0].Transport.Addr())
+	require.True(t, ok)
+	require.NoError(t, s1.send(peer, &Message{Payload: MessageReleaseChunks{ID: chunkNamespace, Ref: refs[1], Keys: chunks}}))
+	time.Sleep(100 * time.Millisecond)
+	for _, key := range chunks {
+		if meta, err := peers[0].Storage.Metadata(chunkNamespace, key); err == nil {
+			assert.ElementsMatch(t, refs, meta.Refs, key)
+		}
+	}
+
+	// s2 reads the chunks stored through s1.
+	require.NoError(t, s1.Delete(ctx, "image.img"))
+	require.NoError(t, s2.Storage.Delete(s2.ID, "copy.img"))
+	r, err := s2.Get(context.Background(), "copy.img")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+}
+
+// randomContent returns size pseudo-random bytes generated from seed.
+func randomContent(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
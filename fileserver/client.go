@@ -0,0 +1,278 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// FileInfo describes a file stored in the network. Size is -1 when it could
+// not be found out. The content type, checksum, creation time and owner come
+// from the metadata of the local copy, they are empty without one.
+type FileInfo struct {
+	Key  string
+	Size int64
+	// Local reports whether the node holds the file, Replicas how many of
+	// the peers owning the key hold a replica of it.
+	Local    bool
+	Replicas int
+
+	ContentType string
+	// Checksum is the hex encoded SHA-256 of the content.
+	Checksum  string
+	CreatedAt time.Time
+	Owner     string
+}
+
+// Stat returns the information of the file stored under key, asking the
+// owners of the key whether they hold a replica. It returns ErrFileNotFound
+// when no copy is found. The file is looked up in the namespace of ctx, see
+// WithNamespace.
+func (s *FileServer) Stat(ctx context.Context, key string) (FileInfo, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	id := s.namespace(ctx)
+	info := FileInfo{Key: key, Size: -1}
+
+	if s.Storage.HasFile(id, key) {
+		size, r, err := s.Storage.Read(id, key)
+		if err != nil {
+			return info, err
+		}
+		r.Close()
+
+		info.Local = true
+		info.Size = size
+
+		meta, err := s.Storage.Metadata(id, key)
+		if err != nil && !errors.Is(err, storage.ErrNoMetadata) {
+			return info, err
+		}
+		// The node keeps the manifest of its erasure coded files.
+		if meta.Manifest {
+			meta = fileMetadata(meta)
+			info.Size = meta.Size
+		}
+		info.ContentType = meta.ContentType
+		info.Checksum = meta.Checksum
+		info.CreatedAt = meta.CreatedAt
+		info.Owner = meta.Owner
+	}
+
+	hashedKey := fscrypto.HashKey(key)
+	msg := &Message{
+		Payload: MessageStatFile{
+			ID:  id,
+			Key: hashedKey,
+		},
+	}
+
+	owners := s.ownerPeers(hashedKey)
+	results := make(chan peerReply, len(owners))
+	for _, peer := range owners {
+		go func(peer transport.Peer) {
+			_, reply, err := s.request(ctx, peer, msg)
+			results <- peerReply{peer: peer, msg: reply, err: err}
+		}(peer)
+	}
+
+	chunked := false
+	for range owners {
+		res := <-results
+		if res.err != nil {
+			s.Logger.Error("could not stat file", zap.Error(res.err), zap.String("remote_addr", res.peer.RemoteAddr().String()))
+			continue
+		}
+
+		stat, ok := res.msg.Payload.(MessageFileStat)
+		if !ok || !stat.Exists {
+			continue
+		}
+
+		info.Replicas++
+		if stat.Manifest {
+			chunked = true
+			continue
+		}
+		// Replicas are encrypted, the size of their content is derived.
+		if info.Size < 0 {
+			if size, err := fscrypto.EnvelopeContentSize(stat.Size); err == nil {
+				info.Size = size
+			}
+		}
+	}
+
+	// The size of a file replicated in chunks is the one in its manifest.
+	if info.Size < 0 && chunked {
+		if m, ok := s.fetchManifest(ctx, id, hashedKey, owners); ok {
+			info.Size = m.Size
+		}
+	}
+
+	if !info.Local && info.Replicas == 0 {
+		return info, ErrFileNotFound
+	}
+
+	return info, nil
+}
+
+// clientContext returns the context client requests are served with.
+func clientContext(level ConsistencyLevel) context.Context {
+	ctx := context.Background()
+	if level != 0 {
+		ctx = WithConsistency(ctx, level)
+	}
+
+	return ctx
+}
+
+func (s *FileServer) handleMessageClientPut(rpc transport.RPC, msg MessageClientPut) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		rpc.Reader.Close()
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	err := s.Store(clientContext(msg.Consistency), msg.Key, rpc.Reader)
+	rpc.Reader.Close()
+
+	s.reply(peer, rpc, &Message{Payload: clientAck(msg.Key, err)})
+
+	return err
+}
+
+func (s *FileServer) handleMessageClientUploadPart(rpc transport.RPC, msg MessageClientUploadPart) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		rpc.Reader.Close()
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	part, err := s.UploadPart(context.Background(), msg.UploadID, msg.Number, msg.Size, rpc.Reader)
+	rpc.Reader.Close()
+
+	reply := clientParts(nil, err)
+	if err == nil {
+		reply.Parts = []storage.Part{part}
+	}
+	s.reply(peer, rpc, &Message{Payload: reply})
+
+	return err
+}
+
+func (s *FileServer) handleClientMessage(rpc transport.RPC, msg *Message) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	switch v := msg.Payload.(type) {
+	case MessageClientGet:
+		return s.handleMessageClientGet(peer, rpc, v)
+	case MessageClientDelete:
+		err := s.Delete(context.Background(), v.Key)
+		s.reply(peer, rpc, &Message{Payload: clientAck(v.Key, err)})
+		return err
+	case MessageClientStat:
+		info, err := s.Stat(context.Background(), v.Key)
+		reply := MessageClientFileInfo{Info: info}
+		if err != nil {
+			reply.Err = err.Error()
+			reply.NotFound = errors.Is(err, ErrFileNotFound)
+		}
+		s.reply(peer, rpc, &Message{Payload: reply})
+		return nil
+	case MessageClientList:
+		keys, next, err := s.List(context.Background(), v.Prefix, v.Cursor, v.Limit)
+		reply := MessageClientKeys{Keys: keys, Next: next}
+		if err != nil {
+			reply.Err = err.Error()
+		}
+		s.reply(peer, rpc, &Message{Payload: reply})
+		return err
+	case MessageClientCreateUpload:
+		ctx := context.Background()
+		if v.ContentType != "" {
+			ctx = WithContentType(ctx, v.ContentType)
+		}
+		u, err := s.CreateUpload(ctx, v.Key)
+		reply := MessageClientUpload{Upload: u}
+		if err != nil {
+			reply.Err = err.Error()
+		}
+		s.reply(peer, rpc, &Message{Payload: reply})
+		return err
+	case MessageClientListParts:
+		parts, err := s.UploadParts(context.Background(), v.UploadID)
+		s.reply(peer, rpc, &Message{Payload: clientParts(parts, err)})
+		return nil
+	case MessageClientCompleteUpload:
+		meta, err := s.CompleteUpload(clientContext(v.Consistency), v.UploadID)
+		s.reply(peer, rpc, &Message{Payload: clientAck(meta.Key, err)})
+		return err
+	case MessageClientAbortUpload:
+		err := s.AbortUpload(context.Background(), v.UploadID)
+		s.reply(peer, rpc, &Message{Payload: clientAck("", err)})
+		return nil
+	}
+
+	return fmt.Errorf("unexpected client message %T", msg.Payload)
+}
+
+func (s *FileServer) handleMessageClientGet(peer transport.Peer, rpc transport.RPC, msg MessageClientGet) error {
+	meta, r, err := s.get(clientContext(msg.Consistency), msg.Key)
+	if err != nil {
+		s.reply(peer, rpc, &Message{Payload: clientAck(msg.Key, err)})
+		if errors.Is(err, ErrFileNotFound) {
+			return nil
+		}
+		return err
+	}
+	defer r.Close()
+
+	payload, err := encodeMessage(&Message{
+		Payload: MessageFileStream{
+			ID:          s.ID,
+			Key:         msg.Key,
+			Size:        meta.Size,
+			ContentType: meta.ContentType,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return transport.ReplyStream(context.Background(), peer, rpc, payload, meta.Size, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func clientAck(key string, err error) MessageClientAck {
+	ack := MessageClientAck{Key: key}
+	if err != nil {
+		ack.Err = err.Error()
+		ack.NotFound = errors.Is(err, ErrFileNotFound)
+		ack.NoSuchUpload = errors.Is(err, storage.ErrNoSuchUpload)
+	}
+
+	return ack
+}
+
+func clientParts(parts []storage.Part, err error) MessageClientParts {
+	reply := MessageClientParts{Parts: parts}
+	if err != nil {
+		reply.Err = err.Error()
+		reply.NoSuchUpload = errors.Is(err, storage.ErrNoSuchUpload)
+	}
+
+	return reply
+}
@@ -0,0 +1,55 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer_Stat(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 2)
+	s2 := newTestServer(t, disc, 2)
+	waitForPeers(t, 1, s1, s2)
+
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("stat me "), 1024)
+
+	require.NoError(t, s1.Store(WithContentType(WithConsistency(ctx, All), "text/plain"), "my_file.txt", bytes.NewReader(content)))
+
+	info, err := s1.Stat(ctx, "my_file.txt")
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), info.CreatedAt, time.Minute)
+	sum := sha256.Sum256(content)
+	assert.Equal(t, FileInfo{
+		Key:         "my_file.txt",
+		Size:        int64(len(content)),
+		Local:       true,
+		Replicas:    1,
+		ContentType: "text/plain",
+		Checksum:    hex.EncodeToString(sum[:]),
+		CreatedAt:   info.CreatedAt,
+		Owner:       s1.ID,
+	}, info)
+
+	// Without the local copy the size is derived from the replica.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "my_file.txt"))
+	info, err = s1.Stat(ctx, "my_file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, FileInfo{Key: "my_file.txt", Size: int64(len(content)), Replicas: 1}, info)
+
+	require.NoError(t, s2.Storage.Delete(s1.ID, fscrypto.HashKey("my_file.txt")))
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err = s1.Stat(ctx, "my_file.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
@@ -0,0 +1,91 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConsistencyLevel is the number of replicas that must answer a read or a
+// write before it is considered successful.
+type ConsistencyLevel int
+
+const (
+	One ConsistencyLevel = iota + 1
+	Quorum
+	All
+)
+
+var ErrQuorumNotMet = errors.New("quorum not met")
+
+func (l ConsistencyLevel) String() string {
+	switch l {
+	case One:
+		return "ONE"
+	case Quorum:
+		return "QUORUM"
+	case All:
+		return "ALL"
+	}
+
+	return fmt.Sprintf("ConsistencyLevel(%d)", int(l))
+}
+
+// ParseConsistencyLevel returns the level named s, case insensitively.
+func ParseConsistencyLevel(s string) (ConsistencyLevel, error) {
+	for _, l := range []ConsistencyLevel{One, Quorum, All} {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown consistency level %q", s)
+}
+
+// Required returns how many of the replicas must answer to satisfy l.
+func (l ConsistencyLevel) Required(replicas int) int {
+	switch l {
+	case Quorum:
+		return replicas/2 + 1
+	case All:
+		return replicas
+	}
+
+	return 1
+}
+
+// QuorumError is returned when not enough replicas answered a request, or
+// agreed on the content of the file read, before its context was done.
+type QuorumError struct {
+	Op       string
+	Level    ConsistencyLevel
+	Required int
+	// Received is, for reads, the largest number of replicas agreeing on
+	// the content of the file.
+	Received int
+}
+
+func (e *QuorumError) Error() string {
+	return fmt.Sprintf("%s consistency %s not met: %d of %d required replicas answered", e.Op, e.Level, e.Received, e.Required)
+}
+
+func (e *QuorumError) Unwrap() error {
+	return ErrQuorumNotMet
+}
+
+type consistencyKey struct{}
+
+// WithConsistency returns a copy of ctx that makes the FileServer requests
+// using it wait for the given consistency level instead of the default one.
+func WithConsistency(ctx context.Context, level ConsistencyLevel) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, level)
+}
+
+func consistencyFromContext(ctx context.Context, fallback ConsistencyLevel) ConsistencyLevel {
+	if level, ok := ctx.Value(consistencyKey{}).(ConsistencyLevel); ok {
+		return level
+	}
+
+	return fallback
+}
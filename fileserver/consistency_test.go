@@ -0,0 +1,56 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistencyLevel_Required(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		level    ConsistencyLevel
+		replicas int
+		want     int
+	}{
+		{level: One, replicas: 3, want: 1},
+		{level: Quorum, replicas: 3, want: 2},
+		{level: Quorum, replicas: 4, want: 3},
+		{level: Quorum, replicas: 1, want: 1},
+		{level: All, replicas: 3, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.level.Required(tt.replicas))
+		})
+	}
+}
+
+func TestParseConsistencyLevel(t *testing.T) {
+	for _, level := range []ConsistencyLevel{One, Quorum, All} {
+		got, err := ParseConsistencyLevel(strings.ToLower(level.String()))
+		assert.NoError(t, err)
+		assert.Equal(t, level, got)
+	}
+
+	_, err := ParseConsistencyLevel("most")
+	assert.Error(t, err)
+}
+
+func TestWithConsistency(t *testing.T) {
+	ctx := context.Background()
+
+	assert.Equal(t, One, consistencyFromContext(ctx, One))
+	assert.Equal(t, All, consistencyFromContext(WithConsistency(ctx, All), One))
+}
+
+func TestQuorumError(t *testing.T) {
+	var err error = &QuorumError{Op: "write", Level: Quorum, Required: 2, Received: 1}
+
+	assert.True(t, errors.Is(err, ErrQuorumNotMet))
+	assert.Equal(t, "write consistency QUORUM not met: 1 of 2 required replicas answered", err.Error())
+}
@@ -0,0 +1,704 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/erasure"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// maxPieceSize bounds the size of the pieces of a file every shard gets in
+// turn, so a stripe of them fits in memory.
+const maxPieceSize = 64 << 10
+
+var ErrNotEnoughPeers = errors.New("not enough peers")
+
+// ErasureCode selects how the replicas of a file are stored. The zero value
+// replicates them whole, or in chunks, ReplicationFactor times. Otherwise
+// the file is split in Data shards to which Parity shards are added, each
+// one stored on a distinct peer: any Data of them give the file back.
+type ErasureCode struct {
+	Data   int
+	Parity int
+}
+
+func (c ErasureCode) Enabled() bool {
+	return c.Data > 0
+}
+
+func (c ErasureCode) shards() int {
+	return c.Data + c.Parity
+}
+
+func (c ErasureCode) String() string {
+	if !c.Enabled() {
+		return "none"
+	}
+
+	return fmt.Sprintf("%d+%d", c.Data, c.Parity)
+}
+
+// ParseErasureCode returns the code written as data+parity shards, like
+// "4+2". "none" and the empty string are the zero code.
+func ParseErasureCode(s string) (ErasureCode, error) {
+	if s == "" || strings.EqualFold(s, "none") {
+		return ErasureCode{}, nil
+	}
+
+	data, parity, ok := strings.Cut(s, "+")
+	if !ok {
+		return ErasureCode{}, fmt.Errorf("invalid erasure code %q, expected data+parity shards", s)
+	}
+
+	var code ErasureCode
+	var err error
+	if code.Data, err = strconv.Atoi(data); err != nil {
+		return ErasureCode{}, fmt.Errorf("invalid erasure code %q: %w", s, err)
+	}
+	if code.Parity, err = strconv.Atoi(parity); err != nil {
+		return ErasureCode{}, fmt.Errorf("invalid erasure code %q: %w", s, err)
+	}
+	if _, err := code.coder(); err != nil {
+		return ErasureCode{}, err
+	}
+
+	return code, nil
+}
+
+func (c ErasureCode) coder() (*erasure.Coder, error) {
+	return erasure.NewCoder(erasure.CoderOpts{DataShards: c.Data, ParityShards: c.Parity})
+}
+
+type erasureKey struct{}
+
+// WithErasure returns a copy of ctx that makes Store use code for the file
+// instead of the one of the server.
+func WithErasure(ctx context.Context, code ErasureCode) context.Context {
+	return context.WithValue(ctx, erasureKey{}, code)
+}
+
+func erasureFromContext(ctx context.Context, def ErasureCode) ErasureCode {
+	if code, ok := ctx.Value(erasureKey{}).(ErasureCode); ok {
+		return code
+	}
+
+	return def
+}
+
+// shardLayout describes how the content of a file of size bytes is split
+// in shards: every shard gets a piece of pieceSize bytes of every stripe
+// in turn, the last stripe padded with zeros.
+type shardLayout struct {
+	code      ErasureCode
+	size      int64
+	pieceSize int64
+}
+
+func newShardLayout(code ErasureCode, size int64) shardLayout {
+	piece := (size + int64(code.Data) - 1) / int64(code.Data)
+	return shardLayout{
+		code:      code,
+		size:      size,
+		pieceSize: min(max(piece, 1), maxPieceSize),
+	}
+}
+
+func (l shardLayout) stripes() int64 {
+	stripe := l.pieceSize * int64(l.code.Data)
+	return (l.size + stripe - 1) / stripe
+}
+
+// layout returns the layout of the shards of the erasure coded file m
+// describes.
+func (m manifest) layout() shardLayout {
+	return shardLayout{
+		code:      ErasureCode{Data: m.Data, Parity: m.Parity},
+		size:      m.Size,
+		pieceSize: m.PieceSize,
+	}
+}
+
+// shardSize returns the size of every shard.
+func (l shardLayout) shardSize() int64 {
+	return l.stripes() * l.pieceSize
+}
+
+// shardKey returns the key shard i of the file replicated under hashedKey
+// with the given checksum is stored under. The checksum keeps the shards
+// of two versions of the file apart.
+func shardKey(hashedKey, checksum string, i int) string {
+	return fmt.Sprintf("%s.%s.%d", hashedKey, checksum[:16], i)
+}
+
+// shardKeys returns the keys of the shards of the file described by meta,
+// none when it is not erasure coded.
+func shardKeys(hashedKey string, meta storage.Metadata) []string {
+	meta = fileMetadata(meta)
+	if meta.DataShards <= 0 || len(meta.Checksum) < 16 {
+		return nil
+	}
+
+	keys := make([]string, meta.DataShards+meta.ParityShards)
+	for i := range keys {
+		keys[i] = shardKey(hashedKey, meta.Checksum, i)
+	}
+
+	return keys
+}
+
+// stripeReader reads the content of a file a stripe at a time.
+type stripeReader struct {
+	r      io.Reader
+	layout shardLayout
+	coder  *erasure.Coder
+	shards [][]byte
+	read   int64
+}
+
+func newStripeReader(r io.Reader, layout shardLayout) (*stripeReader, error) {
+	coder, err := layout.code.coder()
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, coder.Shards())
+	for i := range shards {
+		shards[i] = make([]byte, layout.pieceSize)
+	}
+
+	return &stripeReader{r: r, layout: layout, coder: coder, shards: shards}, nil
+}
+
+// next reads the next stripe and encodes it, the pieces of every shard are
+// then in shards. It returns io.EOF once every stripe was read.
+func (s *stripeReader) next() error {
+	if s.read >= s.layout.stripes() {
+		return io.EOF
+	}
+	s.read++
+
+	for _, piece := range s.shards[:s.layout.code.Data] {
+		n, err := io.ReadFull(s.r, piece)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			clear(piece[n:])
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return s.coder.Encode(s.shards)
+}
+
+// shardReader streams shard i of the content read by a stripeReader.
+type shardReader struct {
+	stripes *stripeReader
+	i       int
+	buf     []byte
+	closer  io.Closer
+}
+
+func (r *shardReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if err := r.stripes.next(); err != nil {
+			return 0, err
+		}
+		r.buf = r.stripes.shards[r.i]
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *shardReader) Close() error {
+	return r.closer.Close()
+}
+
+// localShard returns a function opening shard i of the local file stored
+// under key in the namespace id.
+func (s *FileServer) localShard(id, key string, layout shardLayout, i int) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		_, r, err := s.Storage.Read(id, key)
+		if err != nil {
+			return nil, err
+		}
+
+		stripes, err := newStripeReader(r, layout)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+
+		return &shardReader{stripes: stripes, i: i, closer: r}, nil
+	}
+}
+
+// shardSums returns the size and the checksum of every shard of the local
+// file stored under key in the namespace id.
+func (s *FileServer) shardSums(id, key string, layout shardLayout) ([]chunkInfo, error) {
+	_, r, err := s.Storage.Read(id, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	stripes, err := newStripeReader(r, layout)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]hash.Hash, layout.code.shards())
+	for i := range hashes {
+		hashes[i] = sha256.New()
+	}
+
+	for {
+		err := stripes.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, piece := range stripes.shards {
+			hashes[i].Write(piece)
+		}
+	}
+
+	sums := make([]chunkInfo, len(hashes))
+	for i, h := range hashes {
+		sums[i] = chunkInfo{Size: layout.shardSize(), Checksum: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	return sums, nil
+}
+
+// ringPeers returns the connected peers in the order of the hash ring from
+// key. The local node is never part of the result.
+func (s *FileServer) ringPeers(key string) []transport.Peer {
+	var peers []transport.Peer
+	for _, node := range s.ring.Owners(key, len(s.ring.Nodes())) {
+		if node.Address == s.Transport.Addr() {
+			continue
+		}
+		if peer, ok := s.peerForNode(node.Address); ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// storeErasure encodes the local file stored under key in the namespace id,
+// described by meta, in shards stored on distinct peers, and then
+// replicates the manifest listing them, which replaces the local copy.
+// Every shard must be stored for the write to succeed.
+func (s *FileServer) storeErasure(ctx context.Context, id, key, hashedKey string, meta storage.Metadata, code ErasureCode) error {
+	layout := newShardLayout(code, meta.Size)
+	m, err := s.localManifest(id, meta)
+	if err != nil {
+		return err
+	}
+
+	peers := s.ringPeers(hashedKey)
+	if len(peers) < code.shards() {
+		return fmt.Errorf("%w: %s erasure code needs %d peers, %d connected", ErrNotEnoughPeers, code, code.shards(), len(peers))
+	}
+
+	results := make(chan error, code.shards())
+	for i, peer := range peers[:code.shards()] {
+		go func(i int, peer transport.Peer) {
+			msg := &Message{
+				Payload: MessageStoreFile{
+					ID:   id,
+					Key:  shardKey(hashedKey, meta.Checksum, i),
+					Size: fscrypto.EnvelopeSize(layout.shardSize()),
+				},
+			}
+			results <- s.replicate(ctx, peer, msg, s.localShard(id, key, layout, i))
+		}(i, peer)
+	}
+
+	stored := 0
+	for range peers[:code.shards()] {
+		if err := <-results; err != nil {
+			s.Logger.Error("could not store shard", zap.Error(err), zap.String("key", key))
+			continue
+		}
+		stored++
+	}
+	if stored < code.shards() {
+		return &QuorumError{Op: "write", Level: All, Required: code.shards(), Received: stored}
+	}
+
+	if err := s.storeManifest(ctx, id, hashedKey, meta.ContentType, m); err != nil {
+		return err
+	}
+
+	_, err = s.keepManifest(id, key, meta.ContentType, m)
+	return err
+}
+
+// keepManifest replaces the local copy of the erasure coded file stored
+// under key in the namespace id with its manifest m: the shards hold the
+// content, the node only keeps what it needs to read, rebuild and delete
+// them.
+func (s *FileServer) keepManifest(id, key, contentType string, m manifest) (storage.Metadata, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return storage.Metadata{}, err
+	}
+
+	return s.Storage.WriteWithMetadata(id, storage.Metadata{
+		Key:          key,
+		ContentType:  contentType,
+		Manifest:     true,
+		DataShards:   m.Data,
+		ParityShards: m.Parity,
+		FileSize:     m.Size,
+		FileChecksum: m.Checksum,
+	}, bytes.NewReader(b))
+}
+
+// fileMetadata returns the metadata of the file the local copy described
+// by meta stands for, which is the manifest of an erasure coded file, see
+// keepManifest.
+func fileMetadata(meta storage.Metadata) storage.Metadata {
+	if meta.Manifest {
+		meta.Size, meta.Checksum = meta.FileSize, meta.FileChecksum
+		meta.FileSize, meta.FileChecksum = 0, ""
+		meta.Manifest = false
+	}
+
+	return meta
+}
+
+// shardStripes reads the stripes of the file erasure coded in the shards
+// listed by m, stored for the server id, a piece of Data of its shards
+// from the peers at a time. A shard failing to be read is replaced by another one, read from the same
+// stripe on, as long as enough of them are left.
+type shardStripes struct {
+	s         *FileServer
+	ctx       context.Context
+	id        string
+	hashedKey string
+	m         manifest
+	layout    shardLayout
+	coder     *erasure.Coder
+	ring      []transport.Peer
+	// tried holds the shards opened, or left out, so far.
+	tried   map[int]bool
+	readers map[int]*stripeShard
+	pieces  [][]byte
+	// shards holds the pieces of every shard of the stripe last read.
+	shards [][]byte
+	read   int64
+}
+
+type stripeShard struct {
+	r    io.Reader
+	rc   io.ReadCloser
+	hash hash.Hash
+}
+
+// openStripes opens the first Data shards of m the peers can send, leaving
+// out the ones of skip.
+func (s *FileServer) openStripes(ctx context.Context, id, hashedKey string, m manifest, skip []int) (*shardStripes, error) {
+	layout := m.layout()
+	coder, err := layout.code.coder()
+	if err != nil {
+		return nil, err
+	}
+
+	st := &shardStripes{
+		s:         s,
+		ctx:       ctx,
+		id:        id,
+		hashedKey: hashedKey,
+		m:         m,
+		layout:    layout,
+		coder:     coder,
+		ring:      s.ringPeers(hashedKey),
+		tried:     make(map[int]bool),
+		readers:   make(map[int]*stripeShard, m.Data),
+		pieces:    make([][]byte, coder.Shards()),
+		shards:    make([][]byte, coder.Shards()),
+	}
+	for _, i := range skip {
+		st.tried[i] = true
+	}
+
+	for len(st.readers) < m.Data {
+		if err := st.open(); err != nil {
+			st.Close()
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// open opens the first shard not tried yet, skipping the pieces of it in
+// the stripes already read.
+func (st *shardStripes) open() error {
+	for i := range st.m.Shards {
+		if st.tried[i] {
+			continue
+		}
+		st.tried[i] = true
+
+		rc, err := st.s.openShard(st.ctx, st.id, shardKey(st.hashedKey, st.m.Checksum, i), shardPeers(st.ring, i), st.layout.shardSize())
+		if err != nil {
+			st.s.Logger.Error("could not get shard", zap.Error(err), zap.String("key", st.hashedKey), zap.Int("shard", i))
+			continue
+		}
+
+		h := sha256.New()
+		r := io.TeeReader(rc, h)
+		if _, err := io.CopyN(io.Discard, r, st.read*st.layout.pieceSize); err != nil {
+			st.s.Logger.Error("could not read shard", zap.Error(err), zap.String("key", st.hashedKey), zap.Int("shard", i))
+			rc.Close()
+			continue
+		}
+
+		st.readers[i] = &stripeShard{r: r, rc: rc, hash: h}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d of the %d shards needed are available", ErrFileNotFound, len(st.readers), st.m.Data)
+}
+
+// next reads the next stripe, the pieces of every shard are then in shards,
+// the ones of the parity shards not read only when parity is set. It
+// returns io.EOF once every stripe was read.
+func (st *shardStripes) next(parity bool) error {
+	if st.read >= st.layout.stripes() {
+		return io.EOF
+	}
+	clear(st.shards)
+
+	// Shards opened in place of the ones failing are read in turn.
+	for len(st.readers) > 0 {
+		failed := false
+		for i, sh := range st.readers {
+			if st.shards[i] != nil {
+				continue
+			}
+			if st.pieces[i] == nil {
+				st.pieces[i] = make([]byte, st.layout.pieceSize)
+			}
+
+			if _, err := io.ReadFull(sh.r, st.pieces[i]); err != nil {
+				st.s.Logger.Error("could not read shard", zap.Error(err), zap.String("key", st.hashedKey), zap.Int("shard", i))
+				sh.rc.Close()
+				delete(st.readers, i)
+				if err := st.open(); err != nil {
+					return err
+				}
+				failed = true
+				continue
+			}
+			st.shards[i] = st.pieces[i]
+		}
+		if !failed {
+			break
+		}
+	}
+	st.read++
+
+	if parity {
+		return st.coder.Reconstruct(st.shards)
+	}
+	return st.coder.ReconstructData(st.shards)
+}
+
+// check returns an error unless every shard read ends with the last stripe
+// and matches the checksum listed for it: a shard is only authenticated
+// whole.
+func (st *shardStripes) check() error {
+	for i, sh := range st.readers {
+		if n, err := io.ReadFull(sh.r, make([]byte, 1)); n > 0 || !errors.Is(err, io.EOF) {
+			return fmt.Errorf("shard %d: %w", i, errChunkMismatch)
+		}
+		if hex.EncodeToString(sh.hash.Sum(nil)) != st.m.Shards[i].Checksum {
+			return fmt.Errorf("shard %d: %w", i, errChunkMismatch)
+		}
+	}
+
+	return nil
+}
+
+func (st *shardStripes) Close() error {
+	for _, sh := range st.readers {
+		sh.rc.Close()
+	}
+
+	return nil
+}
+
+// decodeShards returns a reader of the file of the namespace id erasure
+// coded in the shards listed by m, decoded from the first shards the peers
+// can send as they are read. The reader fails at its end when the shards or
+// the file do not match their checksums.
+func (s *FileServer) decodeShards(ctx context.Context, id, hashedKey string, m manifest) (io.ReadCloser, error) {
+	// The fetch outlives the request that started it.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stripes, err := s.openStripes(ctx, id, hashedKey, m, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer cancel()
+		defer stripes.Close()
+
+		h := sha256.New()
+		w := io.MultiWriter(pw, h)
+		left := m.Size
+		for {
+			err := stripes.next(false)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			for _, piece := range stripes.shards[:m.Data] {
+				n := min(left, stripes.layout.pieceSize)
+				if _, err := w.Write(piece[:n]); err != nil {
+					return
+				}
+				left -= n
+			}
+		}
+
+		err := stripes.check()
+		if err == nil && hex.EncodeToString(h.Sum(nil)) != m.Checksum {
+			err = storage.ErrChecksumMismatch
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// rebuiltShard returns a function opening shard i of the file erasure
+// coded in the shards listed by m, stored for the server id, reconstructed from the other shards the
+// peers hold, leaving out the ones of missing. The shard fails at its end
+// when it does not match its checksum.
+func (s *FileServer) rebuiltShard(ctx context.Context, id, hashedKey string, m manifest, missing []int, i int) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		stripes, err := s.openStripes(ctx, id, hashedKey, m, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			defer stripes.Close()
+
+			h := sha256.New()
+			for {
+				err := stripes.next(true)
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+
+				h.Write(stripes.shards[i])
+				if _, err := pw.Write(stripes.shards[i]); err != nil {
+					return
+				}
+			}
+
+			err := stripes.check()
+			if err == nil && hex.EncodeToString(h.Sum(nil)) != m.Shards[i].Checksum {
+				err = fmt.Errorf("shard %d: %w", i, errChunkMismatch)
+			}
+			pw.CloseWithError(err)
+		}()
+
+		return pr, nil
+	}
+}
+
+// shardPeers returns the peers of ring starting with the one shard i was
+// stored on, the others in case it moved since.
+func shardPeers(ring []transport.Peer, i int) []transport.Peer {
+	if len(ring) == 0 {
+		return nil
+	}
+
+	i %= len(ring)
+	return append(slices.Clone(ring[i:]), ring[:i]...)
+}
+
+// openShard returns the decrypted content of the shard stored under key for
+// the server id, read from the local copy when the node holds one and
+// otherwise asked to peers in turn.
+func (s *FileServer) openShard(ctx context.Context, id, key string, peers []transport.Peer, size int64) (io.ReadCloser, error) {
+	if s.Storage.HasFile(id, key) {
+		_, r, err := s.Storage.Read(id, key)
+		if err == nil {
+			return s.decryptShard(r, size), nil
+		}
+		s.Logger.Error("could not read shard", zap.Error(err), zap.String("key", key))
+	}
+
+	msg := &Message{
+		Payload: MessageGetFile{
+			ID:  id,
+			Key: key,
+		},
+	}
+
+	for _, peer := range peers {
+		rpc, _, err := s.request(ctx, peer, msg)
+		if err != nil {
+			s.Logger.Error("could not get shard", zap.Error(err), zap.String("remote_addr", peer.RemoteAddr().String()))
+			continue
+		}
+		if !rpc.Stream {
+			continue
+		}
+
+		return s.decryptShard(rpc.Reader, size), nil
+	}
+
+	return nil, ErrFileNotFound
+}
+
+// decryptShard returns a reader of the shard of size bytes decrypted from
+// the envelope read from r, which it closes.
+func (s *FileServer) decryptShard(r io.ReadCloser, size int64) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := fscrypto.DecryptEnvelope(s.Keyring, io.LimitReader(r, fscrypto.EnvelopeSize(size)), pw)
+		r.Close()
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
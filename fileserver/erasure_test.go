@@ -0,0 +1,286 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErasureCode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ErasureCode
+		wantErr bool
+	}{
+		{in: "", want: ErasureCode{}},
+		{in: "none", want: ErasureCode{}},
+		{in: "4+2", want: ErasureCode{Data: 4, Parity: 2}},
+		{in: "3+0", want: ErasureCode{Data: 3}},
+		{in: "4", wantErr: true},
+		{in: "0+2", wantErr: true},
+		{in: "4+-1", wantErr: true},
+		{in: "200+100", wantErr: true},
+		{in: "a+b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseErasureCode(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// newErasureCluster starts a server and n peers.
+func newErasureCluster(t *testing.T, n int) (*FileServer, []*FileServer) {
+	t.Helper()
+
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+	s1 := newTestServer(t, disc, 3)
+	var peers []*FileServer
+	for i := 0; i < n; i++ {
+		peers = append(peers, newTestServer(t, disc, 3))
+	}
+	waitForPeers(t, n, append(peers, s1)...)
+
+	return s1, peers
+}
+
+// shardHoldersOf returns the peers holding every shard of keys, by shard.
+func shardHoldersOf(peers []*FileServer, id string, keys []string) [][]*FileServer {
+	holders := make([][]*FileServer, len(keys))
+	for i, key := range keys {
+		for _, srv := range peers {
+			if srv.Storage.HasFile(id, key) {
+				holders[i] = append(holders[i], srv)
+			}
+		}
+	}
+
+	return holders
+}
+
+func TestFileServer_StoreErasure(t *testing.T) {
+	s1, peers := newErasureCluster(t, 6)
+
+	ctx := WithErasure(context.Background(), ErasureCode{Data: 3, Parity: 2})
+	// Two stripes, the last one padded.
+	content := randomContent(4, 200000)
+	require.NoError(t, s1.Store(ctx, "video.mp4", bytes.NewReader(content)))
+
+	// The node keeps the manifest of the file rather than its content.
+	meta, err := s1.Storage.Metadata(s1.ID, "video.mp4")
+	require.NoError(t, err)
+	assert.True(t, meta.Manifest)
+	assert.Equal(t, int64(len(content)), meta.FileSize)
+	assert.Equal(t, 3, meta.DataShards)
+	assert.Equal(t, 2, meta.ParityShards)
+
+	hashedKey := fscrypto.HashKey("video.mp4")
+	keys := shardKeys(hashedKey, meta)
+	require.Len(t, keys, 5)
+
+	// Every shard is stored once, on a distinct peer.
+	distinct := map[string]bool{}
+	for i, holders := range shardHoldersOf(peers, s1.ID, keys) {
+		require.Len(t, holders, 1, "shard %d", i)
+		distinct[holders[0].Transport.Addr()] = true
+	}
+	assert.Len(t, distinct, 5)
+
+	get := func() {
+		t.Helper()
+
+		r, err := s1.Get(ctx, "video.mp4")
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.Equal(t, content, got)
+
+		meta, err := s1.Storage.Metadata(s1.ID, "video.mp4")
+		require.NoError(t, err)
+		assert.True(t, meta.Manifest)
+	}
+
+	// The file is decoded from its shards, which are not kept.
+	get()
+
+	// Any two shards can be lost, here a data shard and a corrupted one.
+	holders := shardHoldersOf(peers, s1.ID, keys)
+	require.NoError(t, holders[0][0].Storage.Delete(s1.ID, keys[0]))
+	corruptFile(t, holders[3][0], s1.ID, keys[3])
+	get()
+
+	// A code needing more peers than connected can not be stored.
+	err = s1.Store(WithErasure(ctx, ErasureCode{Data: 6, Parity: 2}), "video.mp4", bytes.NewReader(content))
+	assert.ErrorIs(t, err, ErrNotEnoughPeers)
+
+	// Replacing the file deletes the shards of its previous content.
+	content = randomContent(5, 1000)
+	require.NoError(t, s1.Store(ctx, "video.mp4", bytes.NewReader(content)))
+	meta, err = s1.Storage.Metadata(s1.ID, "video.mp4")
+	require.NoError(t, err)
+	newKeys := shardKeys(hashedKey, meta)
+	require.Eventually(t, func() bool {
+		for _, holders := range shardHoldersOf(peers, s1.ID, keys) {
+			if len(holders) > 0 {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+	get()
+
+	// Deleting the file deletes its shards, even without a local copy, once
+	// a peer holds the manifest listing them.
+	require.Eventually(t, func() bool {
+		for _, srv := range peers {
+			replica, err := srv.Storage.Metadata(s1.ID, hashedKey)
+			if err == nil && replica.FileChecksum == meta.FileChecksum {
+				return true
+			}
+		}
+		return false
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, s1.Storage.Delete(s1.ID, "video.mp4"))
+	require.NoError(t, s1.Delete(ctx, "video.mp4"))
+	require.Eventually(t, func() bool {
+		for _, holders := range shardHoldersOf(peers, s1.ID, append(newKeys, hashedKey)) {
+			if len(holders) > 0 {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServer_RebuildShards(t *testing.T) {
+	s1, peers := newErasureCluster(t, 6)
+	s1.Erasure = ErasureCode{Data: 3, Parity: 2}
+
+	ctx := context.Background()
+	content := randomContent(6, 50000)
+	require.NoError(t, s1.Store(ctx, "backup.tar", bytes.NewReader(content)))
+
+	meta, err := s1.Storage.Metadata(s1.ID, "backup.tar")
+	require.NoError(t, err)
+	keys := shardKeys(fscrypto.HashKey("backup.tar"), meta)
+
+	report, err := s1.RebuildShards(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, RebuildReport{Checked: 1}, report)
+
+	// The node holding the first shard leaves.
+	gone := shardHoldersOf(peers, s1.ID, keys)[0][0]
+	peer, ok := s1.peerForNode(gone.Transport.Addr())
+	require.True(t, ok)
+	peer.Close()
+	require.Eventually(t, func() bool {
+		return len(s1.ring.Nodes()) == 6
+	}, 2*time.Second, 10*time.Millisecond)
+
+	var left []*FileServer
+	for _, srv := range peers {
+		if srv != gone {
+			left = append(left, srv)
+		}
+	}
+
+	report, err = s1.RebuildShards(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, RebuildReport{Checked: 1, Rebuilt: 1}, report)
+
+	// The shard is reconstructed from the others, the node keeping none of
+	// the content, on the only peer holding no shard of the file.
+	distinct := map[string]bool{}
+	for i, holders := range shardHoldersOf(left, s1.ID, keys) {
+		require.Len(t, holders, 1, "shard %d", i)
+		distinct[holders[0].Transport.Addr()] = true
+	}
+	assert.Len(t, distinct, 5)
+
+	// The file is decoded from the shard rebuilt along with the others.
+	r, err := s1.Get(ctx, "backup.tar")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+}
+
+func TestFileServer_RebuildShardsOfGoneServer(t *testing.T) {
+	s1, peers := newErasureCluster(t, 6)
+	s1.Erasure = ErasureCode{Data: 3, Parity: 2}
+	// The peers share the keyring of s1 to read its manifests and shards.
+	for _, srv := range peers {
+		srv.Keyring = s1.Keyring
+	}
+
+	ctx := WithConsistency(context.Background(), All)
+	content := randomContent(7, 50000)
+	require.NoError(t, s1.Store(ctx, "backup.tar", bytes.NewReader(content)))
+
+	meta, err := s1.Storage.Metadata(s1.ID, "backup.tar")
+	require.NoError(t, err)
+	hashedKey := fscrypto.HashKey("backup.tar")
+	keys := shardKeys(hashedKey, meta)
+
+	// The origin of the file leaves along with a node holding a shard but
+	// not the manifest.
+	var gone *FileServer
+	for _, holders := range shardHoldersOf(peers, s1.ID, keys) {
+		if !holders[0].Storage.HasFile(s1.ID, hashedKey) {
+			gone = holders[0]
+			break
+		}
+	}
+	require.NotNil(t, gone)
+	for _, srv := range []*FileServer{s1, gone} {
+		for _, peer := range srv.peerStore.Values() {
+			peer.Close()
+		}
+	}
+
+	var left []*FileServer
+	for _, srv := range peers {
+		if srv != gone {
+			left = append(left, srv)
+		}
+	}
+	require.Eventually(t, func() bool {
+		for _, srv := range left {
+			if len(srv.ring.Nodes()) != len(left) {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// A single node holding the manifest of the file rebuilds the shard.
+	var total RebuildReport
+	for _, srv := range left {
+		report, err := srv.RebuildShards(ctx)
+		require.NoError(t, err)
+		total.Checked += report.Checked
+		total.Rebuilt += report.Rebuilt
+	}
+	assert.Equal(t, RebuildReport{Checked: 1, Rebuilt: 1}, total)
+
+	// Every shard is held again, once.
+	for i, holders := range shardHoldersOf(left, s1.ID, keys) {
+		assert.Len(t, holders, 1, "shard %d", i)
+	}
+}
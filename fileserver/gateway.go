@@ -0,0 +1,380 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gusga/dfsgo/storage"
+	"go.uber.org/zap"
+)
+
+// objectsPath is the path prefix of the objects served by the gateway, the
+// rest of the path is the key.
+const objectsPath = "/objects/"
+
+// ConsistencyHeader sets the consistency level of a gateway request.
+const ConsistencyHeader = "X-Dfsgo-Consistency"
+
+// ErasureHeader sets the erasure code of a PUT, see ParseErasureCode.
+const ErasureHeader = "X-Dfsgo-Erasure"
+
+type gatewayError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Key     string `json:"key,omitempty"`
+}
+
+// HTTPHandler returns the handler of the HTTP gateway, serving the files of
+// the network as objects:
+//
+//	PUT    /objects/{key} stores the body, which must carry a Content-Length
+//	GET    /objects/{key} returns the content, honoring Range requests
+//	HEAD   /objects/{key} returns the headers of GET
+//	DELETE /objects/{key} removes the file from the network
+//
+// Large files can be uploaded in parts, in any order and in parallel:
+//
+//	POST   /objects/{key}?uploads                     starts an upload session
+//	PUT    /objects/{key}?uploadId={id}&partNumber={n} stores a part
+//	GET    /objects/{key}?uploadId={id}               lists the parts received
+//	POST   /objects/{key}?uploadId={id}               stores the file
+//	DELETE /objects/{key}?uploadId={id}               aborts the session
+//
+// ETags are the SHA-256 of the content. The Content-Type of a PUT, or of
+// the POST starting a session, is recorded and returned by GET, its
+// X-Dfsgo-Erasure header erasure codes the file. Errors are returned as
+// JSON.
+func (s *FileServer) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(objectsPath, s.handleObject)
+
+	return mux
+}
+
+// startHTTP serves the gateway on HTTPAddr until the server is closed.
+func (s *FileServer) startHTTP() error {
+	s.httpServer = &http.Server{
+		Handler:           s.HTTPHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ln, err := net.Listen("tcp", s.HTTPAddr)
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Info("starting http gateway...", zap.String("http_addr", ln.Addr().String()))
+
+	go func() {
+		if err := s.httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Error("http gateway stopped", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (s *FileServer) handleObject(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, objectsPath)
+	if key == "" {
+		writeGatewayError(w, http.StatusBadRequest, "InvalidKey", "missing object key", "")
+		return
+	}
+
+	ctx := r.Context()
+	if v := r.Header.Get(ConsistencyHeader); v != "" {
+		level, err := ParseConsistencyLevel(v)
+		if err != nil {
+			writeGatewayError(w, http.StatusBadRequest, "InvalidConsistency", err.Error(), key)
+			return
+		}
+		ctx = WithConsistency(ctx, level)
+	}
+	if v := r.Header.Get(ErasureHeader); v != "" {
+		code, err := ParseErasureCode(v)
+		if err != nil {
+			writeGatewayError(w, http.StatusBadRequest, "InvalidErasureCode", err.Error(), key)
+			return
+		}
+		ctx = WithErasure(ctx, code)
+	}
+	r = r.WithContext(ctx)
+
+	query := r.URL.Query()
+	if _, ok := query["uploads"]; ok && r.Method == http.MethodPost {
+		s.handleCreateUpload(w, r, key)
+		return
+	}
+	if id := query.Get("uploadId"); id != "" {
+		s.handleUpload(w, r, key, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		s.handlePutObject(w, r, key)
+	case http.MethodGet, http.MethodHead:
+		s.handleGetObject(w, r, key)
+	case http.MethodDelete:
+		if err := s.Delete(ctx, key); err != nil {
+			s.writeError(w, err, key)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeGatewayError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("method %s is not allowed", r.Method), key)
+	}
+}
+
+func (s *FileServer) handlePutObject(w http.ResponseWriter, r *http.Request, key string) {
+	if r.ContentLength < 0 {
+		writeGatewayError(w, http.StatusLengthRequired, "MissingContentLength", "the request must carry a Content-Length", key)
+		return
+	}
+
+	ctx := r.Context()
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		ctx = WithContentType(ctx, contentType)
+	}
+
+	h := sha256.New()
+	if err := s.Store(ctx, key, io.TeeReader(r.Body, h)); err != nil {
+		s.writeError(w, err, key)
+		return
+	}
+
+	w.Header().Set("ETag", quoteETag(h.Sum(nil)))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *FileServer) handleCreateUpload(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := r.Context()
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		ctx = WithContentType(ctx, contentType)
+	}
+
+	u, err := s.CreateUpload(ctx, key)
+	if err != nil {
+		s.writeError(w, err, key)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+// handleUpload serves the requests about the upload session id, which must
+// be the one of key.
+func (s *FileServer) handleUpload(w http.ResponseWriter, r *http.Request, key, id string) {
+	u, err := s.Upload(r.Context(), id)
+	if err == nil && u.Key != key {
+		err = storage.ErrNoSuchUpload
+	}
+	if err != nil {
+		s.writeError(w, err, key)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil {
+			writeGatewayError(w, http.StatusBadRequest, "InvalidPart", "partNumber must be an integer", key)
+			return
+		}
+		if r.ContentLength < 0 {
+			writeGatewayError(w, http.StatusLengthRequired, "MissingContentLength", "the request must carry a Content-Length", key)
+			return
+		}
+
+		part, err := s.UploadPart(r.Context(), id, number, r.ContentLength, r.Body)
+		if err != nil {
+			s.writeError(w, err, key)
+			return
+		}
+		w.Header().Set("ETag", `"`+part.Checksum+`"`)
+		writeJSON(w, http.StatusOK, part)
+	case http.MethodGet:
+		parts, err := s.UploadParts(r.Context(), id)
+		if err != nil {
+			s.writeError(w, err, key)
+			return
+		}
+		writeJSON(w, http.StatusOK, uploadParts{Upload: u, Parts: parts})
+	case http.MethodPost:
+		meta, err := s.CompleteUpload(r.Context(), id)
+		if err != nil {
+			s.writeError(w, err, key)
+			return
+		}
+		w.Header().Set("ETag", `"`+meta.Checksum+`"`)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if err := s.AbortUpload(r.Context(), id); err != nil {
+			s.writeError(w, err, key)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		writeGatewayError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("method %s is not allowed", r.Method), key)
+	}
+}
+
+// uploadParts lists the parts of an upload session received so far.
+type uploadParts struct {
+	storage.Upload
+	Parts []storage.Part `json:"parts"`
+}
+
+func (s *FileServer) handleGetObject(w http.ResponseWriter, r *http.Request, key string) {
+	meta, rc, err := s.get(r.Context(), key)
+	if err != nil {
+		s.writeError(w, err, key)
+		return
+	}
+	defer rc.Close()
+
+	// Content fetched from the network is streamed as it comes.
+	content, ok := rc.(io.ReadSeeker)
+	if !ok {
+		content = NewForwardSeeker(rc, meta.Size)
+	}
+
+	if f, ok := rc.(*os.File); ok && meta.Checksum == "" {
+		// The file was stored before its metadata was recorded.
+		meta, err = legacyMetadata(key, f)
+		if err != nil {
+			s.writeError(w, err, key)
+			return
+		}
+	}
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("ETag", `"`+meta.Checksum+`"`)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	// ServeContent handles the Range and conditional requests. Corrupted
+	// content is cut short, it is never served whole.
+	http.ServeContent(w, r, "", meta.CreatedAt, content)
+}
+
+// NewForwardSeeker returns a ReadSeeker of r, a stream of size bytes which
+// can only be read forward, so http.ServeContent can serve a range of it
+// by skipping to its start.
+func NewForwardSeeker(r io.Reader, size int64) io.ReadSeeker {
+	return &forwardSeeker{r: r, size: size}
+}
+
+type forwardSeeker struct {
+	r    io.Reader
+	size int64
+	// off is the offset read up to, pos the one sought.
+	off int64
+	pos int64
+}
+
+func (f *forwardSeeker) Read(p []byte) (int, error) {
+	if f.pos < f.off {
+		return 0, errors.New("stream can not be read backwards")
+	}
+	if f.pos > f.off {
+		n, err := io.CopyN(io.Discard, f.r, f.pos-f.off)
+		f.off += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.r.Read(p)
+	f.off += int64(n)
+	f.pos = f.off
+
+	return n, err
+}
+
+func (f *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.pos = offset
+
+	return offset, nil
+}
+
+// legacyMetadata returns the metadata of the file stored under key without
+// one, hashing its content. f is left at its start.
+func legacyMetadata(key string, f *os.File) (storage.Metadata, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return storage.Metadata{}, err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return storage.Metadata{}, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return storage.Metadata{}, err
+	}
+
+	return storage.Metadata{
+		Key:       key,
+		Size:      fi.Size(),
+		Checksum:  hex.EncodeToString(h.Sum(nil)),
+		CreatedAt: fi.ModTime(),
+	}, nil
+}
+
+func (s *FileServer) writeError(w http.ResponseWriter, err error, key string) {
+	var quorumErr *QuorumError
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		writeGatewayError(w, http.StatusNotFound, "NotFound", err.Error(), key)
+	case errors.As(err, &quorumErr):
+		writeGatewayError(w, http.StatusServiceUnavailable, "QuorumNotMet", err.Error(), key)
+	case errors.Is(err, storage.ErrNoSuchUpload):
+		writeGatewayError(w, http.StatusNotFound, "NoSuchUpload", err.Error(), key)
+	case errors.Is(err, ErrMissingPart), errors.Is(err, storage.ErrInvalidPart):
+		writeGatewayError(w, http.StatusBadRequest, "InvalidPart", err.Error(), key)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		writeGatewayError(w, http.StatusBadRequest, "IncompleteBody", "the body is shorter than its Content-Length", key)
+	default:
+		s.Logger.Error("gateway request failed", zap.Error(err), zap.String("key", key))
+		writeGatewayError(w, http.StatusInternalServerError, "InternalError", err.Error(), key)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, code, msg, key string) {
+	writeJSON(w, status, gatewayError{Code: code, Message: msg, Key: key})
+}
+
+func quoteETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum) + `"`
+}
@@ -0,0 +1,258 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doRequest(t *testing.T, method, url string, body io.Reader, header map[string]string) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, b
+}
+
+func TestFileServer_HTTPGateway(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 2)
+	s2 := newTestServer(t, disc, 2)
+	waitForPeers(t, 1, s1, s2)
+
+	gw := httptest.NewServer(s1.HTTPHandler())
+	t.Cleanup(gw.Close)
+
+	url := gw.URL + "/objects/photos/cat.png"
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(content)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	resp, _ := doRequest(t, http.MethodPut, url, bytes.NewReader(content), map[string]string{ConsistencyHeader: "all", "Content-Type": "image/png"})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp, body := doRequest(t, http.MethodGet, url, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	assert.Equal(t, "10000", resp.Header.Get("Content-Length"))
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	resp, body = doRequest(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=5-14"})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "5678901234", string(body))
+	assert.Equal(t, "bytes 5-14/10000", resp.Header.Get("Content-Range"))
+
+	resp, _ = doRequest(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=20000-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	resp, body = doRequest(t, http.MethodHead, url, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.Equal(t, "10000", resp.Header.Get("Content-Length"))
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp, _ = doRequest(t, http.MethodGet, url, nil, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// Without the local copy the content is fetched from the replica, along
+	// with its content type.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "photos/cat.png"))
+	resp, body = doRequest(t, http.MethodGet, url, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+
+	resp, _ = doRequest(t, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	s1.ReadConsistency = All
+	resp, body = doRequest(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var gwErr gatewayError
+	require.NoError(t, json.Unmarshal(body, &gwErr))
+	assert.Equal(t, gatewayError{Code: "NotFound", Message: ErrFileNotFound.Error(), Key: "photos/cat.png"}, gwErr)
+}
+
+func TestFileServer_HTTPGatewayStream(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 2)
+	s2 := newTestServer(t, disc, 2)
+	waitForPeers(t, 1, s1, s2)
+	s1.ChunkSize = 1000
+
+	gw := httptest.NewServer(s1.HTTPHandler())
+	t.Cleanup(gw.Close)
+
+	url := gw.URL + "/objects/video.mp4"
+	content := randomContent(7, 10000)
+	ctx := WithConsistency(context.Background(), All)
+	require.NoError(t, s1.Store(ctx, "video.mp4", bytes.NewReader(content)))
+
+	// Chunks fetched from the network are streamed, a range by skipping to
+	// its start.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "video.mp4"))
+	resp, body := doRequest(t, http.MethodGet, url, nil, map[string]string{"Range": "bytes=2500-3499"})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[2500:3500], body)
+	assert.Equal(t, "bytes 2500-3499/10000", resp.Header.Get("Content-Range"))
+
+	require.Eventually(t, func() bool {
+		return s1.Verify("video.mp4") == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	require.NoError(t, s1.Storage.Delete(s1.ID, "video.mp4"))
+	resp, body = doRequest(t, http.MethodGet, url, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+	assert.Equal(t, "10000", resp.Header.Get("Content-Length"))
+}
+
+func TestFileServer_HTTPGatewayUpload(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 2)
+	s2 := newTestServer(t, disc, 2)
+	waitForPeers(t, 1, s1, s2)
+
+	gw := httptest.NewServer(s1.HTTPHandler())
+	t.Cleanup(gw.Close)
+
+	url := gw.URL + "/objects/videos/talk.mp4"
+	resp, body := doRequest(t, http.MethodPost, url+"?uploads", nil, map[string]string{"Content-Type": "video/mp4"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var upload struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.Unmarshal(body, &upload))
+	uploadURL := url + "?uploadId=" + upload.ID
+
+	parts := []string{strings.Repeat("x", 3000), strings.Repeat("y", 3000), "z"}
+	for i := len(parts) - 1; i >= 0; i-- {
+		resp, _ := doRequest(t, http.MethodPut, fmt.Sprintf("%s&partNumber=%d", uploadURL, i+1), strings.NewReader(parts[i]), nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		sum := sha256.Sum256([]byte(parts[i]))
+		assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, resp.Header.Get("ETag"))
+	}
+
+	resp, body = doRequest(t, http.MethodGet, uploadURL, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var listed struct {
+		Key   string `json:"key"`
+		Parts []struct {
+			Number int `json:"number"`
+		} `json:"parts"`
+	}
+	require.NoError(t, json.Unmarshal(body, &listed))
+	assert.Equal(t, "videos/talk.mp4", listed.Key)
+	assert.Len(t, listed.Parts, 3)
+
+	// The session is the one of its key only.
+	resp, _ = doRequest(t, http.MethodPost, gw.URL+"/objects/other?uploadId="+upload.ID, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	content := strings.Join(parts, "")
+	sum := sha256.Sum256([]byte(content))
+	resp, _ = doRequest(t, http.MethodPost, uploadURL, nil, map[string]string{ConsistencyHeader: "all"})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, resp.Header.Get("ETag"))
+	assert.True(t, s2.Storage.HasFile(s1.ID, fscrypto.HashKey("videos/talk.mp4")))
+
+	resp, body = doRequest(t, http.MethodGet, url, nil, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, string(body))
+	assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+
+	resp, _ = doRequest(t, http.MethodGet, uploadURL, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestFileServer_HTTPGatewayErrors(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+	// A lone node cannot meet an ALL consistency with two replicas.
+	srv := newTestServer(t, disc, 2)
+
+	gw := httptest.NewServer(srv.HTTPHandler())
+	t.Cleanup(gw.Close)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       io.Reader
+		header     map[string]string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "missing key", method: http.MethodGet, path: "/objects/", wantStatus: http.StatusBadRequest, wantCode: "InvalidKey"},
+		{name: "method", method: http.MethodPost, path: "/objects/key", wantStatus: http.StatusMethodNotAllowed, wantCode: "MethodNotAllowed"},
+		{name: "consistency", method: http.MethodGet, path: "/objects/key", header: map[string]string{ConsistencyHeader: "most"}, wantStatus: http.StatusBadRequest, wantCode: "InvalidConsistency"},
+		{name: "no content length", method: http.MethodPut, path: "/objects/key", body: io.MultiReader(strings.NewReader("no length")), wantStatus: http.StatusLengthRequired, wantCode: "MissingContentLength"},
+		{name: "quorum", method: http.MethodPut, path: "/objects/key", body: strings.NewReader("content"), header: map[string]string{ConsistencyHeader: "all"}, wantStatus: http.StatusServiceUnavailable, wantCode: "QuorumNotMet"},
+		{name: "erasure code", method: http.MethodPut, path: "/objects/key", body: strings.NewReader("content"), header: map[string]string{ErasureHeader: "4"}, wantStatus: http.StatusBadRequest, wantCode: "InvalidErasureCode"},
+		{name: "no such upload", method: http.MethodGet, path: "/objects/key?uploadId=0123456789abcdef0123456789abcdef", wantStatus: http.StatusNotFound, wantCode: "NoSuchUpload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := doRequest(t, tt.method, gw.URL+tt.path, tt.body, tt.header)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+
+			var gwErr gatewayError
+			require.NoError(t, json.Unmarshal(body, &gwErr))
+			assert.Equal(t, tt.wantCode, gwErr.Code)
+		})
+	}
+}
+
+func TestFileServer_HTTPGatewayCorrupted(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+	srv := newTestServer(t, disc, 1)
+
+	gw := httptest.NewServer(srv.HTTPHandler())
+	t.Cleanup(gw.Close)
+
+	content := bytes.Repeat([]byte("some content "), 10000)
+	require.NoError(t, srv.Store(context.Background(), "key", bytes.NewReader(content)))
+	corruptFile(t, srv, srv.ID, "key")
+
+	// The response is cut short, the corrupted content is never served
+	// whole.
+	resp, err := http.Get(gw.URL + "/objects/key")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	got, err := io.ReadAll(resp.Body)
+	assert.Error(t, err)
+	assert.Less(t, len(got), len(content))
+}
@@ -0,0 +1,253 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// keyHeadersBatch is the number of envelope headers exchanged per message
+// while rewrapping data keys.
+const keyHeadersBatch = 1000
+
+// RotateKey makes a new key of the keyring active and rewraps with it the
+// data keys of the files replicated to the peers, see RewrapKeys.
+func (s *FileServer) RotateKey(ctx context.Context) (int, error) {
+	id, err := s.Keyring.Rotate()
+	if err != nil {
+		return 0, err
+	}
+
+	s.Logger.Info("rotated key encryption key", zap.String("key_id", id))
+
+	return s.RewrapKeys(ctx)
+}
+
+// RewrapKeys asks every connected peer for the envelope headers of the files
+// it stores for this server, in every namespace the node stores files in,
+// and rewraps the data keys not wrapped by the active key of the keyring.
+// Only the headers travel, file contents are not re-encrypted. The keyring
+// is reloaded first, so keys rotated by another process are used. It
+// returns the number of headers rewritten.
+func (s *FileServer) RewrapKeys(ctx context.Context) (int, error) {
+	if err := s.Keyring.Reload(); err != nil {
+		return 0, err
+	}
+
+	ids, err := s.ownNamespaces()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	var (
+		total int
+		errs  []error
+	)
+	for _, peer := range s.nodePeerList() {
+		for _, id := range ids {
+			n, err := s.rewrapPeerKeys(ctx, peer, id)
+			total += n
+			if err != nil {
+				errs = append(errs, fmt.Errorf("peer %s: %w", peer.RemoteAddr(), err))
+			}
+		}
+	}
+
+	return total, errors.Join(errs...)
+}
+
+// ownNamespaces returns the IDs of the namespaces the node stores files in,
+// starting with the default one.
+func (s *FileServer) ownNamespaces() ([]string, error) {
+	ids, err := s.Storage.ServerIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	own := []string{s.ID}
+	for _, id := range ids {
+		if id != s.ID && s.isOwnNamespace(id) {
+			own = append(own, id)
+		}
+	}
+
+	return own, nil
+}
+
+func (s *FileServer) rewrapPeerKeys(ctx context.Context, peer transport.Peer, id string) (int, error) {
+	active := s.Keyring.ActiveID()
+	updated := 0
+	after := ""
+
+	for {
+		_, reply, err := s.request(ctx, peer, &Message{
+			Payload: MessageGetKeyHeaders{ID: id, After: after, Limit: keyHeadersBatch},
+		})
+		if err != nil {
+			return updated, err
+		}
+
+		headers, ok := reply.Payload.(MessageKeyHeaders)
+		if !ok {
+			return updated, fmt.Errorf("unexpected reply %T to key headers request", reply.Payload)
+		}
+		if headers.Err != "" {
+			return updated, errors.New(headers.Err)
+		}
+
+		var updates []KeyHeaderUpdate
+		for _, h := range headers.Headers {
+			keyID, err := fscrypto.EnvelopeKeyID(h.Header)
+			if err != nil || keyID == active {
+				continue
+			}
+
+			header, err := fscrypto.RewrapEnvelope(s.Keyring, h.Header)
+			if err != nil {
+				s.Logger.Error("could not rewrap data key", zap.Error(err), zap.String("path", h.Path))
+				continue
+			}
+
+			updates = append(updates, KeyHeaderUpdate{Path: h.Path, Old: h.Header, New: header})
+		}
+
+		if len(updates) > 0 {
+			_, reply, err := s.request(ctx, peer, &Message{
+				Payload: MessageRewrapKeys{ID: id, Headers: updates},
+			})
+			if err != nil {
+				return updated, err
+			}
+
+			ack, ok := reply.Payload.(MessageRewrapKeysAck)
+			if !ok {
+				return updated, fmt.Errorf("unexpected reply %T to rewrap request", reply.Payload)
+			}
+			updated += ack.Updated
+			if ack.Err != "" {
+				return updated, errors.New(ack.Err)
+			}
+		}
+
+		if len(headers.Headers) < keyHeadersBatch {
+			return updated, nil
+		}
+		after = headers.Headers[len(headers.Headers)-1].Path
+	}
+}
+
+// isFromServer reports whether the peer connected at remoteAddr introduced
+// itself as the server that stored the files kept under id, see serverOf.
+func (s *FileServer) isFromServer(remoteAddr, id string) bool {
+	node, ok := s.peerNodes.Get(remoteAddr)
+	return ok && node.ServerID == serverOf(id)
+}
+
+func (s *FileServer) handleMessageGetKeyHeaders(rpc transport.RPC, msg MessageGetKeyHeaders) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	reply := MessageKeyHeaders{ID: msg.ID}
+	defer func() { s.reply(peer, rpc, &Message{Payload: reply}) }()
+
+	if !s.isFromServer(rpc.From, msg.ID) {
+		reply.Err = fmt.Sprintf("peer %s can not read the key headers of %s", rpc.From, msg.ID)
+		return errors.New(reply.Err)
+	}
+
+	limit := msg.Limit
+	if limit <= 0 || limit > keyHeadersBatch {
+		limit = keyHeadersBatch
+	}
+
+	err := s.Storage.WalkKeyHeaders(msg.ID, func(path string) error {
+		if path <= msg.After {
+			return nil
+		}
+		if len(reply.Headers) == limit {
+			return filepath.SkipAll
+		}
+
+		header, err := s.readKeyHeader(msg.ID, path)
+		if err != nil {
+			s.Logger.Warn("could not read key header", zap.Error(err), zap.String("path", path))
+			return nil
+		}
+
+		reply.Headers = append(reply.Headers, KeyHeader{Path: path, Header: header})
+
+		return nil
+	})
+	if err != nil {
+		reply.Err = err.Error()
+		return err
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageRewrapKeys(rpc transport.RPC, msg MessageRewrapKeys) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	ack := MessageRewrapKeysAck{ID: msg.ID}
+	defer func() { s.reply(peer, rpc, &Message{Payload: ack}) }()
+
+	if !s.isFromServer(rpc.From, msg.ID) {
+		ack.Err = fmt.Sprintf("peer %s can not rewrite the key headers of %s", rpc.From, msg.ID)
+		return errors.New(ack.Err)
+	}
+
+	for _, update := range msg.Headers {
+		ok, err := s.writeKeyHeader(msg.ID, update)
+		if err != nil {
+			ack.Err = err.Error()
+			return err
+		}
+		if ok {
+			ack.Updated++
+		}
+	}
+
+	s.Logger.Info("rewrapped data keys", zap.String("server_id", msg.ID), zap.Int("count", ack.Updated))
+
+	return nil
+}
+
+func (s *FileServer) readKeyHeader(id, path string) ([]byte, error) {
+	f, err := s.Storage.OpenFile(id, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, fscrypto.EnvelopeHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// writeKeyHeader replaces the envelope header of the file at update.Path if
+// it still is update.Old, it reports whether it did.
+func (s *FileServer) writeKeyHeader(id string, update KeyHeaderUpdate) (bool, error) {
+	if len(update.New) != fscrypto.EnvelopeHeaderSize {
+		return false, fmt.Errorf("invalid key header for %s", update.Path)
+	}
+
+	return s.Storage.ReplaceHeader(id, update.Path, update.Old, update.New)
+}
@@ -0,0 +1,112 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// replicaKeyIDs returns the IDs of the keys wrapping the data keys of the
+// files srv stores for the server id. Files still being written, or whose
+// metadata is not recorded yet, are skipped as they are by RewrapKeys.
+func replicaKeyIDs(srv *FileServer, id string) []string {
+	var ids []string
+	srv.Storage.WalkKeyHeaders(id, func(path string) error {
+		header, err := srv.readKeyHeader(id, path)
+		if err != nil {
+			return nil
+		}
+
+		if keyID, err := fscrypto.EnvelopeKeyID(header); err == nil {
+			ids = append(ids, keyID)
+		}
+		return nil
+	})
+
+	return ids
+}
+
+func TestFileServer_RotateKey(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, DefaultReplicationFactor)
+	s2 := newTestServer(t, disc, DefaultReplicationFactor)
+	waitForPeers(t, 1, s1, s2)
+
+	ctx := context.Background()
+	files := map[string][]byte{
+		"a.txt": []byte("content of a"),
+		"b.txt": bytes.Repeat([]byte("content of b "), 10000),
+	}
+	for key, content := range files {
+		require.NoError(t, s1.Store(ctx, key, bytes.NewReader(content)))
+	}
+
+	require.Eventually(t, func() bool {
+		return len(replicaKeyIDs(s2, s1.ID)) == len(files)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	oldID := s1.Keyring.ActiveID()
+	assert.Equal(t, []string{oldID, oldID}, replicaKeyIDs(s2, s1.ID))
+
+	n, err := s1.RotateKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	newID := s1.Keyring.ActiveID()
+	assert.NotEqual(t, oldID, newID)
+	assert.Equal(t, []string{newID, newID}, replicaKeyIDs(s2, s1.ID))
+	// The checksums of the replicas cover their new headers.
+	for key := range files {
+		assert.NoError(t, s2.Storage.Verify(s1.ID, fscrypto.HashKey(key)))
+	}
+
+	// Nothing is left to rewrap.
+	n, err = s1.RewrapKeys(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// The replicas still decrypt with their rewrapped data keys.
+	for key, content := range files {
+		require.NoError(t, s1.Storage.Delete(s1.ID, key))
+
+		r, err := s1.Get(ctx, key)
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+		assert.Equal(t, content, got)
+	}
+}
+
+func TestFileServer_RewrapKeysOfOtherServer(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, DefaultReplicationFactor)
+	s2 := newTestServer(t, disc, DefaultReplicationFactor)
+	s3 := newTestServer(t, disc, DefaultReplicationFactor)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, s1.Store(ctx, "file.txt", bytes.NewReader([]byte("content"))))
+
+	peer, ok := s2.peerForNode(s3.Transport.Addr())
+	require.True(t, ok)
+
+	// s2 can not read nor rewrite the headers of the files s3 stores for s1.
+	_, reply, err := s2.request(ctx, peer, &Message{Payload: MessageGetKeyHeaders{ID: s1.ID}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, reply.Payload.(MessageKeyHeaders).Err)
+
+	_, reply, err = s2.request(ctx, peer, &Message{Payload: MessageRewrapKeys{ID: s1.ID}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, reply.Payload.(MessageRewrapKeysAck).Err)
+}
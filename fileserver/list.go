@@ -0,0 +1,139 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// MaxListLimit is the most keys listed per page, and the number listed when
+// no limit is given.
+const MaxListLimit = 1000
+
+// keysPage is a page of keys listed by a node, next is empty when the node
+// has no more keys to list.
+type keysPage struct {
+	keys []string
+	next string
+}
+
+// List returns, in order and without duplicates, at most limit of the keys
+// stored through any node of the network that start with prefix and sort
+// after cursor, along with the cursor of the next page, empty once every key
+// was listed. Every node lists the keys of its own namespace of the name of
+// ctx, see WithNamespace, the ones failing to answer are left out.
+func (s *FileServer) List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	keys, next, err := s.Storage.List(s.namespace(ctx), prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	pages := []keysPage{{keys: keys, next: next}}
+
+	msg := &Message{
+		Payload: MessageListKeys{
+			Namespace: namespaceFromContext(ctx),
+			Prefix:    prefix,
+			Cursor:    cursor,
+			Limit:     limit,
+		},
+	}
+
+	peers := s.nodePeerList()
+	results := make(chan peerReply, len(peers))
+	for _, peer := range peers {
+		go func(peer transport.Peer) {
+			_, reply, err := s.request(ctx, peer, msg)
+			results <- peerReply{peer: peer, msg: reply, err: err}
+		}(peer)
+	}
+
+	for range peers {
+		res := <-results
+		if res.err == nil {
+			res.err = keysReplyError(res.msg)
+		}
+		if res.err != nil {
+			s.Logger.Error("could not list keys", zap.Error(res.err), zap.String("remote_addr", res.peer.RemoteAddr().String()))
+			continue
+		}
+
+		page := res.msg.Payload.(MessageKeys)
+		pages = append(pages, keysPage{keys: page.Keys, next: page.Next})
+	}
+
+	keys, next = mergePages(pages, limit)
+
+	return keys, next, nil
+}
+
+func keysReplyError(msg *Message) error {
+	page, ok := msg.Payload.(MessageKeys)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T to list request", msg.Payload)
+	}
+	if page.Err != "" {
+		return errors.New(page.Err)
+	}
+
+	return nil
+}
+
+// mergePages merges the sorted pages of keys listed by the nodes into a
+// page of at most limit keys. Every node lists its first keys following the
+// cursor, so no key sorting before the last one kept can be missing.
+func mergePages(pages []keysPage, limit int) ([]string, string) {
+	var (
+		keys      []string
+		truncated bool
+	)
+	for _, page := range pages {
+		keys = append(keys, page.keys...)
+		truncated = truncated || page.next != ""
+	}
+
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	if len(keys) > limit {
+		keys, truncated = keys[:limit], true
+	}
+	if !truncated || len(keys) == 0 {
+		return keys, ""
+	}
+
+	return keys, keys[len(keys)-1]
+}
+
+func (s *FileServer) handleMessageListKeys(rpc transport.RPC, msg MessageListKeys) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	limit := msg.Limit
+	if limit <= 0 || limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	reply := MessageKeys{}
+	keys, next, err := s.Storage.List(s.namespaceID(msg.Namespace), msg.Prefix, msg.Cursor, limit)
+	if err != nil {
+		reply.Err = err.Error()
+	} else {
+		reply.Keys, reply.Next = keys, next
+	}
+	s.reply(peer, rpc, &Message{Payload: reply})
+
+	return err
+}
@@ -0,0 +1,101 @@
+package fileserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer_List(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	s2 := newTestServer(t, disc, 3)
+	s3 := newTestServer(t, disc, 3)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	ctx := WithConsistency(context.Background(), All)
+	stored := map[*FileServer][]string{
+		s1: {"a", "docs/b", "shared"},
+		s2: {"docs/a", "shared"},
+		s3: {"c", "docs/c"},
+	}
+	for s, keys := range stored {
+		for _, key := range keys {
+			require.NoError(t, s.Store(ctx, key, strings.NewReader("content of "+key)))
+		}
+	}
+
+	// Replicas are not listed, only the keys stored through the nodes.
+	keys, next, err := s2.List(ctx, "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c", "docs/a", "docs/b", "docs/c", "shared"}, keys)
+	assert.Empty(t, next)
+
+	keys, _, err = s3.List(ctx, "docs/", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"docs/a", "docs/b", "docs/c"}, keys)
+
+	var paged []string
+	for cursor := ""; ; {
+		keys, next, err := s1.List(ctx, "", cursor, 2)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(keys), 2)
+		paged = append(paged, keys...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"a", "c", "docs/a", "docs/b", "docs/c", "shared"}, paged)
+}
+
+func TestMergePages(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    []keysPage
+		limit    int
+		want     []string
+		wantNext string
+	}{
+		{
+			name:  "merged",
+			pages: []keysPage{{keys: []string{"a", "c"}}, {keys: []string{"b", "d"}}},
+			limit: 10,
+			want:  []string{"a", "b", "c", "d"},
+		},
+		{
+			name:  "duplicates",
+			pages: []keysPage{{keys: []string{"a", "b"}}, {keys: []string{"b", "c"}}},
+			limit: 3,
+			want:  []string{"a", "b", "c"},
+		},
+		{
+			name:     "over limit",
+			pages:    []keysPage{{keys: []string{"a", "c"}}, {keys: []string{"b", "d"}}},
+			limit:    3,
+			want:     []string{"a", "b", "c"},
+			wantNext: "c",
+		},
+		{
+			name:     "truncated page",
+			pages:    []keysPage{{keys: []string{"a"}, next: "a"}, {keys: []string{"b"}}},
+			limit:    1,
+			want:     []string{"a"},
+			wantNext: "a",
+		},
+		{name: "empty", pages: []keysPage{{}, {}}, limit: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, next := mergePages(tt.pages, tt.limit)
+			assert.Equal(t, tt.want, keys)
+			assert.Equal(t, tt.wantNext, next)
+		})
+	}
+}
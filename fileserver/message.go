@@ -1,15 +1,57 @@
 package fileserver
 
-import "encoding/gob"
+import (
+	"encoding/gob"
+
+	"github.com/gusga/dfsgo/storage"
+)
 
 type Message struct {
 	Payload any
 }
 
-type MessageStoreFile struct {
+// MessageHello is sent to every new peer so it knows the ID and listen
+// address of the node on the other side of the connection.
+type MessageHello struct {
 	ID   string
-	Key  string
-	Size int64
+	Addr string
+}
+
+// MessageStoreFile is the stream replicating a file, a chunk of a file or
+// the manifest listing them. ContentType and Manifest are kept in the
+// metadata of the replica and sent back with its content, along with
+// FileSize and FileChecksum, those of the file replicated. Chunks are
+// stored for chunkNamespace, Ref is then set to the reference of the file
+// they are part of, see chunkRef.
+type MessageStoreFile struct {
+	ID           string
+	Key          string
+	Size         int64
+	ContentType  string
+	Manifest     bool
+	FileSize     int64
+	FileChecksum string
+	Ref          string
+}
+
+// MessageStoreFileAck is sent back once a MessageStoreFile stream has been
+// written to disk. Err is empty when the write succeeded.
+type MessageStoreFileAck struct {
+	ID  string
+	Key string
+	Err string
+}
+
+// MessageRepairReplica asks the node that stored a file to send again the
+// replica of Key the peer found corrupted, from the content it decrypts
+// and checks itself. For the chunks stored for chunkNamespace Ref is set
+// to the reference of a file of the node they are part of, see chunkRef.
+// It is answered with a MessageStoreFileAck once the replica was stored
+// again.
+type MessageRepairReplica struct {
+	ID  string
+	Key string
+	Ref string
 }
 
 type MessageGetFile struct {
@@ -17,7 +59,284 @@ type MessageGetFile struct {
 	Key string
 }
 
+// MessageStatFile asks a peer whether it holds a file, it is answered with
+// a MessageFileStat.
+type MessageStatFile struct {
+	ID  string
+	Key string
+}
+
+// MessageFileStat answers a MessageStatFile. Manifest is set when the
+// replica is the manifest of a file replicated in chunks, Size is then the
+// one of the manifest. FileSize and FileChecksum are those of the file the
+// replica holds, so the answers of several peers can be compared.
+type MessageFileStat struct {
+	ID           string
+	Key          string
+	Exists       bool
+	Size         int64
+	Manifest     bool
+	FileSize     int64
+	FileChecksum string
+}
+
+// MessageDeleteFile asks the peers to delete their replica of a file, to
+// release the chunks of it they hold, see MessageReleaseChunks, and to
+// delete the shards of it they hold. Key is empty when only shards are
+// deleted.
+type MessageDeleteFile struct {
+	ID     string
+	Key    string
+	Chunks []string
+	Shards []string
+}
+
+// MessageStatFiles asks a peer which of the files of Keys it holds. It is
+// answered with a MessageFilesHeld.
+type MessageStatFiles struct {
+	ID   string
+	Keys []string
+}
+
+type MessageFilesHeld struct {
+	ID   string
+	Keys []string
+}
+
+// MessageRefChunks asks a peer to record Ref, the reference of a file, see
+// chunkRef, among the references of the chunks of Keys it holds. It is
+// answered with a MessageChunkRefs listing the chunks it lacks.
+type MessageRefChunks struct {
+	ID   string
+	Ref  string
+	Keys []string
+}
+
+type MessageChunkRefs struct {
+	ID      string
+	Missing []string
+	Err     string
+}
+
+// MessageReleaseChunks asks the peers to drop Ref from the references of
+// the chunks of Keys they hold, deleting the chunks left unreferenced.
+type MessageReleaseChunks struct {
+	ID   string
+	Ref  string
+	Keys []string
+}
+
+// MessageFileStream describes a stream carrying the content of a file
+// requested with MessageGetFile. Manifest is set when it carries the
+// manifest listing the chunks of the file instead.
+type MessageFileStream struct {
+	ID          string
+	Key         string
+	Size        int64
+	ContentType string
+	Manifest    bool
+}
+
+// MessageGetKeyHeaders asks a peer for the envelope headers of the files it
+// stores for the server ID, at most Limit of them following the file at
+// path After. It is answered with a MessageKeyHeaders.
+type MessageGetKeyHeaders struct {
+	ID    string
+	After string
+	Limit int
+}
+
+type KeyHeader struct {
+	Path   string
+	Header []byte
+}
+
+type MessageKeyHeaders struct {
+	ID      string
+	Headers []KeyHeader
+	Err     string
+}
+
+// MessageRewrapKeys asks a peer to replace the envelope headers of files it
+// stores for the server ID. Every header is only replaced if it still equals
+// Old. It is answered with a MessageRewrapKeysAck.
+type MessageRewrapKeys struct {
+	ID      string
+	Headers []KeyHeaderUpdate
+}
+
+type KeyHeaderUpdate struct {
+	Path string
+	Old  []byte
+	New  []byte
+}
+
+type MessageRewrapKeysAck struct {
+	ID      string
+	Updated int
+	Err     string
+}
+
+// MessageListKeys asks a node for a page of at most Limit of the keys
+// stored through it in the namespace named Namespace that start with
+// Prefix and sort after Cursor. It is answered with a MessageKeys.
+type MessageListKeys struct {
+	Namespace string
+	Prefix    string
+	Cursor    string
+	Limit     int
+}
+
+// MessageKeys answers a MessageListKeys, Next is empty when the node has no
+// more keys to list.
+type MessageKeys struct {
+	Keys []string
+	Next string
+	Err  string
+}
+
+// MessageClientPut is the stream a client sends to store Size bytes under
+// Key, as Store does. It is answered with a MessageClientAck. Consistency
+// overrides the write consistency of the node when set.
+type MessageClientPut struct {
+	Key         string
+	Size        int64
+	Consistency ConsistencyLevel
+}
+
+// MessageClientGet asks for the content stored under Key, as Get does. It
+// is answered with a MessageFileStream followed by the content, or a
+// MessageClientAck when the content could not be read.
+type MessageClientGet struct {
+	Key         string
+	Consistency ConsistencyLevel
+}
+
+type MessageClientDelete struct {
+	Key string
+}
+
+// MessageClientStat is answered with a MessageClientFileInfo.
+type MessageClientStat struct {
+	Key string
+}
+
+// MessageClientList asks for a page of at most Limit keys starting with
+// Prefix and sorting after Cursor, as List does. It is answered with a
+// MessageClientKeys.
+type MessageClientList struct {
+	Prefix string
+	Cursor string
+	Limit  int
+}
+
+// MessageClientCreateUpload starts an upload session of Key, as
+// CreateUpload does. It is answered with a MessageClientUpload.
+type MessageClientCreateUpload struct {
+	Key         string
+	ContentType string
+}
+
+type MessageClientUpload struct {
+	Upload storage.Upload
+	Err    string
+}
+
+// MessageClientUploadPart is the stream a client sends to store Size bytes
+// as the part Number of an upload session, as UploadPart does. It is
+// answered with a MessageClientParts listing the part.
+type MessageClientUploadPart struct {
+	UploadID string
+	Number   int
+	Size     int64
+}
+
+// MessageClientListParts asks for the parts of an upload session received
+// so far. It is answered with a MessageClientParts.
+type MessageClientListParts struct {
+	UploadID string
+}
+
+// MessageClientParts answers the requests about the parts of an upload
+// session, NoSuchUpload is set when it failed because the session does
+// not exist.
+type MessageClientParts struct {
+	Parts        []storage.Part
+	Err          string
+	NoSuchUpload bool
+}
+
+// MessageClientCompleteUpload stores the file of an upload session, as
+// CompleteUpload does. It is answered with a MessageClientAck.
+// Consistency overrides the write consistency of the node when set.
+type MessageClientCompleteUpload struct {
+	UploadID    string
+	Consistency ConsistencyLevel
+}
+
+// MessageClientAbortUpload is answered with a MessageClientAck.
+type MessageClientAbortUpload struct {
+	UploadID string
+}
+
+// MessageClientAck answers a client request. Err is empty when the request
+// succeeded, NotFound is set when it failed because the file does not
+// exist and NoSuchUpload when the upload session does not.
+type MessageClientAck struct {
+	Key          string
+	Err          string
+	NotFound     bool
+	NoSuchUpload bool
+}
+
+type MessageClientFileInfo struct {
+	Info     FileInfo
+	Err      string
+	NotFound bool
+}
+
+// MessageClientKeys answers a MessageClientList, Next is the cursor of the
+// next page, empty once every key was listed.
+type MessageClientKeys struct {
+	Keys []string
+	Next string
+	Err  string
+}
+
 func init() {
+	gob.Register(MessageHello{})
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreFileAck{})
+	gob.Register(MessageRepairReplica{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageStatFile{})
+	gob.Register(MessageFileStat{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageRefChunks{})
+	gob.Register(MessageChunkRefs{})
+	gob.Register(MessageReleaseChunks{})
+	gob.Register(MessageStatFiles{})
+	gob.Register(MessageFilesHeld{})
+	gob.Register(MessageFileStream{})
+	gob.Register(MessageGetKeyHeaders{})
+	gob.Register(MessageKeyHeaders{})
+	gob.Register(MessageRewrapKeys{})
+	gob.Register(MessageRewrapKeysAck{})
+	gob.Register(MessageListKeys{})
+	gob.Register(MessageKeys{})
+	gob.Register(MessageClientPut{})
+	gob.Register(MessageClientGet{})
+	gob.Register(MessageClientDelete{})
+	gob.Register(MessageClientStat{})
+	gob.Register(MessageClientList{})
+	gob.Register(MessageClientCreateUpload{})
+	gob.Register(MessageClientUpload{})
+	gob.Register(MessageClientUploadPart{})
+	gob.Register(MessageClientListParts{})
+	gob.Register(MessageClientParts{})
+	gob.Register(MessageClientCompleteUpload{})
+	gob.Register(MessageClientAbortUpload{})
+	gob.Register(MessageClientAck{})
+	gob.Register(MessageClientFileInfo{})
+	gob.Register(MessageClientKeys{})
 }
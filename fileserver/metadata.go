@@ -0,0 +1,28 @@
+package fileserver
+
+import "context"
+
+type contentTypeKey struct{}
+
+// WithContentType returns a copy of ctx that makes Store record contentType
+// as the content type of the file.
+func WithContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+func contentTypeFromContext(ctx context.Context) string {
+	contentType, _ := ctx.Value(contentTypeKey{}).(string)
+	return contentType
+}
+
+// Verify checks the local copy of the file stored under key still matches
+// the checksum recorded when it was written. It returns
+// storage.ErrChecksumMismatch when it does not, and ErrFileNotFound when
+// there is no local copy.
+func (s *FileServer) Verify(key string) error {
+	if !s.Storage.HasFile(s.ID, key) {
+		return ErrFileNotFound
+	}
+
+	return s.Storage.Verify(s.ID, key)
+}
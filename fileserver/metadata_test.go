@@ -0,0 +1,63 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer_Metadata(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 2)
+	s2 := newTestServer(t, disc, 2)
+	waitForPeers(t, 1, s1, s2)
+
+	ctx := WithConsistency(context.Background(), All)
+	content := bytes.Repeat([]byte("check me "), 1024)
+
+	require.NoError(t, s1.Store(WithContentType(ctx, "text/plain"), "my_file.txt", bytes.NewReader(content)))
+	require.NoError(t, s1.Verify("my_file.txt"))
+
+	local, err := s1.Storage.Metadata(s1.ID, "my_file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "my_file.txt", local.Key)
+	assert.Equal(t, s1.ID, local.Owner)
+
+	// The replica records the encrypted content it holds.
+	hashedKey := fscrypto.HashKey("my_file.txt")
+	replica, err := s2.Storage.Metadata(s1.ID, hashedKey)
+	require.NoError(t, err)
+	assert.Equal(t, hashedKey, replica.Key)
+	assert.Equal(t, fscrypto.EnvelopeSize(int64(len(content))), replica.Size)
+	assert.Equal(t, "text/plain", replica.ContentType)
+	assert.Equal(t, s1.ID, replica.Owner)
+	assert.NoError(t, s2.Storage.Verify(s1.ID, hashedKey))
+
+	// A copy fetched from the replica gets the same metadata back.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "my_file.txt"))
+	r, err := s1.Get(context.Background(), "my_file.txt")
+	require.NoError(t, err)
+	r.Close()
+
+	fetched, err := s1.Storage.Metadata(s1.ID, "my_file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, local.Checksum, fetched.Checksum)
+	assert.Equal(t, "text/plain", fetched.ContentType)
+
+	pathKey := storage.CASPathTransformFunc("my_file.txt")
+	f, err := s1.Storage.OpenFile(s1.ID, pathKey.FullPath())
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("C"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, s1.Verify("my_file.txt"), storage.ErrChecksumMismatch)
+
+	assert.ErrorIs(t, s1.Verify("unknown"), ErrFileNotFound)
+}
@@ -0,0 +1,54 @@
+package fileserver
+
+import (
+	"context"
+	"strings"
+)
+
+// namespaceSeparator separates the ID of a server from the name of one of
+// its namespaces in the ID the files of the namespace are stored under.
+const namespaceSeparator = "~"
+
+type namespaceKey struct{}
+
+// WithNamespace returns a copy of ctx that makes the FileServer requests
+// using it work on the files of the namespace name instead of the default
+// one. Every namespace has keys of its own, the files stored in one are not
+// seen from the others. The name must be usable as a file name.
+func WithNamespace(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, name)
+}
+
+func namespaceFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(namespaceKey{}).(string)
+	return name
+}
+
+// namespace returns the ID the files of the namespace of ctx are stored
+// under, see WithNamespace.
+func (s *FileServer) namespace(ctx context.Context) string {
+	return s.namespaceID(namespaceFromContext(ctx))
+}
+
+// namespaceID returns the ID the files of the namespace name of the node
+// are stored under, its own ID for the default namespace.
+func (s *FileServer) namespaceID(name string) string {
+	if name == "" {
+		return s.ID
+	}
+
+	return s.ID + namespaceSeparator + name
+}
+
+// serverOf returns the ID of the server that stored the files kept under
+// id, the ID of one of its namespaces.
+func serverOf(id string) string {
+	server, _, _ := strings.Cut(id, namespaceSeparator)
+	return server
+}
+
+// isOwnNamespace reports whether the files kept under id were stored by
+// the node.
+func (s *FileServer) isOwnNamespace(id string) bool {
+	return serverOf(id) == s.ID
+}
@@ -0,0 +1,73 @@
+package fileserver
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer_Namespaces(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	s2 := newTestServer(t, disc, 3)
+	s3 := newTestServer(t, disc, 3)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	ctx := WithConsistency(context.Background(), All)
+	photos := WithNamespace(ctx, "photos")
+
+	require.NoError(t, s1.Store(ctx, "report", strings.NewReader("default report")))
+	require.NoError(t, s1.Store(photos, "report", strings.NewReader("photos report")))
+	require.NoError(t, s2.Store(photos, "cat", strings.NewReader("photos cat")))
+
+	// The replicas are kept apart from the ones of the default namespace.
+	assert.True(t, s3.Storage.HasFile(s1.ID+"~photos", fscrypto.HashKey("report")))
+	assert.True(t, s3.Storage.HasFile(s1.ID, fscrypto.HashKey("report")))
+
+	keys, _, err := s3.List(photos, "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cat", "report"}, keys)
+	keys, _, err = s3.List(ctx, "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"report"}, keys)
+
+	// Without its local copy the file is fetched from the replicas of its
+	// namespace.
+	require.NoError(t, s1.Storage.Delete(s1.namespaceID("photos"), "report"))
+	assert.Equal(t, "photos report", readFile(WithNamespace(context.Background(), "photos"), t, s1, "report"))
+	assert.Equal(t, "default report", readFile(context.Background(), t, s1, "report"))
+
+	require.NoError(t, s1.Delete(photos, "report"))
+	require.Eventually(t, func() bool {
+		return !s3.Storage.HasFile(s1.ID+"~photos", fscrypto.HashKey("report"))
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.True(t, s3.Storage.HasFile(s1.ID, fscrypto.HashKey("report")))
+	assert.Equal(t, "default report", readFile(context.Background(), t, s1, "report"))
+}
+
+func TestServerOf(t *testing.T) {
+	assert.Equal(t, "abc", serverOf("abc"))
+	assert.Equal(t, "abc", serverOf("abc~photos"))
+	assert.Equal(t, chunkNamespace, serverOf(chunkNamespace))
+}
+
+func readFile(ctx context.Context, t *testing.T, s *FileServer, key string) string {
+	t.Helper()
+
+	r, err := s.Get(ctx, key)
+	require.NoError(t, err)
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(b)
+}
@@ -0,0 +1,319 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// DefaultRebuildDelay leaves a node that left the time to come back before
+// the shards it held are rebuilt elsewhere.
+const DefaultRebuildDelay = time.Minute
+
+// RebuildReport sums up a pass over the erasure coded files of the node.
+type RebuildReport struct {
+	Checked int
+	// Rebuilt is the number of shards no peer held any more that were
+	// reconstructed from the others.
+	Rebuilt int
+}
+
+// RebuildShards checks every shard of the erasure coded files the node
+// holds the manifest of is still held by a peer. The node rebuilds the
+// shards of the files stored through it, and those of the files of a
+// server gone when no node before it on the ring holds their manifest.
+// Missing shards are reconstructed from Data of the others and stored on a
+// peer holding no other shard of the file.
+func (s *FileServer) RebuildShards(ctx context.Context) (RebuildReport, error) {
+	var report RebuildReport
+
+	ids, err := s.Storage.ServerIDs()
+	if err != nil {
+		return report, err
+	}
+
+	var files []shardedFile
+	for _, id := range ids {
+		// A server still connected rebuilds its files itself.
+		if id == chunkNamespace || (!s.isOwnNamespace(id) && s.isConnected(id)) {
+			continue
+		}
+
+		var metas []storage.Metadata
+		err := s.Storage.WalkMetadata(id, func(meta storage.Metadata) error {
+			if meta.Manifest || meta.DataShards > 0 {
+				metas = append(metas, meta)
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+
+		for _, meta := range metas {
+			f, ok, err := s.shardedFile(id, meta)
+			if err != nil {
+				s.Logger.Error("could not read manifest", zap.Error(err), zap.String("server_id", id), zap.String("key", meta.Key))
+				continue
+			}
+			if ok {
+				files = append(files, f)
+			}
+		}
+	}
+
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if !s.rebuildsShards(ctx, f) {
+			continue
+		}
+
+		report.Checked++
+		n, err := s.rebuildShards(ctx, f)
+		report.Rebuilt += n
+		if err != nil {
+			s.Logger.Error("could not rebuild shards", zap.Error(err), zap.String("server_id", f.id), zap.String("key", f.key))
+		}
+	}
+
+	return report, nil
+}
+
+// shardedFile is an erasure coded file stored for the server id, under key
+// in the local storage.
+type shardedFile struct {
+	id        string
+	key       string
+	hashedKey string
+	m         manifest
+}
+
+// shardedFile returns the erasure coded file described by meta, stored for
+// the server id, and whether it is one the node can rebuild. The node
+// keeps the manifest of its own files under their key, and the replicas of
+// the manifests of the others under their hashed key, which it only reads
+// when it shares the keyring of their server.
+func (s *FileServer) shardedFile(id string, meta storage.Metadata) (shardedFile, bool, error) {
+	f := shardedFile{id: id, key: meta.Key, hashedKey: meta.Key}
+
+	if s.isOwnNamespace(id) {
+		if meta.DataShards <= 0 {
+			return f, false, nil
+		}
+
+		m, err := s.localManifest(id, meta)
+		f.hashedKey, f.m = fscrypto.HashKey(meta.Key), m
+		return f, err == nil, err
+	}
+
+	if !meta.Manifest {
+		return f, false, nil
+	}
+
+	size, r, err := s.Storage.Read(id, meta.Key)
+	if err != nil {
+		return f, false, err
+	}
+	defer r.Close()
+
+	f.m, err = s.readManifest(r, size)
+	if errors.Is(err, fscrypto.ErrUnknownKey) {
+		return f, false, nil
+	}
+
+	// The manifests of chunked files are left out.
+	return f, err == nil && f.m.Data > 0, err
+}
+
+// isConnected reports whether a peer introduced itself as the server that
+// stored the files kept under id, see serverOf.
+func (s *FileServer) isConnected(id string) bool {
+	for _, node := range s.peerNodes.Values() {
+		if node.ServerID == serverOf(id) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rebuildsShards reports whether the node rebuilds the missing shards of
+// f: the server that stored it does, and once it is gone the first node on
+// the ring holding the manifest, so only one node does.
+func (s *FileServer) rebuildsShards(ctx context.Context, f shardedFile) bool {
+	if s.isOwnNamespace(f.id) {
+		return true
+	}
+
+	for _, node := range s.ring.Owners(f.hashedKey, len(s.ring.Nodes())) {
+		if node.Address == s.Transport.Addr() {
+			return true
+		}
+
+		peer, ok := s.peerForNode(node.Address)
+		if !ok {
+			continue
+		}
+		keys, err := s.statFiles(ctx, peer, f.id, []string{f.hashedKey})
+		if err != nil {
+			s.Logger.Error("could not stat manifest", zap.Error(err), zap.String("remote_addr", node.Address))
+			continue
+		}
+		if len(keys) > 0 {
+			return false
+		}
+	}
+
+	return false
+}
+
+// rebuildShards rebuilds the missing shards of f and returns how many
+// were.
+func (s *FileServer) rebuildShards(ctx context.Context, f shardedFile) (int, error) {
+	keys := f.m.shardKeys(f.hashedKey)
+
+	held, holders := s.shardHolders(ctx, f.id, keys)
+
+	var missing []int
+	for i, key := range keys {
+		if !held[key] {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	// Shards go to the peers holding none of the file, so a peer lost
+	// still costs a single shard.
+	var candidates []transport.Peer
+	for _, peer := range s.ringPeers(f.hashedKey) {
+		if !holders[peer.RemoteAddr().String()] {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	rebuilt := 0
+	for _, i := range missing {
+		if len(candidates) == 0 {
+			return rebuilt, fmt.Errorf("%w: no peer left for shard %d", ErrNotEnoughPeers, i)
+		}
+		peer := candidates[0]
+		candidates = candidates[1:]
+
+		msg := &Message{
+			Payload: MessageStoreFile{
+				ID:   f.id,
+				Key:  keys[i],
+				Size: fscrypto.EnvelopeSize(f.m.layout().shardSize()),
+			},
+		}
+		if err := s.replicate(ctx, peer, msg, s.rebuiltShard(ctx, f.id, f.hashedKey, f.m, missing, i)); err != nil {
+			s.Logger.Error("could not store shard", zap.Error(err), zap.String("key", f.key), zap.Int("shard", i))
+			continue
+		}
+
+		s.Logger.Info("rebuilt shard", zap.String("server_id", f.id), zap.String("key", f.key), zap.Int("shard", i), zap.String("remote_addr", peer.RemoteAddr().String()))
+		rebuilt++
+	}
+
+	return rebuilt, nil
+}
+
+// shardHolders asks every peer which of keys it holds for the server id.
+// It returns the keys held by the node or at least one peer, and the
+// remote addresses of the peers holding any of them.
+func (s *FileServer) shardHolders(ctx context.Context, id string, keys []string) (map[string]bool, map[string]bool) {
+	held := make(map[string]bool)
+	holders := make(map[string]bool)
+
+	for _, key := range keys {
+		if s.Storage.HasFile(id, key) {
+			held[key] = true
+		}
+	}
+
+	for _, peer := range s.nodePeerList() {
+		addr := peer.RemoteAddr().String()
+		files, err := s.statFiles(ctx, peer, id, keys)
+		if err != nil {
+			s.Logger.Error("could not stat shards", zap.Error(err), zap.String("remote_addr", addr))
+			continue
+		}
+
+		for _, key := range files {
+			held[key] = true
+			holders[addr] = true
+		}
+	}
+
+	return held, holders
+}
+
+// statFiles returns which of keys peer holds for the server id.
+func (s *FileServer) statFiles(ctx context.Context, peer transport.Peer, id string, keys []string) ([]string, error) {
+	_, reply, err := s.request(ctx, peer, &Message{
+		Payload: MessageStatFiles{
+			ID:   id,
+			Keys: keys,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files, _ := reply.Payload.(MessageFilesHeld)
+	return files.Keys, nil
+}
+
+// scheduleRebuild rebuilds the shards RebuildDelay from now, or pushes back
+// the rebuild already scheduled.
+func (s *FileServer) scheduleRebuild() {
+	s.rebuildMu.Lock()
+	defer s.rebuildMu.Unlock()
+
+	if s.rebuildTimer != nil {
+		s.rebuildTimer.Reset(s.RebuildDelay)
+		return
+	}
+
+	s.rebuildTimer = time.AfterFunc(s.RebuildDelay, func() {
+		// A pass in progress stops with the server.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-s.quitch:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		s.rebuild(ctx)
+	})
+}
+
+func (s *FileServer) rebuild(ctx context.Context) {
+	start := time.Now()
+	report, err := s.RebuildShards(ctx)
+	if err != nil {
+		s.Logger.Error("rebuilding shards stopped", zap.Error(err), zap.Int("checked", report.Checked))
+		return
+	}
+	if report.Checked == 0 {
+		return
+	}
+
+	s.Logger.Info("rebuilt missing shards",
+		zap.Int("checked", report.Checked),
+		zap.Int("rebuilt", report.Rebuilt),
+		zap.Duration("took", time.Since(start)))
+}
@@ -0,0 +1,365 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"go.uber.org/zap"
+)
+
+// ScrubReport sums up a pass of the scrubber over the stored files.
+type ScrubReport struct {
+	Checked int
+	// Corrupted files were quarantined, Repaired of them were fetched
+	// again from the peers.
+	Corrupted int
+	Repaired  int
+}
+
+// Scrub checks every file stored with its metadata, the node's own ones
+// and the replicas it holds for other nodes, still matches its checksum.
+// Corrupted files are quarantined and a good copy is stored again, see
+// repair.
+func (s *FileServer) Scrub(ctx context.Context) (ScrubReport, error) {
+	var report ScrubReport
+
+	ids, err := s.Storage.ServerIDs()
+	if err != nil {
+		return report, err
+	}
+
+	for _, id := range ids {
+		// The files are checked once the walk is over, repairing them
+		// changes the tree walked.
+		var files []storage.Metadata
+		err := s.Storage.WalkMetadata(id, func(meta storage.Metadata) error {
+			files = append(files, meta)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+
+		for _, meta := range files {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+
+			report.Checked++
+			err := s.Storage.Verify(id, meta.Key)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, storage.ErrChecksumMismatch) {
+				s.Logger.Error("could not check file", zap.Error(err), zap.String("server_id", id), zap.String("key", meta.Key))
+				continue
+			}
+
+			report.Corrupted++
+			if _, err := s.Storage.Quarantine(id, meta.Key); err != nil {
+				s.Logger.Error("could not quarantine file", zap.Error(err), zap.String("server_id", id), zap.String("key", meta.Key))
+				continue
+			}
+
+			if err := s.repair(ctx, id, meta); err != nil {
+				s.Logger.Error("could not repair file", zap.Error(err), zap.String("server_id", id), zap.String("key", meta.Key))
+				continue
+			}
+			report.Repaired++
+		}
+	}
+
+	return report, nil
+}
+
+// repair stores again a good copy of the file described by meta, stored
+// for id. The node's own files are fetched from the replicas, decrypted and
+// checked against their checksum. Replicas can only be decrypted by the
+// node that stored them, which is asked to send them again, and chunks by
+// the nodes with a file they are part of.
+func (s *FileServer) repair(ctx context.Context, id string, meta storage.Metadata) error {
+	switch {
+	case s.isOwnNamespace(id):
+		owners := s.ownerPeers(fscrypto.HashKey(meta.Key))
+		_, r, err := s.fetch(ctx, id, meta.Key, fileMetadata(meta).Checksum, owners, s.otherPeers(owners))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		// Chunks are stored as they are read, the copy is complete once
+		// read through.
+		_, err = io.Copy(io.Discard, r)
+		return err
+	case id == chunkNamespace:
+		return s.repairChunk(ctx, meta)
+	}
+
+	return s.requestRepair(ctx, id, MessageRepairReplica{ID: id, Key: meta.Key}, meta.Size)
+}
+
+// repairChunk stores again the chunk described by meta, from the first
+// file it is part of that a node can read it from, and records again all
+// of its references.
+func (s *FileServer) repairChunk(ctx context.Context, meta storage.Metadata) error {
+	err := fmt.Errorf("%w: no file references chunk %s", ErrFileNotFound, meta.Key)
+	for _, ref := range meta.Refs {
+		id, hashedKey, ok := parseChunkRef(ref)
+		if !ok {
+			continue
+		}
+
+		if s.isOwnNamespace(id) {
+			err = s.restoreChunk(id, hashedKey, meta)
+		} else {
+			err = s.requestRepair(ctx, id, MessageRepairReplica{ID: chunkNamespace, Key: meta.Key, Ref: ref}, meta.Size)
+		}
+		if err != nil {
+			s.Logger.Error("could not repair chunk", zap.Error(err), zap.String("key", meta.Key), zap.String("ref", ref))
+			continue
+		}
+
+		// The chunk sent again only records the file it was read from.
+		for _, ref := range meta.Refs {
+			if _, err := s.Storage.AddRef(chunkNamespace, meta.Key, ref); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return err
+}
+
+// restoreChunk stores again the chunk described by meta, read from the
+// local file replicated under hashedKey in the namespace id.
+func (s *FileServer) restoreChunk(id, hashedKey string, meta storage.Metadata) error {
+	file, off, c, err := s.chunkOf(id, hashedKey, meta.Key)
+	if err != nil {
+		return err
+	}
+
+	r, err := s.localChunk(id, file.Key, off, c)()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = s.Storage.WriteWithMetadata(chunkNamespace, storage.Metadata{
+		Key:  meta.Key,
+		Size: fscrypto.EncryptedSize(c.Size),
+		Refs: meta.Refs,
+	}, r)
+	return err
+}
+
+// requestRepair asks the node that stored the files kept under id to send
+// msg.Key again, size bytes long. The node answers once it is sent.
+func (s *FileServer) requestRepair(ctx context.Context, id string, msg MessageRepairReplica, size int64) error {
+	peer, ok := s.peerForServer(id)
+	if !ok {
+		return fmt.Errorf("%w: node %s storing the replica is not connected", ErrFileNotFound, id)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, transferTimeout(size))
+	defer cancel()
+
+	_, reply, err := s.request(ctx, peer, &Message{Payload: msg})
+	if err != nil {
+		return err
+	}
+
+	ack, ok := reply.Payload.(MessageStoreFileAck)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T to repair request", reply.Payload)
+	}
+	if ack.Err != "" {
+		return fmt.Errorf("node %s failed to repair replica: %s", id, ack.Err)
+	}
+
+	return nil
+}
+
+// peerForServer returns the connected peer of the node of server ID id.
+func (s *FileServer) peerForServer(id string) (transport.Peer, bool) {
+	for _, peer := range s.nodePeerList() {
+		if s.isFromServer(peer.RemoteAddr().String(), id) {
+			return peer, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *FileServer) handleMessageRepairReplica(rpc transport.RPC, msg MessageRepairReplica) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	// The replica takes as long as it does to send, the requester bounds
+	// the wait for it.
+	ack := MessageStoreFileAck{ID: msg.ID, Key: msg.Key}
+	err := s.repairReplica(context.Background(), peer, msg)
+	if err != nil {
+		ack.Err = err.Error()
+	}
+	s.reply(peer, rpc, &Message{Payload: ack})
+
+	return err
+}
+
+// repairReplica sends again to the peer the replica of msg.Key, from the
+// local file it was made of. The local file is read through first, so a
+// corrupted one is never sent.
+func (s *FileServer) repairReplica(ctx context.Context, peer transport.Peer, msg MessageRepairReplica) error {
+	if msg.ID == chunkNamespace {
+		id, hashedKey, ok := parseChunkRef(msg.Ref)
+		if !ok || !s.isOwnNamespace(id) {
+			return fmt.Errorf("chunk %s is not part of a file of node %s", msg.Key, s.ID)
+		}
+		file, off, c, err := s.chunkOf(id, hashedKey, msg.Key)
+		if err != nil {
+			return err
+		}
+		return s.replicate(ctx, peer, &Message{Payload: s.chunkReplica(id, hashedKey, c)}, s.localChunk(id, file.Key, off, c))
+	}
+	if !s.isOwnNamespace(msg.ID) {
+		return fmt.Errorf("replica of %s was not stored by node %s", msg.Key, s.ID)
+	}
+
+	// Shard keys start with the hashed key of their file.
+	hashedKey, _, _ := strings.Cut(msg.Key, ".")
+	meta, err := s.localFile(msg.ID, hashedKey)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(shardKeys(hashedKey, meta), msg.Key) {
+		f, _, err := s.shardedFile(msg.ID, meta)
+		if err != nil {
+			return err
+		}
+		_, err = s.rebuildShards(ctx, f)
+		return err
+	}
+	if msg.Key != hashedKey {
+		return fmt.Errorf("%w: %s is not a replica of %s", ErrFileNotFound, msg.Key, meta.Key)
+	}
+
+	if !isChunked(meta) && meta.DataShards == 0 {
+		// A corrupted copy is caught before any of it is sent.
+		if err := s.Storage.Verify(msg.ID, meta.Key); err != nil {
+			return err
+		}
+		return s.replicate(ctx, peer, &Message{Payload: s.fileReplica(msg.ID, hashedKey, meta)}, s.localContent(msg.ID, meta.Key, 0, meta.Size))
+	}
+
+	m, err := s.localManifest(msg.ID, meta)
+	if err != nil {
+		return err
+	}
+	replica, open, err := s.manifestReplica(msg.ID, hashedKey, meta.ContentType, m)
+	if err != nil {
+		return err
+	}
+
+	return s.replicate(ctx, peer, &Message{Payload: replica}, open)
+}
+
+// chunkOf returns the local file replicated under hashedKey in the
+// namespace id, and the offset in it and the description of its chunk
+// stored under key.
+func (s *FileServer) chunkOf(id, hashedKey, key string) (storage.Metadata, int64, chunkInfo, error) {
+	meta, err := s.localFile(id, hashedKey)
+	if err != nil {
+		return meta, 0, chunkInfo{}, err
+	}
+	if !isChunked(meta) {
+		return meta, 0, chunkInfo{}, fmt.Errorf("%w: %s is not replicated in chunks", ErrFileNotFound, meta.Key)
+	}
+
+	m, err := s.localManifest(id, meta)
+	if err != nil {
+		return meta, 0, chunkInfo{}, err
+	}
+
+	var off int64
+	for _, c := range m.Chunks {
+		if chunkKey(c.Checksum) == key {
+			return meta, off, c, nil
+		}
+		off += c.Size
+	}
+
+	return meta, 0, chunkInfo{}, fmt.Errorf("%w: %s is not a chunk of %s", ErrFileNotFound, key, meta.Key)
+}
+
+// localFile returns the metadata of the local file replicated under
+// hashedKey in the namespace id.
+func (s *FileServer) localFile(id, hashedKey string) (storage.Metadata, error) {
+	var file storage.Metadata
+	err := s.Storage.WalkMetadata(id, func(meta storage.Metadata) error {
+		if fscrypto.HashKey(meta.Key) == hashedKey {
+			file = meta
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return file, err
+	}
+	if file.Key == "" {
+		return file, fmt.Errorf("%w: no local file is replicated under %s", ErrFileNotFound, hashedKey)
+	}
+
+	return file, nil
+}
+
+// scrubLoop scrubs the stored files every ScrubInterval until the server is
+// closed, rebuilding the missing shards after every pass.
+func (s *FileServer) scrubLoop() {
+	ticker := time.NewTicker(s.ScrubInterval)
+	defer ticker.Stop()
+
+	// A pass in progress stops with the server.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.quitch
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			report, err := s.Scrub(ctx)
+			if err != nil {
+				s.Logger.Error("scrubbing stopped", zap.Error(err), zap.Int("checked", report.Checked))
+				continue
+			}
+
+			s.Logger.Info("scrubbed stored files",
+				zap.Int("checked", report.Checked),
+				zap.Int("corrupted", report.Corrupted),
+				zap.Int("repaired", report.Repaired),
+				zap.Duration("took", time.Since(start)))
+
+			// Shards the peers quarantined can only be rebuilt from the
+			// others.
+			s.rebuild(ctx)
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptFile flips the first byte of the file stored for id under key.
+func corruptFile(t *testing.T, s *FileServer, id, key string) {
+	t.Helper()
+
+	pathKey := storage.CASPathTransformFunc(key)
+	f, err := s.Storage.OpenFile(id, pathKey.FullPath())
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 0xff}, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestFileServer_Scrub(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	s2 := newTestServer(t, disc, 3)
+	s3 := newTestServer(t, disc, 3)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	ctx := WithConsistency(context.Background(), All)
+	content := bytes.Repeat([]byte("scrub me "), 4096)
+	require.NoError(t, s1.Store(ctx, "my_file.txt", bytes.NewReader(content)))
+	require.NoError(t, s1.Store(ctx, "other.txt", bytes.NewReader(content)))
+
+	report, err := s1.Scrub(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ScrubReport{Checked: 2}, report)
+
+	// A corrupted local copy is not read back whole.
+	corruptFile(t, s1, s1.ID, "my_file.txt")
+	r, err := s1.Get(ctx, "my_file.txt")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	r.Close()
+	assert.ErrorIs(t, err, storage.ErrChecksumMismatch)
+
+	// The scrubber fetches it again from the replicas.
+	report, err = s1.Scrub(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ScrubReport{Checked: 2, Corrupted: 1, Repaired: 1}, report)
+	require.NoError(t, s1.Verify("my_file.txt"))
+
+	r, err = s1.Get(ctx, "my_file.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	// Replicas are sent again by the node that stored them.
+	hashedKey := fscrypto.HashKey("my_file.txt")
+	corruptFile(t, s2, s1.ID, hashedKey)
+
+	report, err = s2.Scrub(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ScrubReport{Checked: 2, Corrupted: 1, Repaired: 1}, report)
+	assert.NoError(t, s2.Storage.Verify(s1.ID, hashedKey))
+
+	meta, err := s2.Storage.Metadata(s1.ID, hashedKey)
+	require.NoError(t, err)
+	assert.True(t, meta.KeyHeader)
+	local, err := s1.Storage.Metadata(s1.ID, "my_file.txt")
+	require.NoError(t, err)
+	assert.Equal(t, local.Checksum, meta.FileChecksum)
+
+	// The node that stored the file sends nothing from a corrupted copy.
+	corruptFile(t, s1, s1.ID, "my_file.txt")
+	corruptFile(t, s2, s1.ID, hashedKey)
+
+	report, err = s2.Scrub(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, ScrubReport{Checked: 2, Corrupted: 1}, report)
+	assert.False(t, s2.Storage.HasFile(s1.ID, hashedKey))
+}
+
+func TestFileServer_ScrubChunks(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 2)
+	s2 := newTestServer(t, disc, 2)
+	waitForPeers(t, 1, s1, s2)
+	s1.ChunkSize = 1000
+
+	ctx := WithConsistency(context.Background(), All)
+	content := randomContent(1, 5000)
+	require.NoError(t, s1.Store(ctx, "chunked.bin", bytes.NewReader(content)))
+
+	chunks, err := s1.localChunks(s1.ID, "chunked.bin")
+	require.NoError(t, err)
+	require.NotEmpty(t, chunks)
+
+	hashedKey := fscrypto.HashKey("chunked.bin")
+	corruptFile(t, s2, s1.ID, hashedKey)
+	corruptFile(t, s2, chunkNamespace, chunks[0])
+	_, err = s2.Storage.AddRef(chunkNamespace, chunks[0], chunkRef("gone", hashedKey))
+	require.NoError(t, err)
+
+	report, err := s2.Scrub(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Corrupted)
+	assert.Equal(t, 2, report.Repaired)
+
+	assert.NoError(t, s2.Storage.Verify(s1.ID, hashedKey))
+	assert.NoError(t, s2.Storage.Verify(chunkNamespace, chunks[0]))
+
+	// Every reference of the chunk is kept.
+	meta, err := s2.Storage.Metadata(chunkNamespace, chunks[0])
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{chunkRef(s1.ID, hashedKey), chunkRef("gone", hashedKey)}, meta.Refs)
+
+	// The repaired replicas are read back through s2.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "chunked.bin"))
+	r, err := s1.Get(context.Background(), "chunked.bin")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
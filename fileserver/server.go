@@ -2,23 +2,49 @@ package fileserver
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 
+	fscrypto "github.com/gusga/dfsgo/crypto"
 	"github.com/gusga/dfsgo/discovery"
 	kvstore "github.com/gusga/dfsgo/kv_store"
+	"github.com/gusga/dfsgo/placement"
 	"github.com/gusga/dfsgo/storage"
 	"github.com/gusga/dfsgo/transport"
 	"go.uber.org/zap"
 )
 
+const (
+	// defaultRequestTimeout bounds how long Get waits for the peers when
+	// the caller's context does not carry a deadline.
+	defaultRequestTimeout = 10 * time.Second
+
+	// minTransferRate is the rate, in bytes per second, a transfer is
+	// expected to go at least at, see transferTimeout.
+	minTransferRate = 1 << 20
+
+	// ownerFetchTimeout is how long Get waits for the owners of a file
+	// before asking the rest of the network.
+	ownerFetchTimeout = time.Second
+
+	DefaultReplicationFactor = 3
+)
+
+var ErrFileNotFound = errors.New("file not found in the network")
+
 type FileServerOpts struct {
-	ID                string
+	ID string
+	// Keyring wraps the data key of every file replicated to the peers.
+	// When it is nil a keyring holding only EncKey is used.
+	Keyring           *fscrypto.Keyring
 	EncKey            []byte
 	StorageRoot       string
 	PathTransformFunc storage.PathTransformFunc
@@ -26,19 +52,82 @@ type FileServerOpts struct {
 	Logger            *zap.Logger
 	DiscoverySrv      discovery.DiscoveryService
 	Storage           *storage.Storage
+	// ReplicationFactor is the number of nodes, picked from the hash ring,
+	// a file is stored on.
+	ReplicationFactor int
+	// WriteConsistency and ReadConsistency are the levels used by requests
+	// whose context does not set one with WithConsistency.
+	WriteConsistency ConsistencyLevel
+	ReadConsistency  ConsistencyLevel
+	// HTTPAddr is the address the HTTP gateway listens on, it is not
+	// started when empty. See HTTPHandler.
+	HTTPAddr string
+	// ScrubInterval is how often the stored files are checked for
+	// corruption, see Scrub. They are not when it is zero.
+	ScrubInterval time.Duration
+	// ChunkSize is the size of the chunks files larger than it are
+	// replicated in, DefaultChunkSize when zero.
+	ChunkSize int64
+	// Erasure is the erasure code of the files stored through the server
+	// whose context does not set one with WithErasure. They are replicated
+	// when it is the zero code.
+	Erasure ErasureCode
+	// RebuildDelay is how long after a node left the shards it held are
+	// rebuilt, DefaultRebuildDelay when zero. See RebuildShards.
+	RebuildDelay time.Duration
+	// UploadTTL is how long an upload session is kept, DefaultUploadTTL
+	// when zero. See CreateUpload.
+	UploadTTL time.Duration
 }
 
 type FileServer struct {
 	FileServerOpts
 	peerStore kvstore.KVStore[string, transport.Peer]
-	peers     map[string]transport.Peer
 	quitch    chan struct{}
+
+	ring *placement.Ring
+	// peerNodes maps the remote address of a peer connection to the node
+	// it introduced itself as, and nodePeers does the opposite.
+	peerNodes kvstore.KVStore[string, discovery.Node]
+	nodePeers kvstore.KVStore[string, string]
+
+	// rebuildTimer is the rebuild of the shards scheduled once a node left.
+	rebuildMu    sync.Mutex
+	rebuildTimer *time.Timer
+
+	httpServer *http.Server
 }
 
 func NewServer(opts FileServerOpts) *FileServer {
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = DefaultReplicationFactor
+	}
+	if opts.WriteConsistency == 0 {
+		opts.WriteConsistency = One
+	}
+	if opts.ReadConsistency == 0 {
+		opts.ReadConsistency = One
+	}
+	if opts.Keyring == nil {
+		opts.Keyring = fscrypto.NewKeyring(opts.EncKey)
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.RebuildDelay <= 0 {
+		opts.RebuildDelay = DefaultRebuildDelay
+	}
+	if opts.UploadTTL <= 0 {
+		opts.UploadTTL = DefaultUploadTTL
+	}
+
 	srv := &FileServer{
 		FileServerOpts: opts,
 		peerStore:      kvstore.NewInMemoryKVStore[string, transport.Peer](),
+		quitch:         make(chan struct{}),
+		ring:           placement.NewRing(placement.RingOpts{}),
+		peerNodes:      kvstore.NewInMemoryKVStore[string, discovery.Node](),
+		nodePeers:      kvstore.NewInMemoryKVStore[string, string](),
 	}
 
 	return srv
@@ -51,11 +140,26 @@ func (s *FileServer) Start() error {
 		return err
 	}
 
+	if s.HTTPAddr != "" {
+		if err := s.startHTTP(); err != nil {
+			s.Transport.Close()
+			return err
+		}
+	}
+
 	s.addSelfNode()
 
+	if s.ScrubInterval > 0 {
+		go s.scrubLoop()
+	}
+	go s.uploadGCLoop()
+
+	// Nodes joining after the bootstrap are reported by the watch.
+	events := s.DiscoverySrv.Watch()
+
 	s.bootstrapNetwork()
 
-	s.loop()
+	s.loop(events)
 
 	return nil
 }
@@ -67,15 +171,533 @@ func (s *FileServer) OnPeer(p transport.Peer) error {
 
 	s.Logger.Info("connecting to remote fileserver...", zap.String("remote_addr", remoteAddr))
 
-	return nil
+	// Inbound connections come from an ephemeral port, so the peer needs to
+	// be told which node is on the other side before it can place files.
+	hello := &Message{
+		Payload: MessageHello{
+			ID:   s.ID,
+			Addr: s.Transport.Addr(),
+		},
+	}
+
+	return s.send(p, hello)
 }
 
 func (s *FileServer) Close() {
+	close(s.quitch)
+	s.rebuildMu.Lock()
+	if s.rebuildTimer != nil {
+		s.rebuildTimer.Stop()
+	}
+	s.rebuildMu.Unlock()
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
 	s.Transport.Close()
 	s.DiscoverySrv.Close()
 }
 
-func (s *FileServer) loop() {
+// Store writes the content of r to the local storage under key and then
+// replicates an encrypted copy of it to the owners of the key. Files larger
+// than ChunkSize are split in chunks at content-defined boundaries
+// instead, every chunk replicated to the owners of its own key unless they
+// already hold it, followed by the manifest listing them. Files stored with
+// an erasure code are encoded in shards spread on distinct peers, see
+// ErasureCode. It returns once enough owners acknowledged every write to
+// satisfy the write consistency level, or a *QuorumError if they did not
+// before ctx is done. The file is stored in the namespace of ctx, see
+// WithNamespace.
+func (s *FileServer) Store(ctx context.Context, key string, r io.Reader) error {
+	id := s.namespace(ctx)
+	hashedKey := fscrypto.HashKey(key)
+	code := erasureFromContext(ctx, s.Erasure)
+
+	// The chunks and the shards of the content replaced are released once
+	// the new content is replicated.
+	prevMeta, _ := s.Storage.Metadata(id, key)
+	prevShards := shardKeys(hashedKey, prevMeta)
+	prev, err := s.localChunks(id, key)
+	if err != nil {
+		s.Logger.Error("could not split local copy in chunks", zap.Error(err), zap.String("key", key))
+	}
+
+	meta := storage.Metadata{
+		Key:         key,
+		ContentType: contentTypeFromContext(ctx),
+		ChunkSize:   s.ChunkSize,
+	}
+	chunks := newChunker(s.ChunkSize)
+	var w io.Writer = chunks
+	if code.Enabled() {
+		meta.ChunkSize = 0
+		meta.DataShards = code.Data
+		meta.ParityShards = code.Parity
+		w = io.Discard
+	}
+
+	meta, err = s.Storage.WriteWithMetadata(id, meta, io.TeeReader(r, w))
+	if err != nil {
+		return err
+	}
+	size := meta.Size
+
+	s.Logger.Info("file stored on disk", zap.String("key", key), zap.Int64("size", size))
+
+	// Sending the content takes as long as it does, the transport bounds
+	// the wait for every ack once it is sent.
+
+	var keys []string
+	switch {
+	case code.Enabled():
+		err = s.storeErasure(ctx, id, key, hashedKey, meta, code)
+	case isChunked(meta):
+		m := newManifest(meta, chunks.Chunks())
+		keys = m.keys()
+		err = s.storeChunked(ctx, id, key, hashedKey, meta.ContentType, m, prev)
+	default:
+		err = s.storeReplicas(ctx, s.fileReplica(id, hashedKey, meta), s.localContent(id, key, 0, size))
+	}
+	if err != nil {
+		return err
+	}
+
+	s.releaseChunks(id, hashedKey, without(prev, keys))
+	s.deleteShards(id, without(prevShards, shardKeys(hashedKey, meta)))
+
+	return nil
+}
+
+// storeReplicas replicates the content opened by open to the owners of
+// msg.Key, see replicateTo. The local node counts as an owner holding the
+// content when it is one.
+func (s *FileServer) storeReplicas(ctx context.Context, msg MessageStoreFile, open func() (io.ReadCloser, error)) error {
+	acked := 0
+	if s.isOwner(msg.Key) {
+		acked++
+	}
+
+	return s.replicateTo(ctx, msg, s.ownerPeers(msg.Key), acked, open)
+}
+
+// fileReplica returns the message replicating whole under hashedKey the
+// local file of the namespace id described by meta.
+func (s *FileServer) fileReplica(id, hashedKey string, meta storage.Metadata) MessageStoreFile {
+	return MessageStoreFile{
+		ID:           id,
+		Key:          hashedKey,
+		Size:         fscrypto.EnvelopeSize(meta.Size),
+		ContentType:  meta.ContentType,
+		FileSize:     meta.Size,
+		FileChecksum: meta.Checksum,
+	}
+}
+
+// replicateTo replicates the content opened by open to the peers, see
+// replicate, and waits for enough of them to acknowledge it to satisfy the
+// write consistency level, counting the acked owners already holding it.
+func (s *FileServer) replicateTo(ctx context.Context, msg MessageStoreFile, peers []transport.Peer, acked int, open func() (io.ReadCloser, error)) error {
+	level := consistencyFromContext(ctx, s.WriteConsistency)
+	required := level.Required(s.ReplicationFactor)
+
+	results := make(chan error, len(peers))
+	for _, peer := range peers {
+		go func(peer transport.Peer) {
+			results <- s.replicate(ctx, peer, &Message{Payload: msg}, open)
+		}(peer)
+	}
+
+	outstanding := len(peers)
+	for acked < required {
+		if acked+outstanding < required {
+			return &QuorumError{Op: "write", Level: level, Required: required, Received: acked}
+		}
+
+		select {
+		case err := <-results:
+			outstanding--
+			if err != nil {
+				s.Logger.Error("could not replicate file", zap.Error(err), zap.String("key", msg.Key))
+				continue
+			}
+			acked++
+		case <-ctx.Done():
+			return &QuorumError{Op: "write", Level: level, Required: required, Received: acked}
+		}
+	}
+
+	return nil
+}
+
+// Get returns the content stored under key. With a read consistency level
+// of ONE the local copy is served when there is one, otherwise the file is
+// fetched from the first peer able to serve it, asking the owners of the key
+// before the rest of the network, and kept locally for later reads.
+// Stronger levels first wait for enough owners to agree on the content of
+// the file, which is fetched from one of them when the local copy differs,
+// and return a *QuorumError if they do not. The file is read from the
+// namespace of ctx, see WithNamespace.
+func (s *FileServer) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	_, r, err := s.get(ctx, key)
+	return r, err
+}
+
+// get is Get also returning the metadata of the content, read along with it.
+func (s *FileServer) get(ctx context.Context, key string) (storage.Metadata, io.ReadCloser, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	id := s.namespace(ctx)
+	hashedKey := fscrypto.HashKey(key)
+	level := consistencyFromContext(ctx, s.ReadConsistency)
+	required := level.Required(s.ReplicationFactor)
+	local, hasLocal := s.localVersion(id, key)
+
+	if required > 1 {
+		version, holders, err := s.readQuorum(ctx, id, level, required, hashedKey, local, hasLocal)
+		if err != nil {
+			return storage.Metadata{}, nil, err
+		}
+
+		if !hasLocal || local != version {
+			return s.fetch(ctx, id, key, version.checksum, holders, nil)
+		}
+	} else if !hasLocal {
+		owners := s.ownerPeers(hashedKey)
+		return s.fetch(ctx, id, key, "", owners, s.otherPeers(owners))
+	}
+
+	return s.readLocal(ctx, id, key)
+}
+
+// readLocal opens the local copy of the file stored under key in the
+// namespace id. The content of an erasure coded file, of which the node
+// keeps the manifest, is decoded from its shards.
+func (s *FileServer) readLocal(ctx context.Context, id, key string) (storage.Metadata, io.ReadCloser, error) {
+	meta, r, err := s.Storage.ReadWithMetadata(id, key)
+	if err != nil || !meta.Manifest {
+		return meta, r, err
+	}
+	r.Close()
+
+	m, err := s.localManifest(id, meta)
+	if err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	r, err = s.decodeShards(ctx, id, fscrypto.HashKey(key), m)
+	if err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	return fileMetadata(meta), r, nil
+}
+
+// fileVersion identifies the content of a file by its size and checksum.
+// The zero value stands for no content.
+type fileVersion struct {
+	size     int64
+	checksum string
+}
+
+// localVersion returns the version of the local copy of the file stored
+// under key in the namespace id, and whether there is one.
+func (s *FileServer) localVersion(id, key string) (fileVersion, bool) {
+	if !s.Storage.HasFile(id, key) {
+		return fileVersion{}, false
+	}
+
+	meta, _ := s.Storage.Metadata(id, key)
+	meta = fileMetadata(meta)
+	return fileVersion{size: meta.Size, checksum: meta.Checksum}, true
+}
+
+// readQuorum asks the owners of key which version of the file they hold
+// until required of the answers agree on one. The local node answers for
+// itself, with the version of its local copy, when it owns the key or has a
+// copy of it. It returns the version agreed on and the peers holding it,
+// ErrFileNotFound when they agree no one does.
+func (s *FileServer) readQuorum(ctx context.Context, id string, level ConsistencyLevel, required int, hashedKey string, local fileVersion, hasLocal bool) (fileVersion, []transport.Peer, error) {
+	votes := make(map[fileVersion]int)
+	if hasLocal || s.isOwner(hashedKey) {
+		votes[local]++
+	}
+
+	msg := &Message{
+		Payload: MessageStatFile{
+			ID:  id,
+			Key: hashedKey,
+		},
+	}
+
+	owners := s.ownerPeers(hashedKey)
+	results := make(chan peerReply, len(owners))
+	for _, peer := range owners {
+		go func(peer transport.Peer) {
+			_, reply, err := s.request(ctx, peer, msg)
+			results <- peerReply{peer: peer, msg: reply, err: err}
+		}(peer)
+	}
+
+	outstanding := len(owners)
+	holders := make(map[fileVersion][]transport.Peer)
+
+	for {
+		agreed, best := fileVersion{}, 0
+		for version, n := range votes {
+			if n > best {
+				agreed, best = version, n
+			}
+		}
+
+		if best >= required {
+			if agreed == (fileVersion{}) {
+				return agreed, nil, ErrFileNotFound
+			}
+			return agreed, holders[agreed], nil
+		}
+		if best+outstanding < required {
+			return fileVersion{}, nil, &QuorumError{Op: "read", Level: level, Required: required, Received: best}
+		}
+
+		select {
+		case res := <-results:
+			outstanding--
+			if res.err != nil {
+				s.Logger.Error("could not stat file", zap.Error(res.err), zap.String("remote_addr", res.peer.RemoteAddr().String()))
+				continue
+			}
+
+			var version fileVersion
+			if stat, ok := res.msg.Payload.(MessageFileStat); ok && stat.Exists {
+				version = fileVersion{size: stat.FileSize, checksum: stat.FileChecksum}
+				holders[version] = append(holders[version], res.peer)
+			}
+			votes[version]++
+		case <-ctx.Done():
+			return fileVersion{}, nil, &QuorumError{Op: "read", Level: level, Required: required, Received: best}
+		}
+	}
+}
+
+type peerReply struct {
+	peer transport.Peer
+	rpc  transport.RPC
+	msg  *Message
+	err  error
+}
+
+// fetch asks the first peers for the file stored under key in the
+// namespace id, and the rest of them if none of the first ones could serve
+// it in time, then decrypts the first copy received into the local
+// storage, see writeStream. When checksum is set, copies of other content
+// are rejected.
+func (s *FileServer) fetch(ctx context.Context, id, key, checksum string, first, rest []transport.Peer) (storage.Metadata, io.ReadCloser, error) {
+	s.Logger.Info("file not found locally, fetching from network", zap.String("key", key))
+
+	firstCtx, cancel := context.WithTimeout(ctx, ownerFetchTimeout)
+	defer cancel()
+
+	if meta, r, ok := s.fetchFrom(firstCtx, id, key, checksum, first); ok {
+		return meta, r, nil
+	}
+	if meta, r, ok := s.fetchFrom(ctx, id, key, checksum, rest); ok {
+		return meta, r, nil
+	}
+
+	if err := ctx.Err(); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return storage.Metadata{}, nil, err
+	}
+
+	return storage.Metadata{}, nil, ErrFileNotFound
+}
+
+func (s *FileServer) fetchFrom(ctx context.Context, id, key, checksum string, peers []transport.Peer) (storage.Metadata, io.ReadCloser, bool) {
+	msg := &Message{
+		Payload: MessageGetFile{
+			ID:  id,
+			Key: fscrypto.HashKey(key),
+		},
+	}
+
+	results := make(chan peerReply, len(peers))
+	for _, peer := range peers {
+		go func(peer transport.Peer) {
+			rpc, reply, err := s.request(ctx, peer, msg)
+			results <- peerReply{peer: peer, rpc: rpc, msg: reply, err: err}
+		}(peer)
+	}
+
+	for i := range peers {
+		res := <-results
+		if res.err != nil {
+			s.Logger.Error("could not get file", zap.Error(res.err), zap.String("remote_addr", res.peer.RemoteAddr().String()))
+			continue
+		}
+
+		// Peers without the file answer with a plain message.
+		if !res.rpc.Stream {
+			continue
+		}
+
+		stream, _ := res.msg.Payload.(MessageFileStream)
+		meta, r, err := s.writeStream(ctx, id, key, checksum, stream, res.rpc.Reader)
+		res.rpc.Reader.Close()
+		if err != nil {
+			s.Logger.Error("could not write file received over the network", zap.Error(err), zap.String("remote_addr", res.peer.RemoteAddr().String()))
+			continue
+		}
+
+		s.Logger.Info("received file over the network", zap.String("key", key), zap.Int64("size", meta.Size), zap.String("remote_addr", res.peer.RemoteAddr().String()))
+
+		// Copies sent by slower peers are not needed anymore.
+		go discardReplies(results, len(peers)-i-1)
+
+		return meta, r, true
+	}
+
+	return storage.Metadata{}, nil, false
+}
+
+// writeStream writes the file received in stream to the local storage
+// under key in the namespace id and opens it. When the stream carries the manifest of a file
+// replicated in chunks, the chunks are read as they are fetched instead,
+// see fetchChunks, and the shards of an erasure coded file are decoded as
+// they are read, only its manifest being kept. When checksum is set, a
+// file of other content is rejected.
+func (s *FileServer) writeStream(ctx context.Context, id, key, checksum string, stream MessageFileStream, r io.Reader) (storage.Metadata, io.ReadCloser, error) {
+	if stream.Manifest {
+		m, err := s.readManifest(r, stream.Size)
+		if err != nil {
+			return storage.Metadata{}, nil, err
+		}
+		if checksum != "" && m.Checksum != checksum {
+			return storage.Metadata{}, nil, fmt.Errorf("manifest of %s: %w", key, storage.ErrChecksumMismatch)
+		}
+
+		if m.Data == 0 {
+			meta, r := s.fetchChunks(ctx, id, key, stream.ContentType, m)
+			return meta, r, nil
+		}
+
+		meta, err := s.keepManifest(id, key, stream.ContentType, m)
+		if err != nil {
+			return storage.Metadata{}, nil, err
+		}
+		r, err := s.decodeShards(ctx, id, stream.Key, m)
+		if err != nil {
+			return storage.Metadata{}, nil, err
+		}
+		return fileMetadata(meta), r, nil
+	}
+
+	size, err := fscrypto.EnvelopeContentSize(stream.Size)
+	if err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	_, err = s.Storage.WriteDecrypt(s.Keyring, id, storage.Metadata{Key: key, Size: size, Checksum: checksum, ContentType: stream.ContentType}, r)
+	if err != nil {
+		return storage.Metadata{}, nil, err
+	}
+
+	return s.Storage.ReadWithMetadata(id, key)
+}
+
+func discardReplies(results <-chan peerReply, n int) {
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res.err == nil && res.rpc.Stream {
+			res.rpc.Reader.Close()
+		}
+	}
+}
+
+// transferTimeout returns how long to wait for a peer answering once it
+// sent size bytes on its own.
+func transferTimeout(size int64) time.Duration {
+	return defaultRequestTimeout + time.Duration(size/minTransferRate)*time.Second
+}
+
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, defaultRequestTimeout)
+}
+
+// Delete removes the file stored under key from the local storage, releases
+// the chunks of it the node keeps and asks every peer to remove its replica,
+// release the chunks of it and delete the shards of it they hold. The file
+// is deleted from the namespace of ctx, see WithNamespace.
+func (s *FileServer) Delete(ctx context.Context, key string) error {
+	id := s.namespace(ctx)
+	hashedKey := fscrypto.HashKey(key)
+
+	meta, _ := s.Storage.Metadata(id, key)
+	shards := shardKeys(hashedKey, meta)
+	chunks, err := s.localChunks(id, key)
+	if err != nil {
+		s.Logger.Error("could not split local copy in chunks", zap.Error(err), zap.String("key", key))
+	}
+
+	local := s.Storage.HasFile(id, key)
+	if local {
+		if err := s.Storage.Delete(id, key); err != nil {
+			return err
+		}
+	}
+
+	// Without a readable local copy the chunks and the shards are the ones
+	// the manifest lists.
+	if !local || err != nil {
+		fetchCtx, cancel := withDefaultTimeout(ctx)
+		m, ok := s.fetchManifest(fetchCtx, id, hashedKey, s.ownerPeers(hashedKey))
+		cancel()
+		if ok {
+			chunks = m.keys()
+			shards = m.shardKeys(hashedKey)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.releaseLocalChunks(id, hashedKey, chunks)
+
+	msg := &Message{
+		Payload: MessageDeleteFile{
+			ID:     id,
+			Key:    hashedKey,
+			Chunks: chunks,
+			Shards: shards,
+		},
+	}
+
+	return s.broadcast(msg)
+}
+
+// deleteShards asks every peer to delete the shards of keys of the
+// namespace id it holds.
+func (s *FileServer) deleteShards(id string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	msg := &Message{
+		Payload: MessageDeleteFile{
+			ID:     id,
+			Shards: keys,
+		},
+	}
+
+	if err := s.broadcast(msg); err != nil {
+		s.Logger.Error("could not delete shards", zap.Error(err))
+	}
+}
+
+func (s *FileServer) loop(events <-chan discovery.Event) {
 	defer func() {
 		s.Logger.Warn("file server stopped due to error or user quit action")
 		s.Transport.Close()
@@ -84,52 +706,400 @@ func (s *FileServer) loop() {
 	for {
 		select {
 		case rpc := <-s.Transport.Consume():
-			var msg Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
+			msg, err := decodeMessage(rpc.Payload)
+			if err != nil {
 				log.Println("decoding error: ", err)
 				s.Logger.Error("decoding error", zap.Error(err))
+				if rpc.Stream {
+					rpc.Reader.Close()
+				}
+				continue
+			}
+
+			// Streams are consumed concurrently, they do not hold up the
+			// connection they arrive on.
+			if rpc.Stream {
+				go func() {
+					if err := s.handleStream(rpc, msg); err != nil {
+						s.Logger.Error("handle stream error", zap.Error(err))
+					}
+				}()
+				continue
 			}
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
+
+			if err := s.handleMessage(rpc, msg); err != nil {
 				s.Logger.Error("handle message error", zap.Error(err))
 			}
 		case addr := <-s.Transport.ClosedPeer():
 			s.Logger.Info("removing peer from list", zap.String("remote_peer_addr", addr))
 			s.peerStore.Delete(addr)
+			s.removePeerNode(addr)
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			s.handleDiscoveryEvent(event)
 		case <-s.quitch:
 			return
 		}
 	}
 }
 
-func (s *FileServer) broadcast(msg *Message) error {
+func encodeMessage(msg *Message) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeMessage(payload []byte) (*Message, error) {
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&msg); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+func (s *FileServer) send(peer transport.Peer, msg *Message) error {
+	return s.multicast([]transport.Peer{peer}, msg)
+}
+
+// request sends msg to the peer and waits for the message it replies with.
+func (s *FileServer) request(ctx context.Context, peer transport.Peer, msg *Message) (transport.RPC, *Message, error) {
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return transport.RPC{}, nil, err
+	}
+
+	rpc, err := s.Transport.Request(ctx, peer, payload)
+	if err != nil {
+		return rpc, nil, err
+	}
+
+	reply, err := decodeMessage(rpc.Payload)
+	if err != nil {
+		if rpc.Stream {
+			rpc.Reader.Close()
+		}
+		return rpc, nil, err
+	}
+
+	return rpc, reply, nil
+}
+
+// reply answers the request req with msg. It does not block the caller,
+// which is usually the loop goroutine.
+func (s *FileServer) reply(peer transport.Peer, req transport.RPC, msg *Message) {
+	go func() {
+		payload, err := encodeMessage(msg)
+		if err == nil {
+			err = transport.Reply(peer, req, payload)
+		}
+		if err != nil {
+			s.Logger.Error("could not reply to peer", zap.Error(err), zap.String("remote_addr", peer.RemoteAddr().String()))
+		}
+	}()
+}
+
+func (s *FileServer) broadcast(msg *Message) error {
+	return s.multicast(s.nodePeerList(), msg)
+}
+
+func (s *FileServer) multicast(peers []transport.Peer, msg *Message) error {
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	frame := transport.Frame{
+		Type: transport.IncomingMessage,
+		Body: payload,
+	}
+
+	for _, peer := range peers {
+		if err := peer.Send(frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileServer) isOwner(key string) bool {
+	for _, node := range s.ring.Owners(key, s.ReplicationFactor) {
+		if node.Address == s.Transport.Addr() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ownerPeers returns the connected peers among the owners of key on the
+// hash ring. The local node is never part of the result.
+func (s *FileServer) ownerPeers(key string) []transport.Peer {
+	owners := s.ring.Owners(key, s.ReplicationFactor)
+
+	peers := make([]transport.Peer, 0, len(owners))
+	for _, node := range owners {
+		if node.Address == s.Transport.Addr() {
+			continue
+		}
+
+		peer, ok := s.peerForNode(node.Address)
+		if !ok {
+			s.Logger.Warn("owner node is not connected", zap.String("key", key), zap.String("node_addr", node.Address))
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// otherPeers returns every connected peer not included in exclude.
+func (s *FileServer) otherPeers(exclude []transport.Peer) []transport.Peer {
+	excluded := make(map[string]bool, len(exclude))
+	for _, peer := range exclude {
+		excluded[peer.RemoteAddr().String()] = true
+	}
+
+	var peers []transport.Peer
+	for _, peer := range s.nodePeerList() {
+		if !excluded[peer.RemoteAddr().String()] {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// nodePeerList returns the connected peers that introduced themselves as
+// nodes, leaving out the clients.
+func (s *FileServer) nodePeerList() []transport.Peer {
+	var peers []transport.Peer
+	for _, peer := range s.peerStore.Values() {
+		if _, ok := s.peerNodes.Get(peer.RemoteAddr().String()); ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+func (s *FileServer) peerForNode(addr string) (transport.Peer, bool) {
+	remoteAddr, ok := s.nodePeers.Get(addr)
+	if !ok {
+		return nil, false
+	}
+
+	return s.peerStore.Get(remoteAddr)
+}
+
+// replicate streams the encrypted content opened by open to the peer and
+// waits for the peer to acknowledge it was written. Content is encrypted in
+// an envelope, chunks are opened encrypted already, see localChunk.
+func (s *FileServer) replicate(ctx context.Context, peer transport.Peer, msg *Message, open func() (io.ReadCloser, error)) error {
+	r, err := open()
+	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	for _, peer := range s.peers {
-		peer.SendData([]byte{transport.IncomingMessage})
-		if err := peer.SendData(buf.Bytes()); err != nil {
+	payload, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	store := msg.Payload.(MessageStoreFile)
+	size := store.Size
+	rpc, err := s.Transport.RequestStream(ctx, peer, payload, size, func(w io.Writer) error {
+		if store.ID == chunkNamespace {
+			_, err := io.Copy(w, r)
 			return err
 		}
+		_, err := fscrypto.EncryptEnvelope(s.Keyring, r, w)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	reply, err := decodeMessage(rpc.Payload)
+	if err != nil {
+		return err
 	}
 
+	ack, ok := reply.Payload.(MessageStoreFileAck)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T to store request", reply.Payload)
+	}
+	if ack.Err != "" {
+		return fmt.Errorf("peer %s failed to store file: %s", peer.RemoteAddr(), ack.Err)
+	}
+
+	s.Logger.Info("replicated file over the network", zap.String("key", ack.Key), zap.Int64("size", size), zap.String("remote_addr", peer.RemoteAddr().String()))
+
 	return nil
 }
 
-func (s *FileServer) handleMessage(from string, msg *Message) error {
+// localContent returns a function opening size bytes of the local file
+// stored under key in the namespace id, from off.
+func (s *FileServer) localContent(id, key string, off, size int64) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		_, r, err := s.Storage.Read(id, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if off > 0 {
+			seeker, ok := r.(io.Seeker)
+			if !ok {
+				r.Close()
+				return nil, fmt.Errorf("content of %s is not seekable", key)
+			}
+			if _, err := seeker.Seek(off, io.SeekStart); err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(r, size), r}, nil
+	}
+}
+
+func (s *FileServer) handleMessage(rpc transport.RPC, msg *Message) error {
 	switch v := msg.Payload.(type) {
-	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+	case MessageHello:
+		return s.handleMessageHello(rpc.From, v)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		// Serving a file may take long, the loop must keep consuming the
+		// messages of other peers meanwhile.
+		go func() {
+			if err := s.handleMessageGetFile(rpc, v); err != nil {
+				s.Logger.Error("handle message error", zap.Error(err))
+			}
+		}()
+	case MessageRepairReplica:
+		go func() {
+			if err := s.handleMessageRepairReplica(rpc, v); err != nil {
+				s.Logger.Error("handle message error", zap.Error(err))
+			}
+		}()
+	case MessageStatFile:
+		return s.handleMessageStatFile(rpc, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(rpc.From, v)
+	case MessageRefChunks:
+		return s.handleMessageRefChunks(rpc, v)
+	case MessageReleaseChunks:
+		return s.handleMessageReleaseChunks(rpc.From, v)
+	case MessageStatFiles:
+		return s.handleMessageStatFiles(rpc, v)
+	case MessageGetKeyHeaders:
+		go func() {
+			if err := s.handleMessageGetKeyHeaders(rpc, v); err != nil {
+				s.Logger.Error("handle message error", zap.Error(err))
+			}
+		}()
+	case MessageRewrapKeys:
+		go func() {
+			if err := s.handleMessageRewrapKeys(rpc, v); err != nil {
+				s.Logger.Error("handle message error", zap.Error(err))
+			}
+		}()
+	case MessageListKeys:
+		go func() {
+			if err := s.handleMessageListKeys(rpc, v); err != nil {
+				s.Logger.Error("handle message error", zap.Error(err))
+			}
+		}()
+	case MessageClientGet, MessageClientDelete, MessageClientStat, MessageClientList,
+		MessageClientCreateUpload, MessageClientListParts, MessageClientCompleteUpload, MessageClientAbortUpload:
+		// Client requests wait on the network.
+		go func() {
+			if err := s.handleClientMessage(rpc, msg); err != nil {
+				s.Logger.Error("handle client message error", zap.Error(err))
+			}
+		}()
 	}
 
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
+func (s *FileServer) handleStream(rpc transport.RPC, msg *Message) error {
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		return s.handleMessageStoreFile(rpc, v)
+	case MessageClientPut:
+		return s.handleMessageClientPut(rpc, v)
+	case MessageClientUploadPart:
+		return s.handleMessageClientUploadPart(rpc, v)
+	}
+
+	rpc.Reader.Close()
+
+	return fmt.Errorf("[%s] received a stream of unknown type %T from %s", s.Transport.Addr(), msg.Payload, rpc.From)
+}
+
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	// A peer identified during the transport handshake can not introduce
+	// itself as another node.
+	if peer, ok := s.peerStore.Get(from); ok && peer.ID() != "" && peer.ID() != msg.ID {
+		peer.Close()
+		return fmt.Errorf("peer %s identified as %s introduced itself as %s", from, peer.ID(), msg.ID)
+	}
+
+	node := discovery.Node{
+		ServerID: msg.ID,
+		Address:  msg.Addr,
+	}
+
+	s.peerNodes.Set(from, node)
+	s.nodePeers.Set(node.Address, from)
+	s.ring.Add(node)
+
+	s.Logger.Info("node joined the hash ring", zap.String("node_addr", node.Address), zap.String("remote_addr", from))
+
+	return nil
+}
+
+func (s *FileServer) removePeerNode(remoteAddr string) {
+	node, ok := s.peerNodes.Get(remoteAddr)
+	if !ok {
+		return
+	}
+
+	s.peerNodes.Delete(remoteAddr)
+
+	// The node may have reconnected through another connection already.
+	if current, ok := s.nodePeers.Get(node.Address); ok && current != remoteAddr {
+		return
+	}
+
+	s.nodePeers.Delete(node.Address)
+	s.ring.Remove(node.Address)
+
+	s.Logger.Info("node left the hash ring", zap.String("node_addr", node.Address))
+
+	s.scheduleRebuild()
+}
+
+func (s *FileServer) handleMessageGetFile(rpc transport.RPC, msg MessageGetFile) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
 	if !s.Storage.HasFile(msg.ID, msg.Key) {
+		s.reply(peer, rpc, &Message{Payload: MessageFileStat{ID: msg.ID, Key: msg.Key}})
 		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
 	}
 
@@ -139,45 +1109,187 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing readCloser")
-		defer rc.Close()
-	}
+	// Replicas stored before their metadata was recorded have no content
+	// type.
+	meta, _ := s.Storage.Metadata(msg.ID, msg.Key)
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+	// The reply is a stream frame describing the file followed by its
+	// content.
+	payload, err := encodeMessage(&Message{
+		Payload: MessageFileStream{
+			ID:          msg.ID,
+			Key:         msg.Key,
+			Size:        fileSize,
+			ContentType: meta.ContentType,
+			Manifest:    meta.Manifest,
+		},
+	})
+	if err != nil {
+		return err
 	}
 
-	// First send the "incomingStream" byte to the peer and then we can send
-	// the file size as an int64.
-	peer.SendData([]byte{transport.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	var n int64
+	err = transport.ReplyStream(context.Background(), peer, rpc, payload, fileSize, func(w io.Writer) error {
+		n, err = io.Copy(w, r)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, rpc.From)
 
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageStoreFile(rpc transport.RPC, msg MessageStoreFile) error {
+	peer, ok := s.peerStore.Get(rpc.From)
 	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+		return fmt.Errorf("peer (%s) could not be found in the peer list", rpc.From)
 	}
 
-	n, err := s.Storage.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	meta := storage.Metadata{
+		Key:          msg.Key,
+		Size:         msg.Size,
+		ContentType:  msg.ContentType,
+		Manifest:     msg.Manifest,
+		FileSize:     msg.FileSize,
+		FileChecksum: msg.FileChecksum,
+		// Chunks are encrypted with a key derived from their content.
+		KeyHeader: msg.ID != chunkNamespace,
+	}
+	if msg.Ref != "" {
+		meta.Refs = []string{msg.Ref}
+	}
+
+	// A stream cut short must not leave part of the replica behind.
+	meta, err := s.Storage.WriteWithMetadata(msg.ID, meta, rpc.Reader)
+	rpc.Reader.Close()
+
+	ack := MessageStoreFileAck{
+		ID:  msg.ID,
+		Key: msg.Key,
+	}
+	if err != nil {
+		ack.Err = err.Error()
+	}
+	s.reply(peer, rpc, &Message{Payload: ack})
+
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), meta.Size)
+
+	return nil
+}
+
+func (s *FileServer) handleMessageStatFile(rpc transport.RPC, msg MessageStatFile) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	stat := MessageFileStat{
+		ID:     msg.ID,
+		Key:    msg.Key,
+		Exists: s.Storage.HasFile(msg.ID, msg.Key),
+	}
+	if stat.Exists {
+		size, r, err := s.Storage.Read(msg.ID, msg.Key)
+		if err == nil {
+			r.Close()
+			stat.Size = size
+		}
+		meta, _ := s.Storage.Metadata(msg.ID, msg.Key)
+		stat.Manifest = meta.Manifest
+		stat.FileSize = meta.FileSize
+		stat.FileChecksum = meta.FileChecksum
+	}
+
+	s.reply(peer, rpc, &Message{Payload: stat})
+
+	return nil
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, msg MessageDeleteFile) error {
+	if !s.isFromServer(from, msg.ID) {
+		return fmt.Errorf("peer %s can not delete the files of %s", from, msg.ID)
+	}
+
+	for _, key := range append([]string{msg.Key}, msg.Shards...) {
+		if key == "" || !s.Storage.HasFile(msg.ID, key) {
+			continue
+		}
+
+		s.Logger.Info("deleting file on peer request", zap.String("key", key), zap.String("remote_addr", from))
+
+		if err := s.Storage.Delete(msg.ID, key); err != nil {
+			return err
+		}
+	}
+
+	return s.handleMessageReleaseChunks(from, MessageReleaseChunks{ID: chunkNamespace, Ref: chunkRef(msg.ID, msg.Key), Keys: msg.Chunks})
+}
+
+func (s *FileServer) handleMessageRefChunks(rpc transport.RPC, msg MessageRefChunks) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	reply := MessageChunkRefs{ID: msg.ID}
+	for _, key := range msg.Keys {
+		held, err := s.Storage.AddRef(msg.ID, key, msg.Ref)
+		if err != nil {
+			reply.Err = err.Error()
+			break
+		}
+		if !held {
+			reply.Missing = append(reply.Missing, key)
+		}
+	}
+
+	s.reply(peer, rpc, &Message{Payload: reply})
+
+	return nil
+}
+
+func (s *FileServer) handleMessageStatFiles(rpc transport.RPC, msg MessageStatFiles) error {
+	peer, ok := s.peerStore.Get(rpc.From)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", rpc.From)
+	}
+
+	reply := MessageFilesHeld{ID: msg.ID}
+	for _, key := range msg.Keys {
+		if s.Storage.HasFile(msg.ID, key) {
+			reply.Keys = append(reply.Keys, key)
+		}
+	}
 
-	peer.CloseStream()
+	s.reply(peer, rpc, &Message{Payload: reply})
+
+	return nil
+}
+
+func (s *FileServer) handleMessageReleaseChunks(from string, msg MessageReleaseChunks) error {
+	id, _, ok := parseChunkRef(msg.Ref)
+	if msg.ID != chunkNamespace || !ok || !s.isFromServer(from, id) {
+		return fmt.Errorf("peer %s can not release the reference %s", from, msg.Ref)
+	}
+
+	for _, key := range msg.Keys {
+		left, err := s.Storage.Release(msg.ID, key, msg.Ref)
+		if err != nil {
+			return err
+		}
+		if left == 0 {
+			s.Logger.Debug("released chunk on peer request", zap.String("key", key), zap.String("remote_addr", from))
+		}
+	}
 
 	return nil
 }
@@ -212,16 +1324,49 @@ func (s *FileServer) bootstrapNetwork() error {
 	return nil
 }
 
+// handleDiscoveryEvent connects to the nodes joining the network and drops
+// the connection to the nodes leaving it.
+func (s *FileServer) handleDiscoveryEvent(event discovery.Event) {
+	node := event.Node
+	if node.Address == s.Transport.Addr() {
+		return
+	}
+
+	s.Logger.Info("discovery event", zap.Stringer("type", event.Type), zap.String("node_addr", node.Address))
+
+	switch event.Type {
+	case discovery.NodeJoined:
+		// The joining node usually dialed us already.
+		if _, ok := s.peerForNode(node.Address); ok {
+			return
+		}
+		go func() {
+			if err := s.Transport.Dial(node.Address); err != nil {
+				s.Logger.Info("dial error", zap.Error(err), zap.String("remote_addr", node.Address))
+			}
+		}()
+	case discovery.NodeLeft:
+		s.ring.Remove(node.Address)
+		if peer, ok := s.peerForNode(node.Address); ok {
+			peer.Close()
+		}
+		s.scheduleRebuild()
+	}
+}
+
 func (s *FileServer) addSelfNode() {
 
 	hostname, _ := os.Hostname()
 
 	node := discovery.Node{
+		ServerID:  s.ID,
 		CreatedAt: time.Now(),
 		Address:   s.Transport.Addr(),
 		Hostmane:  hostname,
 	}
 
+	s.ring.Add(node)
+
 	err := s.DiscoverySrv.AddNode(node)
 	if err != nil {
 		s.Logger.Error("error adding node to discovery service", zap.Error(err))
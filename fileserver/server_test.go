@@ -0,0 +1,314 @@
+package fileserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type memDiscovery struct {
+	mu     sync.Mutex
+	nodes  map[string]discovery.Node
+	events chan discovery.Event
+}
+
+func (d *memDiscovery) Watch() <-chan discovery.Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.events == nil {
+		d.events = make(chan discovery.Event, 16)
+	}
+	return d.events
+}
+
+// emit sends an event to the server watching the discovery.
+func (d *memDiscovery) emit(event discovery.Event) {
+	d.Watch()
+	d.events <- event
+}
+
+func (d *memDiscovery) GetNodes() ([]discovery.Node, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	nodes := make([]discovery.Node, 0, len(d.nodes))
+	for _, n := range d.nodes {
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+func (d *memDiscovery) AddNode(n discovery.Node) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nodes[n.Address] = n
+	return nil
+}
+
+func (d *memDiscovery) RemoveDeadNode(n discovery.Node) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.nodes, n.Address)
+	return nil
+}
+
+func (d *memDiscovery) Close() error {
+	return nil
+}
+
+func newTestServer(t *testing.T, disc *memDiscovery, replicationFactor int) *FileServer {
+	t.Helper()
+
+	known, _ := disc.GetNodes()
+
+	logger := zap.NewNop()
+	id := fscrypto.GenerateServerID()
+
+	tr := transport.NewTCPTransport(transport.TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: transport.NewTCPHandshakeFunc(id),
+		Logger:        logger,
+	})
+
+	srv := NewServer(FileServerOpts{
+		ID:                id,
+		EncKey:            fscrypto.NewEncryptionKey(),
+		Transport:         tr,
+		Logger:            logger,
+		DiscoverySrv:      disc,
+		ReplicationFactor: replicationFactor,
+		Storage: storage.NewStorage(storage.StorageOpts{
+			Root:              t.TempDir(),
+			PathTransformFunc: storage.CASPathTransformFunc,
+			Logger:            logger,
+		}),
+	})
+	tr.OnPeer = srv.OnPeer
+
+	go srv.Start()
+	t.Cleanup(srv.Close)
+
+	// The server registers itself once it is listening.
+	require.Eventually(t, func() bool {
+		nodes, _ := disc.GetNodes()
+		return len(nodes) == len(known)+1
+	}, time.Second, 10*time.Millisecond)
+
+	return srv
+}
+
+func waitForPeers(t *testing.T, n int, servers ...*FileServer) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		for _, srv := range servers {
+			if len(srv.peerStore.Values()) < n || len(srv.ring.Nodes()) < n+1 {
+				return false
+			}
+		}
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFileServer_StoreGetDelete(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, DefaultReplicationFactor)
+	s2 := newTestServer(t, disc, DefaultReplicationFactor)
+	waitForPeers(t, 1, s1, s2)
+
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("some big file content "), 4096)
+
+	require.NoError(t, s1.Store(ctx, "my_file.txt", bytes.NewReader(content)))
+
+	hashedKey := fscrypto.HashKey("my_file.txt")
+	require.Eventually(t, func() bool { return s2.Storage.HasFile(s1.ID, hashedKey) }, 2*time.Second, 10*time.Millisecond)
+
+	// Removing the local copy forces Get to fetch the replica from s2.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "my_file.txt"))
+
+	r, err := s1.Get(ctx, "my_file.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+
+	require.NoError(t, s1.Delete(ctx, "my_file.txt"))
+	assert.False(t, s1.Storage.HasFile(s1.ID, "my_file.txt"))
+	require.Eventually(t, func() bool { return !s2.Storage.HasFile(s1.ID, hashedKey) }, 2*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = s1.Get(ctx, "my_file.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestFileServer_DeleteFilesOfOtherServer(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, DefaultReplicationFactor)
+	s2 := newTestServer(t, disc, DefaultReplicationFactor)
+	s3 := newTestServer(t, disc, DefaultReplicationFactor)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	require.NoError(t, s1.Store(context.Background(), "file.txt", bytes.NewReader([]byte("content"))))
+
+	hashedKey := fscrypto.HashKey("file.txt")
+	require.Eventually(t, func() bool { return s3.Storage.HasFile(s1.ID, hashedKey) }, 2*time.Second, 10*time.Millisecond)
+
+	peer, ok := s2.peerForNode(s3.Transport.Addr())
+	require.True(t, ok)
+
+	// s2 can not delete the replica s3 stores for s1.
+	require.NoError(t, s2.send(peer, &Message{Payload: MessageDeleteFile{ID: s1.ID, Key: hashedKey}}))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, s3.Storage.HasFile(s1.ID, hashedKey))
+}
+
+func TestFileServer_StorePlacement(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	servers := make([]*FileServer, 5)
+	for i := range servers {
+		servers[i] = newTestServer(t, disc, 2)
+	}
+	waitForPeers(t, len(servers)-1, servers...)
+
+	coordinator := servers[0]
+	key := "placed_file.txt"
+	hashedKey := fscrypto.HashKey(key)
+
+	require.NoError(t, coordinator.Store(context.Background(), key, bytes.NewReader([]byte("placed content"))))
+
+	owners := map[string]bool{}
+	for _, node := range coordinator.ring.Owners(hashedKey, 2) {
+		owners[node.Address] = true
+	}
+
+	for _, srv := range servers[1:] {
+		if owners[srv.Transport.Addr()] {
+			require.Eventually(t, func() bool { return srv.Storage.HasFile(coordinator.ID, hashedKey) }, 2*time.Second, 10*time.Millisecond)
+		}
+	}
+
+	// Give any misplaced replica time to land before checking it did not.
+	time.Sleep(100 * time.Millisecond)
+	for _, srv := range servers[1:] {
+		assert.Equal(t, owners[srv.Transport.Addr()], srv.Storage.HasFile(coordinator.ID, hashedKey))
+	}
+}
+
+func TestFileServer_Consistency(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	s2 := newTestServer(t, disc, 3)
+	waitForPeers(t, 1, s1, s2)
+
+	// With only two nodes a replication factor of three can never be fully
+	// acknowledged, so ALL fails while QUORUM succeeds.
+	ctx := context.Background()
+	err := s1.Store(WithConsistency(ctx, All), "file.txt", bytes.NewReader([]byte("content")))
+	var quorumErr *QuorumError
+	require.ErrorAs(t, err, &quorumErr)
+	assert.Equal(t, 3, quorumErr.Required)
+
+	require.NoError(t, s1.Store(WithConsistency(ctx, Quorum), "file.txt", bytes.NewReader([]byte("content"))))
+
+	r, err := s1.Get(WithConsistency(ctx, Quorum), "file.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "content", string(got))
+
+	_, err = s1.Get(WithConsistency(ctx, All), "file.txt")
+	assert.ErrorIs(t, err, ErrQuorumNotMet)
+}
+
+func TestFileServer_ReadQuorumAgreement(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	s1 := newTestServer(t, disc, 3)
+	s2 := newTestServer(t, disc, 3)
+	s3 := newTestServer(t, disc, 3)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	ctx := WithConsistency(context.Background(), Quorum)
+	require.NoError(t, s1.Store(WithConsistency(ctx, All), "file.txt", bytes.NewReader([]byte("content"))))
+
+	get := func(ctx context.Context) (string, error) {
+		t.Helper()
+
+		r, err := s1.Get(ctx, "file.txt")
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return string(got), nil
+	}
+
+	// The local copy diverged from the replicas the peers agree on, it is
+	// replaced by theirs.
+	_, err := s1.Storage.WriteWithMetadata(s1.ID, storage.Metadata{Key: "file.txt"}, strings.NewReader("diverged"))
+	require.NoError(t, err)
+
+	_, err = get(WithConsistency(ctx, All))
+	assert.ErrorIs(t, err, ErrQuorumNotMet)
+
+	got, err := get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "content", got)
+
+	// A lost local copy is fetched as long as enough peers agree.
+	require.NoError(t, s1.Storage.Delete(s1.ID, "file.txt"))
+	got, err = get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "content", got)
+
+	// A peer lost its replica, they do not all agree anymore.
+	require.NoError(t, s2.Storage.Delete(s1.ID, fscrypto.HashKey("file.txt")))
+	_, err = get(WithConsistency(ctx, All))
+	assert.ErrorIs(t, err, ErrQuorumNotMet)
+}
+
+func TestFileServer_DiscoveryEvents(t *testing.T) {
+	d1 := &memDiscovery{nodes: map[string]discovery.Node{}}
+	d2 := &memDiscovery{nodes: map[string]discovery.Node{}}
+
+	// The servers do not find each other while bootstrapping.
+	s1 := newTestServer(t, d1, DefaultReplicationFactor)
+	s2 := newTestServer(t, d2, DefaultReplicationFactor)
+
+	node := discovery.Node{ServerID: s2.ID, Address: s2.Transport.Addr()}
+
+	d1.emit(discovery.Event{Type: discovery.NodeJoined, Node: node})
+	waitForPeers(t, 1, s1, s2)
+
+	d1.emit(discovery.Event{Type: discovery.NodeLeft, Node: node})
+	require.Eventually(t, func() bool {
+		return len(s1.peerStore.Values()) == 0 && len(s2.peerStore.Values()) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Len(t, s1.ring.Nodes(), 1)
+}
@@ -0,0 +1,143 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gusga/dfsgo/storage"
+	"go.uber.org/zap"
+)
+
+// DefaultUploadTTL is how long an upload session is kept before it is
+// garbage collected, completed or not.
+const DefaultUploadTTL = 24 * time.Hour
+
+// ErrMissingPart is returned completing an upload whose parts are not
+// numbered from 1 without a gap.
+var ErrMissingPart = errors.New("missing part")
+
+type uploadMetadataKey struct{}
+
+// WithUploadMetadata returns a copy of ctx that makes CreateUpload keep
+// metadata with the session.
+func WithUploadMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, uploadMetadataKey{}, metadata)
+}
+
+// CreateUpload starts an upload session of the file stored under key. Its
+// parts are sent with UploadPart, in any order and in parallel, and the
+// file is stored once CompleteUpload is called. The content type of ctx,
+// see WithContentType, is recorded for the file, and its upload metadata,
+// see WithUploadMetadata, kept with the session. The session belongs to
+// the namespace of ctx, see WithNamespace, the other upload calls must be
+// made with the same one.
+func (s *FileServer) CreateUpload(ctx context.Context, key string) (storage.Upload, error) {
+	now := time.Now().UTC()
+	metadata, _ := ctx.Value(uploadMetadataKey{}).(map[string]string)
+
+	u, err := s.Storage.CreateUpload(s.namespace(ctx), storage.Upload{
+		Key:         key,
+		ContentType: contentTypeFromContext(ctx),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.UploadTTL),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return u, err
+	}
+
+	s.Logger.Info("upload started", zap.String("upload_id", u.ID), zap.String("key", key))
+
+	return u, nil
+}
+
+// Upload returns the upload session id.
+func (s *FileServer) Upload(ctx context.Context, id string) (storage.Upload, error) {
+	return s.Storage.Upload(s.namespace(ctx), id)
+}
+
+// UploadPart stores the content read from r as the part number of the
+// upload session id, replacing the one sent before with the same number.
+// When size is not negative, content of another size is rejected.
+func (s *FileServer) UploadPart(ctx context.Context, id string, number int, size int64, r io.Reader) (storage.Part, error) {
+	return s.Storage.WritePart(s.namespace(ctx), id, number, size, r)
+}
+
+// UploadParts returns, in order, the parts of the upload session id
+// received so far, so an interrupted upload only sends the others again.
+func (s *FileServer) UploadParts(ctx context.Context, id string) ([]storage.Part, error) {
+	return s.Storage.Parts(s.namespace(ctx), id)
+}
+
+// CompleteUpload stores the parts of the upload session id, concatenated in
+// order, as Store does, and then ends the session. The file is published
+// at once, whole, and the session is kept when storing it fails so it can
+// be completed again.
+func (s *FileServer) CompleteUpload(ctx context.Context, id string) (storage.Metadata, error) {
+	serverID := s.namespace(ctx)
+	u, err := s.Storage.Upload(serverID, id)
+	if err != nil {
+		return storage.Metadata{}, err
+	}
+
+	parts, r, err := s.Storage.OpenParts(serverID, id)
+	if err != nil {
+		return storage.Metadata{}, err
+	}
+	defer r.Close()
+
+	if len(parts) == 0 {
+		return storage.Metadata{}, fmt.Errorf("%w: no part received", ErrMissingPart)
+	}
+	for i, part := range parts {
+		if part.Number != i+1 {
+			return storage.Metadata{}, fmt.Errorf("%w: part %d", ErrMissingPart, i+1)
+		}
+	}
+
+	if u.ContentType != "" {
+		ctx = WithContentType(ctx, u.ContentType)
+	}
+	if err := s.Store(ctx, u.Key, r); err != nil {
+		return storage.Metadata{}, err
+	}
+
+	if err := s.Storage.DeleteUpload(serverID, id); err != nil && !errors.Is(err, storage.ErrNoSuchUpload) {
+		s.Logger.Error("could not remove completed upload", zap.Error(err), zap.String("upload_id", id))
+	}
+
+	s.Logger.Info("upload completed", zap.String("upload_id", id), zap.String("key", u.Key), zap.Int("parts", len(parts)))
+
+	meta, err := s.Storage.Metadata(serverID, u.Key)
+	return fileMetadata(meta), err
+}
+
+// AbortUpload ends the upload session id, dropping its parts.
+func (s *FileServer) AbortUpload(ctx context.Context, id string) error {
+	return s.Storage.DeleteUpload(s.namespace(ctx), id)
+}
+
+// uploadGCLoop removes the expired upload sessions, of every server ID, as
+// they expire until the server is closed.
+func (s *FileServer) uploadGCLoop() {
+	ticker := time.NewTicker(min(s.UploadTTL, time.Hour))
+	defer ticker.Stop()
+
+	for {
+		removed, err := s.Storage.RemoveExpiredUploads(time.Now())
+		if err != nil {
+			s.Logger.Error("could not remove expired uploads", zap.Error(err))
+		} else if removed > 0 {
+			s.Logger.Info("removed expired uploads", zap.Int("removed", removed))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		}
+	}
+}
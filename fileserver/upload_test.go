@@ -0,0 +1,61 @@
+package fileserver
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServer_Upload(t *testing.T) {
+	disc := &memDiscovery{nodes: map[string]discovery.Node{}}
+	// A lone node cannot meet an ALL consistency with two replicas.
+	srv := newTestServer(t, disc, 2)
+
+	ctx := WithContentType(context.Background(), "text/plain")
+	u, err := srv.CreateUpload(WithUploadMetadata(ctx, map[string]string{"owner": "gus"}), "notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, u.CreatedAt.Add(DefaultUploadTTL), u.ExpiresAt)
+
+	u, err = srv.Upload(ctx, u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "gus"}, u.Metadata)
+
+	_, err = srv.CompleteUpload(ctx, u.ID)
+	assert.ErrorIs(t, err, ErrMissingPart)
+
+	for number, content := range map[int]string{2: "world", 1: "hello "} {
+		_, err := srv.UploadPart(ctx, u.ID, number, int64(len(content)), strings.NewReader(content))
+		require.NoError(t, err)
+	}
+
+	// A failed write keeps the session so it can be completed again.
+	_, err = srv.CompleteUpload(WithConsistency(ctx, All), u.ID)
+	var quorumErr *QuorumError
+	require.ErrorAs(t, err, &quorumErr)
+	parts, err := srv.UploadParts(ctx, u.ID)
+	require.NoError(t, err)
+	assert.Len(t, parts, 2)
+
+	meta, err := srv.CompleteUpload(context.Background(), u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "notes.txt", meta.Key)
+	assert.Equal(t, int64(11), meta.Size)
+	assert.Equal(t, "text/plain", meta.ContentType)
+
+	r, err := srv.Get(ctx, "notes.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "hello world", string(got))
+
+	_, err = srv.UploadParts(ctx, u.ID)
+	assert.ErrorIs(t, err, storage.ErrNoSuchUpload)
+	assert.ErrorIs(t, srv.AbortUpload(ctx, u.ID), storage.ErrNoSuchUpload)
+}
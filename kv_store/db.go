@@ -4,4 +4,5 @@ type KVStore[K any, V any] interface {
 	Set(K, V)
 	Get(K) (V, bool)
 	Delete(K)
+	Values() []V
 }
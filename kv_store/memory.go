@@ -33,3 +33,15 @@ func (kv *InMemoryKVStore[K, V]) Delete(key K) {
 	defer kv.mu.Unlock()
 	delete(kv.data, key)
 }
+
+func (kv *InMemoryKVStore[K, V]) Values() []V {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	values := make([]V, 0, len(kv.data))
+	for _, val := range kv.data {
+		values = append(values, val)
+	}
+
+	return values
+}
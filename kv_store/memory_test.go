@@ -81,3 +81,18 @@ func TestInMemoryKVStore_Delete(t *testing.T) {
 	}
 
 }
+
+func TestInMemoryKVStore_Values(t *testing.T) {
+	t.Parallel()
+
+	kv := NewInMemoryKVStore[string, string]()
+
+	require.Empty(t, kv.Values())
+
+	kv.data = map[string]string{
+		"127.0.0.1:3000": "alive",
+		"127.0.0.1:4000": "dead",
+	}
+
+	require.ElementsMatch(t, []string{"alive", "dead"}, kv.Values())
+}
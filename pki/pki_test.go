@@ -0,0 +1,63 @@
+package pki
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCA_IssueNodeCert(t *testing.T) {
+	ca, err := NewCA("dfsgo test CA", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, ca.Cert.IsCA)
+
+	nodeCert, err := ca.IssueNodeCert("node-1", []string{"127.0.0.1", "localhost"}, time.Hour)
+	require.NoError(t, err)
+
+	cert, err := nodeCert.TLSCertificate()
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	assert.Equal(t, "node-1", leaf.Subject.CommonName)
+	assert.Equal(t, []string{"localhost"}, leaf.DNSNames)
+	assert.Len(t, leaf.IPAddresses, 1)
+
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots:     ca.CertPool(),
+			DNSName:   "127.0.0.1",
+			KeyUsages: []x509.ExtKeyUsage{usage},
+		})
+		assert.NoError(t, err)
+	}
+
+	other, err := NewCA("other CA", time.Hour)
+	require.NoError(t, err)
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: other.CertPool()})
+	assert.Error(t, err)
+}
+
+func TestCA_SaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	ca, err := NewCA("dfsgo test CA", 0)
+	require.NoError(t, err)
+	require.NoError(t, ca.Save(certFile, keyFile))
+
+	loaded, err := LoadCA(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, ca.Cert.Raw, loaded.Cert.Raw)
+	assert.True(t, ca.Key.Equal(loaded.Key))
+
+	_, err = LoadCA(keyFile, keyFile)
+	assert.Error(t, err)
+	_, err = LoadCA(filepath.Join(dir, "missing.crt"), keyFile)
+	assert.Error(t, err)
+}
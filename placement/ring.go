@@ -0,0 +1,146 @@
+package placement
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gusga/dfsgo/discovery"
+)
+
+const DefaultVirtualNodes = 128
+
+type RingOpts struct {
+	// VirtualNodes is the number of points every node takes on the ring.
+	// The more points, the more even the keys are spread between nodes.
+	VirtualNodes int
+}
+
+// Ring is a consistent hash ring of the nodes in the network. Nodes are
+// identified by their address.
+type Ring struct {
+	RingOpts
+	mu     sync.RWMutex
+	hashes []uint64
+	points map[uint64]string
+	nodes  map[string]discovery.Node
+}
+
+func NewRing(opts RingOpts) *Ring {
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = DefaultVirtualNodes
+	}
+
+	return &Ring{
+		RingOpts: opts,
+		points:   make(map[uint64]string),
+		nodes:    make(map[string]discovery.Node),
+	}
+}
+
+func hash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Add places the nodes on the ring. Adding a node that is already on the
+// ring only updates its information.
+func (r *Ring) Add(nodes ...discovery.Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, node := range nodes {
+		if _, ok := r.nodes[node.Address]; ok {
+			r.nodes[node.Address] = node
+			continue
+		}
+
+		r.nodes[node.Address] = node
+		for i := 0; i < r.VirtualNodes; i++ {
+			h := hash(node.Address + "#" + strconv.Itoa(i))
+			if _, taken := r.points[h]; taken {
+				continue
+			}
+			r.points[h] = node.Address
+			r.hashes = append(r.hashes, h)
+		}
+	}
+
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+func (r *Ring) Remove(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[addr]; !ok {
+		return
+	}
+	delete(r.nodes, addr)
+
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.points[h] == addr {
+			delete(r.points, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+}
+
+func (r *Ring) Has(addr string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.nodes[addr]
+	return ok
+}
+
+func (r *Ring) Nodes() []discovery.Node {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]discovery.Node, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Address < nodes[j].Address })
+
+	return nodes
+}
+
+// Owners returns up to n distinct nodes responsible for key, walking the
+// ring clockwise from the position of the key. The first node returned is
+// the primary owner.
+func (r *Ring) Owners(key string, n int) []discovery.Node {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	owners := make([]discovery.Node, 0, n)
+	seen := make(map[string]bool, n)
+
+	for i := 0; i < len(r.hashes) && len(owners) < n; i++ {
+		addr := r.points[r.hashes[(start+i)%len(r.hashes)]]
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		owners = append(owners, r.nodes[addr])
+	}
+
+	return owners
+}
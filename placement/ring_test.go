@@ -0,0 +1,95 @@
+package placement
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRing(n int) *Ring {
+	ring := NewRing(RingOpts{})
+	for i := 0; i < n; i++ {
+		ring.Add(discovery.Node{Address: fmt.Sprintf("127.0.0.1:%d000", i+3)})
+	}
+	return ring
+}
+
+func TestRing_Owners(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		nodes int
+		n     int
+		want  int
+	}{
+		{name: "empty ring", nodes: 0, n: 3, want: 0},
+		{name: "less nodes than replicas", nodes: 2, n: 3, want: 2},
+		{name: "more nodes than replicas", nodes: 5, n: 3, want: 3},
+		{name: "no replicas", nodes: 5, n: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := newTestRing(tt.nodes)
+
+			owners := ring.Owners("my_awesome_file.txt", tt.n)
+			require.Len(t, owners, tt.want)
+
+			seen := map[string]bool{}
+			for _, owner := range owners {
+				assert.False(t, seen[owner.Address], "owner %s returned twice", owner.Address)
+				seen[owner.Address] = true
+			}
+
+			assert.Equal(t, owners, ring.Owners("my_awesome_file.txt", tt.n))
+		})
+	}
+}
+
+func TestRing_Distribution(t *testing.T) {
+	ring := newTestRing(4)
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		owner := ring.Owners(fmt.Sprintf("file-%d", i), 1)[0]
+		counts[owner.Address]++
+	}
+
+	require.Len(t, counts, 4)
+	for addr, count := range counts {
+		assert.InDelta(t, 2500, count, 750, "node %s owns %d keys", addr, count)
+	}
+}
+
+func TestRing_AddRemove(t *testing.T) {
+	ring := newTestRing(4)
+
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("file-%d", i)
+		before[key] = ring.Owners(key, 1)[0].Address
+	}
+
+	newNode := discovery.Node{Address: "127.0.0.1:9000"}
+	ring.Add(newNode)
+	assert.True(t, ring.Has(newNode.Address))
+	assert.Len(t, ring.Nodes(), 5)
+
+	// Only the keys taken over by the new node change owner.
+	for key, owner := range before {
+		got := ring.Owners(key, 1)[0].Address
+		if got != owner {
+			assert.Equal(t, newNode.Address, got)
+		}
+	}
+
+	ring.Remove(newNode.Address)
+	assert.False(t, ring.Has(newNode.Address))
+
+	for key, owner := range before {
+		assert.Equal(t, owner, ring.Owners(key, 1)[0].Address)
+	}
+}
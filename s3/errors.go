@@ -0,0 +1,56 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+// apiError is an error returned to clients with its S3 error code.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// withMessage returns a copy of e with a more specific message.
+func (e *apiError) withMessage(msg string) *apiError {
+	err := *e
+	err.Message = msg
+	return &err
+}
+
+var (
+	errAccessDenied                 = &apiError{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errAuthorizationHeaderMalformed = &apiError{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	errBadDigest                    = &apiError{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received"}
+	errContentSHA256Mismatch        = &apiError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed"}
+	errIncompleteBody               = &apiError{http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header"}
+	errInternalError                = &apiError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again"}
+	errInvalidAccessKeyID           = &apiError{http.StatusForbidden, "InvalidAccessKeyId", "The AWS access key Id you provided does not exist in our records"}
+	errInvalidArgument              = &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	errInvalidBucketName            = &apiError{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid"}
+	errInvalidDigest                = &apiError{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified is not valid"}
+	errInvalidPart                  = &apiError{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errInvalidPartOrder             = &apiError{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errInvalidRequest               = &apiError{http.StatusBadRequest, "InvalidRequest", "Invalid Request"}
+	errMalformedXML                 = &apiError{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+	errMethodNotAllowed             = &apiError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource"}
+	errMissingContentLength         = &apiError{http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header"}
+	errNoSuchKey                    = &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errNoSuchUpload                 = &apiError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errNotImplemented               = &apiError{http.StatusNotImplemented, "NotImplemented", "A header or operation you provided implies functionality that is not implemented"}
+	errRequestTimeTooSkewed         = &apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	errSignatureDoesNotMatch        = &apiError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided"}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
@@ -0,0 +1,191 @@
+// Package s3 serves a subset of the Amazon S3 API on top of a FileServer,
+// so tools and SDKs speaking S3 can store objects in the network.
+//
+// Every bucket is a namespace of the FileServer, see
+// fileserver.WithNamespace, its objects are stored in it as files under
+// their key, replicated to the peers as any other file. Requests must be
+// signed with AWS Signature Version 4 by one of the configured credentials
+// and address buckets in the path, like http://localhost:9000/bucket/key.
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gusga/dfsgo/storage"
+	"go.uber.org/zap"
+)
+
+const DefaultRegion = "us-east-1"
+
+var bucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// Backend stores the content of the objects, a *fileserver.FileServer is
+// one. Every call works in the namespace of its context, see
+// fileserver.WithNamespace. Get fails with fileserver.ErrFileNotFound for
+// missing keys. Multipart uploads are its upload sessions, see
+// fileserver.FileServer.CreateUpload.
+type Backend interface {
+	Store(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error)
+
+	CreateUpload(ctx context.Context, key string) (storage.Upload, error)
+	Upload(ctx context.Context, id string) (storage.Upload, error)
+	UploadPart(ctx context.Context, id string, number int, size int64, r io.Reader) (storage.Part, error)
+	UploadParts(ctx context.Context, id string) ([]storage.Part, error)
+	CompleteUpload(ctx context.Context, id string) (storage.Metadata, error)
+	AbortUpload(ctx context.Context, id string) error
+}
+
+type GatewayOpts struct {
+	Backend Backend
+	// Credentials maps the access keys allowed to sign requests to their
+	// secret keys.
+	Credentials map[string]string
+	// Region is the region requests are signed for, DefaultRegion when
+	// empty.
+	Region string
+	Logger *zap.Logger
+}
+
+type Gateway struct {
+	GatewayOpts
+
+	now func() time.Time
+}
+
+func NewGateway(opts GatewayOpts) (*Gateway, error) {
+	if opts.Backend == nil {
+		return nil, errors.New("s3 gateway needs a backend")
+	}
+	if len(opts.Credentials) == 0 {
+		return nil, errors.New("s3 gateway needs credentials")
+	}
+	if opts.Region == "" {
+		opts.Region = DefaultRegion
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	return &Gateway{
+		GatewayOpts: opts,
+		now:         time.Now,
+	}, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := newID()[:16]
+	w.Header().Set("X-Amz-Request-Id", requestID)
+
+	if err := g.serve(w, r); err != nil {
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			g.Logger.Error("s3 request failed", zap.Error(err), zap.String("method", r.Method), zap.String("path", r.URL.Path))
+			apiErr = errInternalError
+		}
+		writeError(w, r, apiErr, requestID)
+	}
+}
+
+func (g *Gateway) serve(w http.ResponseWriter, r *http.Request) error {
+	sig, err := g.authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		return errNotImplemented.withMessage("listing buckets is not implemented")
+	}
+	if !bucketPattern.MatchString(bucket) {
+		return errInvalidBucketName
+	}
+
+	query := r.URL.Query()
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodGet && query.Get("list-type") == "2":
+			return g.listObjects(w, r, bucket, query)
+		case r.Method == http.MethodGet:
+			return errNotImplemented.withMessage("only ListObjectsV2 is implemented")
+		// Buckets are created along with their first object.
+		case r.Method == http.MethodPut, r.Method == http.MethodHead:
+			return nil
+		}
+		return errMethodNotAllowed
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		return g.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		return g.completeMultipartUpload(w, r, sig, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		return g.uploadPart(w, r, sig, bucket, key, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		return g.abortMultipartUpload(w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return errNotImplemented.withMessage("copying objects is not implemented")
+		}
+		return g.putObject(w, r, sig, bucket, key)
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		return g.getObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		return g.deleteObject(w, r, bucket, key)
+	}
+
+	return errMethodNotAllowed
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+
+	return nil
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err *apiError, requestID string) {
+	resp := errorResponse{
+		Code:      err.Code,
+		Message:   err.Message,
+		Resource:  r.URL.Path,
+		RequestID: requestID,
+	}
+
+	// Responses to HEAD requests have no body.
+	if r.Method == http.MethodHead {
+		w.WriteHeader(err.Status)
+		return
+	}
+
+	if err := writeXML(w, err.Status, resp); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// newID returns a random hex ID.
+func newID() string {
+	b := make([]byte, 16)
+	io.ReadFull(rand.Reader, b)
+	return hex.EncodeToString(b)
+}
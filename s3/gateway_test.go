@@ -0,0 +1,403 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/gusga/dfsgo/discovery"
+	"github.com/gusga/dfsgo/fileserver"
+	"github.com/gusga/dfsgo/storage"
+	"github.com/gusga/dfsgo/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const (
+	testAccessKey = "AKIDDFSGO"
+	testSecretKey = "dfsgo-secret"
+)
+
+// newTestBackend starts a node with no peers storing the objects.
+func newTestBackend(t *testing.T) *fileserver.FileServer {
+	t.Helper()
+
+	logger := zap.NewNop()
+	id := fscrypto.GenerateServerID()
+
+	disc, err := discovery.NewStaticDiscoverySrv(nil, logger)
+	require.NoError(t, err)
+
+	tr := transport.NewTCPTransport(transport.TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: transport.NewTCPHandshakeFunc(id),
+		Logger:        logger,
+	})
+
+	srv := fileserver.NewServer(fileserver.FileServerOpts{
+		ID:           id,
+		EncKey:       fscrypto.NewEncryptionKey(),
+		Transport:    tr,
+		Logger:       logger,
+		DiscoverySrv: disc,
+		Storage: storage.NewStorage(storage.StorageOpts{
+			Root:              t.TempDir(),
+			PathTransformFunc: storage.CASPathTransformFunc,
+			Logger:            logger,
+		}),
+	})
+	tr.OnPeer = srv.OnPeer
+
+	go srv.Start()
+	t.Cleanup(srv.Close)
+
+	// The node joins its own ring once it is listening.
+	require.Eventually(t, func() bool {
+		nodes, _ := disc.GetNodes()
+		return len(nodes) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	return srv
+}
+
+// keys returns the keys the node stores in the namespace name, in order.
+func keys(t *testing.T, srv *fileserver.FileServer, name string) []string {
+	t.Helper()
+
+	keys, _, err := srv.List(fileserver.WithNamespace(context.Background(), name), "", "", 0)
+	require.NoError(t, err)
+
+	return keys
+}
+
+// streamingBackend serves content that can not be sought, like content
+// fetched from the network.
+type streamingBackend struct {
+	*fileserver.FileServer
+}
+
+func (b streamingBackend) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := b.FileServer.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct{ io.ReadCloser }{rc}, nil
+}
+
+// newTestClient starts a gateway storing its objects in backend and returns
+// an AWS SDK client signing its requests with secretKey.
+func newTestClient(t *testing.T, backend Backend, secretKey string) *awss3.Client {
+	t.Helper()
+
+	g, err := NewGateway(GatewayOpts{
+		Backend:     backend,
+		Credentials: map[string]string{testAccessKey: testSecretKey},
+	})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+
+	return awss3.New(awss3.Options{
+		Region:       DefaultRegion,
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: testAccessKey, SecretAccessKey: secretKey}, nil
+		}),
+	})
+}
+
+func requireErrorCode(t *testing.T, err error, code string) {
+	t.Helper()
+
+	var apiErr smithy.APIError
+	require.True(t, errors.As(err, &apiErr), "expected an API error, got %v", err)
+	assert.Equal(t, code, apiErr.ErrorCode())
+}
+
+func TestGateway_Objects(t *testing.T) {
+	backend := newTestBackend(t)
+	client := newTestClient(t, backend, testSecretKey)
+	ctx := context.Background()
+	content := []byte("some object content")
+
+	_, err := client.CreateBucket(ctx, &awss3.CreateBucketInput{Bucket: aws.String("photos")})
+	require.NoError(t, err)
+
+	put, err := client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket:      aws.String("photos"),
+		Key:         aws.String("2024/cat one.png"),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("image/png"),
+		Metadata:    map[string]string{"owner": "gus"},
+	})
+	require.NoError(t, err)
+	sum := md5.Sum(content)
+	assert.Equal(t, quoteETag(hex.EncodeToString(sum[:])), aws.ToString(put.ETag))
+	// The content is stored under the key in the namespace of the bucket,
+	// its record in the one next to it.
+	assert.Equal(t, []string{"2024/cat one.png"}, keys(t, backend, "photos"))
+	assert.Equal(t, []string{"2024/cat one.png"}, keys(t, backend, "photos_records"))
+	assert.Empty(t, keys(t, backend, ""))
+
+	head, err := client.HeadObject(ctx, &awss3.HeadObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat one.png")})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), aws.ToInt64(head.ContentLength))
+	assert.Equal(t, "image/png", aws.ToString(head.ContentType))
+	assert.Equal(t, put.ETag, head.ETag)
+	assert.Equal(t, map[string]string{"owner": "gus"}, head.Metadata)
+
+	get, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat one.png"), Range: aws.String("bytes=5-10")})
+	require.NoError(t, err)
+	got, err := io.ReadAll(get.Body)
+	require.NoError(t, err)
+	get.Body.Close()
+	assert.Equal(t, "object", string(got))
+	assert.Equal(t, "bytes 5-10/19", aws.ToString(get.ContentRange))
+
+	// Replacing the object leaves no trace of the previous content.
+	_, err = client.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat one.png"), Body: strings.NewReader("new")})
+	require.NoError(t, err)
+	get, err = client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat one.png")})
+	require.NoError(t, err)
+	got, _ = io.ReadAll(get.Body)
+	get.Body.Close()
+	assert.Equal(t, "new", string(got))
+
+	_, err = client.DeleteObject(ctx, &awss3.DeleteObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat one.png")})
+	require.NoError(t, err)
+
+	_, err = client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat one.png")})
+	var noSuchKey *types.NoSuchKey
+	assert.ErrorAs(t, err, &noSuchKey)
+	assert.Empty(t, keys(t, backend, "photos"))
+	assert.Empty(t, keys(t, backend, "photos_records"))
+
+	// Content not matching its Content-MD5 does not replace the object.
+	_, err = client.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("photos"), Key: aws.String("a.txt"), Body: strings.NewReader("first")})
+	require.NoError(t, err)
+	wrong := md5.Sum([]byte("other"))
+	_, err = client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket:     aws.String("photos"),
+		Key:        aws.String("a.txt"),
+		Body:       strings.NewReader("second"),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(wrong[:])),
+	})
+	requireErrorCode(t, err, "BadDigest")
+	get, err = client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("a.txt")})
+	require.NoError(t, err)
+	got, _ = io.ReadAll(get.Body)
+	get.Body.Close()
+	assert.Equal(t, "first", string(got))
+
+	// Deleting a missing object succeeds.
+	_, err = client.DeleteObject(ctx, &awss3.DeleteObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat one.png")})
+	assert.NoError(t, err)
+
+	_, err = client.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("Invalid_Bucket"), Key: aws.String("key"), Body: strings.NewReader("content")})
+	requireErrorCode(t, err, "InvalidBucketName")
+}
+
+func TestGateway_GetStreamedObject(t *testing.T) {
+	client := newTestClient(t, streamingBackend{newTestBackend(t)}, testSecretKey)
+	ctx := context.Background()
+
+	_, err := client.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.png"), Body: strings.NewReader("some object content")})
+	require.NoError(t, err)
+
+	get, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.png"), Range: aws.String("bytes=5-10")})
+	require.NoError(t, err)
+	got, err := io.ReadAll(get.Body)
+	require.NoError(t, err)
+	get.Body.Close()
+	assert.Equal(t, "object", string(got))
+	assert.Equal(t, "bytes 5-10/19", aws.ToString(get.ContentRange))
+
+	get, err = client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("cat.png"), Range: aws.String("bytes=-7")})
+	require.NoError(t, err)
+	got, err = io.ReadAll(get.Body)
+	require.NoError(t, err)
+	get.Body.Close()
+	assert.Equal(t, "content", string(got))
+}
+
+func TestGateway_ListObjectsV2(t *testing.T) {
+	client := newTestClient(t, newTestBackend(t), testSecretKey)
+	ctx := context.Background()
+
+	keys := []string{"a.txt", "docs/2023/report.pdf", "docs/2024/report.pdf", "docs/readme.md", "photos/cat.png", "z.txt"}
+	for _, key := range keys {
+		_, err := client.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("files"), Key: aws.String(key), Body: strings.NewReader(key)})
+		require.NoError(t, err)
+	}
+	// The objects of other buckets are not listed.
+	for _, key := range []string{"a.txt", "b.txt"} {
+		_, err := client.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("others"), Key: aws.String(key), Body: strings.NewReader(key)})
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name         string
+		input        awss3.ListObjectsV2Input
+		wantKeys     []string
+		wantPrefixes []string
+	}{
+		{name: "all", wantKeys: keys},
+		{name: "prefix", input: awss3.ListObjectsV2Input{Prefix: aws.String("docs/")}, wantKeys: keys[1:4]},
+		{
+			name:         "delimiter",
+			input:        awss3.ListObjectsV2Input{Delimiter: aws.String("/")},
+			wantKeys:     []string{"a.txt", "z.txt"},
+			wantPrefixes: []string{"docs/", "photos/"},
+		},
+		{
+			name:         "prefix and delimiter",
+			input:        awss3.ListObjectsV2Input{Prefix: aws.String("docs/"), Delimiter: aws.String("/")},
+			wantKeys:     []string{"docs/readme.md"},
+			wantPrefixes: []string{"docs/2023/", "docs/2024/"},
+		},
+		{name: "start after", input: awss3.ListObjectsV2Input{StartAfter: aws.String("docs/readme.md")}, wantKeys: keys[4:]},
+		{
+			name:         "paged",
+			input:        awss3.ListObjectsV2Input{Delimiter: aws.String("/"), MaxKeys: aws.Int32(1)},
+			wantKeys:     []string{"a.txt", "z.txt"},
+			wantPrefixes: []string{"docs/", "photos/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := tt.input
+			input.Bucket = aws.String("files")
+
+			var gotKeys, gotPrefixes []string
+			pages := awss3.NewListObjectsV2Paginator(client, &input)
+			for pages.HasMorePages() {
+				page, err := pages.NextPage(ctx)
+				require.NoError(t, err)
+				for _, obj := range page.Contents {
+					gotKeys = append(gotKeys, aws.ToString(obj.Key))
+				}
+				for _, p := range page.CommonPrefixes {
+					gotPrefixes = append(gotPrefixes, aws.ToString(p.Prefix))
+				}
+			}
+
+			assert.Equal(t, tt.wantKeys, gotKeys)
+			assert.Equal(t, tt.wantPrefixes, gotPrefixes)
+		})
+	}
+
+	empty, err := client.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{Bucket: aws.String("empty")})
+	require.NoError(t, err)
+	assert.Empty(t, empty.Contents)
+	assert.False(t, aws.ToBool(empty.IsTruncated))
+}
+
+func TestGateway_MultipartUpload(t *testing.T) {
+	backend := newTestBackend(t)
+	client := newTestClient(t, backend, testSecretKey)
+	ctx := context.Background()
+	bucket, key := aws.String("backups"), aws.String("db/dump.sql")
+
+	created, err := client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{Bucket: bucket, Key: key, ContentType: aws.String("application/sql"), Metadata: map[string]string{"owner": "gus"}})
+	require.NoError(t, err)
+	uploadID := created.UploadId
+
+	parts := []string{strings.Repeat("first part ", 1000), strings.Repeat("second part ", 1000), "last part"}
+	etags := make(map[int32]*string)
+	// Parts are sent out of order and the second one is replaced.
+	for _, n := range []int32{3, 2, 1, 2} {
+		body := parts[n-1]
+		if etags[n] == nil && n == 2 {
+			body = "replaced part"
+		}
+		part, err := client.UploadPart(ctx, &awss3.UploadPartInput{
+			Bucket:     bucket,
+			Key:        key,
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(n),
+			Body:       strings.NewReader(body),
+		})
+		require.NoError(t, err)
+		etags[n] = part.ETag
+	}
+
+	var completed []types.CompletedPart
+	for n := int32(1); n <= 3; n++ {
+		completed = append(completed, types.CompletedPart{PartNumber: aws.Int32(n), ETag: etags[n]})
+	}
+
+	_, err = client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          bucket,
+		Key:             key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{completed[1], completed[0]}},
+	})
+	requireErrorCode(t, err, "InvalidPartOrder")
+
+	_, err = client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          bucket,
+		Key:             key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{{PartNumber: aws.Int32(1), ETag: aws.String(`"0123"`)}}},
+	})
+	requireErrorCode(t, err, "InvalidPart")
+
+	done, err := client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          bucket,
+		Key:             key,
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(aws.ToString(done.ETag), `-3"`))
+
+	get, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: bucket, Key: key})
+	require.NoError(t, err)
+	got, err := io.ReadAll(get.Body)
+	require.NoError(t, err)
+	get.Body.Close()
+	assert.Equal(t, strings.Join(parts, ""), string(got))
+	assert.Equal(t, "application/sql", aws.ToString(get.ContentType))
+	assert.Equal(t, done.ETag, get.ETag)
+	assert.Equal(t, map[string]string{"owner": "gus"}, get.Metadata)
+	// The parts of the upload are gone.
+	assert.Equal(t, []string{"db/dump.sql"}, keys(t, backend, "backups"))
+
+	// The upload is gone once completed.
+	_, err = client.UploadPart(ctx, &awss3.UploadPartInput{Bucket: bucket, Key: key, UploadId: uploadID, PartNumber: aws.Int32(1), Body: strings.NewReader("late")})
+	requireErrorCode(t, err, "NoSuchUpload")
+
+	aborted, err := client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{Bucket: bucket, Key: key})
+	require.NoError(t, err)
+	_, err = client.UploadPart(ctx, &awss3.UploadPartInput{Bucket: bucket, Key: key, UploadId: aborted.UploadId, PartNumber: aws.Int32(1), Body: strings.NewReader("part")})
+	require.NoError(t, err)
+	_, err = client.AbortMultipartUpload(ctx, &awss3.AbortMultipartUploadInput{Bucket: bucket, Key: key, UploadId: aborted.UploadId})
+	require.NoError(t, err)
+	_, err = client.AbortMultipartUpload(ctx, &awss3.AbortMultipartUploadInput{Bucket: bucket, Key: key, UploadId: aborted.UploadId})
+	requireErrorCode(t, err, "NoSuchUpload")
+}
+
+func TestGateway_WrongSecretKey(t *testing.T) {
+	client := newTestClient(t, newTestBackend(t), "not-the-secret")
+
+	_, err := client.PutObject(context.Background(), &awss3.PutObjectInput{Bucket: aws.String("photos"), Key: aws.String("key"), Body: strings.NewReader("content")})
+	requireErrorCode(t, err, "SignatureDoesNotMatch")
+}
@@ -0,0 +1,227 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gusga/dfsgo/fileserver"
+	"github.com/gusga/dfsgo/storage"
+)
+
+// maxCompleteBody bounds the size of the list of parts sent to complete an
+// upload.
+const maxCompleteBody = 1 << 20
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+// createMultipartUpload starts an upload session of the backend in the
+// namespace of the bucket, which expires when it is not completed. The ETag
+// of a part is its SHA-256.
+func (g *Gateway) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	ctx := bucketContext(r.Context(), bucket)
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		ctx = fileserver.WithContentType(ctx, contentType)
+	}
+	ctx = fileserver.WithUploadMetadata(ctx, userMetadata(r.Header))
+
+	u, err := g.Backend.CreateUpload(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: u.ID})
+}
+
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, sig *signature, bucket, key, id, partNumber string) error {
+	number, err := strconv.Atoi(partNumber)
+	if err != nil || number < 1 || number > storage.MaxPartNumber {
+		return errInvalidArgument.withMessage("part number must be an integer between 1 and 10000")
+	}
+
+	ctx := bucketContext(r.Context(), bucket)
+	if _, err := g.readUpload(ctx, id, key); err != nil {
+		return err
+	}
+
+	body, size, err := payloadReader(r, sig)
+	if err != nil {
+		return err
+	}
+	body, _, err = md5Body(body, r.Header.Get("Content-MD5"))
+	if err != nil {
+		return err
+	}
+
+	part, err := g.Backend.UploadPart(ctx, id, number, size, body)
+	if errors.Is(err, storage.ErrNoSuchUpload) {
+		// The upload was completed or aborted in the meantime.
+		return errNoSuchUpload
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", quoteETag(part.Checksum))
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func (g *Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, sig *signature, bucket, key, id string) error {
+	body, _, err := payloadReader(r, sig)
+	if err != nil {
+		return err
+	}
+
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(body, maxCompleteBody)).Decode(&req); err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			return err
+		}
+		return errMalformedXML
+	}
+	if len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	ctx := bucketContext(r.Context(), bucket)
+	u, err := g.readUpload(ctx, id, key)
+	if err != nil {
+		return err
+	}
+	parts, err := g.Backend.UploadParts(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkParts(parts, req.Parts); err != nil {
+		return err
+	}
+
+	// The session is kept when storing the object fails, so the client can
+	// retry.
+	stored, err := g.Backend.CompleteUpload(ctx, id)
+	if errors.Is(err, storage.ErrNoSuchUpload) {
+		return errNoSuchUpload
+	}
+	if errors.Is(err, fileserver.ErrMissingPart) {
+		return errInvalidPart.withMessage("every part uploaded must be completed, numbered from 1")
+	}
+	if err != nil {
+		return err
+	}
+
+	sums := make([][]byte, 0, len(parts))
+	for _, part := range parts {
+		sum, err := hex.DecodeString(part.Checksum)
+		if err != nil {
+			return err
+		}
+		sums = append(sums, sum)
+	}
+
+	meta := objectMeta{
+		Key:          key,
+		Size:         stored.Size,
+		ETag:         multipartETag(sums),
+		ContentType:  u.ContentType,
+		LastModified: g.now().UTC(),
+		Metadata:     u.Metadata,
+	}
+	if err := g.writeMeta(r.Context(), bucket, meta); err != nil {
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, completeMultipartUploadResult{Bucket: bucket, Key: key, ETag: quoteETag(meta.ETag)})
+}
+
+// checkParts checks the parts listed to complete an upload are in
+// ascending order and match the ETags of the parts uploaded. The backend
+// stores every part uploaded, so they must all be listed.
+func checkParts(parts []storage.Part, completed []completedPart) error {
+	for i, c := range completed {
+		if i > 0 && c.PartNumber <= completed[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+	}
+	if len(completed) != len(parts) {
+		return errInvalidPart.withMessage("every part uploaded must be completed, numbered from 1")
+	}
+
+	for i, c := range completed {
+		if c.PartNumber != parts[i].Number || strings.Trim(c.ETag, `"`) != parts[i].Checksum {
+			return errInvalidPart
+		}
+	}
+
+	return nil
+}
+
+func (g *Gateway) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key, id string) error {
+	ctx := bucketContext(r.Context(), bucket)
+	if _, err := g.readUpload(ctx, id, key); err != nil {
+		return err
+	}
+
+	err := g.Backend.AbortUpload(ctx, id)
+	if errors.Is(err, storage.ErrNoSuchUpload) {
+		return errNoSuchUpload
+	}
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// readUpload returns the upload session id of the object key, in the
+// namespace of the bucket of ctx.
+func (g *Gateway) readUpload(ctx context.Context, id, key string) (storage.Upload, error) {
+	u, err := g.Backend.Upload(ctx, id)
+	if errors.Is(err, storage.ErrNoSuchUpload) || (err == nil && u.Key != key) {
+		return u, errNoSuchUpload
+	}
+
+	return u, err
+}
+
+// multipartETag returns the ETag of an object assembled from parts with the
+// given sums: the MD5 of their concatenation followed by their number.
+func multipartETag(sums [][]byte) string {
+	h := md5.New()
+	for _, sum := range sums {
+		h.Write(sum)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(sums))
+}
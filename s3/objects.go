@@ -0,0 +1,402 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gusga/dfsgo/fileserver"
+)
+
+const (
+	maxListKeys = 1000
+
+	// recordsSuffix names the namespace of the records of the objects of a
+	// bucket after it. Bucket names have no underscore, so no bucket has
+	// the name of such a namespace.
+	recordsSuffix = "_records"
+
+	userMetadataPrefix = "X-Amz-Meta-"
+	defaultContentType = "binary/octet-stream"
+	lastModifiedFormat = "2006-01-02T15:04:05.000Z"
+)
+
+// objectMeta is the record of an object, describing the content stored under
+// its key in the namespace of its bucket, see bucketContext.
+type objectMeta struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	ContentType  string            `json:"contentType,omitempty"`
+	LastModified time.Time         `json:"lastModified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []listEntry
+	CommonPrefixes        []commonPrefix
+}
+
+type listEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+// bucketContext returns a copy of ctx making the backend store and read
+// the content of the objects of bucket, under their keys, in the namespace
+// of the bucket, see fileserver.WithNamespace.
+func bucketContext(ctx context.Context, bucket string) context.Context {
+	return fileserver.WithNamespace(ctx, bucket)
+}
+
+// recordsContext returns a copy of ctx making the backend store and read
+// the records of the objects of bucket, under their keys, in a namespace of
+// their own next to the one of the bucket.
+func recordsContext(ctx context.Context, bucket string) context.Context {
+	return fileserver.WithNamespace(ctx, bucket+recordsSuffix)
+}
+
+// isNotFound reports whether err is the backend failing to find a key.
+func isNotFound(err error) bool {
+	return errors.Is(err, fileserver.ErrFileNotFound)
+}
+
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, sig *signature, bucket, key string) error {
+	body, size, err := payloadReader(r, sig)
+	if err != nil {
+		return err
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	sum, err := g.storeContent(bucketContext(r.Context(), bucket), key, contentType, body, r.Header.Get("Content-MD5"))
+	if err != nil {
+		return err
+	}
+
+	meta := objectMeta{
+		Key:          key,
+		Size:         size,
+		ETag:         hex.EncodeToString(sum),
+		ContentType:  contentType,
+		LastModified: g.now().UTC(),
+		Metadata:     userMetadata(r.Header),
+	}
+	if err := g.writeMeta(r.Context(), bucket, meta); err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", quoteETag(meta.ETag))
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// storeContent stores the content read from r under key and returns its
+// MD5. The content is checked against contentMD5 when it is set, content
+// not matching it is not stored.
+func (g *Gateway) storeContent(ctx context.Context, key, contentType string, r io.Reader, contentMD5 string) ([]byte, error) {
+	body, h, err := md5Body(r, contentMD5)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		ctx = fileserver.WithContentType(ctx, contentType)
+	}
+	if err := g.Backend.Store(ctx, key, body); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// md5Body returns a reader of r hashing what it reads with the MD5 it
+// returns. When contentMD5 is set, the reader fails at its end unless the
+// content matches it.
+func md5Body(r io.Reader, contentMD5 string) (io.Reader, hash.Hash, error) {
+	h := md5.New()
+	if contentMD5 == "" {
+		return io.TeeReader(r, h), h, nil
+	}
+
+	want, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil || len(want) != md5.Size {
+		return nil, nil, errInvalidDigest
+	}
+
+	return &verifyingReader{r: r, h: h, want: hex.EncodeToString(want), err: errBadDigest}, h, nil
+}
+
+// writeMeta records meta as the current version of its object. The record
+// is written once the content is, so it never describes content not
+// stored yet.
+func (g *Gateway) writeMeta(ctx context.Context, bucket string, meta objectMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return g.Backend.Store(recordsContext(ctx, bucket), meta.Key, bytes.NewReader(b))
+}
+
+// readMeta returns the record of the object stored under key.
+func (g *Gateway) readMeta(ctx context.Context, bucket, key string) (objectMeta, error) {
+	var meta objectMeta
+
+	r, err := g.Backend.Get(recordsContext(ctx, bucket), key)
+	if isNotFound(err) {
+		return meta, errNoSuchKey
+	}
+	if err != nil {
+		return meta, err
+	}
+	defer r.Close()
+
+	err = json.NewDecoder(r).Decode(&meta)
+	return meta, err
+}
+
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	meta, err := g.readMeta(r.Context(), bucket, key)
+	if err != nil {
+		return err
+	}
+
+	rc, err := g.Backend.Get(bucketContext(r.Context(), bucket), key)
+	if isNotFound(err) {
+		// The object was deleted in the meantime.
+		return errNoSuchKey
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	w.Header().Set("ETag", quoteETag(meta.ETag))
+	w.Header().Set("Content-Type", contentType)
+	for k, v := range meta.Metadata {
+		w.Header().Set(userMetadataPrefix+k, v)
+	}
+
+	content, ok := rc.(io.ReadSeeker)
+	if !ok {
+		// Content streamed from the network is read forward, a range is
+		// served by skipping to its start.
+		content = fileserver.NewForwardSeeker(rc, meta.Size)
+	}
+
+	// ServeContent handles the Range and conditional requests.
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, "", meta.LastModified, content)
+
+	return nil
+}
+
+func (g *Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	ctx := r.Context()
+
+	_, err := g.readMeta(ctx, bucket, key)
+	switch {
+	case errors.Is(err, errNoSuchKey):
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	// The record goes first, the object is not listed without its content.
+	if err := g.Backend.Delete(recordsContext(ctx, bucket), key); err != nil {
+		return err
+	}
+	if err := g.Backend.Delete(bucketContext(ctx, bucket), key); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// listObjects implements ListObjectsV2. Continuation tokens hold the last
+// key returned, or the last common prefix followed by 0xff which sorts
+// after every key sharing it.
+func (g *Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) error {
+	result := listBucketResult{
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType:      query.Get("encoding-type"),
+		MaxKeys:           maxListKeys,
+	}
+
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errInvalidArgument.withMessage("max-keys must be a positive integer")
+		}
+		result.MaxKeys = min(n, maxListKeys)
+	}
+	if result.EncodingType != "" && result.EncodingType != "url" {
+		return errInvalidArgument.withMessage("encoding-type must be url")
+	}
+
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidArgument.withMessage("the continuation token is not valid")
+		}
+		after = string(token)
+	}
+
+	var last string
+	err := g.walkObjects(r.Context(), bucket, result.Prefix, after, func(key string) (bool, error) {
+		marker, prefix := key, ""
+		if result.Delimiter != "" {
+			rest := key[len(result.Prefix):]
+			if i := strings.Index(rest, result.Delimiter); i >= 0 {
+				prefix = result.Prefix + rest[:i+len(result.Delimiter)]
+				marker = prefix + "\xff"
+			}
+		}
+		if marker == last {
+			return true, nil
+		}
+
+		if result.KeyCount == result.MaxKeys {
+			// Listing no keys at all is not truncated.
+			if last != "" {
+				result.IsTruncated = true
+				result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			}
+			return false, nil
+		}
+
+		if prefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encodeKey(prefix, result.EncodingType)})
+		} else {
+			meta, err := g.readMeta(r.Context(), bucket, key)
+			if errors.Is(err, errNoSuchKey) {
+				// The object was deleted in the meantime.
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+
+			result.Contents = append(result.Contents, listEntry{
+				Key:          encodeKey(meta.Key, result.EncodingType),
+				LastModified: meta.LastModified.UTC().Format(lastModifiedFormat),
+				ETag:         quoteETag(meta.ETag),
+				Size:         meta.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		last = marker
+
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if result.EncodingType != "" {
+		result.Prefix = encodeKey(result.Prefix, result.EncodingType)
+		result.Delimiter = encodeKey(result.Delimiter, result.EncodingType)
+		result.StartAfter = encodeKey(result.StartAfter, result.EncodingType)
+	}
+
+	return writeXML(w, http.StatusOK, result)
+}
+
+// walkObjects calls fn, in order, with the keys of the objects of bucket
+// starting with prefix and sorting after after, until fn reports false.
+// Only the objects with a record are walked.
+func (g *Gateway) walkObjects(ctx context.Context, bucket, prefix, after string, fn func(key string) (bool, error)) error {
+	ctx = recordsContext(ctx, bucket)
+	cursor := after
+
+	for {
+		keys, next, err := g.Backend.List(ctx, prefix, cursor, maxListKeys)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			more, err := fn(key)
+			if err != nil || !more {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// userMetadata returns the x-amz-meta-* headers of h, without their prefix.
+func userMetadata(h http.Header) map[string]string {
+	var metadata map[string]string
+	for k := range h {
+		if name, ok := strings.CutPrefix(k, userMetadataPrefix); ok {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[strings.ToLower(name)] = h.Get(k)
+		}
+	}
+
+	return metadata
+}
+
+func encodeKey(key, encodingType string) string {
+	if encodingType == "url" {
+		return url.QueryEscape(key)
+	}
+
+	return key
+}
+
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
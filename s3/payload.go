@@ -0,0 +1,252 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxChunkHeader bounds the length of the lines of aws-chunked payloads.
+const maxChunkHeader = 4096
+
+var (
+	sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	errMalformedChunk = errIncompleteBody.withMessage("the aws-chunked payload is malformed")
+)
+
+// payloadReader returns the content sent in the body of r, decoded and
+// verified against the payload hash or the chunk signatures of sig, and
+// its size. Reading the content fails when it does not match.
+func payloadReader(r *http.Request, sig *signature) (io.Reader, int64, error) {
+	var (
+		body io.Reader
+		size = r.ContentLength
+	)
+
+	switch sig.payload {
+	case streamingPayload, streamingPayloadTrailer, streamingUnsignedPayloadTrail:
+		var err error
+		size, err = strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, 0, errMissingContentLength.withMessage("streaming payloads must carry a valid X-Amz-Decoded-Content-Length")
+		}
+
+		var chunkSig *signature
+		if sig.payload != streamingUnsignedPayloadTrail {
+			chunkSig = sig
+		}
+		body = newChunkedReader(r.Body, chunkSig)
+	case unsignedPayload:
+		body = r.Body
+	default:
+		if !sha256Pattern.MatchString(sig.payload) {
+			return nil, 0, errInvalidArgument.withMessage("x-amz-content-sha256 must be UNSIGNED-PAYLOAD, a streaming payload or the SHA-256 of the payload")
+		}
+		body = &verifyingReader{r: r.Body, h: sha256.New(), want: sig.payload, err: errContentSHA256Mismatch}
+	}
+
+	if size < 0 {
+		return nil, 0, errMissingContentLength
+	}
+
+	return &sizedReader{r: body, remaining: size}, size, nil
+}
+
+// verifyingReader fails with err when the hash of what it read does not
+// match want.
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+	err  error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.h.Sum(nil)) != v.want {
+		return n, v.err
+	}
+
+	return n, err
+}
+
+// sizedReader fails when r does not hold exactly remaining bytes.
+type sizedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.remaining -= int64(n)
+
+	switch {
+	case s.remaining < 0:
+		return n, errInvalidRequest.withMessage("the payload is longer than its declared length")
+	case err == io.EOF && s.remaining > 0, errors.Is(err, io.ErrUnexpectedEOF):
+		return n, errIncompleteBody
+	}
+
+	return n, err
+}
+
+// chunkedReader decodes payloads sent in aws-chunked encoding:
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n
+//	...
+//	0[;chunk-signature=<signature>]\r\n[<trailing headers>\r\n]\r\n
+//
+// Chunks are signed when sig is not nil, each signature being chained to
+// the previous one starting with the signature of the request. The
+// trailing headers, which carry the checksums of the content, are skipped.
+type chunkedReader struct {
+	r   *bufio.Reader
+	sig *signature
+
+	previous  string
+	chunkSig  string
+	chunkHash hash.Hash
+	remaining int64
+	inChunk   bool
+	err       error
+}
+
+func newChunkedReader(r io.Reader, sig *signature) *chunkedReader {
+	c := &chunkedReader{
+		r:         bufio.NewReaderSize(r, maxChunkHeader),
+		sig:       sig,
+		chunkHash: sha256.New(),
+	}
+	if sig != nil {
+		c.previous = sig.signature
+	}
+
+	return c
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.err == nil && c.remaining == 0 {
+		if c.inChunk {
+			c.err = c.endChunk()
+			continue
+		}
+		c.err = c.beginChunk()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.chunkHash.Write(p[:n])
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		c.err = errIncompleteBody
+		return n, c.err
+	}
+
+	return n, err
+}
+
+// beginChunk reads the header of the next chunk. The last chunk is empty,
+// the payload ends after its trailing headers.
+func (c *chunkedReader) beginChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 {
+		return errMalformedChunk
+	}
+
+	if c.sig != nil {
+		sig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return errMalformedChunk
+		}
+		c.chunkSig = sig
+	}
+
+	c.chunkHash.Reset()
+	c.remaining = size
+	c.inChunk = true
+
+	if size > 0 {
+		return nil
+	}
+
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return io.EOF
+		}
+	}
+}
+
+// endChunk verifies the chunk read and the line ending it.
+func (c *chunkedReader) endChunk() error {
+	c.inChunk = false
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return errMalformedChunk
+	}
+
+	return c.verifyChunk()
+}
+
+func (c *chunkedReader) verifyChunk() error {
+	if c.sig == nil {
+		return nil
+	}
+
+	want := hex.EncodeToString(hmacSHA256(c.sig.key, chunkStringToSign(c.sig.amzDate, c.sig.scope, c.previous, c.chunkHash.Sum(nil))))
+	if !hmac.Equal([]byte(want), []byte(c.chunkSig)) {
+		return errSignatureDoesNotMatch
+	}
+	c.previous = want
+
+	return nil
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	switch {
+	case err == io.EOF:
+		return "", errIncompleteBody
+	case err != nil:
+		return "", errMalformedChunk
+	}
+
+	line, ok := bytes.CutSuffix(line, []byte("\r\n"))
+	if !ok {
+		return "", errMalformedChunk
+	}
+
+	return string(line), nil
+}
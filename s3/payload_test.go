@@ -0,0 +1,133 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkedExample returns the payload of the example of the AWS
+// documentation uploading 66560 bytes in signed chunks.
+func chunkedExample(finalSignature string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n%s\r\n", strings.Repeat("a", 65536))
+	fmt.Fprintf(&b, "400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n%s\r\n", strings.Repeat("a", 1024))
+	fmt.Fprintf(&b, "0;chunk-signature=%s\r\n\r\n", finalSignature)
+
+	return b.Bytes()
+}
+
+func TestGateway_PutObjectChunked(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     []byte
+		wantCode string
+	}{
+		{name: "signed chunks", body: chunkedExample("b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9")},
+		{name: "tampered chunk", body: bytes.Replace(chunkedExample("b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9"), []byte("aaaa"), []byte("aaab"), 1), wantCode: "SignatureDoesNotMatch"},
+		{name: "tampered final chunk", body: chunkedExample("a6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9"), wantCode: "SignatureDoesNotMatch"},
+		{name: "truncated", body: chunkedExample("b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9")[:60000], wantCode: "IncompleteBody"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newExampleGateway(t)
+
+			r := httptest.NewRequest(http.MethodPut, "/examplebucket/chunkObject.txt", bytes.NewReader(tt.body))
+			r.Host = "s3.amazonaws.com"
+			// The signature covers the length of the full example.
+			r.ContentLength = 66824
+			r.Header.Set("X-Amz-Date", exampleDate)
+			r.Header.Set("X-Amz-Storage-Class", "REDUCED_REDUNDANCY")
+			r.Header.Set("X-Amz-Content-Sha256", streamingPayload)
+			r.Header.Set("Content-Encoding", "aws-chunked")
+			r.Header.Set("X-Amz-Decoded-Content-Length", "66560")
+			r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+exampleScope+
+				",SignedHeaders=content-encoding;content-length;host;x-amz-content-sha256;x-amz-date;x-amz-decoded-content-length;x-amz-storage-class"+
+				",Signature=4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9")
+
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, r)
+
+			ctx := context.Background()
+			if tt.wantCode != "" {
+				assert.Contains(t, w.Body.String(), "<Code>"+tt.wantCode+"</Code>")
+				_, err := g.readMeta(ctx, "examplebucket", "chunkObject.txt")
+				assert.ErrorIs(t, err, errNoSuchKey)
+				_, err = g.Backend.Get(bucketContext(ctx, "examplebucket"), "chunkObject.txt")
+				assert.True(t, isNotFound(err))
+				return
+			}
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			meta, err := g.readMeta(ctx, "examplebucket", "chunkObject.txt")
+			require.NoError(t, err)
+			assert.Equal(t, int64(66560), meta.Size)
+
+			rc, err := g.Backend.Get(bucketContext(ctx, "examplebucket"), "chunkObject.txt")
+			require.NoError(t, err)
+			defer rc.Close()
+			content, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			assert.Equal(t, strings.Repeat("a", 66560), string(content))
+		})
+	}
+}
+
+func TestChunkedReader_UnsignedTrailer(t *testing.T) {
+	body := "5\r\nhello\r\n6\r\n world\r\n0\r\nx-amz-checksum-crc32:DUoRhQ==\r\n\r\n"
+
+	content, err := io.ReadAll(newChunkedReader(strings.NewReader(body), nil))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(content))
+
+	_, err = io.ReadAll(newChunkedReader(strings.NewReader("5\r\nhello world\r\n0\r\n\r\n"), nil))
+	assert.ErrorIs(t, err, errMalformedChunk)
+}
+
+func TestPayloadReader(t *testing.T) {
+	const content = "Welcome to Amazon S3."
+
+	tests := []struct {
+		name    string
+		payload string
+		length  int64
+		wantErr *apiError
+	}{
+		{name: "payload hash", payload: "44ce7dd67c959e0d3524ffac1771dfbba87d2b6b4b4e99e42034a8b803f8b072", length: int64(len(content))},
+		{name: "unsigned", payload: unsignedPayload, length: int64(len(content))},
+		{name: "wrong hash", payload: emptySHA256, length: int64(len(content)), wantErr: errContentSHA256Mismatch},
+		{name: "short body", payload: unsignedPayload, length: 100, wantErr: errIncompleteBody},
+		{name: "long body", payload: unsignedPayload, length: 5, wantErr: errInvalidRequest},
+		{name: "no length", payload: unsignedPayload, length: -1, wantErr: errMissingContentLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/bucket/key", strings.NewReader(content))
+			r.ContentLength = tt.length
+
+			body, size, err := payloadReader(r, &signature{payload: tt.payload})
+			if err == nil {
+				assert.Equal(t, tt.length, size)
+				_, err = io.ReadAll(body)
+			}
+
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var apiErr *apiError
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, tt.wantErr.Code, apiErr.Code)
+		})
+	}
+}
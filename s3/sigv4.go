@@ -0,0 +1,222 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	// maxClockSkew is how far the date of a request can be from the clock of
+	// the gateway.
+	maxClockSkew = 15 * time.Minute
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// Payloads sent in aws-chunked encoding, with or without signed chunks
+	// and trailing headers.
+	streamingPayload              = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingPayloadTrailer       = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedPayloadTrail = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// signature is the verified signature of a request. Signed chunks of the
+// payload are chained to it.
+type signature struct {
+	key       []byte
+	amzDate   string
+	scope     string
+	signature string
+	// payload is the x-amz-content-sha256 of the request.
+	payload string
+}
+
+// authenticate verifies the AWS Signature Version 4 of r, sent in its
+// Authorization header, with the credentials of the gateway.
+func (g *Gateway) authenticate(r *http.Request) (*signature, error) {
+	if r.URL.Query().Has("X-Amz-Signature") {
+		return nil, errAccessDenied.withMessage("query string authentication is not supported")
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errAccessDenied
+	}
+	if !strings.HasPrefix(auth, signingAlgorithm+" ") {
+		return nil, errAuthorizationHeaderMalformed.withMessage("unsupported signing algorithm")
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, signingAlgorithm+" "), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[k] = v
+	}
+
+	// The credential is <access key>/<date>/<region>/s3/aws4_request.
+	credential := strings.Split(fields["Credential"], "/")
+	signedHeaders := fields["SignedHeaders"]
+	if len(credential) != 5 || signedHeaders == "" || fields["Signature"] == "" {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	accessKey, date, region, service, terminator := credential[0], credential[1], credential[2], credential[3], credential[4]
+
+	secretKey, ok := g.Credentials[accessKey]
+	if !ok {
+		return nil, errInvalidAccessKeyID
+	}
+	if region != g.Region || service != "s3" || terminator != "aws4_request" {
+		return nil, errAuthorizationHeaderMalformed.withMessage("the credential scope must be " + g.Region + "/s3/aws4_request")
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return nil, errAccessDenied.withMessage("missing or invalid X-Amz-Date header")
+	}
+	if skew := g.now().Sub(t); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	if t.Format("20060102") != date {
+		return nil, errAuthorizationHeaderMalformed.withMessage("the credential date does not match X-Amz-Date")
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		return nil, errInvalidRequest.withMessage("missing X-Amz-Content-Sha256 header")
+	}
+
+	headers := strings.Split(signedHeaders, ";")
+	// The payload hash is only trusted once signed.
+	if !slices.Contains(headers, "host") || !slices.Contains(headers, "x-amz-content-sha256") {
+		return nil, errAuthorizationHeaderMalformed.withMessage("the host and x-amz-content-sha256 headers must be signed")
+	}
+
+	sig := &signature{
+		key:     signingKey(secretKey, date, region, service),
+		amzDate: amzDate,
+		scope:   strings.Join(credential[1:], "/"),
+		payload: payload,
+	}
+
+	canonical := canonicalRequest(r, headers, payload)
+	sig.signature = hex.EncodeToString(hmacSHA256(sig.key, stringToSign(amzDate, sig.scope, canonical)))
+	if !hmac.Equal([]byte(sig.signature), []byte(fields["Signature"])) {
+		return nil, errSignatureDoesNotMatch
+	}
+
+	return sig, nil
+}
+
+// canonicalRequest returns the canonical form of r covering the headers
+// named in signedHeaders, whose signature is sent by the client.
+func canonicalRequest(r *http.Request, signedHeaders []string, payload string) string {
+	var b strings.Builder
+
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uriEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(r.URL.Query()))
+	b.WriteByte('\n')
+
+	for _, name := range signedHeaders {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(canonicalHeaderValue(r, name))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+
+	b.WriteString(strings.Join(signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payload)
+
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// canonicalHeaderValue returns the values of the header name, trimmed and
+// with their inner spaces collapsed. The host and the content length are
+// not kept in the headers of server requests.
+func canonicalHeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		return strconv.FormatInt(r.ContentLength, 10)
+	}
+
+	var values []string
+	for _, v := range r.Header.Values(name) {
+		values = append(values, strings.Join(strings.Fields(v), " "))
+	}
+
+	return strings.Join(values, ",")
+}
+
+func stringToSign(amzDate, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return signingAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+}
+
+// chunkStringToSign returns the string signed for a chunk of a streaming
+// payload, chained to the signature of the previous chunk.
+func chunkStringToSign(amzDate, scope, previous string, chunkHash []byte) string {
+	return "AWS4-HMAC-SHA256-PAYLOAD\n" + amzDate + "\n" + scope + "\n" + previous + "\n" + emptySHA256 + "\n" + hex.EncodeToString(chunkHash)
+}
+
+func signingKey(secretKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters,
+// and the slashes unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ErrSizeMismatch is returned for writes reading content of another size
+// than the one expected.
+var ErrSizeMismatch = errors.New("size mismatch")
+
+// writeFile writes the content put by write to the file of meta.Key and
+// records its metadata, see recordMetadata. The content goes to a
+// temporary file first, moved in place only once write succeeded and the
+// content matches the size and the checksum meta expects, if any, so the
+// file never holds part of it.
+func (s *Storage) writeFile(serverID string, meta Metadata, write func(io.Writer) (int64, error)) (Metadata, error) {
+	pathKey := s.PathTransformFunc(meta.Key)
+	path := filepath.Join(s.Root, serverID, filepath.FromSlash(pathKey.FullPath()))
+
+	tmp, err := createTemp(path)
+	if err != nil {
+		return meta, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := write(io.MultiWriter(tmp, h))
+	if err != nil {
+		return meta, err
+	}
+
+	sum := h.Sum(nil)
+	if err := checkContent(meta, n, sum); err != nil {
+		return meta, fmt.Errorf("writing %s: %w", meta.Key, err)
+	}
+
+	if err := syncTemp(tmp); err != nil {
+		return meta, err
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if err := renameFile(tmp.Name(), path); err != nil {
+		return meta, err
+	}
+
+	return s.recordMetadata(serverID, meta, n, sum)
+}
+
+// ReplaceHeader replaces the first bytes of the file at path, as given by
+// WalkFiles, with header if they still are old, and records the checksum of
+// the new content along. The file is rewritten aside and moved in place, so
+// reads already started go on with the previous content and a write or a
+// deletion of the file in between wins. It reports whether the header was
+// replaced.
+func (s *Storage) ReplaceHeader(serverID, path string, old, header []byte) (bool, error) {
+	if len(header) != len(old) {
+		return false, fmt.Errorf("replacing a header of %d bytes with %d bytes", len(old), len(header))
+	}
+
+	f, err := s.OpenFile(serverID, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	current := make([]byte, len(old))
+	if _, err := io.ReadFull(f, current); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(current, old) {
+		return false, nil
+	}
+
+	fullPath := filepath.Join(s.Root, serverID, filepath.FromSlash(path))
+	tmp, err := createTemp(fullPath)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(tmp, h)
+	if _, err := w.Write(header); err != nil {
+		return false, err
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return false, err
+	}
+	if err := syncTemp(tmp); err != nil {
+		return false, err
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	read, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	stored, err := os.Stat(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(read, stored) {
+		return false, nil
+	}
+
+	if err := renameFile(tmp.Name(), fullPath); err != nil {
+		return false, err
+	}
+
+	meta, err := s.readMetadata(s.metadataPath(serverID, path))
+	if errors.Is(err, ErrNoMetadata) {
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	meta.Size = int64(len(header)) + n
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	return true, s.writeMetadata(serverID, path, meta)
+}
+
+// checkContent checks content of size bytes hashing to sum is the one meta
+// expects. A zero size or an empty checksum expects any.
+func checkContent(meta Metadata, size int64, sum []byte) error {
+	if meta.Size > 0 && size != meta.Size {
+		return fmt.Errorf("%w: read %d bytes, expected %d", ErrSizeMismatch, size, meta.Size)
+	}
+	if meta.Checksum != "" && hex.EncodeToString(sum) != meta.Checksum {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// createTemp creates the temporary file the content of the file at path is
+// written to before commitFile moves it in place.
+func createTemp(path string) (*os.File, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(dir, tmpPrefix+"*")
+}
+
+// commitFile flushes the temporary file tmp to disk and renames it to path,
+// which holds either its previous content or the one of tmp, even after a
+// crash.
+func commitFile(tmp *os.File, path string) error {
+	if err := syncTemp(tmp); err != nil {
+		return err
+	}
+
+	return renameFile(tmp.Name(), path)
+}
+
+// syncTemp flushes the temporary file tmp to disk and closes it.
+func syncTemp(tmp *os.File) error {
+	err := tmp.Sync()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// renameFile renames the file at oldpath to path, durably.
+func renameFile(oldpath, path string) error {
+	if err := os.Rename(oldpath, path); err != nil {
+		return err
+	}
+
+	// The rename is only durable once the directory is.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// RemoveTempFiles removes the temporary files left behind by the writes a
+// crash interrupted, and returns how many there were. It must be called
+// before the storage is written to, as on startup.
+func (s *Storage) RemoveTempFiles() (int, error) {
+	var removed int
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), tmpPrefix) {
+			return nil
+		}
+
+		if err := removeFile(s.Root, path); err != nil {
+			return err
+		}
+		removed++
+		s.Logger.Debug("removed orphaned temporary file", zap.String("path", path))
+
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return removed, nil
+	}
+
+	return removed, err
+}
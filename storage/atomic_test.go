@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingReader yields its content then fails, like a peer stream cut
+// short.
+type failingReader struct {
+	r io.Reader
+}
+
+func (r failingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// tempFiles returns the temporary files found under root.
+func tempFiles(t *testing.T, root string) []string {
+	t.Helper()
+
+	var found []string
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasPrefix(d.Name(), tmpPrefix) {
+			found = append(found, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	return found
+}
+
+func TestStorage_WriteAtomic(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    Metadata
+		r       io.Reader
+		wantErr error
+	}{
+		{
+			name:    "stream cut short",
+			meta:    Metadata{Key: "key"},
+			r:       failingReader{strings.NewReader("partial")},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "short content",
+			meta:    Metadata{Key: "key", Size: 100},
+			r:       strings.NewReader("new content"),
+			wantErr: ErrSizeMismatch,
+		},
+		{
+			name:    "long content",
+			meta:    Metadata{Key: "key", Size: 3},
+			r:       strings.NewReader("new content"),
+			wantErr: ErrSizeMismatch,
+		},
+		{
+			name:    "wrong checksum",
+			meta:    Metadata{Key: "key", Checksum: checksum("other content")},
+			r:       strings.NewReader("new content"),
+			wantErr: ErrChecksumMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMetadataTestStorage(t)
+			_, err := s.Write("server", "key", strings.NewReader("old content"))
+			require.NoError(t, err)
+
+			_, err = s.WriteWithMetadata("server", tt.meta, tt.r)
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			// The content stored before is left untouched.
+			_, r, err := s.Read("server", "key")
+			require.NoError(t, err)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.Equal(t, "old content", string(got))
+			assert.NoError(t, s.Verify("server", "key"))
+			assert.Empty(t, tempFiles(t, s.Root))
+		})
+	}
+
+	s := newMetadataTestStorage(t)
+	_, err := s.WriteWithMetadata("server", Metadata{Key: "key"}, failingReader{strings.NewReader("partial")})
+	assert.Error(t, err)
+	assert.False(t, s.HasFile("server", "key"))
+
+	meta, err := s.WriteWithMetadata("server", Metadata{Key: "key", Size: 7, Checksum: checksum("content")}, strings.NewReader("content"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), meta.Size)
+	assert.NoError(t, s.Verify("server", "key"))
+}
+
+func TestStorage_RemoveTempFiles(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	_, err := s.Write("server", "key", strings.NewReader("content"))
+	require.NoError(t, err)
+
+	// Writes interrupted by a crash leave their temporary files behind.
+	pathKey := CASPathTransformFunc("key")
+	orphans := []string{
+		filepath.Join(s.Root, "server", filepath.FromSlash(pathKey.FullPath())),
+		filepath.Join(s.Root, "other", "abcde", "abcde"),
+		s.metadataPath("server", pathKey.FullPath()),
+	}
+	for _, path := range orphans {
+		tmp, err := createTemp(path)
+		require.NoError(t, err)
+		_, err = tmp.WriteString("partial")
+		require.NoError(t, err)
+		require.NoError(t, tmp.Close())
+	}
+	require.Len(t, tempFiles(t, s.Root), 3)
+
+	var walked []string
+	require.NoError(t, s.WalkFiles("server", func(path string) error {
+		walked = append(walked, path)
+		return nil
+	}))
+	assert.Equal(t, []string{pathKey.FullPath()}, walked)
+
+	removed, err := s.RemoveTempFiles()
+	require.NoError(t, err)
+	assert.Equal(t, 3, removed)
+	assert.Empty(t, tempFiles(t, s.Root))
+	assert.NoDirExists(t, filepath.Join(s.Root, "other"))
+	assert.NoError(t, s.Verify("server", "key"))
+
+	removed, err = s.RemoveTempFiles()
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+
+	missing := NewStorage(StorageOpts{Root: filepath.Join(t.TempDir(), "missing"), Logger: s.Logger})
+	removed, err = missing.RemoveTempFiles()
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+}
+
+func TestStorage_ReplaceHeader(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	_, err := s.Write("server", "key", strings.NewReader("old-header content"))
+	require.NoError(t, err)
+	pathKey := CASPathTransformFunc("key")
+	path := pathKey.FullPath()
+
+	// A read started before the header is replaced goes on with the
+	// previous content.
+	_, before, err := s.Read("server", "key")
+	require.NoError(t, err)
+	defer before.Close()
+
+	ok, err := s.ReplaceHeader("server", path, []byte("stale-head"), []byte("new-header"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = s.ReplaceHeader("server", path, []byte("old-header"), []byte("new-header"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	content, err := io.ReadAll(before)
+	require.NoError(t, err)
+	assert.Equal(t, "old-header content", string(content))
+
+	require.NoError(t, s.Verify("server", "key"))
+	meta, err := s.Metadata("server", "key")
+	require.NoError(t, err)
+	assert.Equal(t, checksum("new-header content"), meta.Checksum)
+	assert.Empty(t, tempFiles(t, s.Root))
+
+	_, err = s.ReplaceHeader("server", path, []byte("new-header"), []byte("short"))
+	assert.Error(t, err)
+
+	pathKey = CASPathTransformFunc("unknown")
+	ok, err = s.ReplaceHeader("server", pathKey.FullPath(), []byte("old"), []byte("new"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
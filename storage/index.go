@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"slices"
+	"strings"
+)
+
+// keyIndex holds the keys of the files stored for a server ID in sorted
+// order.
+type keyIndex struct {
+	keys []string
+}
+
+func (ix *keyIndex) add(key string) {
+	if i, found := slices.BinarySearch(ix.keys, key); !found {
+		ix.keys = slices.Insert(ix.keys, i, key)
+	}
+}
+
+func (ix *keyIndex) remove(key string) {
+	if i, found := slices.BinarySearch(ix.keys, key); found {
+		ix.keys = slices.Delete(ix.keys, i, i+1)
+	}
+}
+
+// List returns, in order, at most limit of the keys stored for serverID
+// that start with prefix and sort after cursor, along with the cursor of
+// the next page, empty when there is none. A limit of zero or less lists
+// every key. Only the files stored with their metadata are listed.
+func (s *Storage) List(serverID, prefix, cursor string, limit int) ([]string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ix, err := s.index(serverID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	start, _ := slices.BinarySearch(ix.keys, prefix)
+	if cursor >= prefix {
+		var found bool
+		if start, found = slices.BinarySearch(ix.keys, cursor); found {
+			start++
+		}
+	}
+
+	var keys []string
+	for _, key := range ix.keys[start:] {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if limit > 0 && len(keys) == limit {
+			return keys, keys[len(keys)-1], nil
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, "", nil
+}
+
+// index returns the index of the keys stored for serverID, loading it from
+// their metadata the first time. It must be called holding mu.
+func (s *Storage) index(serverID string) (*keyIndex, error) {
+	if ix, ok := s.indexes[serverID]; ok {
+		return ix, nil
+	}
+
+	ix := &keyIndex{}
+	err := s.WalkMetadata(serverID, func(meta Metadata) error {
+		ix.keys = append(ix.keys, meta.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(ix.keys)
+	ix.keys = slices.Compact(ix.keys)
+
+	s.indexes[serverID] = ix
+
+	return ix, nil
+}
+
+// indexKey adds key to the index of serverID, when it is loaded.
+func (s *Storage) indexKey(serverID, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ix, ok := s.indexes[serverID]; ok {
+		ix.add(key)
+	}
+}
+
+func (s *Storage) unindexKey(serverID, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ix, ok := s.indexes[serverID]; ok {
+		ix.remove(key)
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStorage_List(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	for _, key := range []string{"docs/b.txt", "a.txt", "docs/a.txt", "docs/c/d.txt", "e.txt"} {
+		_, err := s.Write("server", key, strings.NewReader("content of "+key))
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		cursor   string
+		limit    int
+		want     []string
+		wantNext string
+	}{
+		{name: "all", want: []string{"a.txt", "docs/a.txt", "docs/b.txt", "docs/c/d.txt", "e.txt"}},
+		{name: "prefix", prefix: "docs/", want: []string{"docs/a.txt", "docs/b.txt", "docs/c/d.txt"}},
+		{name: "first page", limit: 2, want: []string{"a.txt", "docs/a.txt"}, wantNext: "docs/a.txt"},
+		{name: "next page", cursor: "docs/a.txt", limit: 2, want: []string{"docs/b.txt", "docs/c/d.txt"}, wantNext: "docs/c/d.txt"},
+		{name: "last page", cursor: "docs/c/d.txt", limit: 2, want: []string{"e.txt"}},
+		{name: "exact last page", cursor: "docs/b.txt", limit: 2, want: []string{"docs/c/d.txt", "e.txt"}},
+		{name: "cursor between keys", cursor: "b", want: []string{"docs/a.txt", "docs/b.txt", "docs/c/d.txt", "e.txt"}},
+		{name: "cursor before prefix", prefix: "docs/", cursor: "a.txt", limit: 1, want: []string{"docs/a.txt"}, wantNext: "docs/a.txt"},
+		{name: "cursor after prefix", prefix: "docs/", cursor: "e"},
+		{name: "no match", prefix: "images/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, next, err := s.List("server", tt.prefix, tt.cursor, tt.limit)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, keys)
+			assert.Equal(t, tt.wantNext, next)
+		})
+	}
+
+	keys, _, err := s.List("unknown", "", "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestStorage_ListIndex(t *testing.T) {
+	root := t.TempDir()
+	s := NewStorage(StorageOpts{Root: root, PathTransformFunc: CASPathTransformFunc, Logger: zap.NewNop()})
+
+	for _, key := range []string{"b", "a"} {
+		_, err := s.Write("server", key, strings.NewReader(key))
+		require.NoError(t, err)
+	}
+
+	keys, _, err := s.List("server", "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+
+	// The index follows the writes and deletes made once it is loaded.
+	_, err = s.Write("server", "c", strings.NewReader("c"))
+	require.NoError(t, err)
+	_, err = s.Write("server", "a", strings.NewReader("new a"))
+	require.NoError(t, err)
+	require.NoError(t, s.Delete("server", "b"))
+
+	keys, _, err = s.List("server", "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, keys)
+
+	// A new storage rebuilds it from the metadata on disk.
+	reopened := NewStorage(StorageOpts{Root: root, PathTransformFunc: CASPathTransformFunc, Logger: zap.NewNop()})
+	keys, _, err = reopened.List("server", "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, keys)
+}
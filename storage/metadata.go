@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// metadataDir is the directory of Root holding the metadata of the stored
+// files, in a tree mirroring the one of their content. It is not a valid
+// server ID.
+const metadataDir = ".metadata"
+
+// tmpPrefix starts the names of the records being written.
+const tmpPrefix = ".tmp-"
+
+var (
+	// ErrNoMetadata is returned for files stored without metadata, like
+	// the ones written before it was recorded.
+	ErrNoMetadata       = errors.New("no metadata recorded")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// Metadata describes the content stored under Key, which the path
+// transform may not be able to give back.
+type Metadata struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+	// Checksum is the hex encoded SHA-256 of the content.
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Owner is the ID of the server the file belongs to.
+	Owner string `json:"owner"`
+	// ChunkSize is the size of the chunks the file is replicated in when
+	// it is larger, it is replicated whole otherwise or when zero.
+	ChunkSize int64 `json:"chunkSize,omitempty"`
+	// Manifest reports the content lists the chunks, or the shards, of a
+	// file replicated in chunks, or erasure coded, rather than holding it.
+	Manifest bool `json:"manifest,omitempty"`
+	// DataShards and ParityShards are set for files erasure coded rather
+	// than replicated.
+	DataShards   int `json:"dataShards,omitempty"`
+	ParityShards int `json:"parityShards,omitempty"`
+	// FileSize and FileChecksum are, for a replica holding the encrypted
+	// content of a file or its manifest, or for a manifest, the size and
+	// the checksum of the file itself: the same on every replica however it
+	// was encrypted.
+	FileSize     int64  `json:"fileSize,omitempty"`
+	FileChecksum string `json:"fileChecksum,omitempty"`
+	// KeyHeader reports the content is an envelope starting with the data
+	// key wrapped by the keyring of Owner, see ReplaceHeader.
+	KeyHeader bool `json:"keyHeader,omitempty"`
+	// Refs lists, sorted, the references of the files a chunk stored by
+	// content is part of. It is deleted once none is left, see Release.
+	Refs []string `json:"refs,omitempty"`
+}
+
+// WriteWithMetadata stores the content read from r under meta.Key and
+// records meta as its metadata, filling in its size, its checksum and,
+// when they are not set, its creation time and owner. When meta sets a size
+// or a checksum, content not matching them is rejected. A failed write
+// leaves the content previously stored under the key untouched. It returns
+// the metadata recorded.
+func (s *Storage) WriteWithMetadata(serverID string, meta Metadata, r io.Reader) (Metadata, error) {
+	return s.writeFile(serverID, meta, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// recordMetadata completes meta with the size and the checksum of the
+// content just written and records it. When meta lists references, the
+// ones of the content previously stored under the key are kept. It must be
+// called holding commitMu.
+func (s *Storage) recordMetadata(serverID string, meta Metadata, size int64, sum []byte) (Metadata, error) {
+	pathKey := s.PathTransformFunc(meta.Key)
+	if len(meta.Refs) > 0 {
+		meta.Refs = slices.Clone(meta.Refs)
+		if prev, err := s.readMetadata(s.metadataPath(serverID, pathKey.FullPath())); err == nil {
+			for _, ref := range prev.Refs {
+				meta.Refs = addRef(meta.Refs, ref)
+			}
+		}
+	}
+
+	meta.Size = size
+	meta.Checksum = hex.EncodeToString(sum)
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+	if meta.Owner == "" {
+		meta.Owner = serverID
+	}
+
+	if err := s.writeMetadata(serverID, pathKey.FullPath(), meta); err != nil {
+		return meta, err
+	}
+	s.indexKey(serverID, meta.Key)
+
+	return meta, nil
+}
+
+// Metadata returns the metadata of the file stored under key, or
+// ErrNoMetadata when none was recorded.
+func (s *Storage) Metadata(serverID, key string) (Metadata, error) {
+	pathKey := s.PathTransformFunc(key)
+	return s.readMetadata(s.metadataPath(serverID, pathKey.FullPath()))
+}
+
+// WalkMetadata calls fn with the metadata of every file stored for
+// serverID, in the lexical order of their paths. Returning filepath.SkipAll
+// from fn stops the walk.
+func (s *Storage) WalkMetadata(serverID string, fn func(Metadata) error) error {
+	root := s.metadataPath(serverID, "")
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tmpPrefix) {
+			return nil
+		}
+
+		meta, err := s.readMetadata(path)
+		if err != nil {
+			return err
+		}
+
+		return fn(meta)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Verify checks the content stored under key still matches the checksum of
+// its metadata, it returns ErrChecksumMismatch when it does not.
+func (s *Storage) Verify(serverID, key string) error {
+	if _, err := s.Metadata(serverID, key); err != nil {
+		return err
+	}
+
+	_, r, err := s.Read(serverID, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(io.Discard, r)
+
+	return err
+}
+
+func (s *Storage) metadataPath(serverID, path string) string {
+	return filepath.Join(s.Root, metadataDir, serverID, filepath.FromSlash(path))
+}
+
+func (s *Storage) readMetadata(path string) (Metadata, error) {
+	var meta Metadata
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return meta, ErrNoMetadata
+	}
+	if err != nil {
+		return meta, err
+	}
+
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return meta, fmt.Errorf("decoding metadata %s: %w", path, err)
+	}
+
+	return meta, nil
+}
+
+// writeMetadata records meta for the file at path. The record is replaced
+// atomically, it is never read half written.
+func (s *Storage) writeMetadata(serverID, path string, meta Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	dst := s.metadataPath(serverID, path)
+	tmp, err := createTemp(dst)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(b); err != nil {
+		return err
+	}
+
+	return commitFile(tmp, dst)
+}
+
+func (s *Storage) deleteMetadata(serverID, key string) error {
+	pathKey := s.PathTransformFunc(key)
+	if err := removeFile(s.metadataPath(serverID, ""), s.metadataPath(serverID, pathKey.FullPath())); err != nil {
+		return err
+	}
+	s.unindexKey(serverID, key)
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fscrypto "github.com/gusga/dfsgo/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newMetadataTestStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	return NewStorage(StorageOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Logger:            zap.NewNop(),
+	})
+}
+
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestStorage_WriteWithMetadata(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	meta, err := s.WriteWithMetadata("server", Metadata{Key: "docs/report.pdf", ContentType: "application/pdf"}, strings.NewReader("report"))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), meta.CreatedAt, time.Minute)
+	assert.Equal(t, Metadata{
+		Key:         "docs/report.pdf",
+		Size:        6,
+		ContentType: "application/pdf",
+		Checksum:    checksum("report"),
+		CreatedAt:   meta.CreatedAt,
+		Owner:       "server",
+	}, meta)
+
+	got, err := s.Metadata("server", "docs/report.pdf")
+	require.NoError(t, err)
+	assert.True(t, meta.CreatedAt.Equal(got.CreatedAt))
+	got.CreatedAt = meta.CreatedAt
+	assert.Equal(t, meta, got)
+
+	// Write records the metadata it can find out.
+	_, err = s.Write("server", "docs/report.pdf", strings.NewReader("new report"))
+	require.NoError(t, err)
+	got, err = s.Metadata("server", "docs/report.pdf")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), got.Size)
+	assert.Equal(t, checksum("new report"), got.Checksum)
+	assert.Empty(t, got.ContentType)
+
+	_, err = s.Metadata("server", "unknown")
+	assert.ErrorIs(t, err, ErrNoMetadata)
+	_, err = s.Metadata("other", "docs/report.pdf")
+	assert.ErrorIs(t, err, ErrNoMetadata)
+
+	require.NoError(t, s.Delete("server", "docs/report.pdf"))
+	_, err = s.Metadata("server", "docs/report.pdf")
+	assert.ErrorIs(t, err, ErrNoMetadata)
+	pathKey := CASPathTransformFunc("docs/report.pdf")
+	assert.NoDirExists(t, filepath.Join(s.Root, metadataDir, "server", pathKey.FirstDirectoryFromPath()))
+}
+
+func TestStorage_ReadWithMetadata(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	_, err := s.WriteWithMetadata("server", Metadata{Key: "key", ContentType: "text/plain"}, strings.NewReader("first"))
+	require.NoError(t, err)
+
+	meta, r, err := s.ReadWithMetadata("server", "key")
+	require.NoError(t, err)
+	defer r.Close()
+
+	// The content opened is the one the metadata describes, whatever is
+	// written after.
+	_, err = s.WriteWithMetadata("server", Metadata{Key: "key", ContentType: "text/html"}, strings.NewReader("second content"))
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(content))
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, checksum("first"), meta.Checksum)
+	assert.EqualValues(t, 5, meta.Size)
+
+	_, _, err = s.ReadWithMetadata("server", "unknown")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestStorage_WalkMetadata(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		_, err := s.Write("server", key, strings.NewReader("content of "+key))
+		require.NoError(t, err)
+	}
+	_, err := s.Write("other", "e", strings.NewReader("content of e"))
+	require.NoError(t, err)
+
+	var walked []string
+	require.NoError(t, s.WalkMetadata("server", func(meta Metadata) error {
+		assert.Equal(t, checksum("content of "+meta.Key), meta.Checksum)
+		walked = append(walked, meta.Key)
+		return nil
+	}))
+	assert.ElementsMatch(t, keys, walked)
+
+	assert.NoError(t, s.WalkMetadata("unknown", func(Metadata) error {
+		t.Fatal("no metadata expected")
+		return nil
+	}))
+}
+
+func TestStorage_Verify(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	_, err := s.Write("server", "key", strings.NewReader("some content"))
+	require.NoError(t, err)
+	require.NoError(t, s.Verify("server", "key"))
+
+	pathKey := CASPathTransformFunc("key")
+	path := pathKey.FullPath()
+	f, err := s.OpenFile("server", path)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("S"), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.ErrorIs(t, s.Verify("server", "key"), ErrChecksumMismatch)
+
+	assert.ErrorIs(t, s.Verify("server", "unknown"), ErrNoMetadata)
+}
+
+func TestStorage_WriteDecrypt(t *testing.T) {
+	s := newMetadataTestStorage(t)
+	kr := fscrypto.NewKeyring(fscrypto.NewEncryptionKey())
+
+	encrypted := new(bytes.Buffer)
+	_, err := fscrypto.EncryptEnvelope(kr, strings.NewReader("secret content"), encrypted)
+	require.NoError(t, err)
+
+	meta, err := s.WriteDecrypt(kr, "server", Metadata{Key: "key", ContentType: "text/plain"}, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, int64(14), meta.Size)
+	assert.Equal(t, checksum("secret content"), meta.Checksum)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.NoError(t, s.Verify("server", "key"))
+
+	// Content failing to decrypt is not kept, the content stored before is.
+	_, err = s.WriteDecrypt(fscrypto.NewKeyring(fscrypto.NewEncryptionKey()), "server", Metadata{Key: "key"}, bytes.NewReader([]byte("garbage")))
+	assert.Error(t, err)
+	assert.NoError(t, s.Verify("server", "key"))
+
+	_, err = s.WriteDecrypt(fscrypto.NewKeyring(fscrypto.NewEncryptionKey()), "server", Metadata{Key: "other"}, bytes.NewReader([]byte("garbage")))
+	assert.Error(t, err)
+	assert.False(t, s.HasFile("server", "other"))
+	_, err = s.Metadata("server", "other")
+	assert.ErrorIs(t, err, ErrNoMetadata)
+}
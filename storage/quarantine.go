@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// quarantineDir is the directory of Root the corrupted files are moved to,
+// in a tree mirroring the one of their content. It is not a valid server
+// ID.
+const quarantineDir = ".quarantine"
+
+// ServerIDs returns the server IDs files are stored with metadata for.
+func (s *Storage) ServerIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Root, metadataDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			ids = append(ids, entry.Name())
+		}
+	}
+
+	return ids, nil
+}
+
+// Quarantine moves the file stored under key and its metadata out of the
+// storage, under the quarantine directory of Root, so they are not served
+// anymore but can still be looked into. It returns the path of the
+// quarantined content.
+func (s *Storage) Quarantine(serverID, key string) (string, error) {
+	pathKey := s.PathTransformFunc(key)
+	root := filepath.Join(s.Root, serverID)
+	src := filepath.Join(root, filepath.FromSlash(pathKey.FullPath()))
+
+	// The same key may be quarantined more than once.
+	dst := filepath.Join(s.Root, quarantineDir, serverID, filepath.FromSlash(pathKey.FullPath())) +
+		fmt.Sprintf(".%d", time.Now().UnixNano())
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return "", err
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if err := os.Rename(src, dst); err != nil {
+		return "", err
+	}
+	removeFile(root, src)
+
+	metaSrc := s.metadataPath(serverID, pathKey.FullPath())
+	if err := os.Rename(metaSrc, dst+".json"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return dst, err
+	}
+	removeFile(s.metadataPath(serverID, ""), metaSrc)
+	s.unindexKey(serverID, key)
+
+	s.Logger.Warn("quarantined corrupted file", zap.String("server_id", serverID), zap.String("key", key), zap.String("path", dst))
+
+	return dst, nil
+}
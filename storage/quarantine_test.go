@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_ServerIDs(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	ids, err := s.ServerIDs()
+	require.NoError(t, err)
+	assert.Empty(t, ids)
+
+	for _, id := range []string{"b", "a"} {
+		_, err := s.Write(id, "key", strings.NewReader("content"))
+		require.NoError(t, err)
+	}
+
+	ids, err = s.ServerIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+}
+
+func TestStorage_Quarantine(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	for _, key := range []string{"bad", "good"} {
+		_, err := s.Write("server", key, strings.NewReader("content of "+key))
+		require.NoError(t, err)
+	}
+	corrupt(t, s, "server", "bad", 0, []byte("C"))
+	require.ErrorIs(t, s.Verify("server", "bad"), ErrChecksumMismatch)
+
+	path, err := s.Quarantine("server", "bad")
+	require.NoError(t, err)
+
+	assert.False(t, s.HasFile("server", "bad"))
+	_, err = s.Metadata("server", "bad")
+	assert.ErrorIs(t, err, ErrNoMetadata)
+	keys, _, err := s.List("server", "", "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"good"}, keys)
+
+	// The corrupted content is kept aside with its metadata.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Content of bad", string(b))
+	assert.FileExists(t, path+".json")
+	assert.NoError(t, s.Verify("server", "good"))
+
+	// A key stored again can be quarantined again.
+	_, err = s.Write("server", "bad", strings.NewReader("content of bad"))
+	require.NoError(t, err)
+	again, err := s.Quarantine("server", "bad")
+	require.NoError(t, err)
+	assert.NotEqual(t, path, again)
+
+	_, err = s.Quarantine("server", "unknown")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	ids, err := s.ServerIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"server"}, ids)
+}
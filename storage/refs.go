@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"errors"
+	"slices"
+)
+
+// AddRef records ref among the references of the file stored under key,
+// see Metadata.Refs. It reports false, recording nothing, when no file is
+// stored under key.
+func (s *Storage) AddRef(serverID, key, ref string) (bool, error) {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if !s.HasFile(serverID, key) {
+		return false, nil
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	meta, err := s.readMetadata(s.metadataPath(serverID, pathKey.FullPath()))
+	if errors.Is(err, ErrNoMetadata) {
+		// Without metadata the content cannot be told intact.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	meta.Refs = addRef(meta.Refs, ref)
+
+	return true, s.writeMetadata(serverID, pathKey.FullPath(), meta)
+}
+
+// Release removes ref from the references of the file stored under key and
+// deletes the file once none is left. It returns the number of references
+// left, zero as well when no file is stored under key.
+func (s *Storage) Release(serverID, key, ref string) (int, error) {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if !s.HasFile(serverID, key) {
+		return 0, nil
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	meta, err := s.readMetadata(s.metadataPath(serverID, pathKey.FullPath()))
+	if err != nil && !errors.Is(err, ErrNoMetadata) {
+		return 0, err
+	}
+
+	if i, ok := slices.BinarySearch(meta.Refs, ref); ok {
+		meta.Refs = slices.Delete(meta.Refs, i, i+1)
+	}
+	if len(meta.Refs) == 0 {
+		return 0, s.deleteFile(serverID, key)
+	}
+
+	return len(meta.Refs), s.writeMetadata(serverID, pathKey.FullPath(), meta)
+}
+
+// addRef inserts ref in the sorted refs, once.
+func addRef(refs []string, ref string) []string {
+	i, ok := slices.BinarySearch(refs, ref)
+	if ok {
+		return refs
+	}
+
+	return slices.Insert(refs, i, ref)
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_Refs(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	ok, err := s.AddRef("server", "chunk", "a")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = s.WriteWithMetadata("server", Metadata{Key: "chunk", Refs: []string{"b"}}, strings.NewReader("shared"))
+	require.NoError(t, err)
+
+	// Writing the content again keeps the references already recorded.
+	_, err = s.WriteWithMetadata("server", Metadata{Key: "chunk", Refs: []string{"c"}}, strings.NewReader("shared"))
+	require.NoError(t, err)
+
+	for _, ref := range []string{"a", "b"} {
+		ok, err := s.AddRef("server", "chunk", ref)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	meta, err := s.Metadata("server", "chunk")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, meta.Refs)
+
+	tests := []struct {
+		ref  string
+		left int
+	}{
+		{ref: "b", left: 2},
+		{ref: "b", left: 2},
+		{ref: "unknown", left: 2},
+		{ref: "a", left: 1},
+		{ref: "c", left: 0},
+	}
+	for _, tt := range tests {
+		left, err := s.Release("server", "chunk", tt.ref)
+		require.NoError(t, err)
+		assert.Equal(t, tt.left, left, tt.ref)
+	}
+
+	// The content goes with its last reference.
+	assert.False(t, s.HasFile("server", "chunk"))
+	_, err = s.Metadata("server", "chunk")
+	assert.ErrorIs(t, err, ErrNoMetadata)
+
+	left, err := s.Release("server", "chunk", "a")
+	require.NoError(t, err)
+	assert.Zero(t, left)
+}
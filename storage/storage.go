@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"go.uber.org/zap"
 
@@ -66,6 +69,20 @@ type StorageOpts struct {
 
 type Storage struct {
 	StorageOpts
+
+	// mu guards indexes, the keys stored for every server ID listed so
+	// far.
+	mu      sync.Mutex
+	indexes map[string]*keyIndex
+
+	// commitMu is held while the content of a file and its metadata are
+	// replaced or removed, so concurrent writes of a key never leave the
+	// content of one with the metadata of another.
+	commitMu sync.Mutex
+
+	// uploadMu is held while the parts of an upload session are listed,
+	// replaced or removed.
+	uploadMu sync.Mutex
 }
 
 func NewStorage(opts StorageOpts) *Storage {
@@ -75,6 +92,7 @@ func NewStorage(opts StorageOpts) *Storage {
 
 	return &Storage{
 		StorageOpts: opts,
+		indexes:     make(map[string]*keyIndex),
 	}
 }
 
@@ -87,9 +105,16 @@ func (s *Storage) HasFile(serverID, key string) bool {
 }
 
 func (s *Storage) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clear(s.indexes)
+
 	return os.RemoveAll(s.Root)
 }
 
+// Delete removes the file stored under key, its metadata and the
+// directories of their paths left empty, other files sharing them are kept.
 func (s *Storage) Delete(serverID string, key string) error {
 	pathKey := s.PathTransformFunc(key)
 
@@ -98,29 +123,93 @@ func (s *Storage) Delete(serverID string, key string) error {
 		s.Logger.Info(message, zap.String("server_id", serverID))
 	}()
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, serverID, pathKey.FirstDirectoryFromPath())
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	return s.deleteFile(serverID, key)
+}
+
+// deleteFile removes the file stored under key and its metadata. It must
+// be called holding commitMu.
+func (s *Storage) deleteFile(serverID, key string) error {
+	pathKey := s.PathTransformFunc(key)
+	root := filepath.Join(s.Root, serverID)
+	if err := removeFile(root, filepath.Join(root, filepath.FromSlash(pathKey.FullPath()))); err != nil {
+		return err
+	}
+
+	return s.deleteMetadata(serverID, key)
+}
+
+// removeFile removes the file at path and the directories between it and
+// root left empty.
+func removeFile(root, path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// Removing a directory fails once it is not empty.
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
 
-	return os.RemoveAll(firstPathNameWithRoot)
+	return nil
 }
 
+// Write stores the content read from r under key, see WriteWithMetadata.
 func (s *Storage) Write(serverID string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(serverID, key, r)
+	meta, err := s.WriteWithMetadata(serverID, Metadata{Key: key}, r)
+	return meta.Size, err
+}
+
+// WriteDecrypt decrypts the content EncryptEnvelope wrote to r with the
+// keys of the keyring and stores it under meta.Key, recording its metadata
+// as WriteWithMetadata does. Content failing to decrypt is not kept.
+func (s *Storage) WriteDecrypt(kr *fscrypto.Keyring, id string, meta Metadata, r io.Reader) (Metadata, error) {
+	return s.writeFile(id, meta, func(w io.Writer) (int64, error) {
+		n, err := fscrypto.DecryptEnvelope(kr, r, w)
+		return int64(n), err
+	})
+}
+
+// Read opens the content stored under key. Reading it through checks it
+// still matches the checksum of its metadata, the read reaching its end
+// fails with ErrChecksumMismatch when it does not. The content of files
+// stored without metadata, or read out of order, is not checked.
+func (s *Storage) Read(serverID string, key string) (int64, io.ReadCloser, error) {
+	meta, r, err := s.ReadWithMetadata(serverID, key)
+	return meta.Size, r, err
 }
 
-func (s *Storage) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+// ReadWithMetadata is Read also returning the metadata of the content it
+// opens. Only the key and the size are set for files stored without
+// metadata.
+func (s *Storage) ReadWithMetadata(serverID string, key string) (Metadata, io.ReadCloser, error) {
+	// A write committing in between would pair the content with the
+	// metadata of another one.
+	s.commitMu.Lock()
+	size, f, err := s.readStream(serverID, key)
 	if err != nil {
-		return 0, err
+		s.commitMu.Unlock()
+		return Metadata{}, nil, err
 	}
-	n, err := fscrypto.DecryptContent(encKey, r, f)
-	return int64(n), err
-}
 
-func (s *Storage) Read(serverID string, key string) (int64, io.Reader, error) {
-	return s.readStream(serverID, key)
+	meta, err := s.Metadata(serverID, key)
+	s.commitMu.Unlock()
+	if errors.Is(err, ErrNoMetadata) {
+		return Metadata{Key: key, Size: size}, f, nil
+	}
+	if err != nil {
+		f.Close()
+		return Metadata{}, nil, err
+	}
+
+	return meta, newVerifiedFile(f, meta), nil
 }
 
-func (s *Storage) readStream(serverID string, key string) (int64, io.ReadCloser, error) {
+func (s *Storage) readStream(serverID string, key string) (int64, *os.File, error) {
 	pathKey := s.PathTransformFunc(key)
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, serverID, pathKey.FullPath())
 
@@ -131,28 +220,63 @@ func (s *Storage) readStream(serverID string, key string) (int64, io.ReadCloser,
 
 	fi, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return 0, nil, err
 	}
 
 	return fi.Size(), file, nil
 }
 
-func (s *Storage) openFileForWriting(serverID, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, serverID, pathKey.pathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
+// WalkFiles calls fn, in lexical order, with the path of every file stored
+// for serverID, relative to the directory of serverID, leaving out the
+// files being written. Returning filepath.SkipAll from fn stops the walk.
+func (s *Storage) WalkFiles(serverID string, fn func(path string) error) error {
+	root := filepath.Join(s.Root, serverID)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tmpPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		return fn(filepath.ToSlash(rel))
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
 	}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, serverID, pathKey.FullPath())
+	return err
+}
 
-	return os.Create(fullPathWithRoot)
+// WalkKeyHeaders is WalkFiles leaving out the files whose metadata does not
+// report a key header, see Metadata.KeyHeader.
+func (s *Storage) WalkKeyHeaders(serverID string, fn func(path string) error) error {
+	return s.WalkFiles(serverID, func(path string) error {
+		meta, err := s.readMetadata(s.metadataPath(serverID, path))
+		if errors.Is(err, ErrNoMetadata) || (err == nil && !meta.KeyHeader) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return fn(path)
+	})
 }
 
-func (s *Storage) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
+// OpenFile opens for reading and writing the file at path, relative to the
+// directory of serverID, as given by WalkFiles.
+func (s *Storage) OpenFile(serverID, path string) (*os.File, error) {
+	if !fs.ValidPath(path) {
+		return nil, fmt.Errorf("invalid path %q", path)
 	}
-	return io.Copy(f, r)
+
+	return os.OpenFile(filepath.Join(s.Root, serverID, filepath.FromSlash(path)), os.O_RDWR, 0)
 }
@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestPathKey(t *testing.T) {
@@ -53,3 +58,93 @@ func TestCASPathTransformFunc(t *testing.T) {
 		})
 	}
 }
+
+func TestStorage_WalkFilesOpenFile(t *testing.T) {
+	s := NewStorage(StorageOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Logger:            zap.NewNop(),
+	})
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := s.Write("server", key, strings.NewReader("content of "+key))
+		require.NoError(t, err)
+	}
+
+	var paths []string
+	require.NoError(t, s.WalkFiles("server", func(path string) error {
+		paths = append(paths, path)
+		return nil
+	}))
+	require.Len(t, paths, 3)
+	assert.True(t, sort.StringsAreSorted(paths))
+
+	pathKey := CASPathTransformFunc("b")
+	assert.Contains(t, paths, pathKey.FullPath())
+
+	f, err := s.OpenFile("server", pathKey.FullPath())
+	require.NoError(t, err)
+	content, _ := io.ReadAll(f)
+	f.Close()
+	assert.Equal(t, "content of b", string(content))
+
+	_, err = s.OpenFile("server", "../outside")
+	assert.Error(t, err)
+
+	assert.NoError(t, s.WalkFiles("unknown", func(string) error {
+		t.Fatal("no file expected")
+		return nil
+	}))
+}
+
+func TestStorage_WalkKeyHeaders(t *testing.T) {
+	s := NewStorage(StorageOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Logger:            zap.NewNop(),
+	})
+
+	_, err := s.WriteWithMetadata("server", Metadata{Key: "envelope", KeyHeader: true}, strings.NewReader("envelope"))
+	require.NoError(t, err)
+	_, err = s.Write("server", "plain", strings.NewReader("plain"))
+	require.NoError(t, err)
+
+	var paths []string
+	require.NoError(t, s.WalkKeyHeaders("server", func(path string) error {
+		paths = append(paths, path)
+		return nil
+	}))
+	pathKey := CASPathTransformFunc("envelope")
+	assert.Equal(t, []string{pathKey.FullPath()}, paths)
+}
+
+func TestStorage_Delete(t *testing.T) {
+	// Both keys share the first directory of their paths.
+	transform := func(key string) PathKey {
+		return PathKey{pathName: "shared/" + key, fileName: key}
+	}
+
+	root := t.TempDir()
+	s := NewStorage(StorageOpts{
+		Root:              root,
+		PathTransformFunc: transform,
+		Logger:            zap.NewNop(),
+	})
+
+	for _, key := range []string{"a", "b"} {
+		_, err := s.Write("server", key, strings.NewReader("content of "+key))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Delete("server", "a"))
+	assert.False(t, s.HasFile("server", "a"))
+	assert.True(t, s.HasFile("server", "b"))
+	assert.NoDirExists(t, filepath.Join(root, "server", "shared", "a"))
+
+	require.NoError(t, s.Delete("server", "b"))
+	assert.NoDirExists(t, filepath.Join(root, "server", "shared"))
+	assert.DirExists(t, filepath.Join(root, "server"))
+
+	// Deleting a missing file is not an error.
+	assert.NoError(t, s.Delete("server", "a"))
+}
@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// uploadsDir is the directory of Root holding the upload sessions, a
+// directory per session under the one of its server ID. It is not a valid
+// server ID.
+const uploadsDir = ".uploads"
+
+// uploadRecord is the name of the record of a session in its directory.
+const uploadRecord = "upload.json"
+
+// MaxPartNumber is the largest number of a part of an upload.
+const MaxPartNumber = 10000
+
+var (
+	ErrNoSuchUpload = errors.New("no such upload")
+	ErrInvalidPart  = errors.New("invalid part number")
+
+	uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	// Parts are stored under their number and their checksum, so renaming
+	// one in place records both at once.
+	partPattern = regexp.MustCompile(`^(\d{5})\.([0-9a-f]{64})$`)
+)
+
+// Upload is an upload session: the parts of the content of Key are written
+// in any order and then read back together, see OpenParts. Sessions past
+// ExpiresAt are gone, see RemoveExpiredUploads.
+type Upload struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	// Metadata is kept with the session for its caller, like the user
+	// metadata of an S3 object.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (u Upload) expired(now time.Time) bool {
+	return !u.ExpiresAt.IsZero() && now.After(u.ExpiresAt)
+}
+
+// Part is a part of an upload received whole.
+type Part struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+	// Checksum is the hex encoded SHA-256 of the part.
+	Checksum string `json:"checksum"`
+}
+
+func (p Part) fileName() string {
+	return fmt.Sprintf("%05d.%s", p.Number, p.Checksum)
+}
+
+func (s *Storage) uploadPath(serverID, id string) string {
+	return filepath.Join(s.Root, uploadsDir, serverID, id)
+}
+
+// CreateUpload starts the upload session u for serverID, generating its ID
+// and, when it is not set, its creation time. It returns the session
+// recorded.
+func (s *Storage) CreateUpload(serverID string, u Upload) (Upload, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return u, err
+	}
+	u.ID = hex.EncodeToString(b)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now().UTC()
+	}
+
+	record, err := json.Marshal(u)
+	if err != nil {
+		return u, err
+	}
+
+	path := filepath.Join(s.uploadPath(serverID, u.ID), uploadRecord)
+	tmp, err := createTemp(path)
+	if err != nil {
+		return u, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := tmp.Write(record); err != nil {
+		return u, err
+	}
+
+	return u, commitFile(tmp, path)
+}
+
+// Upload returns the upload session id of serverID, ErrNoSuchUpload when
+// there is none or it expired.
+func (s *Storage) Upload(serverID, id string) (Upload, error) {
+	var u Upload
+	if !uploadIDPattern.MatchString(id) {
+		return u, ErrNoSuchUpload
+	}
+
+	b, err := os.ReadFile(filepath.Join(s.uploadPath(serverID, id), uploadRecord))
+	if errors.Is(err, fs.ErrNotExist) {
+		return u, ErrNoSuchUpload
+	}
+	if err != nil {
+		return u, err
+	}
+	if err := json.Unmarshal(b, &u); err != nil {
+		return u, err
+	}
+	if u.expired(time.Now()) {
+		return u, ErrNoSuchUpload
+	}
+
+	return u, nil
+}
+
+// WritePart stores the content read from r as the part number of the
+// upload session id, replacing the part received before with the same
+// number. When size is not negative, content of another size is rejected.
+// A failed write leaves the part previously received untouched.
+func (s *Storage) WritePart(serverID, id string, number int, size int64, r io.Reader) (Part, error) {
+	part := Part{Number: number}
+	if number < 1 || number > MaxPartNumber {
+		return part, fmt.Errorf("%w %d, expected 1 to %d", ErrInvalidPart, number, MaxPartNumber)
+	}
+	if _, err := s.Upload(serverID, id); err != nil {
+		return part, err
+	}
+
+	dir := s.uploadPath(serverID, id)
+	tmp, err := createTemp(filepath.Join(dir, uploadRecord))
+	if err != nil {
+		return part, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	part.Size, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return part, err
+	}
+	if size >= 0 && part.Size != size {
+		return part, fmt.Errorf("writing part %d: %w: read %d bytes, expected %d", number, ErrSizeMismatch, part.Size, size)
+	}
+	part.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	if err := syncTemp(tmp); err != nil {
+		return part, err
+	}
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	// The session may have been completed, aborted or removed meanwhile.
+	parts, err := s.parts(serverID, id)
+	if err != nil {
+		return part, err
+	}
+
+	if err := renameFile(tmp.Name(), filepath.Join(dir, part.fileName())); err != nil {
+		return part, err
+	}
+	for _, p := range parts {
+		if p.Number == number && p.Checksum != part.Checksum {
+			if err := os.Remove(filepath.Join(dir, p.fileName())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return part, err
+			}
+		}
+	}
+
+	return part, nil
+}
+
+// Parts returns, in order, the parts of the upload session id received so
+// far.
+func (s *Storage) Parts(serverID, id string) ([]Part, error) {
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	return s.parts(serverID, id)
+}
+
+// parts returns the parts of the upload session id. It must be called
+// holding uploadMu.
+func (s *Storage) parts(serverID, id string) ([]Part, error) {
+	if _, err := s.Upload(serverID, id); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(s.uploadPath(serverID, id))
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are sorted by name, so by number.
+	var parts []Part
+	for _, entry := range entries {
+		m := partPattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		number, _ := strconv.Atoi(m[1])
+		parts = append(parts, Part{Number: number, Size: info.Size(), Checksum: m[2]})
+	}
+
+	return parts, nil
+}
+
+// OpenParts opens every part of the upload session id received so far and
+// returns them along with their content, in order. Reading it through
+// checks every part still matches its checksum, as Read does. Parts
+// received once it is opened are not part of it. The caller must close the
+// content.
+func (s *Storage) OpenParts(serverID, id string) ([]Part, io.ReadCloser, error) {
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	parts, err := s.parts(serverID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content := &partsReader{}
+	for _, part := range parts {
+		f, err := os.Open(filepath.Join(s.uploadPath(serverID, id), part.fileName()))
+		if err != nil {
+			content.Close()
+			return nil, nil, err
+		}
+
+		content.files = append(content.files, newVerifiedFile(f, Metadata{
+			Key:      fmt.Sprintf("part %d of upload %s", part.Number, id),
+			Size:     part.Size,
+			Checksum: part.Checksum,
+		}))
+	}
+
+	return parts, content, nil
+}
+
+// partsReader reads the parts of an upload one after the other.
+type partsReader struct {
+	files []*verifiedFile
+	next  int
+}
+
+func (r *partsReader) Read(b []byte) (int, error) {
+	for r.next < len(r.files) {
+		n, err := r.files[r.next].Read(b)
+		if errors.Is(err, io.EOF) {
+			r.next++
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+
+	return 0, io.EOF
+}
+
+func (r *partsReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// DeleteUpload removes the upload session id and its parts.
+func (s *Storage) DeleteUpload(serverID, id string) error {
+	if !uploadIDPattern.MatchString(id) {
+		return ErrNoSuchUpload
+	}
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	dir := s.uploadPath(serverID, id)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return ErrNoSuchUpload
+	}
+
+	return s.removeUpload(dir)
+}
+
+// removeUpload removes the directory of a session and the one of its
+// server ID when it is left empty. It must be called holding uploadMu.
+func (s *Storage) removeUpload(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	os.Remove(filepath.Dir(dir))
+
+	return nil
+}
+
+// RemoveExpiredUploads removes the upload sessions, of every server ID,
+// expired at now along with their parts, and returns how many there were.
+// Sessions whose record could not be written, a crash interrupting their
+// creation, are removed too.
+func (s *Storage) RemoveExpiredUploads(now time.Time) (int, error) {
+	dirs, err := filepath.Glob(filepath.Join(s.Root, uploadsDir, "*", "*"))
+	if err != nil {
+		return 0, err
+	}
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+
+	var removed int
+	for _, dir := range dirs {
+		var u Upload
+		b, err := os.ReadFile(filepath.Join(dir, uploadRecord))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// The record of a session being created is not written yet.
+			if info, err := os.Stat(dir); err != nil || now.Sub(info.ModTime()) < time.Minute {
+				continue
+			}
+		case err != nil:
+			return removed, err
+		default:
+			// A record that can not be read is never used again.
+			if err := json.Unmarshal(b, &u); err == nil && !u.expired(now) {
+				continue
+			}
+		}
+
+		if err := s.removeUpload(dir); err != nil {
+			return removed, err
+		}
+		removed++
+		s.Logger.Debug("removed expired upload", zap.String("upload_id", filepath.Base(dir)), zap.String("key", u.Key))
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage_Upload(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	u, err := s.CreateUpload("server", Upload{Key: "backup.tar", ContentType: "application/x-tar", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Len(t, u.ID, 32)
+
+	got, err := s.Upload("server", u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "backup.tar", got.Key)
+	assert.Equal(t, "application/x-tar", got.ContentType)
+
+	// Parts arrive in any order, a part sent again replaces the first one.
+	for _, p := range []struct {
+		number  int
+		content string
+	}{{3, "ghi"}, {1, "abc"}, {2, "xxx"}, {2, "def"}} {
+		part, err := s.WritePart("server", u.ID, p.number, int64(len(p.content)), strings.NewReader(p.content))
+		require.NoError(t, err)
+		assert.Equal(t, checksum(p.content), part.Checksum)
+	}
+
+	parts, err := s.Parts("server", u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []Part{
+		{Number: 1, Size: 3, Checksum: checksum("abc")},
+		{Number: 2, Size: 3, Checksum: checksum("def")},
+		{Number: 3, Size: 3, Checksum: checksum("ghi")},
+	}, parts)
+
+	_, r, err := s.OpenParts("server", u.ID)
+	require.NoError(t, err)
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, "abcdefghi", string(content))
+
+	// A part of another size than the one announced is not kept.
+	_, err = s.WritePart("server", u.ID, 1, 10, strings.NewReader("short"))
+	assert.ErrorIs(t, err, ErrSizeMismatch)
+	_, err = s.WritePart("server", u.ID, 0, 1, strings.NewReader("a"))
+	assert.ErrorIs(t, err, ErrInvalidPart)
+	parts, err = s.Parts("server", u.ID)
+	require.NoError(t, err)
+	assert.Len(t, parts, 3)
+
+	// A corrupted part fails the read of the content.
+	path := filepath.Join(s.uploadPath("server", u.ID), parts[1].fileName())
+	require.NoError(t, os.WriteFile(path, []byte("dXf"), 0o644))
+	_, r, err = s.OpenParts("server", u.ID)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	require.NoError(t, r.Close())
+
+	require.NoError(t, s.DeleteUpload("server", u.ID))
+	_, err = s.Parts("server", u.ID)
+	assert.ErrorIs(t, err, ErrNoSuchUpload)
+	_, err = s.WritePart("server", u.ID, 1, 3, strings.NewReader("abc"))
+	assert.ErrorIs(t, err, ErrNoSuchUpload)
+	assert.ErrorIs(t, s.DeleteUpload("server", u.ID), ErrNoSuchUpload)
+	_, err = s.Upload("server", "../../etc")
+	assert.ErrorIs(t, err, ErrNoSuchUpload)
+}
+
+func TestStorage_RemoveExpiredUploads(t *testing.T) {
+	s := newMetadataTestStorage(t)
+
+	now := time.Now()
+	expired, err := s.CreateUpload("a", Upload{Key: "old", ExpiresAt: now.Add(-time.Minute)})
+	require.NoError(t, err)
+	live, err := s.CreateUpload("b", Upload{Key: "new", ExpiresAt: now.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = s.WritePart("b", live.ID, 1, 3, strings.NewReader("abc"))
+	require.NoError(t, err)
+
+	// Expired sessions are gone before they are removed.
+	_, err = s.Upload("a", expired.ID)
+	assert.ErrorIs(t, err, ErrNoSuchUpload)
+
+	removed, err := s.RemoveExpiredUploads(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoDirExists(t, filepath.Join(s.Root, uploadsDir, "a"))
+
+	parts, err := s.Parts("b", live.ID)
+	require.NoError(t, err)
+	assert.Len(t, parts, 1)
+
+	removed, err = s.RemoveExpiredUploads(now.Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	_, err = s.Upload("b", live.ID)
+	assert.ErrorIs(t, err, ErrNoSuchUpload)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// verifiedFile is a stored file checking, as it is read through, that its
+// content matches the checksum of its metadata.
+type verifiedFile struct {
+	f    *os.File
+	meta Metadata
+	h    hash.Hash
+	// read is the number of bytes hashed so far. The content is not
+	// checked once done is set, after it was checked or read out of order.
+	read int64
+	done bool
+}
+
+func newVerifiedFile(f *os.File, meta Metadata) *verifiedFile {
+	return &verifiedFile{f: f, meta: meta, h: sha256.New()}
+}
+
+func (v *verifiedFile) Read(b []byte) (int, error) {
+	n, err := v.f.Read(b)
+	if v.done {
+		return n, err
+	}
+
+	v.h.Write(b[:n])
+	v.read += int64(n)
+
+	// Readers stopping at the size, as io.CopyN does, never get to the end
+	// of the file. The last bytes read are held back from them when the
+	// content turns out corrupted, so they never get all of it.
+	switch {
+	case v.read > v.meta.Size, v.read < v.meta.Size && err == io.EOF:
+		return 0, v.mismatch()
+	case v.read == v.meta.Size:
+		v.done = true
+		if hex.EncodeToString(v.h.Sum(nil)) != v.meta.Checksum {
+			return 0, v.mismatch()
+		}
+	}
+
+	return n, err
+}
+
+func (v *verifiedFile) mismatch() error {
+	v.done = true
+	return fmt.Errorf("%w for %s", ErrChecksumMismatch, v.meta.Key)
+}
+
+// Seek moves the offset of the next read. The content is checked again when
+// read from its start.
+func (v *verifiedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := v.f.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	if pos == 0 {
+		v.h.Reset()
+		v.read = 0
+		v.done = false
+	} else {
+		v.done = true
+	}
+
+	return pos, nil
+}
+
+func (v *verifiedFile) Close() error {
+	return v.f.Close()
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corrupt overwrites part of the content stored under key.
+func corrupt(t *testing.T, s *Storage, serverID, key string, off int64, b []byte) {
+	t.Helper()
+
+	pathKey := CASPathTransformFunc(key)
+	f, err := s.OpenFile(serverID, pathKey.FullPath())
+	require.NoError(t, err)
+	_, err = f.WriteAt(b, off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestStorage_ReadVerified(t *testing.T) {
+	content := strings.Repeat("some content ", 1024)
+
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, s *Storage)
+		wantErr error
+	}{
+		{name: "intact", corrupt: func(*testing.T, *Storage) {}},
+		{
+			name: "flipped byte",
+			corrupt: func(t *testing.T, s *Storage) {
+				corrupt(t, s, "server", "key", 100, []byte("S"))
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			name: "appended content",
+			corrupt: func(t *testing.T, s *Storage) {
+				corrupt(t, s, "server", "key", int64(len(content)), []byte("more"))
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+		{
+			name: "truncated",
+			corrupt: func(t *testing.T, s *Storage) {
+				pathKey := CASPathTransformFunc("key")
+				f, err := s.OpenFile("server", pathKey.FullPath())
+				require.NoError(t, err)
+				require.NoError(t, f.Truncate(10))
+				require.NoError(t, f.Close())
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newMetadataTestStorage(t)
+			_, err := s.Write("server", "key", strings.NewReader(content))
+			require.NoError(t, err)
+			tt.corrupt(t, s)
+
+			_, r, err := s.Read("server", "key")
+			require.NoError(t, err)
+			defer r.Close()
+
+			_, err = io.Copy(io.Discard, r)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestStorage_ReadVerifiedSeek(t *testing.T) {
+	s := newMetadataTestStorage(t)
+	content := strings.Repeat("some content ", 1024)
+	_, err := s.Write("server", "key", strings.NewReader(content))
+	require.NoError(t, err)
+	corrupt(t, s, "server", "key", 0, []byte("S"))
+
+	_, r, err := s.Read("server", "key")
+	require.NoError(t, err)
+	defer r.Close()
+	rs := r.(io.ReadSeeker)
+
+	// Content read out of order is not checked.
+	_, err = rs.Seek(10, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, rs)
+	assert.NoError(t, err)
+
+	// Readers stopping at the size are told about the mismatch.
+	_, err = rs.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	_, err = io.CopyN(io.Discard, rs, int64(len(content)))
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+
+	// ServeContent seeks to the end and back before serving the file.
+	_, err = s.Write("server", "served", strings.NewReader(content))
+	require.NoError(t, err)
+	_, r, err = s.Read("server", "served")
+	require.NoError(t, err)
+	defer r.Close()
+
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, httptest.NewRequest(http.MethodGet, "/", nil), "", time.Time{}, r.(io.ReadSeeker))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, content, rec.Body.String())
+	_, err = r.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestStorage_ReadWithoutMetadata(t *testing.T) {
+	s := newMetadataTestStorage(t)
+	_, err := s.Write("server", "key", strings.NewReader("content"))
+	require.NoError(t, err)
+	require.NoError(t, s.deleteMetadata("server", "key"))
+	corrupt(t, s, "server", "key", 0, []byte("C"))
+
+	// Files stored before their metadata was recorded are read unchecked.
+	_, r, err := s.Read("server", "key")
+	require.NoError(t, err)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "Content", string(got))
+}
@@ -0,0 +1,111 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the newest version of the wire format this node
+// speaks, the one it writes its handshake with. Once the handshake is done,
+// frames are written with the version agreed on with the peer.
+const ProtocolVersion byte = 1
+
+// MinProtocolVersion is the oldest version this node can speak, it is
+// offered to peers during the handshake.
+const MinProtocolVersion byte = 1
+
+const (
+	// FrameHeaderSize is the size of the fixed header preceding every frame
+	// body: version (1), type (1), flags (2), body length (4) and
+	// request ID (8).
+	FrameHeaderSize = 16
+
+	// MaxFrameBodySize bounds the memory a single frame can allocate on the
+	// receiving side. File contents travel as streams, never as frame bodies.
+	MaxFrameBodySize = 4 << 20
+)
+
+// FlagReply marks a frame sent in answer to the request with the same
+// request ID.
+const FlagReply uint16 = 1 << 0
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrFrameTooLarge      = errors.New("frame body exceeds the maximum size")
+)
+
+// Frame is the unit of data exchanged between two peers.
+type Frame struct {
+	Version   byte
+	Type      byte
+	Flags     uint16
+	RequestID uint64
+	Body      []byte
+}
+
+// WriteFrame writes the header and body of f to w in a single write, so
+// frames sent concurrently over the same connection do not interleave.
+func WriteFrame(w io.Writer, f Frame) error {
+	if len(f.Body) > MaxFrameBodySize {
+		return ErrFrameTooLarge
+	}
+
+	if f.Version == 0 {
+		f.Version = ProtocolVersion
+	}
+
+	buf := make([]byte, FrameHeaderSize+len(f.Body))
+	buf[0] = f.Version
+	buf[1] = f.Type
+	binary.BigEndian.PutUint16(buf[2:4], f.Flags)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(f.Body)))
+	binary.BigEndian.PutUint64(buf[8:16], f.RequestID)
+	copy(buf[FrameHeaderSize:], f.Body)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a whole frame from r, blocking until the header and the
+// full body have been received. Frames of a version this node does not
+// speak are rejected, except a Handshake: a peer writes it with the newest
+// version it speaks, which may be one this node does not know yet, and
+// both agree on a version from its body.
+func ReadFrame(r io.Reader, f *Frame) error {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	version := header[0]
+	if version == 0 || (header[1] != Handshake && !supportedVersion(version)) {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > MaxFrameBodySize {
+		return ErrFrameTooLarge
+	}
+
+	f.Version = header[0]
+	f.Type = header[1]
+	f.Flags = binary.BigEndian.Uint16(header[2:4])
+	f.RequestID = binary.BigEndian.Uint64(header[8:16])
+	f.Body = make([]byte, length)
+
+	if _, err := io.ReadFull(r, f.Body); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	return nil
+}
+
+// supportedVersion reports whether this node speaks version.
+func supportedVersion(version byte) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
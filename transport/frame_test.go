@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteReadFrame(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		frame Frame
+	}{
+		{
+			name: "message frame",
+			frame: Frame{
+				Type:      IncomingMessage,
+				Flags:     0x3,
+				RequestID: 42,
+				Body:      []byte("some message"),
+			},
+		},
+		{
+			name: "frame bigger than a single read",
+			frame: Frame{
+				Type: IncomingStream,
+				Body: bytes.Repeat([]byte{0xaa}, 64*1024),
+			},
+		},
+		{
+			name: "empty body",
+			frame: Frame{
+				Type: IncomingMessage,
+				Body: []byte{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			require.NoError(t, WriteFrame(buf, tt.frame))
+			assert.Equal(t, FrameHeaderSize+len(tt.frame.Body), buf.Len())
+
+			var got Frame
+			require.NoError(t, ReadFrame(iotest.OneByteReader(buf), &got))
+
+			assert.Equal(t, ProtocolVersion, got.Version)
+			assert.Equal(t, tt.frame.Type, got.Type)
+			assert.Equal(t, tt.frame.Flags, got.Flags)
+			assert.Equal(t, tt.frame.RequestID, got.RequestID)
+			assert.Equal(t, tt.frame.Body, got.Body)
+		})
+	}
+}
+
+func TestReadFrameConsecutive(t *testing.T) {
+	buf := new(bytes.Buffer)
+	require.NoError(t, WriteFrame(buf, Frame{Type: IncomingMessage, Body: []byte("first")}))
+	require.NoError(t, WriteFrame(buf, Frame{Type: IncomingMessage, Body: []byte("second")}))
+
+	var f Frame
+	require.NoError(t, ReadFrame(buf, &f))
+	assert.Equal(t, "first", string(f.Body))
+	require.NoError(t, ReadFrame(buf, &f))
+	assert.Equal(t, "second", string(f.Body))
+	assert.ErrorIs(t, ReadFrame(buf, &f), io.EOF)
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	valid := new(bytes.Buffer)
+	require.NoError(t, WriteFrame(valid, Frame{Type: IncomingMessage, Body: []byte("payload")}))
+
+	unsupported := bytes.Clone(valid.Bytes())
+	unsupported[0] = ProtocolVersion + 1
+
+	tooLarge := bytes.Clone(valid.Bytes())
+	tooLarge[4] = 0xff
+
+	var f Frame
+	assert.ErrorIs(t, ReadFrame(bytes.NewReader(unsupported), &f), ErrUnsupportedVersion)
+	assert.ErrorIs(t, ReadFrame(bytes.NewReader(make([]byte, FrameHeaderSize)), &f), ErrUnsupportedVersion)
+	assert.ErrorIs(t, ReadFrame(bytes.NewReader(tooLarge), &f), ErrFrameTooLarge)
+	assert.ErrorIs(t, ReadFrame(bytes.NewReader(valid.Bytes()[:FrameHeaderSize+2]), &f), io.ErrUnexpectedEOF)
+	assert.ErrorIs(t, WriteFrame(io.Discard, Frame{Body: make([]byte, MaxFrameBodySize+1)}), ErrFrameTooLarge)
+}
+
+func TestReadFrameHandshakeVersion(t *testing.T) {
+	// A handshake of a version not spoken yet is read so the peers can
+	// agree on one they both speak.
+	buf := new(bytes.Buffer)
+	require.NoError(t, WriteFrame(buf, Frame{Version: ProtocolVersion + 1, Type: Handshake, Body: []byte("hello")}))
+
+	var f Frame
+	require.NoError(t, ReadFrame(buf, &f))
+	assert.Equal(t, ProtocolVersion+1, f.Version)
+	assert.Equal(t, "hello", string(f.Body))
+}
+
+func TestTCPDecoder(t *testing.T) {
+	var rpc RPC
+	require.NoError(t, TCPDecoder{}.Decode(Frame{Type: IncomingMessage, Flags: FlagReply, RequestID: 7, Body: []byte("reply")}, &rpc))
+	assert.False(t, rpc.Stream)
+	assert.True(t, rpc.Reply)
+	assert.Equal(t, uint64(7), rpc.RequestID)
+	assert.Equal(t, []byte("reply"), rpc.Payload)
+
+	rpc = RPC{}
+	body := append([]byte{0, 0, 0, 0, 0, 0, 0x1, 0x0, 0, 0, 0, 0, 0, 0, 0, 0x3}, "header"...)
+	require.NoError(t, TCPDecoder{}.Decode(Frame{Type: IncomingStream, Body: body}, &rpc))
+	assert.True(t, rpc.Stream)
+	assert.Equal(t, int64(256), rpc.StreamSize)
+	assert.Equal(t, uint64(3), rpc.StreamID)
+	assert.Equal(t, []byte("header"), rpc.Payload)
+
+	assert.Error(t, TCPDecoder{}.Decode(Frame{Type: IncomingStream, Body: []byte("short")}, &RPC{}))
+	assert.Error(t, TCPDecoder{}.Decode(Frame{Type: 0x7f}, &RPC{}))
+}
@@ -1,37 +1,76 @@
 package transport
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+const DefaultRequestTimeout = 10 * time.Second
+
 // TCPPeer represent the remote node over TCP established connection.
 type TCPPeer struct {
 	net.Conn
 	// if we dial and retrieve a conn => outbound == true
 	// if we accept and retrieve a conn => outbound == false
 	outbound bool
-	wg       *sync.WaitGroup
+	// sendLock keeps the frames written concurrently from interleaving.
+	sendLock sync.Mutex
+
+	// id and version are agreed on during the handshake, frames are
+	// written and must be received with version.
+	id      string
+	version byte
+
+	lastStreamID atomic.Uint64
+	streamsLock  sync.Mutex
+	inStreams    map[uint64]*inStream
+	outStreams   map[uint64]*outStream
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
-		Conn:     conn,
-		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		Conn:       conn,
+		outbound:   outbound,
+		version:    ProtocolVersion,
+		inStreams:  make(map[uint64]*inStream),
+		outStreams: make(map[uint64]*outStream),
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+func (p *TCPPeer) ID() string {
+	return p.id
+}
+
+func (p *TCPPeer) Send(f Frame) error {
+	if f.Version == 0 {
+		f.Version = p.version
+	}
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	return WriteFrame(p.Conn, f)
 }
 
-func (p *TCPPeer) SendData(data []byte) error {
-	_, err := p.Conn.Write(data)
-	return err
+// readFrame reads the next frame sent by the peer, rejecting those of
+// another version than the one agreed on during the handshake.
+func (p *TCPPeer) readFrame(f *Frame) error {
+	if err := ReadFrame(p.Conn, f); err != nil {
+		return err
+	}
+	if f.Version != p.version {
+		return fmt.Errorf("%w: %d, agreed on %d", ErrUnsupportedVersion, f.Version, p.version)
+	}
+
+	return nil
 }
 
 type TCPTransportOpts struct {
@@ -39,6 +78,12 @@ type TCPTransportOpts struct {
 	Decoder       Decoder
 	Logger        *zap.Logger
 	HandshakeFunc HandshakeFunc
+	// RequestTimeout bounds how long Request waits for a reply, once the
+	// request is sent, when the context it is given has no deadline.
+	RequestTimeout time.Duration
+	// TLSConfig wraps every connection in TLS when set, see
+	// NewMutualTLSConfig.
+	TLSConfig *tls.Config
 }
 
 type TCPTransport struct {
@@ -47,6 +92,10 @@ type TCPTransport struct {
 	listener     net.Listener
 	rpcCh        chan RPC
 	closedPeerCh chan string
+
+	lastRequestID atomic.Uint64
+	requestsLock  sync.Mutex
+	requests      map[uint64]pendingRequest
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
@@ -54,12 +103,17 @@ func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
 		TCPTransportOpts: opts,
 		rpcCh:            make(chan RPC, 1024),
 		closedPeerCh:     make(chan string, 1),
+		requests:         make(map[uint64]pendingRequest),
 	}
 
 	if opts.Decoder == nil {
 		transport.Decoder = TCPDecoder{}
 	}
 
+	if opts.RequestTimeout <= 0 {
+		transport.RequestTimeout = DefaultRequestTimeout
+	}
+
 	return transport
 }
 
@@ -75,6 +129,9 @@ func (t *TCPTransport) ClosedPeer() <-chan string {
 
 // Close implements the Transport interface.
 func (t *TCPTransport) Close() error {
+	if t.listener == nil {
+		return nil
+	}
 	return t.listener.Close()
 }
 
@@ -94,6 +151,21 @@ func (t *TCPTransport) Dial(addr string) error {
 		return err
 	}
 
+	// The TLS handshake is completed here so certificate errors reach the
+	// caller.
+	if t.TLSConfig != nil {
+		tlsConn := tls.Client(conn, t.clientTLSConfig(addr))
+
+		ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+		defer cancel()
+
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+
 	go t.handleConn(conn, true)
 
 	return nil
@@ -107,6 +179,10 @@ func (t *TCPTransport) ListenAndAccept() error {
 		return err
 	}
 
+	if t.TLSConfig != nil {
+		t.listener = tls.NewListener(t.listener, t.TLSConfig)
+	}
+
 	go t.startAcceptLoop()
 
 	t.Logger.Info("TCP transport listening", zap.String("port", t.ListenAddr))
@@ -123,6 +199,7 @@ func (t *TCPTransport) startAcceptLoop() {
 
 		if err != nil {
 			t.Logger.Error("TCP accept error", zap.Error(err))
+			continue
 		}
 
 		go t.handleConn(conn, false)
@@ -131,6 +208,8 @@ func (t *TCPTransport) startAcceptLoop() {
 
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	var err error
+	peer := NewTCPPeer(conn, outbound)
+
 	defer func() {
 		remoteAddr := conn.RemoteAddr().String()
 		t.Logger.Info(
@@ -138,6 +217,8 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			zap.String("cause", err.Error()),
 			zap.String("peer_address", remoteAddr),
 		)
+		peer.closeStreams(ErrPeerClosed)
+		t.failRequests(remoteAddr)
 		t.closedPeerCh <- remoteAddr
 		t.Logger.Info(
 			"sending address peer connection",
@@ -147,7 +228,14 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		conn.Close()
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+		err = tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
 
 	err = t.HandshakeFunc(peer)
 	if err != nil {
@@ -155,7 +243,7 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	}
 
 	if t.OnPeer != nil {
-		t.OnPeer(peer)
+		err = t.OnPeer(peer)
 		if err != nil {
 			return
 		}
@@ -163,8 +251,23 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 
 	// Read Loop
 	for {
+		var frame Frame
+		err = peer.readFrame(&frame)
+		if err != nil {
+			return
+		}
+
+		var handled bool
+		handled, err = peer.handleStreamFrame(frame)
+		if err != nil {
+			return
+		}
+		if handled {
+			continue
+		}
+
 		rcp := RPC{}
-		err = t.Decoder.Decode(conn, &rcp)
+		err = t.Decoder.Decode(frame, &rcp)
 		if err != nil {
 			return
 		}
@@ -172,12 +275,32 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 		rcp.From = conn.RemoteAddr().String()
 
 		if rcp.Stream {
-			peer.wg.Add(1)
-			t.Logger.Info("incoming stream, waiting...", zap.String("peer", conn.RemoteAddr().String()))
+			rcp.Reader = peer.openInStream(rcp.StreamID, rcp.StreamSize)
+		}
 
-			peer.wg.Wait()
-			t.Logger.Info("istream closed, resuming read loop.", zap.String("peer", conn.RemoteAddr().String()))
+		if rcp.Reply {
+			if !t.deliverReply(rcp) {
+				t.Logger.Warn("dropping reply to unknown request", zap.Uint64("request_id", rcp.RequestID), zap.String("peer", rcp.From))
+				if rcp.Stream {
+					rcp.Reader.Close()
+				}
+			}
 			continue
 		}
+
+		t.rpcCh <- rcp
 	}
 }
+
+// clientTLSConfig returns the TLS configuration used to dial addr, verifying
+// the certificate of the peer against its host.
+func (t *TCPTransport) clientTLSConfig(addr string) *tls.Config {
+	config := t.TLSConfig.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	return config
+}
@@ -1,36 +1,49 @@
 package transport
 
-import "io"
+import (
+	"encoding/binary"
+	"fmt"
+)
 
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
-)
 
-type TCPDecoder struct{}
+	// The content of a stream travels in StreamData frames carrying the
+	// stream ID in the RequestID field of their header, as do the
+	// StreamWindow frames granting the sender more room and the StreamReset
+	// frames aborting it.
+	StreamData   = 0x3
+	StreamWindow = 0x4
+	StreamReset  = 0x5
 
-func (dec TCPDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuff := make([]byte, 1)
-	_, err := r.Read(peekBuff)
-	if err != nil {
-		return err
-	}
+	// Handshake frames are only exchanged when a connection is established.
+	Handshake = 0x6
+)
 
-	// In case of a stream we are not decoding what is being sent over the network.
-	// We are just setting Stream true so we can handle that in our logic.
-	stream := peekBuff[0] == IncomingStream
-	if stream {
-		msg.Stream = stream
-		return nil
-	}
+type TCPDecoder struct{}
 
-	buf := make([]byte, 1024)
-	n, err := r.Read(buf)
-	if err != nil {
-		return err
+func (dec TCPDecoder) Decode(frame Frame, msg *RPC) error {
+	switch frame.Type {
+	case IncomingMessage:
+	case IncomingStream:
+		// The body of a stream frame starts with the size of the stream and
+		// its ID, the content itself follows in StreamData frames. We are
+		// just setting Stream true so we can handle that in our logic.
+		if len(frame.Body) < 16 {
+			return fmt.Errorf("stream frame too short: %d bytes", len(frame.Body))
+		}
+		msg.Stream = true
+		msg.StreamSize = int64(binary.BigEndian.Uint64(frame.Body[:8]))
+		msg.StreamID = binary.BigEndian.Uint64(frame.Body[8:16])
+		frame.Body = frame.Body[16:]
+	default:
+		return fmt.Errorf("unknown frame type: %#x", frame.Type)
 	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = frame.Body
+	msg.RequestID = frame.RequestID
+	msg.Reply = frame.Flags&FlagReply != 0
 
 	return nil
 }
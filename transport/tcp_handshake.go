@@ -1,5 +1,94 @@
 package transport
 
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// HandshakeTimeout bounds how long a new connection can take to complete
+// its handshake.
+const HandshakeTimeout = 10 * time.Second
+
+var (
+	ErrSelfConnection      = errors.New("connected to itself")
+	ErrIncompatibleVersion = errors.New("no protocol version in common with peer")
+	ErrIdentityMismatch    = errors.New("server ID does not match the peer certificate")
+)
+
 func TCPNoHandshakeFunc(Peer) error {
 	return nil
 }
+
+// NewTCPHandshakeFunc returns a handshake in which both ends of a
+// connection send the ID of their server and the range of protocol versions
+// they speak. The peer is identified with the ID it sent and they agree on
+// the highest version both speak, every frame exchanged afterwards must
+// carry it. Over TLS, the ID sent must be the common name or one of the DNS
+// names of the certificate the peer presented.
+func NewTCPHandshakeFunc(id string) HandshakeFunc {
+	return func(p Peer) error {
+		peer, ok := p.(*TCPPeer)
+		if !ok {
+			return fmt.Errorf("handshake: unsupported peer type %T", p)
+		}
+
+		peer.SetDeadline(time.Now().Add(HandshakeTimeout))
+		defer peer.SetDeadline(time.Time{})
+
+		body := append([]byte{MinProtocolVersion, ProtocolVersion}, id...)
+		if err := peer.Send(Frame{Type: Handshake, Body: body}); err != nil {
+			return fmt.Errorf("handshake: %w", err)
+		}
+
+		var f Frame
+		if err := ReadFrame(peer.Conn, &f); err != nil {
+			return fmt.Errorf("handshake: %w", err)
+		}
+		if f.Type != Handshake || len(f.Body) < 2 {
+			return fmt.Errorf("handshake: unexpected frame type %#x", f.Type)
+		}
+
+		remoteMin, remoteMax, remoteID := f.Body[0], f.Body[1], string(f.Body[2:])
+		if remoteID == id {
+			return ErrSelfConnection
+		}
+		if err := verifyPeerID(peer.Conn, remoteID); err != nil {
+			return fmt.Errorf("handshake: %w", err)
+		}
+
+		version := min(ProtocolVersion, remoteMax)
+		if version < max(MinProtocolVersion, remoteMin) {
+			return fmt.Errorf("%w: peer speaks %d to %d", ErrIncompatibleVersion, remoteMin, remoteMax)
+		}
+
+		peer.id = remoteID
+		peer.version = version
+
+		return nil
+	}
+}
+
+// verifyPeerID checks id is one of the names of the certificate the peer
+// presented over conn. Connections without TLS are not checked.
+func verifyPeerID(conn net.Conn, id string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("%w: no certificate presented", ErrIdentityMismatch)
+	}
+
+	names := certificateNames(certs[0])
+	if slices.Contains(names, id) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %q, certificate issued to %q", ErrIdentityMismatch, id, names)
+}
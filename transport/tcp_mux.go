@@ -0,0 +1,372 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// maxStreamChunk is the biggest body of a StreamData frame.
+	maxStreamChunk = 32 * 1024
+
+	// streamWindow is the number of bytes a stream may have in flight
+	// before the receiving side consumes them. It bounds the memory every
+	// stream takes on the receiving side.
+	streamWindow = 256 * 1024
+)
+
+var (
+	ErrStreamReset = errors.New("stream reset by peer")
+	// ErrStreamWindowExceeded is returned for a peer sending more content
+	// than the window it was granted, or than the stream announced.
+	ErrStreamWindowExceeded = errors.New("stream content exceeds the window granted")
+)
+
+// inStream is a stream received from the peer. Its content arrives in
+// StreamData frames and is buffered until the consumer reads it.
+type inStream struct {
+	peer *TCPPeer
+	id   uint64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// remaining is the number of bytes still to be received from the peer.
+	remaining int64
+	// window is the number of bytes the peer may send before it is granted
+	// more.
+	window int64
+	// unacked is the number of consumed bytes not yet given back to the
+	// sender as window.
+	unacked int64
+	closed  bool
+	err     error
+}
+
+func (s *inStream) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && s.remaining > 0 && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+
+	if s.buf.Len() > 0 {
+		n, _ := s.buf.Read(b)
+		s.unacked += int64(n)
+		increment := s.takeWindow(false)
+		s.mu.Unlock()
+
+		s.peer.sendWindow(s.id, increment)
+		return n, nil
+	}
+
+	err := s.err
+	s.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	return 0, io.EOF
+}
+
+// Close stops the consumption of the stream. Content still to come is
+// dropped as it arrives.
+func (s *inStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	s.unacked += int64(s.buf.Len())
+	s.buf.Reset()
+	increment := s.takeWindow(true)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.peer.sendWindow(s.id, increment)
+	return nil
+}
+
+// takeWindow returns the window to give back to the sender, batching small
+// increments unless force is set. It must be called with mu held.
+func (s *inStream) takeWindow(force bool) uint32 {
+	if s.remaining <= 0 || (!force && s.unacked < streamWindow/2) {
+		return 0
+	}
+
+	increment := uint32(s.unacked)
+	s.unacked = 0
+	s.window += int64(increment)
+
+	return increment
+}
+
+// push buffers data received from the peer. It fails with
+// ErrStreamWindowExceeded when the peer sent more than it was allowed to.
+func (s *inStream) push(data []byte) error {
+	s.mu.Lock()
+	if n := int64(len(data)); n > s.window || n > s.remaining {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %d bytes received, %d granted and %d left", ErrStreamWindowExceeded, n, s.window, s.remaining)
+	}
+	s.window -= int64(len(data))
+	s.remaining -= int64(len(data))
+	done := s.remaining <= 0
+
+	var increment uint32
+	if s.closed {
+		s.unacked += int64(len(data))
+		increment = s.takeWindow(true)
+	} else {
+		s.buf.Write(data)
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	if done {
+		s.peer.forgetInStream(s.id)
+	}
+
+	// The read loop must never block on a write.
+	if increment > 0 {
+		go s.peer.sendWindow(s.id, increment)
+	}
+
+	return nil
+}
+
+func (s *inStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// outStream keeps track of the window the peer granted to a stream sent to
+// it.
+type outStream struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	window int64
+	err    error
+}
+
+func (s *outStream) grow(increment int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.window += increment
+	s.cond.Broadcast()
+}
+
+func (s *outStream) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+	s.cond.Broadcast()
+}
+
+// reserve waits until the peer grants some window and takes up to n bytes
+// of it.
+func (s *outStream) reserve(n int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.window == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	if int64(n) > s.window {
+		n = int(s.window)
+	}
+	s.window -= int64(n)
+
+	return n, nil
+}
+
+// streamWriter splits what is written to it into StreamData frames.
+type streamWriter struct {
+	peer *TCPPeer
+	id   uint64
+	out  *outStream
+	n    int64
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n, err := w.out.reserve(min(len(b), maxStreamChunk))
+		if err != nil {
+			return written, err
+		}
+
+		if err := w.peer.Send(Frame{Type: StreamData, RequestID: w.id, Body: b[:n]}); err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+		written += n
+		w.n += int64(n)
+	}
+
+	return written, nil
+}
+
+// SendStream opens a stream carrying the body of f and lets write put its
+// size bytes of content into it. The content travels in frames of its own,
+// so other messages and streams can use the connection meanwhile. If write
+// fails, does not write exactly size bytes or ctx is done while it waits
+// for the peer to grant window, the stream is reset.
+func (p *TCPPeer) SendStream(ctx context.Context, f Frame, size int64, write func(io.Writer) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	id := p.lastStreamID.Add(1)
+
+	body := make([]byte, 16+len(f.Body))
+	binary.BigEndian.PutUint64(body[:8], uint64(size))
+	binary.BigEndian.PutUint64(body[8:16], id)
+	copy(body[16:], f.Body)
+
+	f.Type = IncomingStream
+	f.Body = body
+
+	out := &outStream{window: streamWindow}
+	out.cond = sync.NewCond(&out.mu)
+
+	p.streamsLock.Lock()
+	p.outStreams[id] = out
+	p.streamsLock.Unlock()
+
+	defer func() {
+		p.streamsLock.Lock()
+		delete(p.outStreams, id)
+		p.streamsLock.Unlock()
+	}()
+
+	stop := context.AfterFunc(ctx, func() {
+		out.fail(ctx.Err())
+	})
+	defer stop()
+
+	if err := p.Send(f); err != nil {
+		return err
+	}
+
+	w := &streamWriter{peer: p, id: id, out: out}
+	err := write(w)
+	if err == nil && w.n != size {
+		err = fmt.Errorf("stream announced %d bytes but %d were written", size, w.n)
+	}
+
+	if err != nil {
+		p.Send(Frame{Type: StreamReset, RequestID: id})
+		return err
+	}
+
+	return nil
+}
+
+// openInStream registers a stream announced by the peer and returns the
+// reader of its content.
+func (p *TCPPeer) openInStream(id uint64, size int64) io.ReadCloser {
+	s := &inStream{peer: p, id: id, remaining: size, window: streamWindow}
+	s.cond = sync.NewCond(&s.mu)
+
+	if size > 0 {
+		p.streamsLock.Lock()
+		p.inStreams[id] = s
+		p.streamsLock.Unlock()
+	}
+
+	return s
+}
+
+func (p *TCPPeer) forgetInStream(id uint64) {
+	p.streamsLock.Lock()
+	defer p.streamsLock.Unlock()
+
+	delete(p.inStreams, id)
+}
+
+// handleStreamFrame processes the frames carrying the content of streams and
+// their flow control. It reports false for any other frame. It fails when
+// the peer does not respect the flow control, the connection must then be
+// closed.
+func (p *TCPPeer) handleStreamFrame(f Frame) (bool, error) {
+	switch f.Type {
+	case StreamData:
+		p.streamsLock.Lock()
+		s, ok := p.inStreams[f.RequestID]
+		p.streamsLock.Unlock()
+		if ok {
+			if err := s.push(f.Body); err != nil {
+				return true, fmt.Errorf("stream %d: %w", f.RequestID, err)
+			}
+		}
+	case StreamReset:
+		p.streamsLock.Lock()
+		s, ok := p.inStreams[f.RequestID]
+		delete(p.inStreams, f.RequestID)
+		p.streamsLock.Unlock()
+		if ok {
+			s.fail(ErrStreamReset)
+		}
+	case StreamWindow:
+		if len(f.Body) < 4 {
+			return true, nil
+		}
+		p.streamsLock.Lock()
+		s, ok := p.outStreams[f.RequestID]
+		p.streamsLock.Unlock()
+		if ok {
+			s.grow(int64(binary.BigEndian.Uint32(f.Body)))
+		}
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (p *TCPPeer) sendWindow(id uint64, increment uint32) {
+	if increment == 0 {
+		return
+	}
+
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, increment)
+
+	p.Send(Frame{Type: StreamWindow, RequestID: id, Body: body})
+}
+
+// closeStreams fails every stream in flight once the connection is gone.
+func (p *TCPPeer) closeStreams(err error) {
+	p.streamsLock.Lock()
+	defer p.streamsLock.Unlock()
+
+	for id, s := range p.inStreams {
+		s.fail(err)
+		delete(p.inStreams, id)
+	}
+	for _, s := range p.outStreams {
+		s.fail(err)
+	}
+}
@@ -0,0 +1,199 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConnection connects two transports and returns them with the peer
+// each one sees.
+func newTestConnection(t *testing.T) (*TCPTransport, Peer, *TCPTransport, Peer) {
+	t.Helper()
+
+	server, serverPeers := newTestTransport(t)
+	client, clientPeers := newTestTransport(t)
+
+	require.NoError(t, client.Dial(server.Addr()))
+
+	return server, <-serverPeers, client, <-clientPeers
+}
+
+func sendStream(peer Peer, payload string, content []byte) error {
+	return peer.SendStream(context.Background(), Frame{Body: []byte(payload)}, int64(len(content)), func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+func TestTCPPeer_StreamDoesNotBlockConnection(t *testing.T) {
+	_, serverPeer, client, _ := newTestConnection(t)
+
+	content := bytes.Repeat([]byte("x"), 4*streamWindow)
+	sent := make(chan error, 1)
+	go func() { sent <- sendStream(serverPeer, "big", content) }()
+
+	stream := <-client.Consume()
+	require.True(t, stream.Stream)
+	assert.Equal(t, []byte("big"), stream.Payload)
+
+	// The stream is not being read, messages still get through.
+	require.NoError(t, serverPeer.Send(Frame{Type: IncomingMessage, Body: []byte("ping")}))
+	msg := <-client.Consume()
+	assert.False(t, msg.Stream)
+	assert.Equal(t, []byte("ping"), msg.Payload)
+
+	got, err := io.ReadAll(stream.Reader)
+	require.NoError(t, err)
+	require.NoError(t, stream.Reader.Close())
+	assert.Equal(t, content, got)
+	require.NoError(t, <-sent)
+}
+
+func TestTCPPeer_ConcurrentStreams(t *testing.T) {
+	_, serverPeer, client, _ := newTestConnection(t)
+
+	const streams = 8
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := bytes.Repeat([]byte{byte(i)}, streamWindow+i*1000)
+			assert.NoError(t, sendStream(serverPeer, fmt.Sprint(i), content))
+		}(i)
+	}
+
+	var readers sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		rpc := <-client.Consume()
+		require.True(t, rpc.Stream)
+
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			defer rpc.Reader.Close()
+
+			var n int
+			fmt.Sscan(string(rpc.Payload), &n)
+
+			got, err := io.ReadAll(rpc.Reader)
+			assert.NoError(t, err)
+			assert.Equal(t, bytes.Repeat([]byte{byte(n)}, streamWindow+n*1000), got)
+		}()
+	}
+
+	readers.Wait()
+	wg.Wait()
+}
+
+func TestTCPPeer_StreamClosedEarly(t *testing.T) {
+	_, serverPeer, client, _ := newTestConnection(t)
+
+	content := bytes.Repeat([]byte("y"), 3*streamWindow)
+	sent := make(chan error, 1)
+	go func() { sent <- sendStream(serverPeer, "dropped", content) }()
+
+	rpc := <-client.Consume()
+	require.NoError(t, rpc.Reader.Close())
+
+	_, err := rpc.Reader.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// The sender is granted window for the dropped content and finishes.
+	require.NoError(t, <-sent)
+}
+
+func TestTCPPeer_StreamReset(t *testing.T) {
+	_, serverPeer, client, _ := newTestConnection(t)
+
+	errWrite := errors.New("source failed")
+	go func() {
+		serverPeer.SendStream(context.Background(), Frame{Body: []byte("failed")}, 100, func(w io.Writer) error {
+			w.Write([]byte("partial"))
+			return errWrite
+		})
+	}()
+
+	rpc := <-client.Consume()
+	_, err := io.ReadAll(rpc.Reader)
+	assert.ErrorIs(t, err, ErrStreamReset)
+	rpc.Reader.Close()
+
+	// A stream shorter than announced is reset as well.
+	go func() {
+		serverPeer.SendStream(context.Background(), Frame{Body: []byte("short")}, 100, func(w io.Writer) error {
+			_, err := w.Write([]byte("short"))
+			return err
+		})
+	}()
+
+	rpc = <-client.Consume()
+	_, err = io.ReadAll(rpc.Reader)
+	assert.ErrorIs(t, err, ErrStreamReset)
+	rpc.Reader.Close()
+}
+
+func TestTCPPeer_StreamCanceled(t *testing.T) {
+	_, serverPeer, client, _ := newTestConnection(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	content := bytes.Repeat([]byte("z"), 2*streamWindow)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- serverPeer.SendStream(ctx, Frame{Body: []byte("stalled")}, int64(len(content)), func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		})
+	}()
+
+	// The stream is never read, the sender waits for window until it gives
+	// up and resets the stream.
+	rpc := <-client.Consume()
+	select {
+	case err := <-sent:
+		t.Fatalf("stream sent without window: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	assert.ErrorIs(t, <-sent, context.Canceled)
+
+	_, err := io.ReadAll(rpc.Reader)
+	assert.ErrorIs(t, err, ErrStreamReset)
+	rpc.Reader.Close()
+}
+
+func TestTCPPeer_StreamWindowExceeded(t *testing.T) {
+	_, serverPeer, client, _ := newTestConnection(t)
+
+	body := make([]byte, 16)
+	binary.BigEndian.PutUint64(body[:8], 2*streamWindow)
+	binary.BigEndian.PutUint64(body[8:16], 1)
+	require.NoError(t, serverPeer.Send(Frame{Type: IncomingStream, Body: body}))
+
+	rpc := <-client.Consume()
+	require.True(t, rpc.Stream)
+
+	// The sender ignores the window it was granted, the connection is
+	// dropped.
+	chunk := make([]byte, maxStreamChunk)
+	for sent := 0; sent <= streamWindow; sent += len(chunk) {
+		if err := serverPeer.Send(Frame{Type: StreamData, RequestID: 1, Body: chunk}); err != nil {
+			break
+		}
+	}
+
+	_, err := io.ReadAll(rpc.Reader)
+	assert.ErrorIs(t, err, ErrPeerClosed)
+	rpc.Reader.Close()
+}
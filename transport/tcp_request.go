@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrPeerClosed = errors.New("peer connection closed")
+
+type pendingRequest struct {
+	peer Peer
+	ch   chan RPC
+}
+
+// Request implements the Transport interface. Requests to the same peer can
+// be issued concurrently, every one of them waits for the reply carrying its
+// own request ID.
+func (t *TCPTransport) Request(ctx context.Context, peer Peer, payload []byte) (RPC, error) {
+	return t.request(ctx, peer, func(id uint64) error {
+		return peer.Send(Frame{
+			Type:      IncomingMessage,
+			RequestID: id,
+			Body:      payload,
+		})
+	})
+}
+
+// RequestStream implements the Transport interface.
+func (t *TCPTransport) RequestStream(ctx context.Context, peer Peer, payload []byte, size int64, write func(io.Writer) error) (RPC, error) {
+	return t.request(ctx, peer, func(id uint64) error {
+		return peer.SendStream(ctx, Frame{
+			RequestID: id,
+			Body:      payload,
+		}, size, write)
+	})
+}
+
+// request registers a new request, sends it with send and waits for its
+// reply. When ctx has no deadline, RequestTimeout only bounds the wait for
+// the reply once the request is sent: a stream takes as long as its content
+// does to send. When the reply is a stream the caller must close its
+// Reader.
+func (t *TCPTransport) request(ctx context.Context, peer Peer, send func(id uint64) error) (RPC, error) {
+	id := t.lastRequestID.Add(1)
+	ch := make(chan RPC, 1)
+
+	t.requestsLock.Lock()
+	t.requests[id] = pendingRequest{peer: peer, ch: ch}
+	t.requestsLock.Unlock()
+
+	defer t.forgetRequest(id, peer, ch)
+
+	if err := send(id); err != nil {
+		return RPC{}, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.RequestTimeout)
+		defer cancel()
+	}
+
+	select {
+	case rpc, ok := <-ch:
+		if !ok {
+			return RPC{}, fmt.Errorf("request %d to %s: %w", id, peer.RemoteAddr(), ErrPeerClosed)
+		}
+		return rpc, nil
+	case <-ctx.Done():
+		return RPC{}, fmt.Errorf("request %d to %s: %w", id, peer.RemoteAddr(), ctx.Err())
+	}
+}
+
+// forgetRequest unregisters a request. A stream reply delivered after its
+// request gave up is discarded so the peer connection stays usable.
+func (t *TCPTransport) forgetRequest(id uint64, peer Peer, ch chan RPC) {
+	t.requestsLock.Lock()
+	delete(t.requests, id)
+	t.requestsLock.Unlock()
+
+	select {
+	case rpc, ok := <-ch:
+		if ok && rpc.Stream {
+			rpc.Reader.Close()
+		}
+	default:
+	}
+}
+
+func (t *TCPTransport) deliverReply(rpc RPC) bool {
+	t.requestsLock.Lock()
+	defer t.requestsLock.Unlock()
+
+	req, ok := t.requests[rpc.RequestID]
+	if !ok || req.peer.RemoteAddr().String() != rpc.From {
+		return false
+	}
+
+	delete(t.requests, rpc.RequestID)
+	req.ch <- rpc
+
+	return true
+}
+
+// failRequests makes every request waiting for a reply from the peer at
+// addr return ErrPeerClosed.
+func (t *TCPTransport) failRequests(addr string) {
+	t.requestsLock.Lock()
+	defer t.requestsLock.Unlock()
+
+	for id, req := range t.requests {
+		if req.peer.RemoteAddr().String() == addr {
+			delete(t.requests, id)
+			close(req.ch)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestTransport(t *testing.T) (*TCPTransport, chan Peer) {
+	t.Helper()
+
+	peers := make(chan Peer, 1)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:     "127.0.0.1:0",
+		HandshakeFunc:  TCPNoHandshakeFunc,
+		Logger:         zap.NewNop(),
+		RequestTimeout: time.Second,
+	})
+	tr.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	require.NoError(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, peers
+}
+
+// echo replies to every request received by tr with its own payload, and to
+// every stream with the content of the stream.
+func echo(tr *TCPTransport, peer Peer) {
+	for rpc := range tr.Consume() {
+		if !rpc.Stream {
+			go Reply(peer, rpc, rpc.Payload)
+			continue
+		}
+
+		content, _ := io.ReadAll(rpc.Reader)
+		rpc.Reader.Close()
+		go ReplyStream(context.Background(), peer, rpc, rpc.Payload, int64(len(content)), func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		})
+	}
+}
+
+func TestTCPTransport_Request(t *testing.T) {
+	server, serverPeers := newTestTransport(t)
+	client, clientPeers := newTestTransport(t)
+
+	require.NoError(t, client.Dial(server.Addr()))
+	go echo(server, <-serverPeers)
+	peer := <-clientPeers
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			payload := []byte(fmt.Sprintf("request-%d", i))
+			reply, err := client.Request(ctx, peer, payload)
+			assert.NoError(t, err)
+			assert.Equal(t, payload, reply.Payload)
+			assert.True(t, reply.Reply)
+		}(i)
+	}
+	wg.Wait()
+
+	content := bytes.Repeat([]byte("stream content "), 1024)
+	reply, err := client.RequestStream(ctx, peer, []byte("stream"), int64(len(content)), func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	require.NoError(t, err)
+	require.True(t, reply.Stream)
+	assert.Equal(t, []byte("stream"), reply.Payload)
+
+	got, err := io.ReadAll(reply.Reader)
+	require.NoError(t, err)
+	reply.Reader.Close()
+	assert.Equal(t, content, got)
+}
+
+func TestTCPTransport_RequestTimeout(t *testing.T) {
+	server, serverPeers := newTestTransport(t)
+	client, clientPeers := newTestTransport(t)
+
+	require.NoError(t, client.Dial(server.Addr()))
+	<-serverPeers
+	peer := <-clientPeers
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Nobody consumes the server messages, so the request never gets a reply.
+	_, err := client.Request(ctx, peer, []byte("ping"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestTCPTransport_RequestStreamSlow(t *testing.T) {
+	server, serverPeers := newTestTransport(t)
+	client, clientPeers := newTestTransport(t)
+	client.RequestTimeout = 50 * time.Millisecond
+
+	require.NoError(t, client.Dial(server.Addr()))
+	go echo(server, <-serverPeers)
+	peer := <-clientPeers
+
+	// Sending the stream outlasts the request timeout, which only bounds
+	// the wait for the reply.
+	content := []byte("slow stream content")
+	reply, err := client.RequestStream(context.Background(), peer, []byte("stream"), int64(len(content)), func(w io.Writer) error {
+		for _, b := range content {
+			time.Sleep(10 * time.Millisecond)
+			if _, err := w.Write([]byte{b}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	got, err := io.ReadAll(reply.Reader)
+	require.NoError(t, err)
+	reply.Reader.Close()
+	assert.Equal(t, content, got)
+}
+
+func TestTCPTransport_RequestPeerClosed(t *testing.T) {
+	server, serverPeers := newTestTransport(t)
+	client, clientPeers := newTestTransport(t)
+
+	require.NoError(t, client.Dial(server.Addr()))
+	serverPeer := <-serverPeers
+	peer := <-clientPeers
+
+	go func() {
+		<-server.Consume()
+		serverPeer.Close()
+	}()
+	go func() {
+		for range client.ClosedPeer() {
+		}
+	}()
+
+	_, err := client.Request(context.Background(), peer, []byte("ping"))
+	assert.ErrorIs(t, err, ErrPeerClosed)
+}
@@ -1,9 +1,11 @@
 package transport
 
 import (
+	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -21,3 +23,21 @@ func TestTCPTransport(t *testing.T) {
 
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestTCPPeer_ReadFrameAgreedVersion(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	peer := NewTCPPeer(local, true)
+	go func() {
+		WriteFrame(remote, Frame{Type: IncomingMessage, Body: []byte("agreed")})
+		// Only the handshake is read whatever its version.
+		WriteFrame(remote, Frame{Version: ProtocolVersion + 1, Type: Handshake})
+	}()
+
+	var f Frame
+	require.NoError(t, peer.readFrame(&f))
+	assert.Equal(t, "agreed", string(f.Body))
+	assert.ErrorIs(t, peer.readFrame(&f), ErrUnsupportedVersion)
+}
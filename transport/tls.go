@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// NewMutualTLSConfig returns a TLS configuration presenting cert and
+// requiring the other side to present a certificate signed by one of the
+// authorities in roots, whether it dialed or accepted the connection.
+func NewMutualTLSConfig(cert tls.Certificate, roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+// LoadMutualTLSConfig builds the configuration of NewMutualTLSConfig from
+// PEM files.
+func LoadMutualTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return NewMutualTLSConfig(cert, roots), nil
+}
+
+// CertificateNames returns the common name and the DNS names of cert, the
+// server IDs a node presenting it may send during the handshake.
+func CertificateNames(cert tls.Certificate) ([]string, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return nil, errors.New("empty certificate")
+		}
+
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return certificateNames(leaf), nil
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
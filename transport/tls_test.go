@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gusga/dfsgo/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestTLSConfig(t *testing.T, ca *pki.CA, name string) *tls.Config {
+	t.Helper()
+
+	nodeCert, err := ca.IssueNodeCert(name, []string{"127.0.0.1"}, time.Hour)
+	require.NoError(t, err)
+
+	cert, err := nodeCert.TLSCertificate()
+	require.NoError(t, err)
+
+	return NewMutualTLSConfig(cert, ca.CertPool())
+}
+
+func newTestTLSTransport(t *testing.T, id string, config *tls.Config) (*TCPTransport, chan Peer) {
+	t.Helper()
+
+	peers := make(chan Peer, 1)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NewTCPHandshakeFunc(id),
+		Logger:        zap.NewNop(),
+		TLSConfig:     config,
+	})
+	tr.OnPeer = func(p Peer) error {
+		peers <- p
+		return nil
+	}
+	require.NoError(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	go func() {
+		for range tr.ClosedPeer() {
+		}
+	}()
+
+	return tr, peers
+}
+
+func TestTCPTransport_MutualTLS(t *testing.T) {
+	ca, err := pki.NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+
+	server, serverPeers := newTestTLSTransport(t, "server", newTestTLSConfig(t, ca, "server"))
+	client, clientPeers := newTestTLSTransport(t, "client", newTestTLSConfig(t, ca, "client"))
+
+	require.NoError(t, client.Dial(server.Addr()))
+
+	serverPeer := <-serverPeers
+	peer := <-clientPeers
+	assert.Equal(t, "client", serverPeer.ID())
+	assert.Equal(t, "server", peer.ID())
+
+	go echo(server, serverPeer)
+
+	reply, err := client.Request(context.Background(), peer, []byte("over tls"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("over tls"), reply.Payload)
+}
+
+func TestTCPTransport_MutualTLSRejectsUnknownCA(t *testing.T) {
+	ca, err := pki.NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+	other, err := pki.NewCA("other CA", time.Hour)
+	require.NoError(t, err)
+
+	server, serverPeers := newTestTLSTransport(t, "server", newTestTLSConfig(t, ca, "server"))
+	client, _ := newTestTLSTransport(t, "client", newTestTLSConfig(t, other, "client"))
+
+	// The client does not trust the certificate of the server.
+	assert.Error(t, client.Dial(server.Addr()))
+
+	// The server does not trust the certificate of the client.
+	untrusted := newTestTLSConfig(t, other, "client")
+	untrusted.RootCAs = ca.CertPool()
+	client, _ = newTestTLSTransport(t, "client", untrusted)
+	client.Dial(server.Addr())
+
+	select {
+	case <-serverPeers:
+		t.Fatal("server accepted a peer with an untrusted certificate")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTCPTransport_MutualTLSRejectsMismatchedID(t *testing.T) {
+	ca, err := pki.NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+
+	server, serverPeers := newTestTLSTransport(t, "server", newTestTLSConfig(t, ca, "server"))
+	// A trusted node can not claim the server ID of another one.
+	client, _ := newTestTLSTransport(t, "impostor", newTestTLSConfig(t, ca, "client"))
+	require.NoError(t, client.Dial(server.Addr()))
+
+	select {
+	case <-serverPeers:
+		t.Fatal("server accepted a peer whose ID does not match its certificate")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNewTCPHandshakeFunc(t *testing.T) {
+	tests := []struct {
+		name     string
+		remoteID string
+		body     []byte
+		err      error
+	}{
+		{name: "compatible", remoteID: "remote", body: append([]byte{MinProtocolVersion, ProtocolVersion}, "remote"...)},
+		{name: "newer peer", remoteID: "remote", body: append([]byte{MinProtocolVersion, ProtocolVersion + 1}, "remote"...)},
+		{name: "too new", body: append([]byte{ProtocolVersion + 1, ProtocolVersion + 2}, "remote"...), err: ErrIncompatibleVersion},
+		{name: "self", body: append([]byte{MinProtocolVersion, ProtocolVersion}, "local"...), err: ErrSelfConnection},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			go func() {
+				remote, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer remote.Close()
+				// A peer writes its handshake with the newest version it speaks.
+				WriteFrame(remote, Frame{Version: tt.body[1], Type: Handshake, Body: tt.body})
+				io.Copy(io.Discard, remote)
+			}()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			peer := NewTCPPeer(conn, true)
+			err = NewTCPHandshakeFunc("local")(peer)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.remoteID, peer.ID())
+			assert.Equal(t, ProtocolVersion, peer.version)
+		})
+	}
+}
+
+func TestCertificateNames(t *testing.T) {
+	ca, err := pki.NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+
+	nodeCert, err := ca.IssueNodeCert("node-1", []string{"127.0.0.1", "node-1.local"}, time.Hour)
+	require.NoError(t, err)
+	cert, err := nodeCert.TLSCertificate()
+	require.NoError(t, err)
+
+	names, err := CertificateNames(cert)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"node-1", "node-1.local"}, names)
+
+	_, err = CertificateNames(tls.Certificate{})
+	assert.Error(t, err)
+}
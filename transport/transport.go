@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"io"
 	"net"
 )
@@ -9,6 +10,16 @@ type RPC struct {
 	From    string
 	Payload []byte
 	Stream  bool
+	// StreamSize is the number of bytes of the stream opened by the
+	// message, Reader yields them. The receiver must Close Reader, content
+	// left unread is discarded.
+	StreamSize int64
+	StreamID   uint64
+	Reader     io.ReadCloser
+	// RequestID correlates a request with its reply, it is zero for
+	// messages not expecting one.
+	RequestID uint64
+	Reply     bool
 }
 
 type Transport interface {
@@ -18,17 +29,45 @@ type Transport interface {
 	Consume() <-chan RPC
 	ClosedPeer() <-chan string
 	Close() error
+	// Request sends payload to the peer and waits for its reply.
+	Request(ctx context.Context, peer Peer, payload []byte) (RPC, error)
+	// RequestStream sends payload to the peer followed by a stream of size
+	// bytes put on the wire by write, and waits for its reply.
+	RequestStream(ctx context.Context, peer Peer, payload []byte, size int64, write func(io.Writer) error) (RPC, error)
 }
 
 // Peer is an interface that represents the remote node.
 type Peer interface {
 	net.Conn
-	SendData(data []byte) error
-	CloseStream()
+	// ID is the server ID the peer sent during the handshake, it is empty
+	// when the handshake does not exchange IDs.
+	ID() string
+	Send(Frame) error
+	SendStream(ctx context.Context, f Frame, size int64, write func(io.Writer) error) error
 }
 
 type Decoder interface {
-	Decode(io.Reader, *RPC) error
+	Decode(Frame, *RPC) error
 }
 
 type HandshakeFunc func(Peer) error
+
+// Reply sends payload to the peer as the answer to req.
+func Reply(peer Peer, req RPC, payload []byte) error {
+	return peer.Send(Frame{
+		Type:      IncomingMessage,
+		Flags:     FlagReply,
+		RequestID: req.RequestID,
+		Body:      payload,
+	})
+}
+
+// ReplyStream answers req with payload followed by a stream of size bytes
+// put on the wire by write, see SendStream.
+func ReplyStream(ctx context.Context, peer Peer, req RPC, payload []byte, size int64, write func(io.Writer) error) error {
+	return peer.SendStream(ctx, Frame{
+		Flags:     FlagReply,
+		RequestID: req.RequestID,
+		Body:      payload,
+	}, size, write)
+}